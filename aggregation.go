@@ -8,10 +8,26 @@ import (
 	"cloud.google.com/go/datastore/apiv1/datastorepb"
 )
 
+// runAggregationQuery は q に build で集計を追加した集計クエリを実行します。
+// ctx に ReadAt で読み取り時刻を指定した場合は、その時刻のスナップショットに対して実行します。
+func runAggregationQuery(ctx context.Context, q Query, build func(aq *datastore.AggregationQuery) *datastore.AggregationQuery) (datastore.AggregationResult, error) {
+	q, tx, err := snapshotQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer endSnapshot(tx)
+	return client.RunAggregationQuery(ctx, build(q.NewAggregationQuery()))
+}
+
 // Count はクエリに一致するエンティティの数を返します。
+// ctx に ReadAt で読み取り時刻を指定した場合は、その時刻のスナップショットに対して集計します。
 func Count(ctx context.Context, q Query) (int, error) {
-	aq := q.NewAggregationQuery().WithCount("count")
-	ar, err := client.RunAggregationQuery(ctx, aq)
+	if err := q.Err(); err != nil {
+		return 0, err
+	}
+	ar, err := runAggregationQuery(ctx, q, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithCount("count")
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -24,8 +40,12 @@ func Count(ctx context.Context, q Query) (int, error) {
 
 // Avg はクエリに一致するエンティティの指定フィールドの平均値を返します。
 func Avg(ctx context.Context, q Query, f string) (float64, error) {
-	aq := q.NewAggregationQuery().WithAvg(f, "avg")
-	ar, err := client.RunAggregationQuery(ctx, aq)
+	if err := aggregationErr(q, f); err != nil {
+		return 0, err
+	}
+	ar, err := runAggregationQuery(ctx, q, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithAvg(f, "avg")
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -38,8 +58,12 @@ func Avg(ctx context.Context, q Query, f string) (float64, error) {
 
 // IntSum はクエリに一致するエンティティのInt型の指定フィールドの合計値を返します。
 func IntSum(ctx context.Context, q Query, f string) (int, error) {
-	aq := q.NewAggregationQuery().WithSum(f, "sum")
-	ar, err := client.RunAggregationQuery(ctx, aq)
+	if err := aggregationErr(q, f); err != nil {
+		return 0, err
+	}
+	ar, err := runAggregationQuery(ctx, q, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithSum(f, "sum")
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -52,8 +76,12 @@ func IntSum(ctx context.Context, q Query, f string) (int, error) {
 
 // Float64Sum はクエリに一致するエンティティのFloat64型の指定フィールドの合計値を返します。
 func Float64Sum(ctx context.Context, q Query, f string) (float64, error) {
-	aq := q.NewAggregationQuery().WithSum(f, "sum")
-	ar, err := client.RunAggregationQuery(ctx, aq)
+	if err := aggregationErr(q, f); err != nil {
+		return 0, err
+	}
+	ar, err := runAggregationQuery(ctx, q, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithSum(f, "sum")
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -78,48 +106,90 @@ type Aggregation interface {
 }
 
 type aggregation struct {
-	aq      *datastore.AggregationQuery
+	q Query
+	// aggs は追加した集計です。ReadAt で読み取り時刻を指定した場合にクエリを作り直すため、Run まで集計クエリを作成しません。
+	aggs    []func(aq *datastore.AggregationQuery) *datastore.AggregationQuery
 	iresuts map[string]int
 	fresuts map[string]float64
+	err     error
 }
 
 // NewAggregation コンストラクタ
 func NewAggregation(q Query) Aggregation {
 	return &aggregation{
-		aq:      q.NewAggregationQuery(),
+		q:       q,
 		iresuts: make(map[string]int),
 		fresuts: make(map[string]float64),
+		err:     q.Err(),
 	}
 }
 
+// check は集計するフィールドを検証し、最初のエラーを記録します。
+func (a *aggregation) check(f string) {
+	if a.err == nil {
+		a.err = aggregationErr(a.q, f)
+	}
+}
+
+// aggregationErr はクエリの検証エラーと、NewQueryFor で作成したクエリの場合は集計するフィールド f の検証エラーを返します。
+func aggregationErr(q Query, f string) error {
+	if err := q.Err(); err != nil {
+		return err
+	}
+	if qq, ok := asQuery(q); ok && f != "" {
+		return qq.schema.checkAggregated(f)
+	}
+	return nil
+}
+
 // WithCount はカウント集計を追加します。
 func (a *aggregation) WithCount() Aggregation {
-	a.aq = a.aq.WithCount("count")
+	a.aggs = append(a.aggs, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithCount("count")
+	})
 	return a
 }
 
 // WithAvg は指定フィールドの平均値集計を追加します。
 func (a *aggregation) WithAvg(f string) Aggregation {
-	a.aq = a.aq.WithAvg(f, "avg_"+f)
+	a.check(f)
+	a.aggs = append(a.aggs, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithAvg(f, "avg_"+f)
+	})
 	return a
 }
 
 // WithIntSum は指定フィールドのInt型の合計値集計を追加します。
 func (a *aggregation) WithIntSum(f string) Aggregation {
-	a.aq = a.aq.WithSum(f, "isum_"+f)
+	a.check(f)
+	a.aggs = append(a.aggs, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithSum(f, "isum_"+f)
+	})
 	return a
 }
 
 // WithFloat64Sum は指定フィールドのFloat64型の合計値集計を追加します。
 func (a *aggregation) WithFloat64Sum(f string) Aggregation {
-	a.aq = a.aq.WithSum(f, "fsum_"+f)
+	a.check(f)
+	a.aggs = append(a.aggs, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		return aq.WithSum(f, "fsum_"+f)
+	})
 	return a
 }
 
 // Run は集計クエリを実行します。
 // 結果はAggregation構造体に保存され、Count、Avg、IntSum、Float64Sumメソッドで取得できます。
+// ctx に ReadAt で読み取り時刻を指定した場合は、その時刻のスナップショットに対して集計します。
 func (a *aggregation) Run(ctx context.Context) error {
-	ar, err := client.RunAggregationQuery(ctx, a.aq)
+	if a.err != nil {
+		return a.err
+	}
+	ar, err := runAggregationQuery(ctx, a.q, func(aq *datastore.AggregationQuery) *datastore.AggregationQuery {
+		for _, agg := range a.aggs {
+			aq = agg(aq)
+		}
+		return aq
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,80 @@
+package entitystore
+
+import (
+	"context"
+	"time"
+)
+
+// createdAtProperty は AuditedEntityBase が作成日時を保存するプロパティ名です。
+const createdAtProperty = "CreatedAt"
+
+// createdByProperty は AuditedEntityBase が作成者を保存するプロパティ名です。
+const createdByProperty = "CreatedBy"
+
+// Audited は作成日時と作成者・更新者を記録するエンティティのインターフェースです。
+// AuditedEntityBase を埋め込むことで実装できます。
+// Audited なエンティティを更新する場合は、保存されている作成日時と作成者を維持するため、
+// トランザクション内で既存のエンティティを確認してから書き込みます。
+type Audited interface {
+	SetCreatedAt(t time.Time)
+	CreatedAt() time.Time
+	SetCreatedBy(actor string)
+	CreatedBy() string
+	SetUpdatedBy(actor string)
+	UpdatedBy() string
+}
+
+// actorKey は context.Context に操作者を保存するためのキーです。
+type actorKey struct{}
+
+// WithActor は操作者を設定した context.Context を返します。
+// この context.Context を使って保存した Audited なエンティティには、操作者が作成者・更新者として記録されます。
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext は context.Context に設定されている操作者を返します。
+// 設定されていない場合は空文字列を返します。
+func ActorFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// needsCreationCheck は既存のエンティティの作成日時を確認する必要がある操作かどうかを返します。
+// 新規作成の場合は既存のエンティティが無いことが分かっているので確認しません。
+func needsCreationCheck(op *writeOp) bool {
+	if op.typ != MutationTypeUpdate && op.typ != MutationTypeUpsert {
+		return false
+	}
+	_, ok := op.src.(Audited)
+	return ok
+}
+
+// preserveCreation は既存のエンティティに記録されている作成日時と作成者を、保存するエンティティに引き継ぎます。
+// loadPrevious の後に呼び出します。
+func preserveCreation(ops []*writeOp) {
+	for _, op := range ops {
+		if !op.exists || !needsCreationCheck(op) {
+			continue
+		}
+		var createdAt time.Time
+		var createdBy string
+		for _, p := range op.prev {
+			switch p.Name {
+			case createdAtProperty:
+				createdAt, _ = p.Value.(time.Time)
+			case createdByProperty:
+				createdBy, _ = p.Value.(string)
+			}
+		}
+		if createdAt.IsZero() {
+			continue // 作成日時が記録されていない古いエンティティの場合は新しい値のままにする
+		}
+		a := op.src.(Audited)
+		a.SetCreatedAt(createdAt)
+		a.SetCreatedBy(createdBy)
+	}
+}
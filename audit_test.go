@@ -0,0 +1,61 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActorFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, "", ActorFromContext(ctx))
+	require.Equal(t, "alice", ActorFromContext(WithActor(ctx, "alice")))
+}
+
+func TestPreserveCreation(t *testing.T) {
+	createdAt := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	existing := &AuditedTestEntity{Id: 1}
+	existing.SetCreatedAt(time.Now())
+	existing.SetCreatedBy("bob")
+	inserted := &AuditedTestEntity{Id: 2}
+	inserted.SetCreatedBy("bob")
+	ops := []*writeOp{
+		{
+			typ: MutationTypeUpsert, key: existing.Key(), src: existing, exists: true,
+			prev: []datastore.Property{
+				{Name: "CreatedAt", Value: createdAt},
+				{Name: "CreatedBy", Value: "alice"},
+			},
+		},
+		{typ: MutationTypeUpsert, key: inserted.Key(), src: inserted},
+	}
+	preserveCreation(ops)
+	require.Equal(t, createdAt, existing.CreatedAt())
+	require.Equal(t, "alice", existing.CreatedBy())
+	require.Equal(t, "bob", inserted.CreatedBy())
+}
+
+func TestPutEntity_Audited(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	err := DeleteAll(ctx, "AuditedTestEntity")
+	require.NoError(t, err)
+
+	err = PutEntity(WithActor(ctx, "alice"), &AuditedTestEntity{Id: 1, Value: "Created"})
+	require.NoError(t, err)
+	created := &AuditedTestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, created))
+
+	// ロードせずに上書きしても作成日時と作成者は維持される
+	err = MutateEntity(WithActor(ctx, "bob"), NewUpsert(&AuditedTestEntity{Id: 1, Value: "Updated"}))
+	require.NoError(t, err)
+	e := &AuditedTestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e))
+	require.Equal(t, "Updated", e.Value)
+	require.Equal(t, created.CreatedAt(), e.CreatedAt())
+	require.Equal(t, "alice", e.CreatedBy())
+	require.Equal(t, "bob", e.UpdatedBy())
+}
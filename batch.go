@@ -0,0 +1,193 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// maxLookupKeys は Datastore の1回の Lookup で取得できるキーの最大数です。
+	maxLookupKeys = 1000
+	// maxCommitMutations は Datastore の1回のコミットに含められる Mutation の最大数です。
+	maxCommitMutations = 500
+)
+
+// ErrTooManyMutations は、すべて書き込むかどれも書き込まないことを保証する書き込みが、
+// 1回のコミットの Mutation の数の上限を超えることを表すエラーです。
+var ErrTooManyMutations = errors.New("entitystore: too many mutations for a single commit")
+
+// DefaultParallelism は分割したバッチを同時に実行する数のデフォルトです。
+const DefaultParallelism = 4
+
+// parallelism は分割したバッチを同時に実行する最大数です。
+var parallelism = DefaultParallelism
+
+// batch はスライスを分割した範囲 [lo, hi) です。
+type batch struct {
+	lo, hi int
+}
+
+// batchesOf は n 件を size 件ずつの範囲に分割します。
+func batchesOf(n, size int) []batch {
+	bs := make([]batch, 0, (n+size-1)/size)
+	for lo := 0; lo < n; lo += size {
+		bs = append(bs, batch{lo: lo, hi: min(lo+size, n)})
+	}
+	return bs
+}
+
+// runBatches は f を n 回、最大 parallelism 個ずつ同時に呼び出し、すべて終わるまで待ちます。
+// n が 1 の場合は同じ goroutine で呼び出します。
+func runBatches(n int, f func(i int)) {
+	if n == 1 {
+		f(0)
+		return
+	}
+	sem := make(chan struct{}, max(parallelism, 1))
+	var wg sync.WaitGroup
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// mergeBatchErrors はバッチごとのエラーを、元のスライスの位置に合わせた MultiError にまとめます。
+// バッチが1つの場合はそのエラーをそのまま返します。
+// MultiError ではないエラーで失敗したバッチは、そのバッチのすべての位置にエラーを設定します。
+func mergeBatchErrors(n int, bs []batch, errs []error) error {
+	if len(bs) == 1 {
+		return errs[0]
+	}
+	var merr datastore.MultiError
+	for i, b := range bs {
+		if errs[i] == nil {
+			continue
+		}
+		if merr == nil {
+			merr = make(datastore.MultiError, n)
+		}
+		var berr datastore.MultiError
+		if errors.As(errs[i], &berr) && len(berr) == b.hi-b.lo {
+			copy(merr[b.lo:b.hi], berr)
+			continue
+		}
+		for j := b.lo; j < b.hi; j++ {
+			merr[j] = errs[i]
+		}
+	}
+	if merr == nil {
+		return nil
+	}
+	return merr
+}
+
+// lookupMulti は keys を maxLookupKeys 件ずつに分割して取得します。
+// tx が nil でない場合はトランザクション内で順に取得し、nil の場合は並行して取得します。
+func lookupMulti(ctx context.Context, tx *datastore.Transaction, keys []*datastore.Key, pls []datastore.PropertyList) error {
+	bs := batchesOf(len(keys), maxLookupKeys)
+	errs := make([]error, len(bs))
+	get := func(i int) {
+		b := bs[i]
+		if tx != nil {
+			errs[i] = tx.GetMulti(keys[b.lo:b.hi], pls[b.lo:b.hi])
+		} else {
+			errs[i] = client.GetMulti(ctx, keys[b.lo:b.hi], pls[b.lo:b.hi])
+		}
+	}
+	if tx != nil {
+		for i := range bs {
+			get(i)
+		}
+	} else {
+		runBatches(len(bs), get)
+	}
+	return mergeBatchErrors(len(keys), bs, errs)
+}
+
+// deleteKeys は keys を maxCommitMutations 件ずつに分割して並行して削除します。フックの呼び出しやキャッシュの削除は行いません。
+func deleteKeys(ctx context.Context, keys []*datastore.Key) error {
+	bs := batchesOf(len(keys), maxCommitMutations)
+	errs := make([]error, len(bs))
+	runBatches(len(bs), func(i int) {
+		errs[i] = client.DeleteMulti(ctx, keys[bs[i].lo:bs[i].hi])
+	})
+	return mergeBatchErrors(len(keys), bs, errs)
+}
+
+// allocateIDs は keys を maxCommitMutations 件ずつに分割して並行して ID を割り当てます。
+func allocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	bs := batchesOf(len(keys), maxCommitMutations)
+	allocated := make([]*datastore.Key, len(keys))
+	errs := make([]error, len(bs))
+	runBatches(len(bs), func(i int) {
+		var ks []*datastore.Key
+		ks, errs[i] = client.AllocateIDs(ctx, keys[bs[i].lo:bs[i].hi])
+		copy(allocated[bs[i].lo:bs[i].hi], ks)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return allocated, nil
+}
+
+// cacheGetEntities は keys を maxLookupKeys 件ずつに分割してキャッシュから並行して取得します。
+// 一部のバッチが失敗した場合は、取得できたエンティティとエラーを返します。
+func cacheGetEntities(ctx context.Context, keys []datastore.Key) (map[datastore.Key][]datastore.Property, error) {
+	bs := batchesOf(len(keys), maxLookupKeys)
+	if len(bs) <= 1 {
+		return cache.GetEntities(ctx, keys)
+	}
+	var mu sync.Mutex
+	cached := make(map[datastore.Key][]datastore.Property, len(keys))
+	errs := make([]error, len(bs))
+	runBatches(len(bs), func(i int) {
+		m, err := cache.GetEntities(ctx, keys[bs[i].lo:bs[i].hi])
+		errs[i] = err
+		mu.Lock()
+		maps.Copy(cached, m)
+		mu.Unlock()
+	})
+	return cached, errors.Join(errs...)
+}
+
+// cacheSetEntities は entities を maxLookupKeys 件ずつに分割してキャッシュに並行して保存します。
+func cacheSetEntities(ctx context.Context, entities map[datastore.Key][]datastore.Property) error {
+	if len(entities) <= maxLookupKeys {
+		return cache.SetEntities(ctx, entities)
+	}
+	var chunks []map[datastore.Key][]datastore.Property
+	for key, ps := range entities {
+		if len(chunks) == 0 || len(chunks[len(chunks)-1]) == maxLookupKeys {
+			chunks = append(chunks, make(map[datastore.Key][]datastore.Property, maxLookupKeys))
+		}
+		chunks[len(chunks)-1][key] = ps
+	}
+	errs := make([]error, len(chunks))
+	runBatches(len(chunks), func(i int) {
+		errs[i] = cache.SetEntities(ctx, chunks[i])
+	})
+	return errors.Join(errs...)
+}
+
+// cacheDeleteEntities は keys を maxCommitMutations 件ずつに分割してキャッシュから並行して削除します。
+func cacheDeleteEntities(ctx context.Context, keys []datastore.Key) error {
+	bs := batchesOf(len(keys), maxCommitMutations)
+	if len(bs) <= 1 {
+		return cache.DeleteEntities(ctx, keys)
+	}
+	errs := make([]error, len(bs))
+	runBatches(len(bs), func(i int) {
+		errs[i] = cache.DeleteEntities(ctx, keys[bs[i].lo:bs[i].hi])
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,300 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+
+	"go.fujikura.biz/entitystore/cachestore"
+)
+
+// batchClient は呼び出しごとの件数を記録する DatastoreClient です。
+type batchClient struct {
+	DatastoreClient
+	mu      sync.Mutex
+	sizes   []int
+	missing map[string]bool
+	broken  map[string]bool
+	fail    map[string]bool
+	// failSize は Mutate を失敗させる Mutation の数です。
+	failSize int
+}
+
+func (c *batchClient) record(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizes = append(c.sizes, n)
+}
+
+func (c *batchClient) GetMulti(_ context.Context, keys []*datastore.Key, dst interface{}) error {
+	c.record(len(keys))
+	pls := dst.([]datastore.PropertyList)
+	merr := make(datastore.MultiError, len(keys))
+	problem := false
+	for i, key := range keys {
+		if c.missing[key.Name] {
+			merr[i] = datastore.ErrNoSuchEntity
+			problem = true
+			continue
+		}
+		if c.broken[key.Name] {
+			merr[i] = errors.New("broken")
+			problem = true
+			continue
+		}
+		pls[i] = datastore.PropertyList{{Name: "Value", Value: key.Name}}
+	}
+	if problem {
+		return merr
+	}
+	return nil
+}
+
+func (c *batchClient) Mutate(_ context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error) {
+	c.record(len(muts))
+	if len(muts) == c.failSize {
+		return nil, errors.New("failed")
+	}
+	return nil, nil
+}
+
+func (c *batchClient) DeleteMulti(_ context.Context, keys []*datastore.Key) error {
+	c.record(len(keys))
+	if c.fail[keys[0].Name] {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+// countingCachestore は呼び出しごとの件数を記録する Cachestore です。
+type countingCachestore struct {
+	cachestore.Nostore
+	mu     sync.Mutex
+	cached map[datastore.Key][]datastore.Property
+	sets   []int
+	dels   []int
+	delErr error
+}
+
+func (c *countingCachestore) GetEntities(_ context.Context, keys []datastore.Key) (map[datastore.Key][]datastore.Property, error) {
+	m := map[datastore.Key][]datastore.Property{}
+	for _, key := range keys {
+		if ps, ok := c.cached[key]; ok {
+			m[key] = ps
+		}
+	}
+	return m, nil
+}
+
+func (c *countingCachestore) SetEntities(_ context.Context, m map[datastore.Key][]datastore.Property) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sets = append(c.sets, len(m))
+	return nil
+}
+
+func (c *countingCachestore) DeleteEntities(_ context.Context, keys []datastore.Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dels = append(c.dels, len(keys))
+	return c.delErr
+}
+
+func withBatchClient(t *testing.T) (*batchClient, *countingCachestore) {
+	oldClient, oldCache := client, cache
+	bc := &batchClient{missing: map[string]bool{}, broken: map[string]bool{}, fail: map[string]bool{}}
+	cc := &countingCachestore{}
+	client, cache = bc, cc
+	t.Cleanup(func() { client, cache = oldClient, oldCache })
+	return bc, cc
+}
+
+func nameKeys(kind string, n int) []*datastore.Key {
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.NameKey(kind, strconv.Itoa(i), nil)
+	}
+	return keys
+}
+
+func TestBatchesOf(t *testing.T) {
+	require.Empty(t, batchesOf(0, 500))
+	require.Equal(t, []batch{{0, 500}}, batchesOf(500, 500))
+	require.Equal(t, []batch{{0, 500}, {500, 1000}, {1000, 1001}}, batchesOf(1001, 500))
+}
+
+func TestRunBatches(t *testing.T) {
+	old := parallelism
+	parallelism = 2
+	t.Cleanup(func() { parallelism = old })
+
+	var running, peak atomic.Int32
+	done := make([]bool, 10)
+	runBatches(len(done), func(i int) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		done[i] = true
+		running.Add(-1)
+	})
+	require.Equal(t, []bool{true, true, true, true, true, true, true, true, true, true}, done)
+	require.LessOrEqual(t, peak.Load(), int32(2))
+}
+
+func TestMergeBatchErrors(t *testing.T) {
+	errFailed := errors.New("failed")
+	// バッチが1つの場合はそのまま返す
+	require.Equal(t, errFailed, mergeBatchErrors(3, batchesOf(3, 5), []error{errFailed}))
+
+	bs := batchesOf(5, 2)
+	require.NoError(t, mergeBatchErrors(5, bs, make([]error, len(bs))))
+	err := mergeBatchErrors(5, bs, []error{
+		datastore.MultiError{nil, datastore.ErrNoSuchEntity},
+		nil,
+		errFailed,
+	})
+	require.Equal(t, datastore.MultiError{nil, datastore.ErrNoSuchEntity, nil, nil, errFailed}, err)
+}
+
+func TestGetMulti_Batches(t *testing.T) {
+	ctx := context.Background()
+	bc, cc := withBatchClient(t)
+	keys := nameKeys("TestEntity", 2500)
+	bc.missing["1500"] = true
+
+	dst := make([]any, len(keys))
+	for i := range dst {
+		dst[i] = &datastore.PropertyList{}
+	}
+	err := GetMulti(ctx, keys, dst)
+	var merr datastore.MultiError
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr, 2500)
+	for i, e := range merr {
+		if i == 1500 {
+			require.ErrorIs(t, e, datastore.ErrNoSuchEntity)
+		} else {
+			require.NoError(t, e)
+		}
+	}
+	require.Equal(t, "2499", (*dst[2499].(*datastore.PropertyList))[0].Value)
+	require.ElementsMatch(t, []int{1000, 1000, 500}, bc.sizes)
+	require.ElementsMatch(t, []int{1000, 1000, 499}, cc.sets)
+}
+
+func TestGetMulti_ErrorsWithCacheHits(t *testing.T) {
+	ctx := context.Background()
+	bc, cc := withBatchClient(t)
+	keys := nameKeys("TestEntity", 4)
+	cc.cached = map[datastore.Key][]datastore.Property{
+		*keys[0]: {{Name: "Value", Value: "cached"}},
+	}
+	bc.broken["2"] = true
+
+	dst := make([]any, len(keys))
+	for i := range dst {
+		dst[i] = &datastore.PropertyList{}
+	}
+	err := GetMulti(ctx, keys, dst)
+	var merr datastore.MultiError
+	require.ErrorAs(t, err, &merr)
+	require.True(t, IsProblem(err))
+	// エラーは keys の位置に設定され、取得できたエンティティはロードされる
+	require.Len(t, merr, 4)
+	require.NoError(t, merr[0])
+	require.NoError(t, merr[1])
+	require.EqualError(t, merr[2], "broken")
+	require.NoError(t, merr[3])
+	require.Equal(t, "cached", (*dst[0].(*datastore.PropertyList))[0].Value)
+	require.Equal(t, "3", (*dst[3].(*datastore.PropertyList))[0].Value)
+	require.Equal(t, []int{2}, cc.sets)
+}
+
+func TestWrite_Batches(t *testing.T) {
+	ctx := context.Background()
+	bc, cc := withBatchClient(t)
+	es := make([]*TestEntity, 1200)
+	for i := range es {
+		es[i] = &TestEntity{Id: i}
+	}
+	require.NoError(t, PutEntityMulti(ctx, es))
+	require.ElementsMatch(t, []int{500, 500, 200}, bc.sizes)
+	require.ElementsMatch(t, []int{500, 500, 200}, cc.dels)
+
+	// 変更履歴などの Mutation も含めて上限を超えないように分割する
+	RegisterKind("TestEntity", KindOptions{History: true})
+	defer RegisterKind("TestEntity", KindOptions{})
+	ops := lo.Map(es, func(e *TestEntity, _ int) *writeOp { return &writeOp{typ: MutationTypeUpsert, key: e.Key(), src: e} })
+	require.Equal(t, []batch{{0, 250}, {250, 500}, {500, 750}, {750, 1000}, {1000, 1200}}, commitBatches(ops))
+}
+
+func TestDeleteKeys_PartialFailure(t *testing.T) {
+	ctx := context.Background()
+	bc, _ := withBatchClient(t)
+	keys := nameKeys("TestEntity", 1100)
+	bc.fail["500"] = true
+
+	err := deleteKeys(ctx, keys)
+	var merr datastore.MultiError
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr, 1100)
+	require.NoError(t, merr[499])
+	require.Error(t, merr[500])
+	require.Error(t, merr[999])
+	require.NoError(t, merr[1000])
+}
+
+func TestWrite_TooManyConditionalMutations(t *testing.T) {
+	ctx := context.Background()
+	bc, _ := withBatchClient(t)
+	es := make([]*TestEntity, 501)
+	for i := range es {
+		es[i] = &TestEntity{Id: i + 1}
+	}
+	// 条件付き書き込みは1回のコミットに収まらない場合は何も書き込まない
+	require.ErrorIs(t, PutEntityMultiIfUnchanged(ctx, es), ErrTooManyMutations)
+	require.Empty(t, bc.sizes)
+}
+
+func TestWrite_PartialFailureWithCacheError(t *testing.T) {
+	ctx := context.Background()
+	bc, cc := withBatchClient(t)
+	bc.failSize = 200
+	errCache := errors.New("cache failed")
+	cc.delErr = errCache
+	var postPut atomic.Int32
+	RegisterGlobalHooks(GlobalHooks{
+		PostPut: func(context.Context, *datastore.Key, any) error {
+			postPut.Add(1)
+			return nil
+		},
+	})
+	t.Cleanup(func() { globalHooks = nil })
+
+	es := make([]*TestEntity, 1200)
+	for i := range es {
+		es[i] = &TestEntity{Id: i + 1}
+	}
+	err := PutEntityMulti(ctx, es)
+	// 書き込みのエラーとキャッシュのエラーの両方を返し、書き込まれたエンティティの書き込み後のフックは呼び出す
+	var merr datastore.MultiError
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr, 1200)
+	require.NoError(t, merr[999])
+	require.Error(t, merr[1000])
+	require.ErrorIs(t, err, errCache)
+	require.Equal(t, int32(1000), postPut.Load())
+}
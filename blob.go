@@ -0,0 +1,484 @@
+package entitystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+
+	"go.fujikura.biz/entitystore/blobstore"
+)
+
+// DefaultBlobThreshold は Config.BlobThreshold が指定されていない場合の、BlobStore に保存する値の大きさの下限です。
+const DefaultBlobThreshold = 64 * 1024
+
+// blobStore は大きなプロパティの値を保存する BlobStore のインスタンスです。
+var blobStore blobstore.BlobStore
+
+// blobThreshold はこの大きさを超える値を BlobStore に保存します。
+var blobThreshold = DefaultBlobThreshold
+
+// blobOption は BlobStore に保存するフィールドに付ける構造体タグ `entitystore:"blob"` のオプションです。
+// string と []byte のフィールドに指定でき、大きな値は BlobStore に保存してエンティティには参照を保存します。
+// 保存した値はエンティティの取得時にまとめて BlobStore から取得します。
+// 必要になるまで取得しない場合は、フィールドの型に Blob を使用してください。
+const blobOption = "blob"
+
+// blobValueProperty は Blob を保存する際に、値を入れ子のエンティティから取り出すための目印のプロパティ名です。
+const blobValueProperty = "__blob__"
+
+// blobRefMagic は BlobStore への参照の先頭に付ける目印です。参照は 目印 | Blob の名前 の形式です。
+var blobRefMagic = []byte("\x00ESB1")
+
+// Blob は BlobStore に保存できる大きなバイト列です。
+// エンティティのフィールドとして使用すると、Config.BlobThreshold を超える値は BlobStore に保存され、
+// Datastore には参照のみが保存されます。インデックスは作成しません。
+// 取得したエンティティの Blob は、Bytes を呼び出した時に BlobStore から取得します。
+//
+//	type Document struct {
+//		EntityBase
+//		Id   int
+//		Body Blob
+//	}
+type Blob struct {
+	ref    string
+	data   []byte
+	loaded bool
+}
+
+// NewBlob は data を値とする Blob を作成します。
+func NewBlob(data []byte) Blob {
+	return Blob{data: data, loaded: true}
+}
+
+// Set は値を data に変更します。
+func (b *Blob) Set(data []byte) {
+	*b = NewBlob(data)
+}
+
+// Loaded は値を取得済みかどうかを返します。BlobStore に保存されていない値は常に取得済みです。
+func (b Blob) Loaded() bool {
+	return b.loaded || b.ref == ""
+}
+
+// Bytes は値を返します。取得していない場合は BlobStore から取得します。
+func (b *Blob) Bytes(ctx context.Context) ([]byte, error) {
+	if b.Loaded() {
+		return b.data, nil
+	}
+	data, err := getBlob(ctx, b.ref)
+	if err != nil {
+		return nil, err
+	}
+	b.data, b.loaded = data, true
+	return data, nil
+}
+
+// Save は datastore.PropertyLoadSaver の実装です。
+// 保存時に saveStruct によって値または BlobStore への参照のプロパティに置き換えられます。
+func (b *Blob) Save() ([]datastore.Property, error) {
+	var v any = b.data
+	if !b.Loaded() {
+		v = blobRefValue(b.ref)
+	}
+	return []datastore.Property{{Name: blobValueProperty, Value: v, NoIndex: true}}, nil
+}
+
+// Load は datastore.PropertyLoadSaver の実装です。
+func (b *Blob) Load(ps []datastore.Property) error {
+	*b = Blob{loaded: true}
+	for _, p := range ps {
+		if data, ok := p.Value.([]byte); ok {
+			if name, ok := blobRefName(data); ok {
+				*b = Blob{ref: name}
+			} else {
+				b.data = data
+			}
+		}
+	}
+	return nil
+}
+
+// blobRefValue は Blob の名前から参照の値を作成します。
+func blobRefValue(name string) []byte {
+	return append(slices.Clip(blobRefMagic), name...)
+}
+
+// blobRefName は値が BlobStore への参照の場合に Blob の名前を返します。
+func blobRefName(v any) (string, bool) {
+	data, ok := v.([]byte)
+	if !ok || !bytes.HasPrefix(data, blobRefMagic) {
+		return "", false
+	}
+	return string(data[len(blobRefMagic):]), true
+}
+
+// blobName はエンティティのキーと値から Blob の名前を作成します。
+// 同じエンティティの同じ値は同じ名前になるため、変更していない値を保存し直しても参照は変わりません。
+// 別のエンティティとは名前が重ならないため、エンティティの削除時に Blob を削除できます。
+func blobName(key *datastore.Key, data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(key.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key.String()))
+	h.Write([]byte{0})
+	h.Write(data)
+	return fmt.Sprintf("%s/%x", key.Kind, h.Sum(nil))
+}
+
+// getBlob は BlobStore から Blob を取得します。
+func getBlob(ctx context.Context, name string) ([]byte, error) {
+	if blobStore == nil {
+		return nil, errors.New("entitystore: BlobStore is not configured")
+	}
+	return blobStore.Get(ctx, name)
+}
+
+// blobFields は型の BlobStore に保存するフィールドの情報です。
+type blobFields struct {
+	// tagged は構造体タグ `entitystore:"blob"` を付けたフィールドのプロパティ名です。
+	// 値は string のフィールドの場合に true です。
+	tagged map[string]bool
+	// nested は Blob のフィールドを含むかどうかです。
+	nested bool
+}
+
+// has は BlobStore に保存するフィールドがあるかどうかを返します。
+func (f blobFields) has() bool {
+	return len(f.tagged) > 0 || f.nested
+}
+
+// blobFieldsCache は型ごとの blobFields のキャッシュです。
+var blobFieldsCache sync.Map // map[reflect.Type]blobFields
+
+// blobType は Blob の型です。
+var blobType = reflect.TypeOf(Blob{})
+
+// blobFieldsOf は型の BlobStore に保存するフィールドを返します。結果はキャッシュされます。
+func blobFieldsOf(t reflect.Type) (blobFields, error) {
+	if t == nil {
+		return blobFields{}, nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return blobFields{}, nil
+	}
+	if cached, ok := blobFieldsCache.Load(t); ok {
+		return cached.(blobFields), nil
+	}
+	fields := blobFields{tagged: map[string]bool{}, nested: containsBlob(t, map[reflect.Type]bool{})}
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() || !hasTagOption(sf, blobOption) {
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("datastore"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if hasTagOption(sf, encryptOption) {
+			return blobFields{}, fmt.Errorf("entitystore: field %s of %s cannot be both encrypted and stored as a blob", sf.Name, t.Name())
+		}
+		switch {
+		case sf.Type.Kind() == reflect.String:
+			fields.tagged[name] = true
+		case sf.Type == reflect.TypeOf([]byte(nil)):
+			fields.tagged[name] = false
+		default:
+			return blobFields{}, fmt.Errorf("entitystore: field %s of %s has unsupported type %s for blob", sf.Name, t.Name(), sf.Type)
+		}
+	}
+	blobFieldsCache.Store(t, fields)
+	return fields, nil
+}
+
+// containsBlob は型が Blob のフィールドを含むかどうかを返します。
+// visiting は再帰的な構造体を無限に辿らないために使用します。
+func containsBlob(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return containsBlob(t.Elem(), visiting)
+	case reflect.Struct:
+		if t == blobType {
+			return true
+		}
+		if visiting[t] || isDatastoreValueType(t) {
+			return false
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if (sf.IsExported() || sf.Anonymous) && containsBlob(sf.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blobOffloader は saveStruct で保存したプロパティのうち、大きな値を BlobStore への参照に置き換えます。
+type blobOffloader struct {
+	e any
+	// key は Blob の名前に使用するキーです。nil の場合は e の Key を使用します。
+	key *datastore.Key
+	// keep が true の場合は大きな値も参照に置き換えずに Blob の値を取り出します。
+	keep bool
+	// blobs は BlobStore に保存する値です。
+	blobs map[string][]byte
+}
+
+// offloadBlobs は構造体タグ `entitystore:"blob"` のフィールドと Blob のフィールドのプロパティのうち、
+// Config.BlobThreshold を超える値を BlobStore への参照に置き換え、BlobStore に保存する値を返します。
+// BlobStore への保存は書き込み時に uploadBlobs で行います。
+// Blob の名前には key を使用し、key が nil の場合はエンティティの Key を使用します。
+func offloadBlobs(key *datastore.Key, e any, ps []datastore.Property) (map[string][]byte, error) {
+	fields, err := blobFieldsOf(reflect.TypeOf(e))
+	if !fields.has() || err != nil {
+		return nil, err
+	}
+	o := &blobOffloader{e: e, key: key}
+	for i := range ps {
+		if _, ok := fields.tagged[ps[i].Name]; ok {
+			var data []byte
+			switch v := ps[i].Value.(type) {
+			case string:
+				data = []byte(v)
+			case []byte:
+				data = v
+			}
+			ps[i].NoIndex = true
+			if len(data) > blobThreshold {
+				if ps[i].Value, err = o.offload(data); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if fields.nested {
+			if err := o.property(&ps[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return o.blobs, nil
+}
+
+// unwrapBlobs は Blob を保存した入れ子のエンティティを、BlobStore への参照に置き換えずに Blob の値に置き換えます。
+// 取得していない Blob は参照のままです。
+func unwrapBlobs(ps []datastore.Property) {
+	o := &blobOffloader{keep: true}
+	for i := range ps {
+		_ = o.property(&ps[i]) // 参照に置き換えないためエラーにならない
+	}
+}
+
+// offload は値を BlobStore に保存する値として記録し、参照を返します。
+// 不完全なキーの名前は同じ Kind の同じ値を持つ別のエンティティと重なるため、完全なキーが必要です。
+func (o *blobOffloader) offload(data []byte) ([]byte, error) {
+	key := o.key
+	if key == nil {
+		if ent, ok := o.e.(Entity); ok {
+			key = ent.Key()
+		}
+	}
+	if key == nil || key.Incomplete() {
+		return nil, fmt.Errorf("entitystore: storing a blob requires a complete key but got %T", o.e)
+	}
+	name := blobName(key, data)
+	if o.blobs == nil {
+		o.blobs = map[string][]byte{}
+	}
+	o.blobs[name] = data
+	return blobRefValue(name), nil
+}
+
+// property は Blob を保存した入れ子のエンティティを値または参照に置き換えます。
+func (o *blobOffloader) property(p *datastore.Property) error {
+	v, isBlob, err := o.value(p.Value)
+	if err != nil {
+		return err
+	}
+	p.Value = v
+	if isBlob {
+		p.NoIndex = true
+	}
+	return nil
+}
+
+// value はプロパティの値が Blob の場合に値または参照を返します。
+func (o *blobOffloader) value(v any) (any, bool, error) {
+	switch v := v.(type) {
+	case *datastore.Entity:
+		if v == nil {
+			return v, false, nil
+		}
+		if len(v.Properties) == 1 && v.Properties[0].Name == blobValueProperty {
+			data, _ := v.Properties[0].Value.([]byte)
+			if _, ok := blobRefName(data); ok || o.keep || len(data) <= blobThreshold {
+				return data, true, nil
+			}
+			ref, err := o.offload(data)
+			return ref, true, err
+		}
+		for i := range v.Properties {
+			if err := o.property(&v.Properties[i]); err != nil {
+				return nil, false, err
+			}
+		}
+	case []any:
+		isBlob := false
+		for i := range v {
+			ev, b, err := o.value(v[i])
+			if err != nil {
+				return nil, false, err
+			}
+			v[i], isBlob = ev, isBlob || b
+		}
+		return v, isBlob, nil
+	}
+	return v, false, nil
+}
+
+// loadBlobs は構造体タグ `entitystore:"blob"` のフィールドのプロパティのうち、
+// BlobStore への参照を BlobStore から取得した値に置き換えたプロパティを返します。
+// キャッシュの内容を変更しないよう、置き換えるプロパティがある場合は複製してから置き換えます。
+func loadBlobs(ctx context.Context, dst any, ps []datastore.Property) ([]datastore.Property, error) {
+	fields, err := blobFieldsOf(reflect.TypeOf(dst))
+	if len(fields.tagged) == 0 || err != nil {
+		return ps, err
+	}
+	out := ps
+	for i, p := range ps {
+		isString, ok := fields.tagged[p.Name]
+		if !ok {
+			continue
+		}
+		name, ok := blobRefName(p.Value)
+		if !ok {
+			continue
+		}
+		data, err := getBlob(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("entitystore: failed to load blob of property %s: %w", p.Name, err)
+		}
+		if &out[0] == &ps[0] {
+			out = slices.Clone(ps)
+		}
+		if isString {
+			out[i].Value = string(data)
+		} else {
+			out[i].Value = data
+		}
+	}
+	return out, nil
+}
+
+// blobRefs はプロパティに含まれる BlobStore への参照の Blob の名前を返します。
+func blobRefs(ps []datastore.Property) map[string]bool {
+	refs := map[string]bool{}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case []byte:
+			if name, ok := blobRefName(v); ok {
+				refs[name] = true
+			}
+		case *datastore.Entity:
+			if v != nil {
+				for _, p := range v.Properties {
+					walk(p.Value)
+				}
+			}
+		case []any:
+			for _, ev := range v {
+				walk(ev)
+			}
+		}
+	}
+	for _, p := range ps {
+		walk(p.Value)
+	}
+	return refs
+}
+
+// hasBlobs は書き込むエンティティが BlobStore に保存するフィールドを持つかどうかを返します。
+// 不要になった Blob を削除するため、このような書き込みは書き込み前の値を読み込むトランザクション内で行います。
+// キーのみで削除する場合は KindOptions.Entity の型から判断し、登録されていなければ BlobStore を使用している場合に、
+// 書き込み前の値が参照している Blob を削除するため true を返します。
+func hasBlobs(op *writeOp) bool {
+	src := op.src
+	if src == nil {
+		src = optionsOf(op.key.Kind).Entity
+	}
+	if src == nil {
+		return op.isDelete() && blobStore != nil
+	}
+	fields, _ := blobFieldsOf(reflect.TypeOf(src))
+	return fields.has()
+}
+
+// uploadBlobs は書き込むエンティティの値を BlobStore に保存します。
+// 書き込み前のエンティティが既に参照している Blob は保存し直しません。
+func uploadBlobs(ctx context.Context, ops []*writeOp) error {
+	for _, op := range ops {
+		if len(op.blobs) == 0 {
+			continue
+		}
+		if blobStore == nil {
+			return errors.New("entitystore: BlobStore is not configured")
+		}
+		stored := blobRefs(op.prev)
+		for name, data := range op.blobs {
+			if stored[name] {
+				continue
+			}
+			if err := blobStore.Put(ctx, name, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteUnusedBlobs は書き込みによって参照されなくなった Blob を BlobStore から削除します。
+// KindOptions.History が有効な Kind の Blob は変更履歴から参照されている可能性があり、
+// RestoreHistory で戻せるように削除しません。
+// エンティティの書き込みは完了しているため、削除に失敗しても警告ログを出すだけにします。
+func deleteUnusedBlobs(ctx context.Context, ops []*writeOp) {
+	if blobStore == nil {
+		return
+	}
+	var names []string
+	for _, op := range ops {
+		if op.skipped || op.unchanged || optionsOf(op.key.Kind).History {
+			continue
+		}
+		next := blobRefs(op.next)
+		for name := range blobRefs(op.prev) {
+			if !next[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	if err := blobStore.Delete(ctx, names); err != nil {
+		logger.Warn(
+			fmt.Sprintf(LogFormat, "BlobStore.Delete error"), slog.String("error", err.Error()),
+		)
+	}
+}
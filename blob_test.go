@@ -0,0 +1,226 @@
+package entitystore
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+
+	"go.fujikura.biz/entitystore/blobstore"
+)
+
+func withBlobStore(t *testing.T, threshold int) *blobstore.Local {
+	oldStore, oldThreshold := blobStore, blobThreshold
+	bs := &blobstore.Local{Dir: t.TempDir()}
+	blobStore, blobThreshold = bs, threshold
+	t.Cleanup(func() { blobStore, blobThreshold = oldStore, oldThreshold })
+	return bs
+}
+
+func TestBlob_SaveLoad(t *testing.T) {
+	ctx := context.Background()
+	withBlobStore(t, 8)
+	key := datastore.NameKey("BlobTestEntity", "1", nil)
+
+	src := &BlobTestEntity{
+		Id:          1,
+		Body:        strings.Repeat("a", 16),
+		Attachments: []Blob{NewBlob([]byte("small")), NewBlob([]byte(strings.Repeat("b", 16)))},
+		Thumbnail:   NewBlob([]byte("tiny")),
+	}
+	ps, blobs, err := saveStructBlobs(nil, src)
+	require.NoError(t, err)
+	require.Len(t, blobs, 2)
+
+	// 大きな値は参照に置き換えられ、小さな値はそのまま保存される
+	body := propertyOf(ps, "Body")
+	require.True(t, body.NoIndex)
+	name, ok := blobRefName(body.Value)
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(name, "BlobTestEntity/"))
+	require.Equal(t, []byte(strings.Repeat("a", 16)), blobs[name])
+	attachments := propertyOf(ps, "Attachments").Value.([]any)
+	require.Equal(t, []byte("small"), attachments[0])
+	_, ok = blobRefName(attachments[1])
+	require.True(t, ok)
+	require.Equal(t, []byte("tiny"), propertyOf(ps, "Thumbnail").Value)
+
+	// 同じ値は同じ参照になる
+	ps2, _, err := saveStructBlobs(nil, src)
+	require.NoError(t, err)
+	require.Equal(t, ps, ps2)
+
+	for name, data := range blobs {
+		require.NoError(t, blobStore.Put(ctx, name, data))
+	}
+	skipUnchanged = true
+	defer func() { skipUnchanged = false }()
+	dst := &BlobTestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, dst))
+	// タグを付けたフィールドはロード時に取得する
+	require.Equal(t, strings.Repeat("a", 16), dst.Body)
+	// Blob は必要になった時に取得する
+	require.True(t, dst.Attachments[0].Loaded())
+	require.False(t, dst.Attachments[1].Loaded())
+	data, err := dst.Attachments[1].Bytes(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte(strings.Repeat("b", 16)), data)
+	require.True(t, dst.Attachments[1].Loaded())
+	data, err = dst.Thumbnail.Bytes(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("tiny"), data)
+
+	// ロードしたエンティティは変更が無ければ同じプロパティになる
+	unchanged, err := isUnchanged(dst)
+	require.NoError(t, err)
+	require.True(t, unchanged)
+	dst.Body = strings.Repeat("c", 16)
+	unchanged, err = isUnchanged(dst)
+	require.NoError(t, err)
+	require.False(t, unchanged)
+}
+
+func TestBlob_NotLoadedIsSavedAsReference(t *testing.T) {
+	ctx := context.Background()
+	withBlobStore(t, 8)
+	key := datastore.NameKey("BlobTestEntity", "1", nil)
+	ps, blobs, err := saveStructBlobs(nil, &BlobTestEntity{Id: 1, Thumbnail: NewBlob([]byte(strings.Repeat("t", 16)))})
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+
+	dst := &BlobTestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, dst))
+	require.False(t, dst.Thumbnail.Loaded())
+	// 取得していない Blob は参照のまま保存する
+	ps2, blobs2, err := saveStructBlobs(nil, dst)
+	require.NoError(t, err)
+	require.Equal(t, propertyOf(ps, "Thumbnail"), propertyOf(ps2, "Thumbnail"))
+	require.Empty(t, blobs2)
+
+	// BlobStore に無い場合はエラー
+	_, err = dst.Thumbnail.Bytes(ctx)
+	require.ErrorIs(t, err, blobstore.ErrNotFound)
+	ps3, _, err := saveStructBlobs(nil, &BlobTestEntity{Id: 1, Body: strings.Repeat("a", 16)})
+	require.NoError(t, err)
+	require.ErrorIs(t, loadEntity(ctx, key, ps3, &BlobTestEntity{}), blobstore.ErrNotFound)
+}
+
+func TestBlob_NameFromWriteKey(t *testing.T) {
+	withBlobStore(t, 8)
+	e := &BlobTestEntity{Body: strings.Repeat("a", 16)}
+
+	// Blob の名前は書き込むキーから作成するため、同じ値でもエンティティごとに異なる
+	ps1, _, err := saveStructBlobs(datastore.IDKey("BlobTestEntity", 1, nil), e)
+	require.NoError(t, err)
+	ps2, _, err := saveStructBlobs(datastore.IDKey("BlobTestEntity", 2, nil), e)
+	require.NoError(t, err)
+	require.NotEqual(t, propertyOf(ps1, "Body").Value, propertyOf(ps2, "Body").Value)
+
+	// 不完全なキーでは名前を作成できない
+	_, _, err = saveStructBlobs(datastore.IncompleteKey("BlobTestEntity", nil), e)
+	require.Error(t, err)
+}
+
+func TestBlob_KeyOnlyDelete(t *testing.T) {
+	key := datastore.NameKey("BlobKeyOnlyEntity", "1", nil)
+	op := &writeOp{typ: MutationTypeDelete, key: key}
+	require.False(t, hasBlobs(op))
+
+	// BlobStore を使用している場合は書き込み前の値を読み込んで Blob を削除する
+	withBlobStore(t, 8)
+	require.True(t, hasBlobs(op))
+	RegisterKind("BlobKeyOnlyEntity", KindOptions{Entity: &TestEntity{}})
+	defer RegisterKind("BlobKeyOnlyEntity", KindOptions{})
+	require.False(t, hasBlobs(op))
+	RegisterKind("BlobKeyOnlyEntity", KindOptions{Entity: &BlobTestEntity{}})
+	require.True(t, hasBlobs(op))
+}
+
+func TestBlobFieldsOf_Invalid(t *testing.T) {
+	type unsupported struct {
+		Count int `entitystore:"blob"`
+	}
+	_, err := blobFieldsOf(reflect.TypeOf(unsupported{}))
+	require.Error(t, err)
+
+	type encrypted struct {
+		Body string `entitystore:"blob,encrypt"`
+	}
+	_, err = blobFieldsOf(reflect.TypeOf(encrypted{}))
+	require.Error(t, err)
+}
+
+func TestUploadAndDeleteUnusedBlobs(t *testing.T) {
+	ctx := context.Background()
+	bs := withBlobStore(t, 8)
+
+	old, oldBlobs, err := saveStructBlobs(nil, &BlobTestEntity{Id: 1, Body: strings.Repeat("a", 16)})
+	require.NoError(t, err)
+	next, nextBlobs, err := saveStructBlobs(nil, &BlobTestEntity{Id: 1, Body: strings.Repeat("b", 16)})
+	require.NoError(t, err)
+	key := datastore.NameKey("BlobTestEntity", "1", nil)
+	ops := []*writeOp{{typ: MutationTypeUpsert, key: key, prev: old, next: next, blobs: nextBlobs}}
+	for name, data := range oldBlobs {
+		require.NoError(t, bs.Put(ctx, name, data))
+	}
+	require.NoError(t, uploadBlobs(ctx, ops))
+
+	// 更新によって参照されなくなった Blob は削除される
+	deleteUnusedBlobs(ctx, ops)
+	for name := range oldBlobs {
+		_, err := bs.Get(ctx, name)
+		require.ErrorIs(t, err, blobstore.ErrNotFound)
+	}
+	for name := range nextBlobs {
+		_, err := bs.Get(ctx, name)
+		require.NoError(t, err)
+	}
+
+	// 変更履歴を記録する Kind では、変更履歴から参照されている可能性があるため削除しない
+	RegisterKind("BlobTestEntity", KindOptions{History: true})
+	deleteUnusedBlobs(ctx, []*writeOp{{typ: MutationTypeDelete, key: key, prev: next}})
+	RegisterKind("BlobTestEntity", KindOptions{})
+	for name := range nextBlobs {
+		_, err := bs.Get(ctx, name)
+		require.NoError(t, err)
+	}
+
+	// 削除するとすべての Blob が削除される
+	deleteUnusedBlobs(ctx, []*writeOp{{typ: MutationTypeDelete, key: key, prev: next}})
+	for name := range nextBlobs {
+		_, err := bs.Get(ctx, name)
+		require.ErrorIs(t, err, blobstore.ErrNotFound)
+	}
+}
+
+func TestBlob(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	bs := withBlobStore(t, 8)
+	err := DeleteAll(ctx, "BlobTestEntity")
+	require.NoError(t, err)
+
+	e := &BlobTestEntity{Id: 1, Body: strings.Repeat("a", 16), Thumbnail: NewBlob([]byte(strings.Repeat("t", 16)))}
+	require.NoError(t, PutEntity(ctx, e))
+	e2 := &BlobTestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e2))
+	require.Equal(t, e.Body, e2.Body)
+	data, err := e2.Thumbnail.Bytes(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte(strings.Repeat("t", 16)), data)
+
+	ps, err := saveStruct(e2)
+	require.NoError(t, err)
+	refs := blobRefs(ps)
+	require.Len(t, refs, 2)
+
+	// 削除すると BlobStore からも削除される
+	require.NoError(t, DeleteEntity(ctx, e2))
+	for name := range refs {
+		_, err := bs.Get(ctx, name)
+		require.ErrorIs(t, err, blobstore.ErrNotFound)
+	}
+}
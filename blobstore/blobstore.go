@@ -0,0 +1,22 @@
+// Package blobstore は entitystore で Datastore のエンティティに収まらない大きなプロパティの値を保存するストアを提供します。
+package blobstore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound は指定された名前の Blob が存在しない場合に返されるエラーです。
+var ErrNotFound = errors.New("blobstore: blob not found")
+
+// BlobStore は大きなプロパティの値を保存するストアのインターフェースです。
+// Blob の名前は "/" で区切られた文字列で、entitystore が Kind とキー、値から決定します。
+// 同じ名前には常に同じ値が保存されるため、Put は何度呼び出しても結果が変わらないように実装してください。
+type BlobStore interface {
+	// Put は data を name の Blob として保存します。
+	Put(ctx context.Context, name string, data []byte) error
+	// Get は name の Blob を取得します。存在しない場合は ErrNotFound を返します。
+	Get(ctx context.Context, name string) ([]byte, error)
+	// Delete は指定された名前の Blob を削除します。存在しない Blob は無視します。
+	Delete(ctx context.Context, names []string) error
+}
@@ -0,0 +1,75 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local はローカルのファイルシステムに Blob を保存する BlobStore の実装です。
+// Blob は Dir 以下に名前のパスのファイルとして保存します。
+// 開発環境やテストなど、単一のサーバーで使用する場合を想定しています。
+type Local struct {
+	Dir string
+}
+
+func (l *Local) Put(_ context.Context, name string, data []byte) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// 書き込み途中のファイルを読み込まないよう、一時ファイルに書き込んでから名前を変更する
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (l *Local) Get(_ context.Context, name string) ([]byte, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return data, err
+}
+
+func (l *Local) Delete(_ context.Context, names []string) error {
+	for _, name := range names {
+		path, err := l.path(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// path は Blob の名前をファイルのパスに変換します。Dir の外を指す名前はエラーになります。
+func (l *Local) path(name string) (string, error) {
+	if name == "" || !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("blobstore: invalid blob name %q", name)
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(name)), nil
+}
@@ -0,0 +1,29 @@
+package blobstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l := &Local{Dir: t.TempDir()}
+
+	require.NoError(t, l.Put(ctx, "Kind/abc", []byte("data")))
+	data, err := l.Get(ctx, "Kind/abc")
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+
+	// 同じ名前への書き込みは上書きする
+	require.NoError(t, l.Put(ctx, "Kind/abc", []byte("data")))
+
+	require.NoError(t, l.Delete(ctx, []string{"Kind/abc", "Kind/missing"}))
+	_, err = l.Get(ctx, "Kind/abc")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	for _, name := range []string{"", "../abc", "/abc", "Kind/../../abc"} {
+		require.Error(t, l.Put(ctx, name, []byte("data")), name)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// entitystorePath は entitystore パッケージのインポートパスです。
+const entitystorePath = "go.fujikura.biz/entitystore"
+
+// integerTypes は IntSum で集計できる型です。
+var integerTypes = map[string]bool{
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+}
+
+// floatTypes は Float64Sum で集計できる型です。
+var floatTypes = map[string]bool{
+	"float32": true, "float64": true,
+}
+
+var funcs = template.FuncMap{
+	"quote": func(s string) string {
+		return fmt.Sprintf("%q", s)
+	},
+	"isInt": func(t string) bool {
+		return integerTypes[t]
+	},
+	"isFloat": func(t string) bool {
+		return floatTypes[t]
+	},
+	// filterType はフィルタの値の型を返します。Key と Ref はキーで比較します。
+	"filterType": func(t string) string {
+		if strings.Contains(t, "Key[") || strings.Contains(t, "Ref[") {
+			return "*datastore.Key"
+		}
+		return t
+	},
+	// parentExpr は親のキーの式を返します。
+	"parentExpr": func(f *keyField) string {
+		if f == nil {
+			return "nil"
+		}
+		if f.Type == "*datastore.Key" {
+			return "e." + f.Field
+		}
+		return "e." + f.Field + ".Key()"
+	},
+	// convExpr は key の値 v を型が t でないフィールド f に代入する式を返します。
+	"convExpr": func(f *keyField, v, t string) string {
+		if f.Type == t {
+			return v
+		}
+		return f.Type + "(" + v + ")"
+	},
+	// setParent は親のキーをフィールドに設定する文を返します。Key と Ref 以外の型は設定しません。
+	"setParent": func(f *keyField) string {
+		switch {
+		case f.Type == "*datastore.Key":
+			return "e." + f.Field + " = key.Parent"
+		case strings.Contains(f.Type, "Key["):
+			return "e." + f.Field + ", _ = " + strings.Replace(f.Type, "Key[", "ToKey[", 1) + "(key.Parent)"
+		case strings.Contains(f.Type, "Ref["):
+			return "e." + f.Field + " = " + strings.Replace(f.Type, "Ref[", "RefTo[", 1) + "(key.Parent)"
+		}
+		return ""
+	},
+	// idExpr は数値 ID の式を返します。
+	"idExpr": func(f *keyField) string {
+		if f.Type == "int64" {
+			return "e." + f.Field
+		}
+		return "int64(e." + f.Field + ")"
+	},
+}
+
+var tmpl = template.Must(template.New("gen").Funcs(funcs).Parse(`
+{{- $es := .Qualifier -}}
+{{- range .Entities }}
+{{- $t := .Name }}
+// {{$t}}Kind は {{$t}} の Kind 名です。
+const {{$t}}Kind = {{quote .Kind}}
+
+// {{$t}} のプロパティ名です。
+const (
+{{- range .Properties }}
+	{{$t}}Prop{{.Field}} = {{quote .Name}}
+{{- end }}
+)
+{{ if and (not .HasKey) (or .ID .KeyName) }}
+// Key は構造体タグから {{$t}} のキーを作成します。
+func (e *{{$t}}) Key() *datastore.Key {
+	{{- $ns := or .Namespace .NsField }}
+	{{ if $ns }}key := {{ else }}return {{ end -}}
+	{{- if .ID }}datastore.IDKey({{$t}}Kind, {{idExpr .ID}}, {{parentExpr .Parent}})
+	{{- else }}datastore.NameKey({{$t}}Kind, e.{{.KeyName.Field}}, {{parentExpr .Parent}})
+	{{- end }}
+	{{- if .Namespace }}
+	key.Namespace = {{quote .Namespace}}
+	{{- end }}
+	{{- if .NsField }}
+	if e.{{.NsField}} != "" {
+		key.Namespace = e.{{.NsField}}
+	}
+	{{- end }}
+	{{- if $ns }}
+	return key
+	{{- end }}
+}
+{{ end }}
+{{- if and (not .HasKey) (not .HasSetKey) (or .ID .KeyName) }}
+// SetKey はキーから {{$t}} の構造体タグのフィールドを設定します。{{$es}}KeySetter の実装です。
+// ロードしたエンティティの Key() がロード元のキーを返すように、ロード時に呼び出されます。
+func (e *{{$t}}) SetKey(key *datastore.Key) {
+	{{- if .ID }}
+	e.{{.ID.Field}} = {{convExpr .ID "key.ID" "int64"}}
+	{{- else }}
+	e.{{.KeyName.Field}} = {{convExpr .KeyName "key.Name" "string"}}
+	{{- end }}
+	{{- with .Parent }}{{ with setParent . }}
+	{{.}}
+	{{- end }}{{ end }}
+	{{- if .NsField }}
+	e.{{.NsField}} = key.Namespace
+	{{- end }}
+}
+{{ end }}
+{{- if not .HasKind }}
+// Kind は Kind 名を返します。{{$es}}Kinder の実装です。
+func (e *{{$t}}) Kind() string {
+	return {{$t}}Kind
+}
+{{ end }}
+// {{$t}}Query は {{$t}} の型付きのクエリです。
+// インデックスが作成されるプロパティのフィルタと並び順のメソッドを持ちます。
+type {{$t}}Query struct {
+	{{$es}}Query
+}
+
+// New{{$t}}Query は {{$t}} のクエリを作成します。
+func New{{$t}}Query() {{$t}}Query {
+	return {{$t}}Query{ {{- $es}}NewQuery({{$t}}Kind)}
+}
+
+// With は f で変更したクエリを返します。Limit などの型付きのメソッドが無い変更に使用します。
+func (q {{$t}}Query) With(f func({{$es}}Query) {{$es}}Query) {{$t}}Query {
+	return {{$t}}Query{f(q.Query)}
+}
+{{ range .Properties }}{{ if not .NoIndex }}
+// Filter{{.Field}} は {{.Name}} のフィルタを追加します。
+func (q {{$t}}Query) Filter{{.Field}}(op string, v {{filterType .Type}}) {{$t}}Query {
+	return {{$t}}Query{q.Query.FilterField({{$t}}Prop{{.Field}}, op, v)}
+}
+
+// Order{{.Field}} は {{.Name}} の昇順の並び順を追加します。
+func (q {{$t}}Query) Order{{.Field}}() {{$t}}Query {
+	return {{$t}}Query{q.Query.Order({{$t}}Prop{{.Field}})}
+}
+
+// Order{{.Field}}Desc は {{.Name}} の降順の並び順を追加します。
+func (q {{$t}}Query) Order{{.Field}}Desc() {{$t}}Query {
+	return {{$t}}Query{q.Query.Order("-" + {{$t}}Prop{{.Field}})}
+}
+{{ end }}{{ end }}
+// New{{$t}}Lister はクエリに一致する {{$t}} の EntityLister を作成します。
+func New{{$t}}Lister(q {{$t}}Query) {{$es}}EntityLister[*{{$t}}] {
+	return {{$es}}NewEntityLister(q.Query, &{{$t}}{})
+}
+
+// {{$t}}Aggregation は {{$t}} の型付きの集計です。
+type {{$t}}Aggregation struct {
+	{{$es}}Aggregation
+}
+
+// New{{$t}}Aggregation はクエリに一致する {{$t}} の集計を作成します。
+func New{{$t}}Aggregation(q {{$t}}Query) {{$t}}Aggregation {
+	return {{$t}}Aggregation{ {{- $es}}NewAggregation(q.Query)}
+}
+{{ range .Properties }}{{ if not (or .NoIndex .Base) }}{{ if isInt .Type }}
+// WithIntSum{{.Field}} は {{.Name}} の合計を集計に追加します。
+func (a {{$t}}Aggregation) WithIntSum{{.Field}}() {{$t}}Aggregation {
+	a.Aggregation.WithIntSum({{$t}}Prop{{.Field}})
+	return a
+}
+
+// IntSum{{.Field}} は {{.Name}} の合計を返します。
+func (a {{$t}}Aggregation) IntSum{{.Field}}() int {
+	return a.Aggregation.IntSum({{$t}}Prop{{.Field}})
+}
+{{ end }}{{ if isFloat .Type }}
+// WithFloat64Sum{{.Field}} は {{.Name}} の合計を集計に追加します。
+func (a {{$t}}Aggregation) WithFloat64Sum{{.Field}}() {{$t}}Aggregation {
+	a.Aggregation.WithFloat64Sum({{$t}}Prop{{.Field}})
+	return a
+}
+
+// Float64Sum{{.Field}} は {{.Name}} の合計を返します。
+func (a {{$t}}Aggregation) Float64Sum{{.Field}}() float64 {
+	return a.Aggregation.Float64Sum({{$t}}Prop{{.Field}})
+}
+{{ end }}{{ if or (isInt .Type) (isFloat .Type) }}
+// WithAvg{{.Field}} は {{.Name}} の平均を集計に追加します。
+func (a {{$t}}Aggregation) WithAvg{{.Field}}() {{$t}}Aggregation {
+	a.Aggregation.WithAvg({{$t}}Prop{{.Field}})
+	return a
+}
+
+// Avg{{.Field}} は {{.Name}} の平均を返します。
+func (a {{$t}}Aggregation) Avg{{.Field}}() float64 {
+	return a.Aggregation.Avg({{$t}}Prop{{.Field}})
+}
+{{ end }}{{ end }}{{ end }}
+{{- end }}`))
+
+// generate はエンティティのコードを生成し、gofmt で整形したソースを返します。
+func generate(info *pkgInfo) ([]byte, error) {
+	qualifier := "entitystore."
+	if info.Name == "entitystore" {
+		qualifier = ""
+	}
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, map[string]any{
+		"Qualifier": qualifier,
+		"Entities":  info.Entities,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 生成したコードで使用しているパッケージのみをインポートする
+	candidates := map[string]string{"datastore": "cloud.google.com/go/datastore"}
+	if qualifier != "" {
+		candidates["entitystore"] = entitystorePath
+	}
+	for name, path := range info.Imports {
+		candidates[name] = path
+	}
+	var std, others []string
+	for name, path := range candidates {
+		if !regexp.MustCompile(`\b` + name + `\.`).Match(body.Bytes()) {
+			continue
+		}
+		spec := fmt.Sprintf("%q", path)
+		if path != name && !strings.HasSuffix(path, "/"+name) {
+			spec = name + " " + spec
+		}
+		if first, _, _ := strings.Cut(path, "/"); strings.Contains(first, ".") {
+			others = append(others, spec)
+		} else {
+			std = append(std, spec)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(others)
+
+	var src bytes.Buffer
+	src.WriteString("// Code generated by entitystore-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package %s\n", info.Name)
+	if len(std)+len(others) > 0 {
+		src.WriteString("\nimport (\n")
+		for _, spec := range std {
+			fmt.Fprintf(&src, "\t%s\n", spec)
+		}
+		if len(std) > 0 && len(others) > 0 {
+			src.WriteString("\n")
+		}
+		for _, spec := range others {
+			fmt.Fprintf(&src, "\t%s\n", spec)
+		}
+		src.WriteString(")\n")
+	}
+	src.Write(body.Bytes())
+	out, err := format.Source(src.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w\n%s", err, src.String())
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+// entitystore-gen は EntityBase を埋め込んだ構造体から entitystore のためのコードを生成するコマンドです。
+//
+// 以下のコードを生成します。
+//   - Kind 名とプロパティ名の定数
+//   - 構造体タグ `entitystore:"id"` などからキーを作成する Key() メソッド (Key() が定義されていない場合)
+//   - ロード時にキーから構造体タグのフィールドを設定する SetKey() メソッド (Key() が定義されていない場合)
+//   - Kind() メソッド (entitystore.Kinder の実装)
+//   - プロパティごとのフィルタと並び順のメソッドを持つ型付きのクエリ
+//   - 型付きのクエリから EntityLister を作成する関数
+//   - 数値のプロパティごとの集計のメソッドを持つ型付きの集計
+//
+// プロパティ名を文字列で指定する代わりに生成したメソッドを使用することで、プロパティ名の誤りがコンパイルエラーになります。
+// go:generate で以下のように使用します。
+//
+//	//go:generate go run go.fujikura.biz/entitystore/cmd/entitystore-gen -type=User,Book
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of type names; default all structs embedding EntityBase")
+	output := flag.String("output", "entitystore_gen.go", "output file name")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: entitystore-gen [flags] [directory]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	if err := run(dir, *typeNames, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "entitystore-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run はディレクトリのパッケージからコードを生成し、output に書き込みます。
+func run(dir, typeNames, output string) error {
+	var types []string
+	if typeNames != "" {
+		types = strings.Split(typeNames, ",")
+	}
+	name := filepath.Base(output)
+	info, err := parsePackage(dir, types, name)
+	if err != nil {
+		return err
+	}
+	if len(info.Entities) == 0 {
+		return fmt.Errorf("no entities found in %s", dir)
+	}
+	src, err := generate(info)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(output) && filepath.Dir(output) == "." {
+		output = filepath.Join(dir, output)
+	}
+	return os.WriteFile(output, src, 0o644)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+
+	"go.fujikura.biz/entitystore"
+	"go.fujikura.biz/entitystore/cmd/entitystore-gen/testdata/entities"
+)
+
+func TestGenerate(t *testing.T) {
+	info, err := parsePackage("testdata/entities", nil, "entitystore_gen.go")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Author", "Book", "Custom", "Note"}, entityNames(info))
+
+	src, err := generate(info)
+	require.NoError(t, err)
+	golden, err := os.ReadFile("testdata/entities/entitystore_gen.go")
+	require.NoError(t, err)
+	require.Equal(t, string(golden), string(src), "run go generate ./testdata/entities to update the golden file")
+}
+
+func TestGenerate_SetKey(t *testing.T) {
+	// 生成した SetKey で設定したフィールドから、同じキーを作成できる
+	author := datastore.IDKey(entities.AuthorKind, 10, nil)
+	a := &entities.Author{}
+	a.SetKey(author)
+	require.Equal(t, int64(10), a.Id)
+	require.True(t, author.Equal(a.Key()))
+
+	book := datastore.NameKey(entities.BookKind, "b1", author)
+	book.Namespace = "tenant1"
+	b := &entities.Book{}
+	b.SetKey(book)
+	require.Equal(t, "b1", b.Code)
+	require.Equal(t, "tenant1", b.Tenant)
+	require.True(t, author.Equal(b.Author.Key()))
+	require.True(t, book.Equal(b.Key()))
+
+	// TaggedEntityBase を埋め込んだエンティティにも Key と SetKey を生成する
+	note := datastore.IDKey(entities.NoteKind, 5, nil)
+	n := &entities.Note{}
+	n.SetKey(note)
+	require.True(t, note.Equal(n.Key()))
+	require.Equal(t, entities.NoteKind, n.Kind())
+
+	var _ entitystore.KeySetter = &entities.Book{}
+}
+
+func TestParsePackage(t *testing.T) {
+	info, err := parsePackage("testdata/entities", []string{"Book"}, "entitystore_gen.go")
+	require.NoError(t, err)
+	require.Len(t, info.Entities, 1)
+	b := info.Entities[0]
+	require.Equal(t, "Book", b.Kind)
+	require.False(t, b.HasKey)
+	require.Equal(t, "Code", b.KeyName.Field)
+	require.Equal(t, "Author", b.Parent.Field)
+	require.Equal(t, "Tenant", b.NsField)
+
+	props := map[string]property{}
+	for _, p := range b.Properties {
+		props[p.Field] = p
+	}
+	require.Equal(t, "title", props["Title"].Name)
+	require.Equal(t, "string", props["Tags"].Type)
+	require.Equal(t, "Address.zip", props["AddressZip"].Name)
+	require.Contains(t, props, "DeletedAt")
+	require.NotContains(t, props, "Secret")
+	require.NotContains(t, props, "Code")
+
+	_, err = parsePackage("testdata/entities", []string{"Address"}, "entitystore_gen.go")
+	require.Error(t, err)
+	_, err = parsePackage("testdata/entities", []string{"Missing"}, "entitystore_gen.go")
+	require.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src, err := os.ReadFile("testdata/entities/entities.go")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "entities.go"), src, 0o644))
+
+	require.NoError(t, run(dir, "Author", "author_gen.go"))
+	out, err := os.ReadFile(filepath.Join(dir, "author_gen.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(out), "func NewAuthorQuery() AuthorQuery")
+	require.NotContains(t, string(out), "BookQuery")
+
+	// 生成したファイルは次の実行では解析しない
+	require.NoError(t, run(dir, "Author", "author_gen.go"))
+}
+
+func entityNames(info *pkgInfo) []string {
+	var names []string
+	for _, e := range info.Entities {
+		names = append(names, e.Name)
+	}
+	return names
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// baseProperties はエンティティの基底構造体が持つプロパティです。
+var baseProperties = map[string][]property{
+	"EntityBase": {
+		{Field: "UpdatedAt", Name: "UpdatedAt", Type: "time.Time", Base: true},
+		{Field: "SchemaVersion", Name: "SchemaVersion", Type: "int", Base: true},
+	},
+	"VersionedEntityBase": {
+		{Field: "UpdatedAt", Name: "UpdatedAt", Type: "time.Time", Base: true},
+		{Field: "SchemaVersion", Name: "SchemaVersion", Type: "int", Base: true},
+		{Field: "Version", Name: "Version", Type: "int64", Base: true},
+	},
+	"AuditedEntityBase": {
+		{Field: "UpdatedAt", Name: "UpdatedAt", Type: "time.Time", Base: true},
+		{Field: "SchemaVersion", Name: "SchemaVersion", Type: "int", Base: true},
+		{Field: "CreatedAt", Name: "CreatedAt", Type: "time.Time", Base: true},
+		{Field: "CreatedBy", Name: "CreatedBy", Type: "string", Base: true},
+		{Field: "UpdatedBy", Name: "UpdatedBy", Type: "string", Base: true},
+	},
+	"TaggedEntityBase": {
+		{Field: "UpdatedAt", Name: "UpdatedAt", Type: "time.Time", Base: true},
+		{Field: "SchemaVersion", Name: "SchemaVersion", Type: "int", Base: true},
+	},
+	"SoftDeleteBase": {
+		{Field: "DeletedAt", Name: "DeletedAt", Type: "time.Time", Base: true},
+	},
+	"ExpiryBase": {
+		{Field: "ExpiresAt", Name: "ExpiresAt", Type: "time.Time", Base: true},
+	},
+}
+
+// entityBases はエンティティとして扱う基底構造体です。
+var entityBases = map[string]bool{
+	"EntityBase":          true,
+	"VersionedEntityBase": true,
+	"AuditedEntityBase":   true,
+	"TaggedEntityBase":    true,
+}
+
+// property はエンティティのプロパティです。
+type property struct {
+	// Field は定数名などに使用するフィールド名です。入れ子の場合は連結した名前になります。
+	Field string
+	// Name は Datastore のプロパティ名です。
+	Name string
+	// Type はフィールドの型です。スライスの場合は要素の型になります。
+	Type    string
+	NoIndex bool
+	// Base は基底構造体のプロパティかどうかです。集計のメソッドは生成しません。
+	Base bool
+}
+
+// keyField はキーに使用するフィールドです。
+type keyField struct {
+	Field string
+	Type  string
+}
+
+// entity は生成対象のエンティティです。
+type entity struct {
+	Name       string
+	Kind       string
+	Properties []property
+	// HasKey は Key() メソッドが既に定義されているかどうかです。
+	HasKey bool
+	// HasKind は Kind() メソッドが既に定義されているか、TaggedEntityBase を埋め込んでいるかどうかです。
+	HasKind bool
+	// HasSetKey は SetKey() メソッドが既に定義されているかどうかです。
+	HasSetKey bool
+	ID        *keyField
+	KeyName   *keyField
+	Parent    *keyField
+	Namespace string
+	NsField   string
+}
+
+// pkgInfo は解析したパッケージの情報です。
+type pkgInfo struct {
+	Name     string
+	Entities []*entity
+	// Imports は生成するコードで必要になるパッケージです。
+	Imports map[string]string
+}
+
+// parsePackage はディレクトリのパッケージを解析し、エンティティを取り出します。
+// types が空でない場合は、指定された型のみを対象にします。
+// 前回生成したファイル output は解析の対象から除外します。
+func parsePackage(dir string, types []string, output string) (*pkgInfo, error) {
+	fset := token.NewFileSet()
+	files, err := parseFiles(fset, dir, output)
+	if err != nil {
+		return nil, err
+	}
+	info := &pkgInfo{Name: files[0].Name.Name, Imports: map[string]string{}}
+
+	// 構造体とメソッドを集める
+	structs := map[string]*ast.StructType{}
+	imports := map[*ast.StructType]map[string]string{}
+	methods := map[string]map[string]bool{}
+	var names []string
+	for _, f := range files {
+		fileImports := map[string]string{}
+		for _, im := range f.Imports {
+			path, _ := strconv.Unquote(im.Path.Value)
+			name := path[strings.LastIndex(path, "/")+1:]
+			if im.Name != nil {
+				name = im.Name.Name
+			}
+			fileImports[name] = path
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					ts, ok := spec.(*ast.TypeSpec)
+					if !ok {
+						continue
+					}
+					if st, ok := ts.Type.(*ast.StructType); ok {
+						structs[ts.Name.Name] = st
+						imports[st] = fileImports
+						names = append(names, ts.Name.Name)
+					}
+				}
+			case *ast.FuncDecl:
+				if d.Recv != nil && len(d.Recv.List) == 1 {
+					recv := receiverName(d.Recv.List[0].Type)
+					if methods[recv] == nil {
+						methods[recv] = map[string]bool{}
+					}
+					methods[recv][d.Name.Name] = true
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+
+	want := map[string]bool{}
+	for _, t := range types {
+		want[t] = true
+	}
+	found := map[string]bool{}
+	for _, name := range names {
+		st := structs[name]
+		if len(want) > 0 && !want[name] {
+			continue
+		}
+		e := &entity{Name: name, Kind: name, HasKey: methods[name]["Key"], HasKind: methods[name]["Kind"], HasSetKey: methods[name]["SetKey"]}
+		isEntity := false
+		p := &fieldParser{fset: fset, structs: structs, imports: imports, info: info}
+		for _, f := range st.Fields.List {
+			tag := reflect.StructTag("")
+			if f.Tag != nil {
+				s, _ := strconv.Unquote(f.Tag.Value)
+				tag = reflect.StructTag(s)
+			}
+			if len(f.Names) == 0 {
+				// 埋め込みフィールド
+				base := baseName(f.Type)
+				if entityBases[base] {
+					isEntity = true
+				}
+				if base == "TaggedEntityBase" {
+					e.HasKind = true
+				}
+				if kind, ok := tagOption(tag, "kind"); ok && kind != "" {
+					e.Kind = kind
+				}
+				if ns, ok := tagOption(tag, "namespace"); ok && ns != "" {
+					e.Namespace = ns
+				}
+				e.Properties = append(e.Properties, baseProperties[base]...)
+				continue
+			}
+			for _, n := range f.Names {
+				if n.Name == "Kind" {
+					e.HasKind = true // フィールドとメソッドの名前が衝突する
+				}
+				if !n.IsExported() {
+					continue
+				}
+				typ := p.typeString(st, f.Type)
+				switch {
+				case hasTagOption(tag, "id"):
+					e.ID = &keyField{Field: n.Name, Type: typ}
+				case hasTagOption(tag, "name"):
+					e.KeyName = &keyField{Field: n.Name, Type: typ}
+				case hasTagOption(tag, "parent"):
+					e.Parent = &keyField{Field: n.Name, Type: typ}
+				case hasTagOption(tag, "namespace"):
+					e.NsField = n.Name
+				}
+				e.Properties = append(e.Properties, p.properties(st, n.Name, "", "", tag, f.Type)...)
+			}
+		}
+		if !isEntity {
+			if len(want) > 0 {
+				return nil, fmt.Errorf("%s does not embed an EntityBase", name)
+			}
+			continue
+		}
+		found[name] = true
+		info.Entities = append(info.Entities, e)
+	}
+	for _, name := range types {
+		if !found[name] {
+			return nil, fmt.Errorf("type %s not found", name)
+		}
+	}
+	return info, nil
+}
+
+// parseFiles はディレクトリのテスト以外の Go のファイルを解析します。
+// 前回生成したファイル output は除外します。すべてのファイルが同じパッケージである必要があります。
+func parseFiles(fset *token.FileSet, dir, output string) ([]*ast.File, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []*ast.File
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || name == output {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 && f.Name.Name != files[0].Name.Name {
+			return nil, fmt.Errorf("expected one package in %s but found %s and %s", dir, files[0].Name.Name, f.Name.Name)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return files, nil
+}
+
+// fieldParser はフィールドの型とプロパティを解析します。
+type fieldParser struct {
+	fset    *token.FileSet
+	structs map[string]*ast.StructType
+	imports map[*ast.StructType]map[string]string
+	info    *pkgInfo
+}
+
+// typeString は型を文字列にし、使用しているパッケージを記録します。
+func (p *fieldParser) typeString(st *ast.StructType, expr ast.Expr) string {
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				if path, ok := p.imports[st][id.Name]; ok {
+					p.info.Imports[id.Name] = path
+				}
+			}
+		}
+		return true
+	})
+	var sb strings.Builder
+	_ = printer.Fprint(&sb, p.fset, expr)
+	return sb.String()
+}
+
+// properties はフィールドのプロパティを返します。
+// flatten が指定された同じパッケージの構造体のフィールドは、入れ子のプロパティに展開します。
+func (p *fieldParser) properties(st *ast.StructType, field, prefixField, prefixName string, tag reflect.StructTag, expr ast.Expr) []property {
+	name, opts, _ := strings.Cut(tag.Get("datastore"), ",")
+	if name == "-" {
+		return nil
+	}
+	if name == "" {
+		name = field
+	}
+	// 暗号化するフィールドと BlobStore に保存するフィールドはインデックスを作成しないため、クエリのメソッドを生成しない
+	noindex := strings.Contains(","+opts+",", ",noindex,") || hasTagOption(tag, "encrypt") || hasTagOption(tag, "blob")
+	elem := expr
+	if at, ok := elem.(*ast.ArrayType); ok && !isByteSlice(at) {
+		elem = at.Elt
+	}
+	if star, ok := elem.(*ast.StarExpr); ok {
+		elem = star.X
+	}
+	if id, ok := elem.(*ast.Ident); ok && strings.Contains(","+opts+",", ",flatten,") {
+		if sub, ok := p.structs[id.Name]; ok {
+			var ps []property
+			for _, f := range sub.Fields.List {
+				subTag := reflect.StructTag("")
+				if f.Tag != nil {
+					s, _ := strconv.Unquote(f.Tag.Value)
+					subTag = reflect.StructTag(s)
+				}
+				for _, n := range f.Names {
+					if n.IsExported() {
+						ps = append(ps, p.properties(sub, n.Name, prefixField+field, prefixName+name+".", subTag, f.Type)...)
+					}
+				}
+			}
+			return ps
+		}
+	}
+	return []property{{
+		Field:   prefixField + field,
+		Name:    prefixName + name,
+		Type:    p.typeString(st, elem),
+		NoIndex: noindex || p.isBlob(st, elem),
+	}}
+}
+
+// isBlob は entitystore.Blob かどうかを返します。
+func (p *fieldParser) isBlob(st *ast.StructType, expr ast.Expr) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Blob" {
+		return false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	return ok && p.imports[st][id.Name] == entitystorePath
+}
+
+// isByteSlice は []byte かどうかを返します。
+func isByteSlice(at *ast.ArrayType) bool {
+	id, ok := at.Elt.(*ast.Ident)
+	return ok && at.Len == nil && id.Name == "byte"
+}
+
+// receiverName はメソッドのレシーバの型名を返します。
+func receiverName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// baseName は埋め込みフィールドの型名を返します。
+func baseName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return baseName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.Ident:
+		return t.Name
+	case *ast.IndexExpr:
+		return baseName(t.X)
+	}
+	return ""
+}
+
+// tagOption は構造体タグ `entitystore:"..."` の opt または opt=value の値を返します。
+func tagOption(tag reflect.StructTag, opt string) (string, bool) {
+	s, ok := tag.Lookup("entitystore")
+	if !ok {
+		return "", false
+	}
+	for _, o := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(o), "=")
+		if name == opt {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// hasTagOption は構造体タグ `entitystore:"..."` に opt が含まれているかどうかを返します。
+func hasTagOption(tag reflect.StructTag, opt string) bool {
+	_, ok := tagOption(tag, opt)
+	return ok
+}
@@ -0,0 +1,54 @@
+//go:generate go run ../..
+
+package entities
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"go.fujikura.biz/entitystore"
+)
+
+type Author struct {
+	entitystore.EntityBase `entitystore:"kind=Writer"`
+	Id                     int64 `datastore:"-" entitystore:"id"`
+	Name                   string
+	Born                   time.Time
+	Profile                string `datastore:",noindex"`
+}
+
+type Book struct {
+	entitystore.AuditedEntityBase
+	entitystore.SoftDeleteBase
+	Code    string                   `datastore:"-" entitystore:"name"`
+	Author  entitystore.Key[*Author] `datastore:"-" entitystore:"parent"`
+	Tenant  string                   `datastore:"-" entitystore:"namespace"`
+	Title   string                   `datastore:"title"`
+	Tags    []string
+	Pages   int32
+	Price   float64
+	Address Address `datastore:",flatten"`
+	Editor  entitystore.Ref[*Author]
+	Secret  string `datastore:"-"`
+}
+
+type Address struct {
+	City string
+	Zip  string `datastore:"zip"`
+}
+
+type Note struct {
+	entitystore.TaggedEntityBase[Note]
+	Id   int `datastore:"-" entitystore:"id"`
+	Body string
+}
+
+type Custom struct {
+	entitystore.EntityBase
+	Id int
+}
+
+func (c *Custom) Key() *datastore.Key {
+	return datastore.IDKey("Custom", int64(c.Id), nil)
+}
@@ -0,0 +1,651 @@
+// Code generated by entitystore-gen. DO NOT EDIT.
+
+package entities
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.fujikura.biz/entitystore"
+)
+
+// AuthorKind は Author の Kind 名です。
+const AuthorKind = "Writer"
+
+// Author のプロパティ名です。
+const (
+	AuthorPropUpdatedAt     = "UpdatedAt"
+	AuthorPropSchemaVersion = "SchemaVersion"
+	AuthorPropName          = "Name"
+	AuthorPropBorn          = "Born"
+	AuthorPropProfile       = "Profile"
+)
+
+// Key は構造体タグから Author のキーを作成します。
+func (e *Author) Key() *datastore.Key {
+	return datastore.IDKey(AuthorKind, e.Id, nil)
+}
+
+// SetKey はキーから Author の構造体タグのフィールドを設定します。entitystore.KeySetter の実装です。
+// ロードしたエンティティの Key() がロード元のキーを返すように、ロード時に呼び出されます。
+func (e *Author) SetKey(key *datastore.Key) {
+	e.Id = key.ID
+}
+
+// Kind は Kind 名を返します。entitystore.Kinder の実装です。
+func (e *Author) Kind() string {
+	return AuthorKind
+}
+
+// AuthorQuery は Author の型付きのクエリです。
+// インデックスが作成されるプロパティのフィルタと並び順のメソッドを持ちます。
+type AuthorQuery struct {
+	entitystore.Query
+}
+
+// NewAuthorQuery は Author のクエリを作成します。
+func NewAuthorQuery() AuthorQuery {
+	return AuthorQuery{entitystore.NewQuery(AuthorKind)}
+}
+
+// With は f で変更したクエリを返します。Limit などの型付きのメソッドが無い変更に使用します。
+func (q AuthorQuery) With(f func(entitystore.Query) entitystore.Query) AuthorQuery {
+	return AuthorQuery{f(q.Query)}
+}
+
+// FilterUpdatedAt は UpdatedAt のフィルタを追加します。
+func (q AuthorQuery) FilterUpdatedAt(op string, v time.Time) AuthorQuery {
+	return AuthorQuery{q.Query.FilterField(AuthorPropUpdatedAt, op, v)}
+}
+
+// OrderUpdatedAt は UpdatedAt の昇順の並び順を追加します。
+func (q AuthorQuery) OrderUpdatedAt() AuthorQuery {
+	return AuthorQuery{q.Query.Order(AuthorPropUpdatedAt)}
+}
+
+// OrderUpdatedAtDesc は UpdatedAt の降順の並び順を追加します。
+func (q AuthorQuery) OrderUpdatedAtDesc() AuthorQuery {
+	return AuthorQuery{q.Query.Order("-" + AuthorPropUpdatedAt)}
+}
+
+// FilterSchemaVersion は SchemaVersion のフィルタを追加します。
+func (q AuthorQuery) FilterSchemaVersion(op string, v int) AuthorQuery {
+	return AuthorQuery{q.Query.FilterField(AuthorPropSchemaVersion, op, v)}
+}
+
+// OrderSchemaVersion は SchemaVersion の昇順の並び順を追加します。
+func (q AuthorQuery) OrderSchemaVersion() AuthorQuery {
+	return AuthorQuery{q.Query.Order(AuthorPropSchemaVersion)}
+}
+
+// OrderSchemaVersionDesc は SchemaVersion の降順の並び順を追加します。
+func (q AuthorQuery) OrderSchemaVersionDesc() AuthorQuery {
+	return AuthorQuery{q.Query.Order("-" + AuthorPropSchemaVersion)}
+}
+
+// FilterName は Name のフィルタを追加します。
+func (q AuthorQuery) FilterName(op string, v string) AuthorQuery {
+	return AuthorQuery{q.Query.FilterField(AuthorPropName, op, v)}
+}
+
+// OrderName は Name の昇順の並び順を追加します。
+func (q AuthorQuery) OrderName() AuthorQuery {
+	return AuthorQuery{q.Query.Order(AuthorPropName)}
+}
+
+// OrderNameDesc は Name の降順の並び順を追加します。
+func (q AuthorQuery) OrderNameDesc() AuthorQuery {
+	return AuthorQuery{q.Query.Order("-" + AuthorPropName)}
+}
+
+// FilterBorn は Born のフィルタを追加します。
+func (q AuthorQuery) FilterBorn(op string, v time.Time) AuthorQuery {
+	return AuthorQuery{q.Query.FilterField(AuthorPropBorn, op, v)}
+}
+
+// OrderBorn は Born の昇順の並び順を追加します。
+func (q AuthorQuery) OrderBorn() AuthorQuery {
+	return AuthorQuery{q.Query.Order(AuthorPropBorn)}
+}
+
+// OrderBornDesc は Born の降順の並び順を追加します。
+func (q AuthorQuery) OrderBornDesc() AuthorQuery {
+	return AuthorQuery{q.Query.Order("-" + AuthorPropBorn)}
+}
+
+// NewAuthorLister はクエリに一致する Author の EntityLister を作成します。
+func NewAuthorLister(q AuthorQuery) entitystore.EntityLister[*Author] {
+	return entitystore.NewEntityLister(q.Query, &Author{})
+}
+
+// AuthorAggregation は Author の型付きの集計です。
+type AuthorAggregation struct {
+	entitystore.Aggregation
+}
+
+// NewAuthorAggregation はクエリに一致する Author の集計を作成します。
+func NewAuthorAggregation(q AuthorQuery) AuthorAggregation {
+	return AuthorAggregation{entitystore.NewAggregation(q.Query)}
+}
+
+// BookKind は Book の Kind 名です。
+const BookKind = "Book"
+
+// Book のプロパティ名です。
+const (
+	BookPropUpdatedAt     = "UpdatedAt"
+	BookPropSchemaVersion = "SchemaVersion"
+	BookPropCreatedAt     = "CreatedAt"
+	BookPropCreatedBy     = "CreatedBy"
+	BookPropUpdatedBy     = "UpdatedBy"
+	BookPropDeletedAt     = "DeletedAt"
+	BookPropTitle         = "title"
+	BookPropTags          = "Tags"
+	BookPropPages         = "Pages"
+	BookPropPrice         = "Price"
+	BookPropAddressCity   = "Address.City"
+	BookPropAddressZip    = "Address.zip"
+	BookPropEditor        = "Editor"
+)
+
+// Key は構造体タグから Book のキーを作成します。
+func (e *Book) Key() *datastore.Key {
+	key := datastore.NameKey(BookKind, e.Code, e.Author.Key())
+	if e.Tenant != "" {
+		key.Namespace = e.Tenant
+	}
+	return key
+}
+
+// SetKey はキーから Book の構造体タグのフィールドを設定します。entitystore.KeySetter の実装です。
+// ロードしたエンティティの Key() がロード元のキーを返すように、ロード時に呼び出されます。
+func (e *Book) SetKey(key *datastore.Key) {
+	e.Code = key.Name
+	e.Author, _ = entitystore.ToKey[*Author](key.Parent)
+	e.Tenant = key.Namespace
+}
+
+// Kind は Kind 名を返します。entitystore.Kinder の実装です。
+func (e *Book) Kind() string {
+	return BookKind
+}
+
+// BookQuery は Book の型付きのクエリです。
+// インデックスが作成されるプロパティのフィルタと並び順のメソッドを持ちます。
+type BookQuery struct {
+	entitystore.Query
+}
+
+// NewBookQuery は Book のクエリを作成します。
+func NewBookQuery() BookQuery {
+	return BookQuery{entitystore.NewQuery(BookKind)}
+}
+
+// With は f で変更したクエリを返します。Limit などの型付きのメソッドが無い変更に使用します。
+func (q BookQuery) With(f func(entitystore.Query) entitystore.Query) BookQuery {
+	return BookQuery{f(q.Query)}
+}
+
+// FilterUpdatedAt は UpdatedAt のフィルタを追加します。
+func (q BookQuery) FilterUpdatedAt(op string, v time.Time) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropUpdatedAt, op, v)}
+}
+
+// OrderUpdatedAt は UpdatedAt の昇順の並び順を追加します。
+func (q BookQuery) OrderUpdatedAt() BookQuery {
+	return BookQuery{q.Query.Order(BookPropUpdatedAt)}
+}
+
+// OrderUpdatedAtDesc は UpdatedAt の降順の並び順を追加します。
+func (q BookQuery) OrderUpdatedAtDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropUpdatedAt)}
+}
+
+// FilterSchemaVersion は SchemaVersion のフィルタを追加します。
+func (q BookQuery) FilterSchemaVersion(op string, v int) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropSchemaVersion, op, v)}
+}
+
+// OrderSchemaVersion は SchemaVersion の昇順の並び順を追加します。
+func (q BookQuery) OrderSchemaVersion() BookQuery {
+	return BookQuery{q.Query.Order(BookPropSchemaVersion)}
+}
+
+// OrderSchemaVersionDesc は SchemaVersion の降順の並び順を追加します。
+func (q BookQuery) OrderSchemaVersionDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropSchemaVersion)}
+}
+
+// FilterCreatedAt は CreatedAt のフィルタを追加します。
+func (q BookQuery) FilterCreatedAt(op string, v time.Time) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropCreatedAt, op, v)}
+}
+
+// OrderCreatedAt は CreatedAt の昇順の並び順を追加します。
+func (q BookQuery) OrderCreatedAt() BookQuery {
+	return BookQuery{q.Query.Order(BookPropCreatedAt)}
+}
+
+// OrderCreatedAtDesc は CreatedAt の降順の並び順を追加します。
+func (q BookQuery) OrderCreatedAtDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropCreatedAt)}
+}
+
+// FilterCreatedBy は CreatedBy のフィルタを追加します。
+func (q BookQuery) FilterCreatedBy(op string, v string) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropCreatedBy, op, v)}
+}
+
+// OrderCreatedBy は CreatedBy の昇順の並び順を追加します。
+func (q BookQuery) OrderCreatedBy() BookQuery {
+	return BookQuery{q.Query.Order(BookPropCreatedBy)}
+}
+
+// OrderCreatedByDesc は CreatedBy の降順の並び順を追加します。
+func (q BookQuery) OrderCreatedByDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropCreatedBy)}
+}
+
+// FilterUpdatedBy は UpdatedBy のフィルタを追加します。
+func (q BookQuery) FilterUpdatedBy(op string, v string) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropUpdatedBy, op, v)}
+}
+
+// OrderUpdatedBy は UpdatedBy の昇順の並び順を追加します。
+func (q BookQuery) OrderUpdatedBy() BookQuery {
+	return BookQuery{q.Query.Order(BookPropUpdatedBy)}
+}
+
+// OrderUpdatedByDesc は UpdatedBy の降順の並び順を追加します。
+func (q BookQuery) OrderUpdatedByDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropUpdatedBy)}
+}
+
+// FilterDeletedAt は DeletedAt のフィルタを追加します。
+func (q BookQuery) FilterDeletedAt(op string, v time.Time) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropDeletedAt, op, v)}
+}
+
+// OrderDeletedAt は DeletedAt の昇順の並び順を追加します。
+func (q BookQuery) OrderDeletedAt() BookQuery {
+	return BookQuery{q.Query.Order(BookPropDeletedAt)}
+}
+
+// OrderDeletedAtDesc は DeletedAt の降順の並び順を追加します。
+func (q BookQuery) OrderDeletedAtDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropDeletedAt)}
+}
+
+// FilterTitle は title のフィルタを追加します。
+func (q BookQuery) FilterTitle(op string, v string) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropTitle, op, v)}
+}
+
+// OrderTitle は title の昇順の並び順を追加します。
+func (q BookQuery) OrderTitle() BookQuery {
+	return BookQuery{q.Query.Order(BookPropTitle)}
+}
+
+// OrderTitleDesc は title の降順の並び順を追加します。
+func (q BookQuery) OrderTitleDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropTitle)}
+}
+
+// FilterTags は Tags のフィルタを追加します。
+func (q BookQuery) FilterTags(op string, v string) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropTags, op, v)}
+}
+
+// OrderTags は Tags の昇順の並び順を追加します。
+func (q BookQuery) OrderTags() BookQuery {
+	return BookQuery{q.Query.Order(BookPropTags)}
+}
+
+// OrderTagsDesc は Tags の降順の並び順を追加します。
+func (q BookQuery) OrderTagsDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropTags)}
+}
+
+// FilterPages は Pages のフィルタを追加します。
+func (q BookQuery) FilterPages(op string, v int32) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropPages, op, v)}
+}
+
+// OrderPages は Pages の昇順の並び順を追加します。
+func (q BookQuery) OrderPages() BookQuery {
+	return BookQuery{q.Query.Order(BookPropPages)}
+}
+
+// OrderPagesDesc は Pages の降順の並び順を追加します。
+func (q BookQuery) OrderPagesDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropPages)}
+}
+
+// FilterPrice は Price のフィルタを追加します。
+func (q BookQuery) FilterPrice(op string, v float64) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropPrice, op, v)}
+}
+
+// OrderPrice は Price の昇順の並び順を追加します。
+func (q BookQuery) OrderPrice() BookQuery {
+	return BookQuery{q.Query.Order(BookPropPrice)}
+}
+
+// OrderPriceDesc は Price の降順の並び順を追加します。
+func (q BookQuery) OrderPriceDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropPrice)}
+}
+
+// FilterAddressCity は Address.City のフィルタを追加します。
+func (q BookQuery) FilterAddressCity(op string, v string) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropAddressCity, op, v)}
+}
+
+// OrderAddressCity は Address.City の昇順の並び順を追加します。
+func (q BookQuery) OrderAddressCity() BookQuery {
+	return BookQuery{q.Query.Order(BookPropAddressCity)}
+}
+
+// OrderAddressCityDesc は Address.City の降順の並び順を追加します。
+func (q BookQuery) OrderAddressCityDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropAddressCity)}
+}
+
+// FilterAddressZip は Address.zip のフィルタを追加します。
+func (q BookQuery) FilterAddressZip(op string, v string) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropAddressZip, op, v)}
+}
+
+// OrderAddressZip は Address.zip の昇順の並び順を追加します。
+func (q BookQuery) OrderAddressZip() BookQuery {
+	return BookQuery{q.Query.Order(BookPropAddressZip)}
+}
+
+// OrderAddressZipDesc は Address.zip の降順の並び順を追加します。
+func (q BookQuery) OrderAddressZipDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropAddressZip)}
+}
+
+// FilterEditor は Editor のフィルタを追加します。
+func (q BookQuery) FilterEditor(op string, v *datastore.Key) BookQuery {
+	return BookQuery{q.Query.FilterField(BookPropEditor, op, v)}
+}
+
+// OrderEditor は Editor の昇順の並び順を追加します。
+func (q BookQuery) OrderEditor() BookQuery {
+	return BookQuery{q.Query.Order(BookPropEditor)}
+}
+
+// OrderEditorDesc は Editor の降順の並び順を追加します。
+func (q BookQuery) OrderEditorDesc() BookQuery {
+	return BookQuery{q.Query.Order("-" + BookPropEditor)}
+}
+
+// NewBookLister はクエリに一致する Book の EntityLister を作成します。
+func NewBookLister(q BookQuery) entitystore.EntityLister[*Book] {
+	return entitystore.NewEntityLister(q.Query, &Book{})
+}
+
+// BookAggregation は Book の型付きの集計です。
+type BookAggregation struct {
+	entitystore.Aggregation
+}
+
+// NewBookAggregation はクエリに一致する Book の集計を作成します。
+func NewBookAggregation(q BookQuery) BookAggregation {
+	return BookAggregation{entitystore.NewAggregation(q.Query)}
+}
+
+// WithIntSumPages は Pages の合計を集計に追加します。
+func (a BookAggregation) WithIntSumPages() BookAggregation {
+	a.Aggregation.WithIntSum(BookPropPages)
+	return a
+}
+
+// IntSumPages は Pages の合計を返します。
+func (a BookAggregation) IntSumPages() int {
+	return a.Aggregation.IntSum(BookPropPages)
+}
+
+// WithAvgPages は Pages の平均を集計に追加します。
+func (a BookAggregation) WithAvgPages() BookAggregation {
+	a.Aggregation.WithAvg(BookPropPages)
+	return a
+}
+
+// AvgPages は Pages の平均を返します。
+func (a BookAggregation) AvgPages() float64 {
+	return a.Aggregation.Avg(BookPropPages)
+}
+
+// WithFloat64SumPrice は Price の合計を集計に追加します。
+func (a BookAggregation) WithFloat64SumPrice() BookAggregation {
+	a.Aggregation.WithFloat64Sum(BookPropPrice)
+	return a
+}
+
+// Float64SumPrice は Price の合計を返します。
+func (a BookAggregation) Float64SumPrice() float64 {
+	return a.Aggregation.Float64Sum(BookPropPrice)
+}
+
+// WithAvgPrice は Price の平均を集計に追加します。
+func (a BookAggregation) WithAvgPrice() BookAggregation {
+	a.Aggregation.WithAvg(BookPropPrice)
+	return a
+}
+
+// AvgPrice は Price の平均を返します。
+func (a BookAggregation) AvgPrice() float64 {
+	return a.Aggregation.Avg(BookPropPrice)
+}
+
+// CustomKind は Custom の Kind 名です。
+const CustomKind = "Custom"
+
+// Custom のプロパティ名です。
+const (
+	CustomPropUpdatedAt     = "UpdatedAt"
+	CustomPropSchemaVersion = "SchemaVersion"
+	CustomPropId            = "Id"
+)
+
+// Kind は Kind 名を返します。entitystore.Kinder の実装です。
+func (e *Custom) Kind() string {
+	return CustomKind
+}
+
+// CustomQuery は Custom の型付きのクエリです。
+// インデックスが作成されるプロパティのフィルタと並び順のメソッドを持ちます。
+type CustomQuery struct {
+	entitystore.Query
+}
+
+// NewCustomQuery は Custom のクエリを作成します。
+func NewCustomQuery() CustomQuery {
+	return CustomQuery{entitystore.NewQuery(CustomKind)}
+}
+
+// With は f で変更したクエリを返します。Limit などの型付きのメソッドが無い変更に使用します。
+func (q CustomQuery) With(f func(entitystore.Query) entitystore.Query) CustomQuery {
+	return CustomQuery{f(q.Query)}
+}
+
+// FilterUpdatedAt は UpdatedAt のフィルタを追加します。
+func (q CustomQuery) FilterUpdatedAt(op string, v time.Time) CustomQuery {
+	return CustomQuery{q.Query.FilterField(CustomPropUpdatedAt, op, v)}
+}
+
+// OrderUpdatedAt は UpdatedAt の昇順の並び順を追加します。
+func (q CustomQuery) OrderUpdatedAt() CustomQuery {
+	return CustomQuery{q.Query.Order(CustomPropUpdatedAt)}
+}
+
+// OrderUpdatedAtDesc は UpdatedAt の降順の並び順を追加します。
+func (q CustomQuery) OrderUpdatedAtDesc() CustomQuery {
+	return CustomQuery{q.Query.Order("-" + CustomPropUpdatedAt)}
+}
+
+// FilterSchemaVersion は SchemaVersion のフィルタを追加します。
+func (q CustomQuery) FilterSchemaVersion(op string, v int) CustomQuery {
+	return CustomQuery{q.Query.FilterField(CustomPropSchemaVersion, op, v)}
+}
+
+// OrderSchemaVersion は SchemaVersion の昇順の並び順を追加します。
+func (q CustomQuery) OrderSchemaVersion() CustomQuery {
+	return CustomQuery{q.Query.Order(CustomPropSchemaVersion)}
+}
+
+// OrderSchemaVersionDesc は SchemaVersion の降順の並び順を追加します。
+func (q CustomQuery) OrderSchemaVersionDesc() CustomQuery {
+	return CustomQuery{q.Query.Order("-" + CustomPropSchemaVersion)}
+}
+
+// FilterId は Id のフィルタを追加します。
+func (q CustomQuery) FilterId(op string, v int) CustomQuery {
+	return CustomQuery{q.Query.FilterField(CustomPropId, op, v)}
+}
+
+// OrderId は Id の昇順の並び順を追加します。
+func (q CustomQuery) OrderId() CustomQuery {
+	return CustomQuery{q.Query.Order(CustomPropId)}
+}
+
+// OrderIdDesc は Id の降順の並び順を追加します。
+func (q CustomQuery) OrderIdDesc() CustomQuery {
+	return CustomQuery{q.Query.Order("-" + CustomPropId)}
+}
+
+// NewCustomLister はクエリに一致する Custom の EntityLister を作成します。
+func NewCustomLister(q CustomQuery) entitystore.EntityLister[*Custom] {
+	return entitystore.NewEntityLister(q.Query, &Custom{})
+}
+
+// CustomAggregation は Custom の型付きの集計です。
+type CustomAggregation struct {
+	entitystore.Aggregation
+}
+
+// NewCustomAggregation はクエリに一致する Custom の集計を作成します。
+func NewCustomAggregation(q CustomQuery) CustomAggregation {
+	return CustomAggregation{entitystore.NewAggregation(q.Query)}
+}
+
+// WithIntSumId は Id の合計を集計に追加します。
+func (a CustomAggregation) WithIntSumId() CustomAggregation {
+	a.Aggregation.WithIntSum(CustomPropId)
+	return a
+}
+
+// IntSumId は Id の合計を返します。
+func (a CustomAggregation) IntSumId() int {
+	return a.Aggregation.IntSum(CustomPropId)
+}
+
+// WithAvgId は Id の平均を集計に追加します。
+func (a CustomAggregation) WithAvgId() CustomAggregation {
+	a.Aggregation.WithAvg(CustomPropId)
+	return a
+}
+
+// AvgId は Id の平均を返します。
+func (a CustomAggregation) AvgId() float64 {
+	return a.Aggregation.Avg(CustomPropId)
+}
+
+// NoteKind は Note の Kind 名です。
+const NoteKind = "Note"
+
+// Note のプロパティ名です。
+const (
+	NotePropUpdatedAt     = "UpdatedAt"
+	NotePropSchemaVersion = "SchemaVersion"
+	NotePropBody          = "Body"
+)
+
+// Key は構造体タグから Note のキーを作成します。
+func (e *Note) Key() *datastore.Key {
+	return datastore.IDKey(NoteKind, int64(e.Id), nil)
+}
+
+// SetKey はキーから Note の構造体タグのフィールドを設定します。entitystore.KeySetter の実装です。
+// ロードしたエンティティの Key() がロード元のキーを返すように、ロード時に呼び出されます。
+func (e *Note) SetKey(key *datastore.Key) {
+	e.Id = int(key.ID)
+}
+
+// NoteQuery は Note の型付きのクエリです。
+// インデックスが作成されるプロパティのフィルタと並び順のメソッドを持ちます。
+type NoteQuery struct {
+	entitystore.Query
+}
+
+// NewNoteQuery は Note のクエリを作成します。
+func NewNoteQuery() NoteQuery {
+	return NoteQuery{entitystore.NewQuery(NoteKind)}
+}
+
+// With は f で変更したクエリを返します。Limit などの型付きのメソッドが無い変更に使用します。
+func (q NoteQuery) With(f func(entitystore.Query) entitystore.Query) NoteQuery {
+	return NoteQuery{f(q.Query)}
+}
+
+// FilterUpdatedAt は UpdatedAt のフィルタを追加します。
+func (q NoteQuery) FilterUpdatedAt(op string, v time.Time) NoteQuery {
+	return NoteQuery{q.Query.FilterField(NotePropUpdatedAt, op, v)}
+}
+
+// OrderUpdatedAt は UpdatedAt の昇順の並び順を追加します。
+func (q NoteQuery) OrderUpdatedAt() NoteQuery {
+	return NoteQuery{q.Query.Order(NotePropUpdatedAt)}
+}
+
+// OrderUpdatedAtDesc は UpdatedAt の降順の並び順を追加します。
+func (q NoteQuery) OrderUpdatedAtDesc() NoteQuery {
+	return NoteQuery{q.Query.Order("-" + NotePropUpdatedAt)}
+}
+
+// FilterSchemaVersion は SchemaVersion のフィルタを追加します。
+func (q NoteQuery) FilterSchemaVersion(op string, v int) NoteQuery {
+	return NoteQuery{q.Query.FilterField(NotePropSchemaVersion, op, v)}
+}
+
+// OrderSchemaVersion は SchemaVersion の昇順の並び順を追加します。
+func (q NoteQuery) OrderSchemaVersion() NoteQuery {
+	return NoteQuery{q.Query.Order(NotePropSchemaVersion)}
+}
+
+// OrderSchemaVersionDesc は SchemaVersion の降順の並び順を追加します。
+func (q NoteQuery) OrderSchemaVersionDesc() NoteQuery {
+	return NoteQuery{q.Query.Order("-" + NotePropSchemaVersion)}
+}
+
+// FilterBody は Body のフィルタを追加します。
+func (q NoteQuery) FilterBody(op string, v string) NoteQuery {
+	return NoteQuery{q.Query.FilterField(NotePropBody, op, v)}
+}
+
+// OrderBody は Body の昇順の並び順を追加します。
+func (q NoteQuery) OrderBody() NoteQuery {
+	return NoteQuery{q.Query.Order(NotePropBody)}
+}
+
+// OrderBodyDesc は Body の降順の並び順を追加します。
+func (q NoteQuery) OrderBodyDesc() NoteQuery {
+	return NoteQuery{q.Query.Order("-" + NotePropBody)}
+}
+
+// NewNoteLister はクエリに一致する Note の EntityLister を作成します。
+func NewNoteLister(q NoteQuery) entitystore.EntityLister[*Note] {
+	return entitystore.NewEntityLister(q.Query, &Note{})
+}
+
+// NoteAggregation は Note の型付きの集計です。
+type NoteAggregation struct {
+	entitystore.Aggregation
+}
+
+// NewNoteAggregation はクエリに一致する Note の集計を作成します。
+func NewNoteAggregation(q NoteQuery) NoteAggregation {
+	return NoteAggregation{entitystore.NewAggregation(q.Query)}
+}
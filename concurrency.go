@@ -0,0 +1,191 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+)
+
+// versionProperty は VersionedEntityBase がバージョン番号を保存するプロパティ名です。
+const versionProperty = "Version"
+
+// updatedAtProperty は EntityBase が更新日時を保存するプロパティ名です。
+const updatedAtProperty = "UpdatedAt"
+
+// ErrConflict は楽観的排他制御で競合が検出されたことを表すエラーです。
+// errors.Is(err, ErrConflict) で ConflictError かどうかを判定できます。
+var ErrConflict = errors.New("entitystore: conflict")
+
+// Versioned はバージョン番号を持つエンティティのインターフェースです。
+// VersionedEntityBase を埋め込むことで実装できます。
+type Versioned interface {
+	Version() int64
+	SetVersion(v int64)
+}
+
+// ConflictError は条件付き書き込みで、保存されているエンティティが
+// ロード時から変更されていた場合に返されるエラーです。
+type ConflictError struct {
+	Key *datastore.Key
+	// Current は現在保存されているエンティティです。削除されていた場合は nil になります。
+	Current Entity
+}
+
+func (e *ConflictError) Error() string {
+	if e.Current == nil {
+		return fmt.Sprintf("entitystore: conflict on %v: entity no longer exists", e.Key)
+	}
+	return fmt.Sprintf("entitystore: conflict on %v: entity has been modified", e.Key)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// entityVersion はエンティティのロード時点の状態を表す値です。
+// Versioned の場合はバージョン番号、そうでない場合は UpdatedAt を使用します。
+type entityVersion struct {
+	versioned bool
+	version   int64
+	updatedAt time.Time
+}
+
+// isZero はエンティティが一度も保存されていない状態かどうかを返します。
+func (v entityVersion) isZero() bool {
+	if v.versioned {
+		return v.version == 0
+	}
+	return v.updatedAt.IsZero()
+}
+
+// equal は2つの状態が同じかどうかを返します。
+func (v entityVersion) equal(o entityVersion) bool {
+	if v.versioned {
+		return v.version == o.version
+	}
+	return v.updatedAt.Equal(o.updatedAt)
+}
+
+// versionOf はエンティティの現在の状態を返します。
+func versionOf(e Entity) entityVersion {
+	if ve, ok := e.(Versioned); ok {
+		return entityVersion{versioned: true, version: ve.Version()}
+	}
+	return entityVersion{updatedAt: e.UpdatedAt()}
+}
+
+// storedVersion は保存されているプロパティから状態を取得します。
+func storedVersion(ps []datastore.Property, versioned bool) entityVersion {
+	v := entityVersion{versioned: versioned}
+	for _, p := range ps {
+		switch p.Name {
+		case versionProperty:
+			if n, ok := p.Value.(int64); ok {
+				v.version = n
+			}
+		case updatedAtProperty:
+			if t, ok := p.Value.(time.Time); ok {
+				v.updatedAt = t
+			}
+		}
+	}
+	return v
+}
+
+// PutEntityIfUnchanged はエンティティがロード時から変更されていない場合のみ保存します。
+// 保存されている UpdatedAt (Versioned の場合はバージョン番号) を e の値と比較し、
+// 一致しない場合は保存せずに *ConflictError を返します。
+// e が一度も保存されていない状態 (UpdatedAt がゼロ値) の場合は、エンティティが存在しないことを条件にします。
+// 比較と保存は1つのトランザクション内で行われます。
+func PutEntityIfUnchanged[E Entity](ctx context.Context, e E) error {
+	return write(ctx, []*writeOp{{typ: MutationTypeUpsert, key: e.Key(), src: e, ifUnchanged: true}})
+}
+
+// PutEntityMultiIfUnchanged は複数のエンティティを PutEntityIfUnchanged と同じ条件で一括保存します。
+// いずれかのエンティティで競合が検出された場合はどのエンティティも保存せず、
+// 競合したエンティティの位置に *ConflictError を設定した datastore.MultiError を返します。
+// 比較と保存を1回のコミットで行うため、Mutation の数が1回のコミットの上限を超える場合は何も保存せずに ErrTooManyMutations を返します。
+func PutEntityMultiIfUnchanged[E Entity](ctx context.Context, es []E) error {
+	return write(ctx, lo.Map(es, func(e E, _ int) *writeOp {
+		return &writeOp{typ: MutationTypeUpsert, key: e.Key(), src: e, ifUnchanged: true}
+	}))
+}
+
+// DeleteEntityIfUnchanged はエンティティがロード時から変更されていない場合のみ削除します。
+// 比較の方法は PutEntityIfUnchanged と同じです。
+func DeleteEntityIfUnchanged[E Entity](ctx context.Context, e E) error {
+	return write(ctx, []*writeOp{{typ: MutationTypeDelete, key: e.Key(), src: e, ifUnchanged: true}})
+}
+
+// preserveEntity はエンティティの現在の値を記録し、その値に戻す関数を返します。
+// 条件付き書き込みが失敗した場合に、書き込み前のフックで更新されたフィールドを元に戻すために使用します。
+func preserveEntity(e any) func() {
+	v := reflect.ValueOf(e)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return func() {}
+	}
+	saved := reflect.New(v.Elem().Type()).Elem()
+	saved.Set(v.Elem())
+	return func() { v.Elem().Set(saved) }
+}
+
+// checkUnchanged は条件付き書き込みの条件を確認します。
+// 競合があった場合は競合したエンティティのキャッシュを削除し、
+// 単一の操作なら *ConflictError を、複数の操作なら datastore.MultiError を返します。
+func checkUnchanged(ctx context.Context, ops []*writeOp) error {
+	merr := make(datastore.MultiError, len(ops))
+	var conflicts []datastore.Key
+	for i, op := range ops {
+		if !op.ifUnchanged {
+			continue
+		}
+		expect := op.expect
+		if !op.exists {
+			if expect.isZero() {
+				continue // 新規作成
+			}
+			merr[i] = &ConflictError{Key: op.key}
+		} else if !storedVersion(op.prev, expect.versioned).equal(expect) {
+			cur, err := newEntityLike(op.src)
+			if err == nil {
+				err = loadEntity(ctx, op.key, op.prev, cur)
+			}
+			if errors.Is(err, datastore.ErrNoSuchEntity) {
+				cur = nil // 論理削除されている
+			} else if err != nil {
+				return err
+			}
+			merr[i] = &ConflictError{Key: op.key, Current: cur}
+		} else {
+			continue
+		}
+		conflicts = append(conflicts, *op.key)
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	// 古いキャッシュが競合の原因になっている可能性があるので削除する
+	RemoveCaches(ctx, conflicts)
+	if len(ops) == 1 {
+		return merr[0]
+	}
+	return merr
+}
+
+// newEntityLike は e と同じ型の空のエンティティを作成します。
+func newEntityLike(e any) (Entity, error) {
+	t := reflect.TypeOf(e)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("entitystore: %T is not a pointer", e)
+	}
+	ne, ok := reflect.New(t.Elem()).Interface().(Entity)
+	if !ok {
+		return nil, fmt.Errorf("entitystore: %T is not an Entity", e)
+	}
+	return ne, nil
+}
@@ -0,0 +1,91 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoredVersion(t *testing.T) {
+	updatedAt := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	ps := []datastore.Property{
+		{Name: "UpdatedAt", Value: updatedAt},
+		{Name: "Version", Value: int64(3)},
+	}
+
+	v := storedVersion(ps, false)
+	require.True(t, v.equal(versionOf(&TestEntity{EntityBase: EntityBase{UpdatedAtColumn: updatedAt}})))
+	require.False(t, v.equal(versionOf(&TestEntity{})))
+
+	v = storedVersion(ps, true)
+	e := &VersionedTestEntity{}
+	e.SetVersion(3)
+	require.True(t, v.equal(versionOf(e)))
+	e.SetVersion(2)
+	require.False(t, v.equal(versionOf(e)))
+}
+
+func TestPutEntityIfUnchanged(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+
+	// 新規作成
+	e := &TestEntity{Id: 1, Value: "Test Value"}
+	err := PutEntityIfUnchanged(ctx, e)
+	require.NoError(t, err)
+
+	// 2人の編集者が同じエンティティをロード
+	e1 := &TestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e1))
+	e2 := &TestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e2))
+
+	Now = func() time.Time { return time.Now().Add(time.Second) }
+	t.Cleanup(func() { Now = time.Now })
+
+	e1.Value = "Editor 1"
+	err = PutEntityIfUnchanged(ctx, e1)
+	require.NoError(t, err)
+
+	// 後から保存しようとした方は競合する
+	e2.Value = "Editor 2"
+	updatedAt := e2.UpdatedAt()
+	err = PutEntityIfUnchanged(ctx, e2)
+	require.ErrorIs(t, err, ErrConflict)
+	// 競合した場合は更新日時を元に戻す
+	require.Equal(t, updatedAt, e2.UpdatedAt())
+	var cerr *ConflictError
+	require.True(t, errors.As(err, &cerr))
+	require.Equal(t, "Editor 1", cerr.Current.(*TestEntity).Value)
+
+	// 存在しないエンティティを一度も保存していないものとして保存するのは成功する
+	err = PutEntityMultiIfUnchanged(ctx, []*TestEntity{{Id: 2, Value: "New"}, e2})
+	var merr datastore.MultiError
+	require.True(t, errors.As(err, &merr))
+	require.Nil(t, merr[0])
+	require.ErrorIs(t, merr[1], ErrConflict)
+	// 競合があった場合はどれも保存されない
+	require.ErrorIs(t, GetEntity(ctx, &TestEntity{Id: 2}), datastore.ErrNoSuchEntity)
+}
+
+func TestPutEntityIfUnchanged_RestoreOnError(t *testing.T) {
+	ctx := context.Background()
+	RegisterGlobalHooks(GlobalHooks{
+		PrePut: func(context.Context, *datastore.Key, any) error {
+			return errors.New("rejected")
+		},
+	})
+	t.Cleanup(func() { globalHooks = nil })
+
+	// 書き込まれなかった場合は、書き込み前のフックで更新されたバージョンと更新日時を元に戻す
+	e := &VersionedTestEntity{Id: 1, Value: "Test1"}
+	e.SetVersion(3)
+	require.Error(t, PutEntityIfUnchanged(ctx, e))
+	require.Equal(t, int64(3), e.Version())
+	require.True(t, e.UpdatedAt().IsZero())
+	require.Equal(t, "Test1", e.Value)
+}
@@ -5,7 +5,9 @@ import (
 
 	"google.golang.org/api/option"
 
+	"go.fujikura.biz/entitystore/blobstore"
 	"go.fujikura.biz/entitystore/cachestore"
+	"go.fujikura.biz/entitystore/keyprovider"
 )
 
 //goland:noinspection GoUnusedConst
@@ -17,4 +19,27 @@ type Config struct {
 	Options    []option.ClientOption
 	Cachestore cachestore.Cachestore
 	Logger     *slog.Logger
+	// SkipUnchanged が true の場合、PutEntity や MutateEntity などの保存で、
+	// ロード時から変更されていないエンティティの書き込みを省略します。
+	// 変更の有無は PrePutAction を呼び出す前のプロパティで判定し、省略した場合は保存前後のフックも呼び出しません。
+	SkipUnchanged bool
+	// RecordQueries が true の場合、実行したクエリに必要な複合インデックスを記録します。
+	// 記録したインデックスは RequiredIndexes で取得し、DiffIndexes で index.yaml と比較できます。
+	// テストの実行時などに有効にすることを想定しています。
+	RecordQueries bool
+	// KeyProvider は構造体タグ `entitystore:"encrypt"` を付けたフィールドの暗号化に使用する鍵を提供します。
+	// 暗号化するフィールドを持つエンティティを保存またはロードする場合は指定する必要があります。
+	KeyProvider keyprovider.KeyProvider
+	// BlobStore は構造体タグ `entitystore:"blob"` を付けたフィールドや Blob のフィールドの大きな値を保存するストアです。
+	// BlobThreshold を超える値を保存するエンティティを保存またはロードする場合は指定する必要があります。
+	BlobStore blobstore.BlobStore
+	// BlobThreshold はこの大きさ (バイト数) を超える値を BlobStore に保存します。
+	// 0 の場合は DefaultBlobThreshold を使用します。
+	BlobThreshold int
+	// Retry は Datastore の呼び出しが Aborted や Unavailable などの一時的なエラーで失敗した場合のリトライの設定です。
+	// MaxAttempts が 1 以下の場合はリトライせず、RunInTransaction は Datastore のライブラリのリトライに従います。
+	Retry RetryPolicy
+	// Parallelism は GetMulti や PutMulti などで、Datastore の1回の呼び出しの上限を超えるために分割したバッチを同時に実行する最大数です。
+	// 0 の場合は DefaultParallelism を使用します。
+	Parallelism int
 }
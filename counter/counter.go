@@ -0,0 +1,178 @@
+// Package counter は entitystore を使用した分散カウンタです。
+// 1つのカウンタへの書き込みを複数のシャードエンティティに分散させることで、
+// 1エンティティあたりの書き込み頻度の上限を回避します。
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"cloud.google.com/go/datastore"
+
+	"go.fujikura.biz/entitystore"
+)
+
+// ShardKind はシャードエンティティの Kind です。
+const ShardKind = "EntitystoreCounterShard"
+
+// ConfigKind はカウンタごとのシャード数を保存するエンティティの Kind です。
+const ConfigKind = "EntitystoreCounter"
+
+// countProperty はシャードのカウントを保存するプロパティ名です。
+const countProperty = "Count"
+
+// DefaultShards はシャード数を設定していないカウンタのシャード数です。
+var DefaultShards = 20
+
+// shard はカウンタのシャードエンティティです。
+type shard struct {
+	entitystore.EntityBase
+	Name  string
+	Index int `datastore:",noindex"`
+	Count int64
+}
+
+func (s *shard) Key() *datastore.Key {
+	return datastore.NameKey(ShardKind, fmt.Sprintf("%s#%d", s.Name, s.Index), nil)
+}
+
+// config はカウンタのシャード数の設定です。
+type config struct {
+	entitystore.EntityBase
+	Name   string `datastore:"-"`
+	Shards int    `datastore:",noindex"`
+}
+
+func (c *config) Key() *datastore.Key {
+	return datastore.NameKey(ConfigKind, c.Name, nil)
+}
+
+// shardCount はカウンタのシャード数を返します。
+func shardCount(ctx context.Context, name string) (int, error) {
+	c := &config{Name: name}
+	err := entitystore.GetEntity(ctx, c)
+	if errors.Is(err, datastore.ErrNoSuchEntity) || (err == nil && c.Shards <= 0) {
+		return DefaultShards, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return c.Shards, nil
+}
+
+// transaction はトランザクション内でエンティティを読み書きするメソッドです。
+// *datastore.Transaction が実装します。
+type transaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+}
+
+// Increment はカウンタに delta を加算します。
+// ランダムに選んだ1つのシャードをトランザクション内で更新します。
+func Increment(ctx context.Context, name string, delta int64) error {
+	n, err := shardCount(ctx, name)
+	if err != nil {
+		return err
+	}
+	idx := rand.IntN(n)
+	_, err = entitystore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return incrementShard(ctx, tx, name, idx, delta)
+	})
+	if err != nil {
+		return err
+	}
+	return entitystore.DeleteCacheByKeys(ctx, []*datastore.Key{(&shard{Name: name, Index: idx}).Key()})
+}
+
+// incrementShard はトランザクション内でシャードに delta を加算します。
+// トランザクションは再試行されることがあるため、試行ごとにシャードを読み込み直します。
+func incrementShard(ctx context.Context, tx transaction, name string, idx int, delta int64) error {
+	s := &shard{Name: name, Index: idx}
+	key := s.Key()
+	err := tx.Get(key, s)
+	if err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+		return err
+	}
+	s.Count += delta
+	if err := s.PrePutAction(ctx); err != nil {
+		return err
+	}
+	_, err = tx.Put(key, s)
+	return err
+}
+
+// Get はカウンタの値を返します。
+// すべてのシャードを GetMulti で取得して合計するため、キャッシュが有効な場合はキャッシュから取得します。
+// 存在しないカウンタの値は0になります。
+func Get(ctx context.Context, name string) (int64, error) {
+	n, err := shardCount(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{Name: name, Index: i}
+	}
+	err = entitystore.GetEntityMulti(ctx, shards)
+	if entitystore.IsProblem(err) {
+		return 0, err
+	}
+	var total int64
+	for _, s := range entitystore.PickUp(shards, err) {
+		total += s.Count
+	}
+	return total, nil
+}
+
+// Query はカウンタのシャードを取得するクエリを返します。
+// entitystore.IntSum や entitystore.NewAggregation の WithIntSum に "Count" を指定して集計できます。
+func Query(name string) entitystore.Query {
+	return entitystore.NewQuery(ShardKind).FilterField("Name", "=", name)
+}
+
+// Sum はカウンタの値を集計クエリで返します。
+// シャード数の設定を読み込まずに1回のクエリで集計できますが、キャッシュは使用しません。
+func Sum(ctx context.Context, name string) (int64, error) {
+	n, err := entitystore.IntSum(ctx, Query(name), countProperty)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// GrowShards はカウンタのシャード数を n に増やします。
+// カウンタを使用したまま実行できます。現在のシャード数が n 以上の場合は何もしません。
+// シャード数を減らすと既存のシャードの値が集計されなくなるため、減らすことはできません。
+func GrowShards(ctx context.Context, name string, n int) error {
+	_, err := entitystore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return growShards(ctx, tx, name, n)
+	})
+	if err != nil {
+		return err
+	}
+	return entitystore.DeleteCacheByKeys(ctx, []*datastore.Key{(&config{Name: name}).Key()})
+}
+
+// growShards はトランザクション内でシャード数の設定を n に増やします。
+// トランザクションは再試行されることがあるため、試行ごとに設定を読み込み直します。
+func growShards(ctx context.Context, tx transaction, name string, n int) error {
+	c := &config{Name: name}
+	key := c.Key()
+	err := tx.Get(key, c)
+	if errors.Is(err, datastore.ErrNoSuchEntity) {
+		c.Shards = DefaultShards
+	} else if err != nil {
+		return err
+	}
+	if c.Shards >= n {
+		return nil
+	}
+	c.Shards = n
+	if err := c.PrePutAction(ctx); err != nil {
+		return err
+	}
+	_, err = tx.Put(key, c)
+	return err
+}
@@ -0,0 +1,94 @@
+package counter
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+
+	"go.fujikura.biz/entitystore"
+	"go.fujikura.biz/entitystore/cachestore"
+)
+
+func testInitialize(ctx context.Context) {
+	entitystore.Initialize(ctx, "entitystore-test-project", entitystore.Config{
+		Options: []option.ClientOption{
+			option.WithCredentialsFile("../service-account-key.json"),
+		},
+		Cachestore: &cachestore.Memorystore{},
+	})
+	for _, kind := range []string{ShardKind, ConfigKind} {
+		if err := entitystore.DeleteAll(ctx, kind); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestShard_Key(t *testing.T) {
+	s := &shard{Name: "visits", Index: 3}
+	require.Equal(t, ShardKind, s.Key().Kind)
+	require.Equal(t, "visits#3", s.Key().Name)
+}
+
+// retryTx は Get で既存のエンティティを読み込まずに ErrNoSuchEntity を返し、Put したエンティティを記録するトランザクションです。
+type retryTx struct {
+	put []any
+}
+
+func (tx *retryTx) Get(_ *datastore.Key, _ interface{}) error {
+	return datastore.ErrNoSuchEntity
+}
+
+func (tx *retryTx) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	tx.put = append(tx.put, src)
+	return nil, nil
+}
+
+func TestIncrementShard_Retry(t *testing.T) {
+	ctx := context.Background()
+	tx := &retryTx{}
+	// 再試行しても前回の試行の加算は引き継がない
+	require.NoError(t, incrementShard(ctx, tx, "visits", 1, 2))
+	require.NoError(t, incrementShard(ctx, tx, "visits", 1, 2))
+	require.Len(t, tx.put, 2)
+	require.Equal(t, int64(2), tx.put[0].(*shard).Count)
+	require.Equal(t, int64(2), tx.put[1].(*shard).Count)
+}
+
+func TestGrowShards_Retry(t *testing.T) {
+	ctx := context.Background()
+	tx := &retryTx{}
+	require.NoError(t, growShards(ctx, tx, "visits", DefaultShards+1))
+	require.NoError(t, growShards(ctx, tx, "visits", DefaultShards+1))
+	require.Len(t, tx.put, 2)
+	require.Equal(t, DefaultShards+1, tx.put[1].(*config).Shards)
+}
+
+func TestCounter(t *testing.T) {
+	ctx := context.Background()
+	testInitialize(ctx)
+
+	n, err := Get(ctx, "visits")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, Increment(ctx, "visits", 2))
+	}
+	n, err = Get(ctx, "visits")
+	require.NoError(t, err)
+	require.Equal(t, int64(20), n)
+
+	// シャード数を増やしても値は変わらない
+	require.NoError(t, GrowShards(ctx, "visits", DefaultShards*2))
+	require.NoError(t, Increment(ctx, "visits", -1))
+	n, err = Get(ctx, "visits")
+	require.NoError(t, err)
+	require.Equal(t, int64(19), n)
+
+	n, err = Sum(ctx, "visits")
+	require.NoError(t, err)
+	require.Equal(t, int64(19), n)
+}
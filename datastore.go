@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 
 	"cloud.google.com/go/datastore"
 	"github.com/samber/lo"
@@ -12,137 +13,134 @@ import (
 // Get は単一のエンティティを取得します。
 // キャッシュに存在する場合はキャッシュから取得し、存在しない場合はDatastoreから取得します。
 // 取得後、Datastoreから取得した場合はキャッシュに保存します。
+// エンティティのスキーマバージョンが古い場合は、登録されている移行処理を適用してからロードします。
+// ctx に ReadAt で読み取り時刻を指定した場合は、キャッシュを使用せずにその時刻のエンティティを取得します。
 func Get(ctx context.Context, key *datastore.Key, dst any) error {
+	tx, err := snapshotTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	if tx != nil {
+		// スナップショットから取得する場合はキャッシュを使用しない
+		defer endSnapshot(tx)
+		var pl datastore.PropertyList
+		if err := tx.Get(key, &pl); err != nil {
+			return err
+		}
+		return loadEntity(ctx, key, pl, dst)
+	}
 	// キャッシュから取得
 	cacheKeys := []datastore.Key{*key}
 	cached, err := cache.GetEntities(ctx, cacheKeys)
 	if err == nil {
 		// キャッシュにあった場合はそれを返す
-		if len(cached) > 0 {
-			if ps, ok := cached[*key]; ok {
-				LoadStruct(ps, dst)
-				return nil
-			}
+		if ps, ok := cached[*key]; ok {
+			return loadEntity(ctx, key, ps, dst)
 		}
 	} else {
 		// キャッシュのエラーは警告ログを出すだけにする
 		logger.Warn(
-			fmt.Sprintf(LogFormat, "GetEntity cache.GetEntities error: %v"),
+			fmt.Sprintf(LogFormat, "GetEntity cache.GetEntities error"), slog.String("error", err.Error()),
 		)
 	}
 	// キャッシュから取得出来なければ Datastore から取得
-	err = client.Get(ctx, key, dst)
-	if IsProblem(err) {
-		return err
-	}
-	if errors.Is(err, datastore.ErrNoSuchEntity) {
-		return err // エンティティなし
+	var pl datastore.PropertyList
+	err = client.Get(ctx, key, &pl)
+	if err != nil {
+		return err // ErrNoSuchEntity の場合もそのまま返す
 	}
 	// 取得したエンティティをキャッシュ
 	err = cache.SetEntities(ctx, map[datastore.Key][]datastore.Property{
-		*key: EntityToProperties(dst),
+		*key: pl,
 	})
 	if err != nil {
 		// キャッシュのエラーは警告ログを出すだけにする
 		logger.Warn(
-			fmt.Sprintf(LogFormat, "GetEntity cache.SetEntities error: %v"),
+			fmt.Sprintf(LogFormat, "GetEntity cache.SetEntities error"), slog.String("error", err.Error()),
 		)
 	}
-	return nil
+	return loadEntity(ctx, key, pl, dst)
 }
 
 // GetMulti は複数のエンティティを取得します。
 // キャッシュに存在するエンティティはキャッシュから取得し、存在しないエンティティはDatastoreから取得します。
 // 取得後、Datastoreから取得したエンティティはキャッシュに保存します。
+// エンティティのスキーマバージョンが古い場合は、登録されている移行処理を適用してからロードします。
+// ctx に ReadAt で読み取り時刻を指定した場合は、キャッシュを使用せずにその時刻のエンティティを取得します。
+// Datastore の1回の取得の上限を超える場合は、キャッシュと Datastore からの取得をバッチに分割して並行して実行します。
+// エラーは keys の位置に合わせた datastore.MultiError で返します。
 func GetMulti(ctx context.Context, keys []*datastore.Key, dst []any) error {
+	tx, err := snapshotTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer endSnapshot(tx)
 	// キャッシュから取得
-	cacheKeys := lo.Map(keys, func(key *datastore.Key, _ int) datastore.Key {
-		return *key
-	})
-	cached, err := cache.GetEntities(ctx, cacheKeys)
-	if err == nil {
-		// キャッシュにあった分をセット
-		for i, key := range keys {
-			if ps, ok := cached[*key]; ok {
-				LoadStruct(ps, dst[i])
-			}
-		}
-		if len(cached) == len(keys) {
-			// すべてキャッシュにあった場合は終了
-			return nil
-		}
-	} else {
+	var cached map[datastore.Key][]datastore.Property
+	if tx == nil {
+		cacheKeys := lo.Map(keys, func(key *datastore.Key, _ int) datastore.Key {
+			return *key
+		})
+		cached, err = cacheGetEntities(ctx, cacheKeys)
+	}
+	if err != nil {
 		// キャッシュのエラーは警告ログを出すだけにする
 		logger.Warn(
-			fmt.Sprintf(LogFormat, "GetEntityMulti cache.GetEntities error: %v"),
+			fmt.Sprintf(LogFormat, "GetEntityMulti cache.GetEntities error"), slog.String("error", err.Error()),
 		)
+		cached = nil
 	}
-	noerr := false
-	var merr datastore.MultiError
-	var hits map[datastore.Key][]datastore.Property
-	if len(cached) == 0 {
-		// まったくキャッシュに無かった場合、全て Datastore から取得
-		err = client.GetMulti(ctx, keys, dst)
-		if IsProblem(err) {
-			return err
-		}
-		if err == nil {
-			noerr = true
-			err = make(datastore.MultiError, len(keys))
+	props := make([][]datastore.Property, len(keys))
+	merr := make(datastore.MultiError, len(keys))
+	// キャッシュに無いものだけ Datastore から取得
+	noCacheIdx := make([]int, 0, len(keys))
+	noCacheKeys := make([]*datastore.Key, 0, len(keys))
+	for i, key := range keys {
+		if ps, ok := cached[*key]; ok {
+			props[i] = ps
 		} else {
-			errors.As(err, &merr)
+			noCacheIdx = append(noCacheIdx, i)
+			noCacheKeys = append(noCacheKeys, key)
 		}
-		// キャッシュするデータを準備
-		hits = make(map[datastore.Key][]datastore.Property, len(keys))
-		for i, e := range err.(datastore.MultiError) {
-			if e == nil {
-				hits[*keys[i]] = EntityToProperties(dst[i])
-			}
+	}
+	if len(noCacheKeys) > 0 {
+		pls := make([]datastore.PropertyList, len(noCacheKeys))
+		err = lookupMulti(ctx, tx, noCacheKeys, pls)
+		var gerr datastore.MultiError
+		if err != nil && !errors.As(err, &gerr) {
+			return err // MultiError でなければ全体の失敗
 		}
-	} else {
-		// 一部キャッシュにあった場合
-		noCacheKeys := make([]*datastore.Key, 0, len(keys))
-		noCaches := make([]any, 0, len(keys))
-		for i, key := range keys {
-			if _, ok := cached[*key]; !ok {
-				noCacheKeys = append(noCacheKeys, key)
-				noCaches = append(noCaches, dst[i])
+		// キャッシュするデータを準備し、結果とエラーを keys の位置にセット
+		hits := make(map[datastore.Key][]datastore.Property, len(noCacheKeys))
+		for i, p := range noCacheIdx {
+			if gerr != nil && gerr[i] != nil {
+				merr[p] = gerr[i]
+				continue
 			}
+			props[p] = pls[i]
+			hits[*noCacheKeys[i]] = pls[i]
 		}
-		// キャッシュに無いものだけ Datastore から取得
-		err = client.GetMulti(ctx, noCacheKeys, noCaches)
-		if IsProblem(err) {
-			return err
+		// キャッシュ
+		var cacheErr error
+		if tx == nil {
+			cacheErr = cacheSetEntities(ctx, hits)
 		}
-		if err == nil {
-			noerr = true
-			err = make(datastore.MultiError, len(noCaches))
-		}
-		// 結果を元のスライスにセット
-		merr = make(datastore.MultiError, len(keys))
-		hits = make(map[datastore.Key][]datastore.Property, len(keys))
-		p := 0
-		for i, e := range err.(datastore.MultiError) {
-			for ; p < len(keys); p++ {
-				if *keys[p] == *noCacheKeys[i] {
-					if e == nil {
-						dst[p] = noCaches[i]
-						hits[*keys[p]] = EntityToProperties(dst[i])
-						break
-					} else {
-						merr[p] = e
-					}
-				}
-			}
+		if cacheErr != nil {
+			// キャッシュのエラーは警告ログを出すだけにする
+			logger.Warn(
+				fmt.Sprintf(LogFormat, "GetEntityMulti cache.SetEntities error"), slog.String("error", cacheErr.Error()),
+			)
 		}
 	}
-	// キャッシュ
-	cacheErr := cache.SetEntities(ctx, hits)
-	if cacheErr != nil {
-		// キャッシュのエラーは警告ログを出すだけにする
-		logger.Warn(
-			fmt.Sprintf(LogFormat, "GetEntityMulti cache.SetEntities error: %v"),
-		)
+	// エンティティにロード
+	noerr := true
+	for i, key := range keys {
+		if merr[i] == nil {
+			merr[i] = loadEntity(ctx, key, props[i], dst[i])
+		}
+		if merr[i] != nil {
+			noerr = false
+		}
 	}
 	if noerr {
 		return nil
@@ -151,49 +149,42 @@ func GetMulti(ctx context.Context, keys []*datastore.Key, dst []any) error {
 }
 
 // Put は単一のエンティティをDatastoreに保存します。
+// src が Entity の場合は保存前に PrePutAction を呼び出します。
 // 保存後、キャッシュを削除します。
 func Put(ctx context.Context, key *datastore.Key, src any) error {
-	_, err := client.Put(ctx, key, src)
-	if err != nil {
-		return err
-	}
-	return cache.DeleteEntities(ctx, []datastore.Key{*key})
+	return write(ctx, []*writeOp{{typ: MutationTypeUpsert, key: key, src: src}})
 }
 
 // PutMulti は複数のエンティティをDatastoreに一括保存します。
+// src はエンティティのスライスで、要素が Entity の場合は保存前に PrePutAction を呼び出します。
 // 保存後、キャッシュを削除します。
+// 1回のコミットの上限を超える場合は、バッチに分割して並行して書き込みます。一部のバッチだけが書き込まれた場合は、
+// 書き込まれたエンティティのキャッシュの削除と書き込み後のフックを行ってから、keys の位置に合わせた datastore.MultiError を返します。
+// 変更履歴の記録や一意制約などのトランザクションを使用する書き込みも、バッチごとに別のトランザクションになるため、
+// すべてのエンティティが一括で書き込まれるとは限りません。
 func PutMulti(ctx context.Context, keys []*datastore.Key, src any) error {
-	_, err := client.PutMulti(ctx, keys, src)
+	ops, err := putOps(keys, src)
 	if err != nil {
 		return err
 	}
-	return cache.DeleteEntities(ctx, lo.Map(keys, func(key *datastore.Key, _ int) datastore.Key {
-		return *key
-	}))
+	return write(ctx, ops)
 }
 
 // Delete は単一のエンティティをDatastoreとキャッシュから削除します。
 func Delete(ctx context.Context, key *datastore.Key) error {
-	err := client.Delete(ctx, key)
-	if err != nil {
-		return err
-	}
-	return cache.DeleteEntities(ctx, []datastore.Key{*key})
+	return write(ctx, deleteOps([]*datastore.Key{key}))
 }
 
 // DeleteMulti は複数のエンティティをDatastoreとキャッシュから一括削除します。
+// 1回のコミットの上限を超える場合は、PutMulti と同様にバッチに分割して並行して削除します。
+// 論理削除や変更履歴の記録などのトランザクションを使用する書き込みも、バッチごとに別のトランザクションになります。
 func DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
-	err := client.DeleteMulti(ctx, keys)
-	if err != nil {
-		return err
-	}
-	return cache.DeleteEntities(ctx, lo.Map(keys, func(key *datastore.Key, _ int) datastore.Key {
-		return *key
-	}))
+	return write(ctx, deleteOps(keys))
 }
 
 // Run は client.Run のラッパーです。
 // 特別な処理は行いません。
+// NewQueryFor で作成したクエリの検証エラーは返せないため、必要に応じて事前に Query.Err で確認してください。
 //
 //goland:noinspection GoUnusedExportedFunction
 func Run(ctx context.Context, q Query) *datastore.Iterator {
@@ -41,14 +41,23 @@ func NewClient(client *datastore.Client) DatastoreClient {
 
 //goland:noinspection GoDeprecation
 func (c datastoreClient) Count(ctx context.Context, q Query) (n int, err error) {
+	if err := q.Err(); err != nil {
+		return 0, err
+	}
 	return c.Client.Count(ctx, q.Q())
 }
 
 func (c datastoreClient) GetAll(ctx context.Context, q Query, dst interface{}) (keys []*datastore.Key, err error) {
+	if err := q.Err(); err != nil {
+		return nil, err
+	}
 	return c.Client.GetAll(ctx, q.Q(), dst)
 }
 
 func (c datastoreClient) GetAllWithOptions(ctx context.Context, q Query, dst interface{}, opts ...datastore.RunOption) (res datastore.GetAllWithOptionsResult, err error) {
+	if err := q.Err(); err != nil {
+		return res, err
+	}
 	return c.Client.GetAllWithOptions(ctx, q.Q(), dst, opts...)
 }
 
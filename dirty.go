@@ -0,0 +1,258 @@
+package entitystore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+	"weak"
+
+	"cloud.google.com/go/datastore"
+)
+
+// skipUnchanged が true の場合、ロード時から変更されていないエンティティの保存を省略します。
+var skipUnchanged bool
+
+// snapshotHolder はロード時のプロパティを保持するエンティティのインターフェースです。
+// EntityBase を埋め込むことで実装されます。
+type snapshotHolder interface {
+	loadedSnapshot() []datastore.Property
+	setLoadedSnapshot(ps []datastore.Property)
+}
+
+// ChangeType はプロパティの変更の種類です。
+type ChangeType int
+
+const (
+	ChangeTypeAdded ChangeType = iota
+	ChangeTypeRemoved
+	ChangeTypeModified
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeTypeAdded:
+		return "added"
+	case ChangeTypeRemoved:
+		return "removed"
+	case ChangeTypeModified:
+		return "modified"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(t))
+	}
+}
+
+// PropertyChange は1つのプロパティの変更です。
+type PropertyChange struct {
+	Name string
+	Type ChangeType
+	// Before は変更前の値です。追加されたプロパティの場合は nil になります。
+	Before any
+	// After は変更後の値です。削除されたプロパティの場合は nil になります。
+	After any
+}
+
+// Diff は2つのエンティティのプロパティを比較し、変更されたプロパティをプロパティ名の順に返します。
+// before, after にはエンティティ (構造体のポインタ) または []datastore.Property, datastore.PropertyList を指定できます。
+// nil を指定した場合はプロパティが無いものとして扱います。
+// time.Time はタイムゾーンに関係なく同じ時刻であれば変更無しとみなします。
+func Diff(before, after any) ([]PropertyChange, error) {
+	bps, err := propertiesOf(before)
+	if err != nil {
+		return nil, err
+	}
+	aps, err := propertiesOf(after)
+	if err != nil {
+		return nil, err
+	}
+	return diffProperties(bps, aps), nil
+}
+
+// propertiesOf は Diff の引数をプロパティに変換します。
+func propertiesOf(v any) ([]datastore.Property, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []datastore.Property:
+		return v, nil
+	case datastore.PropertyList:
+		return v, nil
+	case *datastore.PropertyList:
+		return *v, nil
+	default:
+		return saveStruct(v)
+	}
+}
+
+// diffProperties は2つのプロパティを比較し、変更されたプロパティをプロパティ名の順に返します。
+func diffProperties(before, after []datastore.Property) []PropertyChange {
+	b := propertyMap(before)
+	a := propertyMap(after)
+	var changes []PropertyChange
+	for name, bp := range b {
+		ap, ok := a[name]
+		if !ok {
+			changes = append(changes, PropertyChange{Name: name, Type: ChangeTypeRemoved, Before: bp.Value})
+		} else if !propertyEqual(bp, ap) {
+			changes = append(changes, PropertyChange{Name: name, Type: ChangeTypeModified, Before: bp.Value, After: ap.Value})
+		}
+	}
+	for name, ap := range a {
+		if _, ok := b[name]; !ok {
+			changes = append(changes, PropertyChange{Name: name, Type: ChangeTypeAdded, After: ap.Value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// propertyMap はプロパティをプロパティ名で引けるようにします。
+func propertyMap(ps []datastore.Property) map[string]datastore.Property {
+	m := make(map[string]datastore.Property, len(ps))
+	for _, p := range ps {
+		m[p.Name] = p
+	}
+	return m
+}
+
+// propertiesEqual は2つのプロパティが同じ内容かどうかを返します。プロパティの順番は考慮しません。
+func propertiesEqual(a, b []datastore.Property) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(diffProperties(a, b)) == 0
+}
+
+// propertyEqual は2つのプロパティの値とインデックスの有無が同じかどうかを返します。
+func propertyEqual(a, b datastore.Property) bool {
+	return a.NoIndex == b.NoIndex && valueEqual(a.Value, b.Value)
+}
+
+// valueEqual は2つのプロパティの値が同じかどうかを返します。
+func valueEqual(a, b any) bool {
+	switch av := a.(type) {
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Equal(bv)
+	case *datastore.Key:
+		bv, ok := b.(*datastore.Key)
+		return ok && av.Equal(bv)
+	case []byte:
+		bv, ok := b.([]byte)
+		return ok && bytes.Equal(av, bv)
+	case *datastore.Entity:
+		bv, ok := b.(*datastore.Entity)
+		if !ok || (av == nil) != (bv == nil) {
+			return false
+		}
+		return av == nil || (av.Key.Equal(bv.Key) && propertiesEqual(av.Properties, bv.Properties))
+	case []any:
+		bv, ok := b.([]any)
+		return ok && slices.EqualFunc(av, bv, valueEqual)
+	default:
+		return a == b
+	}
+}
+
+// snapshots は EntityBase ごとのロード時のプロパティです。
+// EntityBase を埋め込んだ構造体を比較可能なままにするため、フィールドではなく EntityBase の弱参照をキーにして保持し、
+// エンティティが回収されると削除します。構造体をコピーした場合、コピー先にはロード時のプロパティは引き継がれません。
+var snapshots sync.Map // map[weak.Pointer[EntityBase]][]datastore.Property
+
+// loadedSnapshot はロード時のプロパティを返します。
+func (e *EntityBase) loadedSnapshot() []datastore.Property {
+	v, _ := snapshots.Load(weak.Make(e))
+	ps, _ := v.([]datastore.Property)
+	return ps
+}
+
+// setLoadedSnapshot はロード時のプロパティを設定します。nil を指定した場合は削除します。
+func (e *EntityBase) setLoadedSnapshot(ps []datastore.Property) {
+	wp := weak.Make(e)
+	if ps == nil {
+		snapshots.Delete(wp)
+		return
+	}
+	if _, loaded := snapshots.Swap(wp, ps); !loaded {
+		runtime.AddCleanup(e, func(wp weak.Pointer[EntityBase]) { snapshots.Delete(wp) }, wp)
+	}
+}
+
+// needsSnapshot はエンティティのロード時のプロパティを記録する必要があるかどうかを返します。
+// 記録したプロパティは skipUnchanged による変更の検出と、暗号化したプロパティの暗号文の再利用にのみ使用するため、
+// どちらにも該当しない場合は記録しません。
+func needsSnapshot(v any) bool {
+	if skipUnchanged {
+		return true
+	}
+	fields, err := encryptedFieldsOf(reflect.TypeOf(v))
+	return err == nil && len(fields) > 0
+}
+
+// takeSnapshot はロードしたエンティティにロード時のプロパティを記録します。
+// 移行処理が必要なエンティティは保存し直す必要があるため記録しません。
+// ReadAt で指定した時刻のスナップショットから読み取ったエンティティは、現在の内容と異なる可能性があるため記録しません。
+func takeSnapshot(ctx context.Context, ps []datastore.Property, dst any) {
+	h, ok := dst.(snapshotHolder)
+	if !ok || !needsSnapshot(dst) {
+		return
+	}
+	if _, ok := readTimeOf(ctx); ok {
+		h.setLoadedSnapshot(nil)
+		return
+	}
+	if e, ok := dst.(Entity); ok && storedSchemaVersion(ps) < e.CurrentSchemaVersion() {
+		h.setLoadedSnapshot(nil)
+		return
+	}
+	h.setLoadedSnapshot(ps)
+}
+
+// isUnchanged はエンティティがロード時から変更されていないかどうかを返します。
+// ロード時のプロパティが記録されていない場合は false を返します。
+func isUnchanged(src any) (bool, error) {
+	h, ok := src.(snapshotHolder)
+	if !ok || h.loadedSnapshot() == nil {
+		return false, nil
+	}
+	ps, err := saveStruct(src)
+	if err != nil {
+		return false, err
+	}
+	return propertiesEqual(h.loadedSnapshot(), ps), nil
+}
+
+// markUnchanged は skipUnchanged が有効な場合に、ロード時から変更されていない保存操作に印を付けます。
+// 印を付けた操作は書き込み前後のフックや検証も含めて省略されます。
+func markUnchanged(ops []*writeOp) error {
+	if !skipUnchanged {
+		return nil
+	}
+	for _, op := range ops {
+		if op.isDelete() || op.patch != nil || op.props != nil {
+			continue
+		}
+		unchanged, err := isUnchanged(op.src)
+		if err != nil {
+			return err
+		}
+		op.unchanged = unchanged
+	}
+	return nil
+}
+
+// updateSnapshots は保存したエンティティのロード時のプロパティを、保存した内容で置き換えます。
+func updateSnapshots(ops []*writeOp) {
+	for _, op := range ops {
+		if h, ok := op.src.(snapshotHolder); ok && !op.isDelete() && !op.unchanged && op.next != nil && needsSnapshot(op.src) {
+			h.setLoadedSnapshot(op.next)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+	before := &TestEntity{Id: 1, Value: "Test1"}
+	before.SetUpdatedAt(now)
+	after := &TestEntity{Id: 1, Value: "Test2"}
+	after.SetUpdatedAt(now.UTC())
+	changes, err := Diff(before, after)
+	require.NoError(t, err)
+	require.Equal(t, []PropertyChange{
+		{Name: "Value", Type: ChangeTypeModified, Before: "Test1", After: "Test2"},
+	}, changes)
+
+	changes, err = Diff([]datastore.Property{{Name: "A", Value: int64(1)}}, datastore.PropertyList{{Name: "B", Value: int64(1)}})
+	require.NoError(t, err)
+	require.Equal(t, []PropertyChange{
+		{Name: "A", Type: ChangeTypeRemoved, Before: int64(1)},
+		{Name: "B", Type: ChangeTypeAdded, After: int64(1)},
+	}, changes)
+}
+
+func TestIsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	key := datastore.NameKey("TestEntity", "1", nil)
+	ps, err := saveStruct(&TestEntity{Id: 1, Value: "Test1"})
+	require.NoError(t, err)
+
+	// skipUnchanged が無効な場合はロード時のプロパティを記録しない
+	e := &TestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, e))
+	require.Nil(t, e.loadedSnapshot())
+
+	skipUnchanged = true
+	defer func() { skipUnchanged = false }()
+	e = &TestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, e))
+	unchanged, err := isUnchanged(e)
+	require.NoError(t, err)
+	require.True(t, unchanged)
+
+	e.Value = "Test2"
+	unchanged, err = isUnchanged(e)
+	require.NoError(t, err)
+	require.False(t, unchanged)
+
+	// ReadAt で読み取ったエンティティは変更ありとして扱う
+	require.NoError(t, loadEntity(ReadAt(ctx, time.Now().Add(-time.Minute)), key, ps, e))
+	unchanged, err = isUnchanged(e)
+	require.NoError(t, err)
+	require.False(t, unchanged)
+
+	// ロードしていないエンティティは変更ありとして扱う
+	unchanged, err = isUnchanged(&TestEntity{Id: 1, Value: "Test1"})
+	require.NoError(t, err)
+	require.False(t, unchanged)
+}
+
+func TestPutEntity_SkipUnchanged(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	skipUnchanged = true
+	defer func() { skipUnchanged = false }()
+
+	require.NoError(t, PutEntity(ctx, &TestEntity{Id: 1, Value: "Test1"}))
+	e := &TestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e))
+	updatedAt := e.UpdatedAt()
+
+	// 変更が無い場合は保存されない
+	require.NoError(t, PutEntity(ctx, e))
+	require.Equal(t, updatedAt, e.UpdatedAt())
+
+	e.Value = "Test2"
+	require.NoError(t, PutEntity(ctx, e))
+	require.NotEqual(t, updatedAt, e.UpdatedAt())
+	e2 := &TestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e2))
+	require.Equal(t, "Test2", e2.Value)
+}
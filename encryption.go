@@ -0,0 +1,298 @@
+package entitystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+
+	"go.fujikura.biz/entitystore/keyprovider"
+)
+
+// keyProvider はフィールド暗号化の鍵を提供する KeyProvider のインスタンスです。
+var keyProvider keyprovider.KeyProvider
+
+// encryptOption は暗号化するフィールドに付ける構造体タグ `entitystore:"encrypt"` のオプションです。
+// string と []byte のフィールドに指定できます。暗号化したプロパティはキャッシュにも暗号化したまま保存されます。
+// 入れ子の構造体や構造体のスライスのフィールドには指定できません。
+// 暗号化したプロパティはインデックスを作成しないため、クエリや一意制約には使用できません。
+// 構造体タグ `entitystore:"unique"` や KindOptions.Unique と同時に指定した場合は保存時にエラーになります。
+const encryptOption = "encrypt"
+
+// encryptedMagic は暗号化したプロパティの値の先頭に付ける目印です。
+// 暗号化を有効にする前に平文で保存されたプロパティと区別するために使用します。
+var encryptedMagic = []byte("\x00ESE2")
+
+// legacyEncryptedMagic はプロパティ名だけを追加データとして暗号化した以前の形式の目印です。
+// 以前の形式の暗号文も復号でき、保存し直すと現在の形式で暗号化されます。
+var legacyEncryptedMagic = []byte("\x00ESE1")
+
+// encryptedFieldsCache は型ごとの暗号化するプロパティのキャッシュです。
+var encryptedFieldsCache sync.Map // map[reflect.Type]map[string]bool
+
+// encryptedFieldsOf は構造体タグ `entitystore:"encrypt"` を付けたフィールドのプロパティ名を返します。
+// 値は []byte のフィールドの場合に true、string のフィールドの場合に false です。結果はキャッシュされます。
+func encryptedFieldsOf(t reflect.Type) (map[string]bool, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	if cached, ok := encryptedFieldsCache.Load(t); ok {
+		return cached.(map[string]bool), nil
+	}
+	fields := map[string]bool{}
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() {
+			continue
+		}
+		if !hasTagOption(sf, encryptOption) {
+			if !sf.Anonymous {
+				if nested, ok := nestedEncryptedField(sf.Type, map[reflect.Type]bool{}); ok {
+					return nil, fmt.Errorf("entitystore: field %s.%s of %s cannot be encrypted because it is in a nested struct", sf.Name, nested, t.Name())
+				}
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("datastore"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if hasTagOption(sf, "unique") {
+			// 暗号文は毎回異なるため、同じ値を検出できない
+			return nil, fmt.Errorf("entitystore: field %s of %s cannot be both encrypted and unique", sf.Name, t.Name())
+		}
+		switch {
+		case sf.Type.Kind() == reflect.String:
+			fields[name] = false
+		case sf.Type == reflect.TypeOf([]byte(nil)):
+			fields[name] = true
+		default:
+			return nil, fmt.Errorf("entitystore: field %s of %s has unsupported type %s for encryption", sf.Name, t.Name(), sf.Type)
+		}
+	}
+	encryptedFieldsCache.Store(t, fields)
+	return fields, nil
+}
+
+// nestedEncryptedField は入れ子の構造体に構造体タグ `entitystore:"encrypt"` を付けたフィールドがある場合にその名前を返します。
+// 入れ子の構造体や構造体のスライスのプロパティは暗号化できないため、平文で保存されないようにエラーにするために使用します。
+// visiting は再帰的な構造体を無限に辿らないために使用します。
+func nestedEncryptedField(t reflect.Type, visiting map[reflect.Type]bool) (string, bool) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return nestedEncryptedField(t.Elem(), visiting)
+	case reflect.Struct:
+		if visiting[t] || isDatastoreValueType(t) {
+			return "", false
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if !sf.IsExported() && !sf.Anonymous {
+				continue
+			}
+			if hasTagOption(sf, encryptOption) {
+				return sf.Name, true
+			}
+			if name, ok := nestedEncryptedField(sf.Type, visiting); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isEncrypted はプロパティの値が暗号化されたものかどうかを返します。
+func isEncrypted(v any) bool {
+	b, ok := v.([]byte)
+	return ok && (bytes.HasPrefix(b, encryptedMagic) || bytes.HasPrefix(b, legacyEncryptedMagic))
+}
+
+// additionalData は暗号化で認証する追加データを返します。
+// エンティティのキーとプロパティ名を追加データにすることで、暗号文を別のエンティティや別のプロパティにコピーしても復号できないようにします。
+func additionalData(key *datastore.Key, name string) ([]byte, error) {
+	if key == nil || key.Incomplete() {
+		return nil, fmt.Errorf("entitystore: encrypted property %s requires a complete key", name)
+	}
+	return []byte(key.Encode() + "\x00" + name), nil
+}
+
+// newGCM は鍵から AES-GCM を作成します。
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue はプロパティの値を暗号化します。
+// 暗号文は 目印 | 鍵の ID の長さ (1バイト) | 鍵の ID | nonce | 暗号文 の形式で、
+// エンティティのキー entityKey とプロパティ名を追加データとして認証します。
+func encryptValue(entityKey *datastore.Key, name, id string, key, plain []byte) ([]byte, error) {
+	if len(id) > 255 {
+		return nil, fmt.Errorf("entitystore: key id %q is too long", id)
+	}
+	ad, err := additionalData(entityKey, name)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(encryptedMagic)+1+len(id)+len(nonce)+len(plain)+gcm.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, ad), nil
+}
+
+// decryptValue は暗号化したプロパティの値を復号し、暗号化に使用した鍵の ID と平文を返します。
+// 以前の形式の暗号文はプロパティ名だけを追加データとして復号します。
+func decryptValue(entityKey *datastore.Key, name string, data []byte) (string, []byte, error) {
+	if keyProvider == nil {
+		return "", nil, errors.New("entitystore: KeyProvider is not configured")
+	}
+	var ad []byte
+	if bytes.HasPrefix(data, legacyEncryptedMagic) {
+		ad = []byte(name)
+	} else {
+		var err error
+		if ad, err = additionalData(entityKey, name); err != nil {
+			return "", nil, err
+		}
+	}
+	rest := data[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return "", nil, fmt.Errorf("entitystore: encrypted property %s is malformed", name)
+	}
+	id := string(rest[1 : 1+rest[0]])
+	rest = rest[1+rest[0]:]
+	key, err := keyProvider.Key(id)
+	if err != nil {
+		return "", nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return "", nil, fmt.Errorf("entitystore: encrypted property %s is malformed", name)
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], ad)
+	if err != nil {
+		return "", nil, fmt.Errorf("entitystore: failed to decrypt property %s: %w", name, err)
+	}
+	return id, plain, nil
+}
+
+// encryptProperties は saveStruct で保存したプロパティのうち、暗号化するフィールドのプロパティを暗号化します。
+// 暗号化したプロパティはインデックスを作成しません。
+// ロード時から値が変わっておらず、現在の鍵で暗号化されている場合はロード時の暗号文をそのまま使用するため、
+// 変更の検出や変更履歴で暗号化したプロパティが変更されたと扱われることはありません。
+// entityKey は追加データとして認証するエンティティのキーで、完全なキーである必要があります。
+func encryptProperties(entityKey *datastore.Key, e any, ps []datastore.Property) error {
+	fields, err := encryptedFieldsOf(reflect.TypeOf(e))
+	if len(fields) == 0 || err != nil {
+		return err
+	}
+	if entityKey != nil {
+		for _, c := range optionsOf(entityKey.Kind).Unique {
+			for _, name := range c {
+				if _, ok := fields[name]; ok {
+					// 暗号文は毎回異なるため、同じ値を検出できない
+					return fmt.Errorf("entitystore: property %s of %s cannot be both encrypted and unique", name, entityKey.Kind)
+				}
+			}
+		}
+	}
+	if keyProvider == nil {
+		return errors.New("entitystore: KeyProvider is not configured")
+	}
+	id, key, err := keyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+	loaded := map[string]any{}
+	if h, ok := e.(snapshotHolder); ok {
+		for _, p := range h.loadedSnapshot() {
+			if _, ok := fields[p.Name]; ok {
+				loaded[p.Name] = p.Value
+			}
+		}
+	}
+	for i := range ps {
+		if _, ok := fields[ps[i].Name]; !ok {
+			continue
+		}
+		var plain []byte
+		switch v := ps[i].Value.(type) {
+		case string:
+			plain = []byte(v)
+		case []byte:
+			plain = v
+		}
+		ps[i].NoIndex = true
+		if old, ok := loaded[ps[i].Name].([]byte); ok && bytes.HasPrefix(old, encryptedMagic) {
+			if oldID, oldPlain, err := decryptValue(entityKey, ps[i].Name, old); err == nil && oldID == id && bytes.Equal(oldPlain, plain) {
+				ps[i].Value = old
+				continue
+			}
+		}
+		if ps[i].Value, err = encryptValue(entityKey, ps[i].Name, id, key, plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptProperties は暗号化されたプロパティを復号したプロパティを返します。
+// キャッシュの内容を変更しないよう、復号するプロパティがある場合は複製してから復号します。
+// 暗号化を有効にする前に平文で保存されたプロパティはそのまま返します。
+// entityKey は暗号化したときに追加データとして認証したエンティティのキーです。
+func decryptProperties(entityKey *datastore.Key, e any, ps []datastore.Property) ([]datastore.Property, error) {
+	fields, err := encryptedFieldsOf(reflect.TypeOf(e))
+	if len(fields) == 0 || err != nil {
+		return ps, err
+	}
+	out := ps
+	for i, p := range ps {
+		isBytes, ok := fields[p.Name]
+		if !ok || !isEncrypted(p.Value) {
+			continue
+		}
+		_, plain, err := decryptValue(entityKey, p.Name, p.Value.([]byte))
+		if err != nil {
+			return nil, err
+		}
+		if &out[0] == &ps[0] {
+			out = slices.Clone(ps)
+		}
+		if isBytes {
+			out[i].Value = plain
+		} else {
+			out[i].Value = string(plain)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,239 @@
+package entitystore
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+
+	"go.fujikura.biz/entitystore/keyprovider"
+)
+
+func withKeyProvider(t *testing.T, kp keyprovider.KeyProvider) {
+	old := keyProvider
+	keyProvider = kp
+	t.Cleanup(func() { keyProvider = old })
+}
+
+func propertyOf(ps []datastore.Property, name string) datastore.Property {
+	for _, p := range ps {
+		if p.Name == name {
+			return p
+		}
+	}
+	return datastore.Property{}
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	withKeyProvider(t, &keyprovider.Static{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}})
+
+	src := &EncryptionTestEntity{Id: 1, Email: "user@example.com", Secret: []byte("secret"), Value: "plain"}
+	ps, err := saveStruct(src)
+	require.NoError(t, err)
+
+	email := propertyOf(ps, "Email")
+	require.True(t, email.NoIndex)
+	require.True(t, isEncrypted(email.Value))
+	require.NotContains(t, string(email.Value.([]byte)), "user@example.com")
+	require.True(t, isEncrypted(propertyOf(ps, "secret").Value))
+	require.Equal(t, "plain", propertyOf(ps, "Value").Value)
+
+	dst := &EncryptionTestEntity{}
+	require.NoError(t, loadStruct(src.Key(), ps, dst))
+	require.Equal(t, "user@example.com", dst.Email)
+	require.Equal(t, []byte("secret"), dst.Secret)
+	// ロード元のプロパティは変更しない
+	require.True(t, isEncrypted(propertyOf(ps, "Email").Value))
+}
+
+func TestEncryption_KeyRotation(t *testing.T) {
+	keys := map[string][]byte{"k1": make([]byte, 32), "k2": []byte("0123456789abcdef")}
+	withKeyProvider(t, &keyprovider.Static{Current: "k1", Keys: keys})
+	ctx := context.Background()
+	key := datastore.NameKey("EncryptionTestEntity", "1", nil)
+	ps, err := saveStruct(&EncryptionTestEntity{Id: 1, Email: "user@example.com"})
+	require.NoError(t, err)
+
+	// 古い鍵で暗号化したプロパティも復号できる
+	keyProvider = &keyprovider.Static{Current: "k2", Keys: keys}
+	e := &EncryptionTestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, e))
+	require.Equal(t, "user@example.com", e.Email)
+
+	// 保存し直すと現在の鍵で暗号化される
+	next, err := saveStruct(e)
+	require.NoError(t, err)
+	id, _, err := decryptValue(key, "Email", propertyOf(next, "Email").Value.([]byte))
+	require.NoError(t, err)
+	require.Equal(t, "k2", id)
+	unchanged, err := isUnchanged(e)
+	require.NoError(t, err)
+	require.False(t, unchanged)
+
+	// 鍵が無い場合はエラー
+	keyProvider = &keyprovider.Static{Current: "k2", Keys: map[string][]byte{"k2": keys["k2"]}}
+	require.ErrorIs(t, loadStruct(key, ps, &EncryptionTestEntity{}), keyprovider.ErrKeyNotFound)
+}
+
+func TestEncryption_Unchanged(t *testing.T) {
+	withKeyProvider(t, &keyprovider.Static{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}})
+	ctx := context.Background()
+	key := datastore.NameKey("EncryptionTestEntity", "1", nil)
+	ps, err := saveStruct(&EncryptionTestEntity{Id: 1, Email: "user@example.com"})
+	require.NoError(t, err)
+
+	e := &EncryptionTestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, e))
+	// 変更していないプロパティはロード時の暗号文をそのまま使用する
+	unchanged, err := isUnchanged(e)
+	require.NoError(t, err)
+	require.True(t, unchanged)
+	next, err := saveStruct(e)
+	require.NoError(t, err)
+	require.Empty(t, diffProperties(ps, next))
+
+	e.Email = "other@example.com"
+	unchanged, err = isUnchanged(e)
+	require.NoError(t, err)
+	require.False(t, unchanged)
+}
+
+func TestEncryption_Tampered(t *testing.T) {
+	withKeyProvider(t, &keyprovider.Static{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}})
+	key := datastore.NameKey("EncryptionTestEntity", "1", nil)
+	ps, err := saveStruct(&EncryptionTestEntity{Id: 1, Email: "user@example.com"})
+	require.NoError(t, err)
+	for i := range ps {
+		if ps[i].Name == "Email" {
+			b := ps[i].Value.([]byte)
+			b[len(b)-1] ^= 1
+		}
+	}
+	require.Error(t, loadStruct(key, ps, &EncryptionTestEntity{}))
+
+	// 別のプロパティの暗号文に置き換えた場合も復号できない
+	ps, err = saveStruct(&EncryptionTestEntity{Id: 1, Email: "user@example.com", Secret: []byte("secret")})
+	require.NoError(t, err)
+	secret := propertyOf(ps, "secret").Value
+	for i := range ps {
+		if ps[i].Name == "Email" {
+			ps[i].Value = secret
+		}
+	}
+	require.Error(t, loadStruct(key, ps, &EncryptionTestEntity{}))
+
+	// 別のエンティティにコピーした暗号文も復号できない
+	ps, err = saveStruct(&EncryptionTestEntity{Id: 1, Email: "user@example.com"})
+	require.NoError(t, err)
+	require.NoError(t, loadStruct(key, ps, &EncryptionTestEntity{}))
+	require.Error(t, loadStruct(datastore.NameKey("EncryptionTestEntity", "2", nil), ps, &EncryptionTestEntity{}))
+	require.Error(t, loadStruct(nil, ps, &EncryptionTestEntity{}))
+
+	// キーが無い場合は暗号化できない
+	_, _, err = saveStructBlobs(datastore.IncompleteKey("EncryptionTestEntity", nil), &EncryptionTestEntity{Email: "user@example.com"})
+	require.Error(t, err)
+}
+
+func TestEncryption_Legacy(t *testing.T) {
+	k1 := make([]byte, 32)
+	withKeyProvider(t, &keyprovider.Static{Current: "k1", Keys: map[string][]byte{"k1": k1}})
+	ctx := context.Background()
+	key := datastore.NameKey("EncryptionTestEntity", "1", nil)
+
+	// プロパティ名だけを追加データとした以前の形式の暗号文
+	gcm, err := newGCM(k1)
+	require.NoError(t, err)
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := append(append(append([]byte{}, legacyEncryptedMagic...), 2), "k1"...)
+	legacy = gcm.Seal(append(legacy, nonce...), nonce, []byte("user@example.com"), []byte("Email"))
+	ps := []datastore.Property{
+		{Name: "Id", Value: int64(1)},
+		{Name: "Email", Value: legacy, NoIndex: true},
+	}
+	e := &EncryptionTestEntity{}
+	require.NoError(t, loadEntity(ctx, key, ps, e))
+	require.Equal(t, "user@example.com", e.Email)
+
+	// 保存し直すと現在の形式で暗号化される
+	next, err := saveStruct(e)
+	require.NoError(t, err)
+	email := propertyOf(next, "Email").Value.([]byte)
+	require.True(t, bytes.HasPrefix(email, encryptedMagic))
+	_, plain, err := decryptValue(key, "Email", email)
+	require.NoError(t, err)
+	require.Equal(t, "user@example.com", string(plain))
+}
+
+func TestEncryption_Plaintext(t *testing.T) {
+	// 暗号化を有効にする前に保存されたプロパティはそのままロードする
+	ps := []datastore.Property{
+		{Name: "Id", Value: int64(1)},
+		{Name: "Email", Value: "user@example.com"},
+		{Name: "secret", Value: []byte("secret")},
+	}
+	e := &EncryptionTestEntity{}
+	require.NoError(t, loadStruct(nil, ps, e))
+	require.Equal(t, "user@example.com", e.Email)
+	require.Equal(t, []byte("secret"), e.Secret)
+
+	// KeyProvider が無い場合は保存できない
+	withKeyProvider(t, nil)
+	_, err := saveStruct(e)
+	require.Error(t, err)
+}
+
+func TestEncryptedFieldsOf_UnsupportedType(t *testing.T) {
+	type invalid struct {
+		Count int `entitystore:"encrypt"`
+	}
+	_, err := encryptedFieldsOf(reflect.TypeOf(invalid{}))
+	require.Error(t, err)
+}
+
+func TestEncryptedFieldsOf_Unique(t *testing.T) {
+	type invalid struct {
+		Email string `entitystore:"encrypt,unique"`
+	}
+	_, err := encryptedFieldsOf(reflect.TypeOf(invalid{}))
+	require.Error(t, err)
+}
+
+func TestEncryption_KindUnique(t *testing.T) {
+	withKeyProvider(t, &keyprovider.Static{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}})
+	RegisterKind("EncryptionTestEntity", KindOptions{Unique: [][]string{{"Value"}, {"Email"}}})
+	defer RegisterKind("EncryptionTestEntity", KindOptions{})
+	// KindOptions.Unique に指定したプロパティも暗号化できない
+	_, err := saveStruct(&EncryptionTestEntity{Id: 1, Email: "user@example.com"})
+	require.Error(t, err)
+}
+
+func TestEncryptedFieldsOf_Nested(t *testing.T) {
+	type secret struct {
+		Token string `entitystore:"encrypt"`
+	}
+	type nested struct {
+		Secret secret
+	}
+	type flattened struct {
+		Secret secret `datastore:",flatten"`
+	}
+	type slice struct {
+		Secrets []*secret
+	}
+	// 入れ子の構造体のフィールドは暗号化できないため、平文で保存せずにエラーにする
+	for _, v := range []any{nested{}, flattened{}, slice{}} {
+		_, err := encryptedFieldsOf(reflect.TypeOf(v))
+		require.Error(t, err)
+	}
+
+	// 埋め込んだ構造体のフィールドは暗号化できる
+	type embedded struct {
+		secret
+	}
+	fields, err := encryptedFieldsOf(reflect.TypeOf(embedded{}))
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"Token": false}, fields)
+}
@@ -38,3 +38,76 @@ func (e *EntityBase) PrePutAction(_ context.Context) error {
 	e.SchemaVersionColumn = e.CurrentSchemaVersion()
 	return nil
 }
+
+// VersionedEntityBase はバージョン番号による楽観的排他制御を行うための EntityBase です。
+// 保存のたびにバージョン番号を1つ増やします。
+// PutEntityIfUnchanged などの条件付き書き込みでは、UpdatedAt の代わりにこのバージョン番号を比較します。
+type VersionedEntityBase struct {
+	EntityBase
+	VersionColumn int64 `datastore:"Version"`
+}
+
+func (e *VersionedEntityBase) SetVersion(v int64) {
+	e.VersionColumn = v
+}
+
+func (e *VersionedEntityBase) Version() int64 {
+	return e.VersionColumn
+}
+
+func (e *VersionedEntityBase) PrePutAction(ctx context.Context) error {
+	err := e.EntityBase.PrePutAction(ctx)
+	if err != nil {
+		return err
+	}
+	e.VersionColumn++
+	return nil
+}
+
+// AuditedEntityBase は作成日時と、作成者・更新者を記録するための EntityBase です。
+// 作成者・更新者は WithActor で context.Context に設定したものが使用されます。
+// 作成日時と作成者は最初の保存時に記録され、以降の更新では保存されている値が維持されます。
+type AuditedEntityBase struct {
+	EntityBase
+	CreatedAtColumn time.Time `datastore:"CreatedAt"`
+	CreatedByColumn string    `datastore:"CreatedBy"`
+	UpdatedByColumn string    `datastore:"UpdatedBy"`
+}
+
+func (e *AuditedEntityBase) SetCreatedAt(t time.Time) {
+	e.CreatedAtColumn = t.Truncate(time.Microsecond)
+}
+
+func (e *AuditedEntityBase) CreatedAt() time.Time {
+	return e.CreatedAtColumn
+}
+
+func (e *AuditedEntityBase) SetCreatedBy(actor string) {
+	e.CreatedByColumn = actor
+}
+
+func (e *AuditedEntityBase) CreatedBy() string {
+	return e.CreatedByColumn
+}
+
+func (e *AuditedEntityBase) SetUpdatedBy(actor string) {
+	e.UpdatedByColumn = actor
+}
+
+func (e *AuditedEntityBase) UpdatedBy() string {
+	return e.UpdatedByColumn
+}
+
+func (e *AuditedEntityBase) PrePutAction(ctx context.Context) error {
+	err := e.EntityBase.PrePutAction(ctx)
+	if err != nil {
+		return err
+	}
+	actor := ActorFromContext(ctx)
+	e.UpdatedByColumn = actor
+	if e.CreatedAtColumn.IsZero() {
+		e.CreatedAtColumn = e.UpdatedAtColumn
+		e.CreatedByColumn = actor
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package entitystore
 
 import (
+	"context"
+	"reflect"
+	"runtime"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/datastore"
 	"github.com/stretchr/testify/require"
 )
 
@@ -43,3 +47,59 @@ func TestEntityBase_PrePutAction(t *testing.T) {
 	require.Equal(t, Now().Truncate(time.Microsecond), e.UpdatedAt())
 	require.Equal(t, 0, e.SchemaVersion())
 }
+
+func TestVersionedEntityBase_PrePutAction(t *testing.T) {
+	Now = func() time.Time {
+		return time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	}
+	e := &VersionedEntityBase{}
+	require.Equal(t, int64(0), e.Version())
+
+	err := e.PrePutAction(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), e.Version())
+	require.Equal(t, Now().Truncate(time.Microsecond), e.UpdatedAt())
+
+	err = e.PrePutAction(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), e.Version())
+}
+
+func TestAuditedEntityBase_PrePutAction(t *testing.T) {
+	Now = func() time.Time {
+		return time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	}
+	ctx := WithActor(context.Background(), "alice")
+	e := &AuditedEntityBase{}
+
+	err := e.PrePutAction(ctx)
+	require.NoError(t, err)
+	require.Equal(t, Now(), e.CreatedAt())
+	require.Equal(t, "alice", e.CreatedBy())
+	require.Equal(t, "alice", e.UpdatedBy())
+
+	// 2回目以降は作成日時と作成者を維持する
+	Now = func() time.Time {
+		return time.Date(2009, time.November, 11, 23, 0, 0, 0, time.UTC)
+	}
+	err = e.PrePutAction(WithActor(context.Background(), "bob"))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), e.CreatedAt())
+	require.Equal(t, Now(), e.UpdatedAt())
+	require.Equal(t, "alice", e.CreatedBy())
+	require.Equal(t, "bob", e.UpdatedBy())
+}
+
+func TestEntityBase_Comparable(t *testing.T) {
+	// ロード時のプロパティを保持しても EntityBase を埋め込んだ構造体は比較可能
+	require.True(t, reflect.TypeOf(TestEntity{}).Comparable())
+
+	e := &TestEntity{}
+	ps := []datastore.Property{{Name: "Value", Value: "Test1"}}
+	e.setLoadedSnapshot(ps)
+	require.Equal(t, ps, e.loadedSnapshot())
+	require.Nil(t, (&TestEntity{}).loadedSnapshot())
+	e.setLoadedSnapshot(nil)
+	require.Nil(t, e.loadedSnapshot())
+	runtime.KeepAlive(e)
+}
@@ -9,10 +9,13 @@ import (
 )
 
 // EntityLister はエンティティのリストの取得を容易にするためのインターフェースです。
+// ctx に ReadAt で読み取り時刻を指定した場合は、キャッシュを使用せずにその時刻のスナップショットから取得します。
+// 同じ読み取り時刻を指定すれば、カーソルで続きを取得する間にエンティティが更新されても一貫したリストを取得できます。
 type EntityLister[E Entity] interface {
 	WithFilter(f func(*datastore.Key) bool) EntityLister[E]
 	GetList(ctx context.Context, limit int, cur string) ([]E, string, error)
 	GetKeyList(ctx context.Context, limit int, cur string) ([]*datastore.Key, string, error)
+	GetKeyListTyped(ctx context.Context, limit int, cur string) ([]Key[E], string, error)
 }
 
 type entityLister[E Entity] struct {
@@ -43,7 +46,12 @@ func (l *entityLister[E]) WithFilter(f func(*datastore.Key) bool) EntityLister[E
 // 戻り値として、取得したエンティティのスライス、新しいカーソル文字列、エラーを返します。
 // カーソル文字列はリストに続きがある場合に新しい文字列が返され、
 // リストの終わりまで達した際には空文字列が返されます。
+// 期限切れのエンティティなど、取得時に存在しないものとして扱われたエンティティは結果から除外するため、
+// 続きがある場合でも limit より少ない数のエンティティを返すことがあります。
 func (l *entityLister[E]) GetList(ctx context.Context, limit int, cur string) ([]E, string, error) {
+	if err := l.q.Err(); err != nil {
+		return nil, "", err
+	}
 	q := l.q.KeysOnly()
 	if cur != "" {
 		cursor, err := datastore.DecodeCursor(cur)
@@ -52,6 +60,11 @@ func (l *entityLister[E]) GetList(ctx context.Context, limit int, cur string) ([
 		}
 		q = q.Start(cursor)
 	}
+	q, tx, err := snapshotQuery(ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+	defer endSnapshot(tx)
 	itr := client.Run(ctx, q)
 	var keys []*datastore.Key
 	var ents []E
@@ -88,7 +101,7 @@ func (l *entityLister[E]) GetList(ctx context.Context, limit int, cur string) ([
 	}
 	// エンティティ取得
 	anys := toAnySlice(ents)
-	err := GetMulti(ctx, keys, anys)
+	ents, err = excludeMissing(ents, GetMulti(withIncludeDeleted(ctx, l.q), keys, anys))
 	if err != nil {
 		return nil, "", err
 	}
@@ -97,7 +110,11 @@ func (l *entityLister[E]) GetList(ctx context.Context, limit int, cur string) ([
 
 // GetKeyList はエンティティのキーのリストを取得します。
 // キーのリストを返すこと以外は EntityLister.GetList と同様に動作します。
+// エンティティを取得しないため、期限切れのエンティティのキーも含まれます。
 func (l *entityLister[E]) GetKeyList(ctx context.Context, limit int, cur string) ([]*datastore.Key, string, error) {
+	if err := l.q.Err(); err != nil {
+		return nil, "", err
+	}
 	q := l.q.KeysOnly()
 	if cur != "" {
 		cursor, err := datastore.DecodeCursor(cur)
@@ -106,6 +123,11 @@ func (l *entityLister[E]) GetKeyList(ctx context.Context, limit int, cur string)
 		}
 		q = q.Start(cursor)
 	}
+	q, tx, err := snapshotQuery(ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+	defer endSnapshot(tx)
 	itr := client.Run(ctx, q)
 	var keys []*datastore.Key
 	// キーの取得
@@ -138,3 +160,17 @@ func (l *entityLister[E]) GetKeyList(ctx context.Context, limit int, cur string)
 	return keys, newCur, nil
 
 }
+
+// GetKeyListTyped はエンティティの Key のリストを取得します。
+// 型付きの Key を返すこと以外は EntityLister.GetKeyList と同様に動作します。
+func (l *entityLister[E]) GetKeyListTyped(ctx context.Context, limit int, cur string) ([]Key[E], string, error) {
+	keys, newCur, err := l.GetKeyList(ctx, limit, cur)
+	if err != nil {
+		return nil, "", err
+	}
+	tkeys, err := ToKeys[E](keys)
+	if err != nil {
+		return nil, "", err
+	}
+	return tkeys, newCur, nil
+}
@@ -37,14 +37,9 @@ func Client() DatastoreClient {
 
 // EntityToProperties はエンティティをdatastoreのプロパティスライスに変換します。
 // 変換時にエラーが発生した場合はパニックを起こします。
+// BlobStore に保存する大きな値は参照に置き換えますが、BlobStore への保存は行いません。
 func EntityToProperties(e any) []datastore.Property {
-	var ps []datastore.Property
-	var err error
-	if ls, ok := e.(datastore.PropertyLoadSaver); ok {
-		ps, err = ls.Save()
-	} else {
-		ps, err = datastore.SaveStruct(e)
-	}
+	ps, err := saveStruct(e)
 	if err != nil {
 		panic(err)
 	}
@@ -54,16 +49,99 @@ func EntityToProperties(e any) []datastore.Property {
 // LoadStruct はdatastoreのプロパティスライスをエンティティにロードします。
 // datastore.PropertyLoadSaver を実装している場合はそのエンティティに実装されているLoadメソッドを使用し、
 // そうでない場合はdatastore.LoadStructを使用します。
+// 構造体タグ `entitystore:"blob"` のフィールドの BlobStore への参照は取得しないため、Get などで取得してください。
+// 構造体タグ `entitystore:"encrypt"` のフィールドはキーが分からないため復号できません。Get などで取得してください。
 func LoadStruct(ps []datastore.Property, e any) {
+	err := loadStruct(nil, ps, e)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// saveStruct は EntityToProperties のエラーを返す版です。
+// Ref のフィールドは参照先のキーとして保存し、構造体タグ `entitystore:"encrypt"` のフィールドは暗号化します。
+func saveStruct(e any) ([]datastore.Property, error) {
+	ps, _, err := saveStructBlobs(nil, e)
+	return ps, err
+}
+
+// saveStructBlobs は saveStruct と同様にプロパティを作成し、BlobStore への参照に置き換えた値も返します。
+// Blob の名前と暗号化の追加データには key を使用し、key が nil の場合はエンティティの Key を使用します。
+func saveStructBlobs(key *datastore.Key, e any) ([]datastore.Property, map[string][]byte, error) {
+	if ent, ok := e.(Entity); ok && key == nil {
+		key = ent.Key()
+	}
+	ps, err := savePlainStruct(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := encryptProperties(key, e, ps); err != nil {
+		return nil, nil, err
+	}
+	blobs, err := offloadBlobs(key, e, ps)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ps, blobs, nil
+}
+
+// savePlainStruct は暗号化と BlobStore への参照の置き換えを行う前のプロパティを作成します。
+// Ref のフィールドは参照先のキーとして保存します。
+func savePlainStruct(e any) ([]datastore.Property, error) {
+	var ps []datastore.Property
 	var err error
 	if ls, ok := e.(datastore.PropertyLoadSaver); ok {
-		err = ls.Load(ps)
+		ps, err = ls.Save()
 	} else {
-		err = datastore.LoadStruct(e, ps)
+		ps, err = datastore.SaveStruct(e)
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	unwrapRefs(ps)
+	return ps, nil
+}
+
+// loadStruct は LoadStruct のエラーを返す版です。
+// 暗号化されたプロパティは key を追加データとして復号してからロードします。
+func loadStruct(key *datastore.Key, ps []datastore.Property, e any) error {
+	ps, err := decryptProperties(key, e, ps)
+	if err != nil {
+		return err
 	}
+	if ls, ok := e.(datastore.PropertyLoadSaver); ok {
+		return ls.Load(ps)
+	}
+	return datastore.LoadStruct(e, ps)
+}
+
+// loadEntity はキャッシュまたはDatastoreから取得したプロパティをエンティティにロードします。
+// Get と GetMulti から呼び出され、スキーマの移行やロード後のフックなど、ロード時に必要な処理をまとめて行います。
+// 論理削除されたエンティティや期限切れのエンティティの場合は datastore.ErrNoSuchEntity を返します。
+func loadEntity(ctx context.Context, key *datastore.Key, ps []datastore.Property, dst any) error {
+	if (isSoftDeleted(key.Kind, ps) && !includesDeleted(ctx)) || isExpired(key.Kind, ps) {
+		return datastore.ErrNoSuchEntity
+	}
+	loaded, err := loadBlobs(ctx, dst, ps)
+	if err != nil {
+		return err
+	}
+	if e, ok := dst.(Entity); ok {
+		err = migrateEntity(ctx, key, loaded, e)
+	} else {
+		err = loadStruct(key, loaded, dst)
+	}
+	if err != nil {
+		return err
+	}
+	if ks, ok := dst.(KeySetter); ok {
+		ks.SetKey(key)
+	} else if _, ok := dst.(keyTagged); ok {
+		// キーの Kind が異なるなど、設定できない場合は何もしない
+		_ = ApplyKey(dst, key)
+	}
+	takeSnapshot(ctx, ps, dst)
+	return runPostLoad(ctx, key, dst)
 }
 
 // IsProblem はエラーが問題が発生していることを示しているかどうかを判定します。
@@ -131,6 +209,9 @@ func Initialize(ctx context.Context, projectId string, conf Config) {
 		}
 		client = NewClient(cl)
 	}
+	if conf.Retry.enabled() {
+		client = NewRetryingClient(client, conf.Retry)
+	}
 
 	if conf.Cachestore == nil {
 		cache = cachestore.Nostore{}
@@ -142,30 +223,33 @@ func Initialize(ctx context.Context, projectId string, conf Config) {
 	} else {
 		logger = conf.Logger
 	}
+	skipUnchanged = conf.SkipUnchanged
+	if conf.Parallelism > 0 {
+		parallelism = conf.Parallelism
+	} else {
+		parallelism = DefaultParallelism
+	}
+	recordQueries = conf.RecordQueries
+	keyProvider = conf.KeyProvider
+	blobStore = conf.BlobStore
+	if conf.BlobThreshold == 0 {
+		blobThreshold = DefaultBlobThreshold
+	} else {
+		blobThreshold = conf.BlobThreshold
+	}
 }
 
 // DeleteAll は指定された Kind のすべてのエンティティを削除します。
+// 論理削除されたエンティティも消去します。
 func DeleteAll(ctx context.Context, kind string) error {
 	// クエリで対象の Kind のすべてのキーを取得
-	query := NewQuery(kind).KeysOnly()
+	query := NewQuery(kind).IncludeDeleted().KeysOnly()
 	keys, err := client.GetAll(ctx, query, nil)
 	if err != nil {
 		return err
 	}
-	// Datastore API の制限により、最大500件ずつ削除
-	const batchSize = 500
-	for i := 0; i < len(keys); i += batchSize {
-		end := i + batchSize
-		if end > len(keys) {
-			end = len(keys)
-		}
-
-		if err := client.DeleteMulti(ctx, keys[i:end]); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	// Datastore API の制限により、最大500件ずつ並行して削除
+	return deleteKeys(ctx, keys)
 }
 
 // GetEntity は単一のエンティティを取得します。
@@ -187,38 +271,32 @@ func GetEntityMulti[E Entity](ctx context.Context, es []E) error {
 }
 
 // PutEntity は単一のエンティティを保存します。
-// 保存後、キャッシュを削除します。
+// 保存前に PrePutAction を呼び出し、保存後、キャッシュを削除します。
+// e.Key() が不完全なキーを返す場合は ID を割り当て、KeySetter または `entitystore:"id"` タグのフィールドに書き戻します。
 func PutEntity[E Entity](ctx context.Context, e E) error {
-	err := e.PrePutAction(ctx)
-	if err != nil {
-		return err
-	}
 	return Put(ctx, e.Key(), e)
 }
 
 // PutEntityMulti は複数のエンティティを一括保存します。
-// 保存後、キャッシュを削除します。
+// 保存前に各エンティティの PrePutAction を呼び出し、保存後、キャッシュを削除します。
+// 不完全なキーのエンティティには ID をまとめて割り当てます。
+// 1回のコミットの上限を超える場合は、PutMulti と同様にバッチに分割して並行して書き込むため、一部のエンティティだけが保存されることがあります。
 func PutEntityMulti[E Entity](ctx context.Context, es []E) error {
-	var keys []*datastore.Key
-	for _, e := range es {
-		err := e.PrePutAction(ctx)
-		if err != nil {
-			return err
-		}
-		keys = append(keys, e.Key())
-	}
-	return PutMulti(ctx, keys, es)
+	return write(ctx, lo.Map(es, func(e E, _ int) *writeOp {
+		return &writeOp{typ: MutationTypeUpsert, key: e.Key(), src: e}
+	}))
 }
 
 // DeleteEntity は単一のエンティティをDatastoreとキャッシュから削除します。
 func DeleteEntity[E Entity](ctx context.Context, e E) error {
-	return Delete(ctx, e.Key())
+	return write(ctx, []*writeOp{{typ: MutationTypeDelete, key: e.Key(), src: e}})
 }
 
 // DeleteEntityMulti は複数のエンティティをDatastoreとキャッシュから一括削除します。
+// 1回のコミットの上限を超える場合は、PutMulti と同様にバッチに分割して並行して削除します。
 func DeleteEntityMulti[E Entity](ctx context.Context, es []E) error {
-	return DeleteMulti(ctx, lo.Map(es, func(e E, _ int) *datastore.Key {
-		return e.Key()
+	return write(ctx, lo.Map(es, func(e E, _ int) *writeOp {
+		return &writeOp{typ: MutationTypeDelete, key: e.Key(), src: e}
 	}))
 }
 
@@ -227,8 +305,10 @@ func DeleteEntityMulti[E Entity](ctx context.Context, es []E) error {
 // キャッシュに存在するエンティティはキャッシュから取得し、存在しないエンティティはDatastoreから取得します。
 // 取得後、Datastoreから取得したエンティティはキャッシュに保存します。
 // クエリやキーはキャッシュしません。毎回Datastoreに問い合わせ、エンティティの取得のみキャッシュを利用します。
+// 期限切れのエンティティなど、取得時に存在しないものとして扱われたエンティティは結果から除外します。
+// ctx に ReadAt で読み取り時刻を指定した場合は、キャッシュを使用せずにその時刻のスナップショットから取得します。
 func GetEntityAll[E Entity](ctx context.Context, q Query, dst *[]E) error {
-	keys, err := client.GetAll(ctx, q.KeysOnly(), nil)
+	keys, err := GetKeyAll(ctx, q)
 	if err != nil {
 		return err
 	}
@@ -242,13 +322,22 @@ func GetEntityAll[E Entity](ctx context.Context, q Query, dst *[]E) error {
 		(*dst)[i] = constructor()
 	}
 	anys := toAnySlice(*dst)
-	return GetMulti(ctx, keys, anys)
+	*dst, err = excludeMissing(*dst, GetMulti(withIncludeDeleted(ctx, q), keys, anys))
+	return err
 }
 
 // GetEntityFirst はクエリにマッチする最初のエンティティを取得します。
 // 最初のエンティティのみを取得すること以外は GetEntityAll と同様に動作します。
 func GetEntityFirst[E Entity](ctx context.Context, q Query, dst E) error {
-	q = q.KeysOnly()
+	if err := q.Err(); err != nil {
+		return err
+	}
+	ctx = withIncludeDeleted(ctx, q)
+	q, tx, err := snapshotQuery(ctx, q.KeysOnly())
+	if err != nil {
+		return err
+	}
+	defer endSnapshot(tx)
 	it := client.Run(ctx, q.Limit(1))
 	key, err := it.Next(nil)
 	if err != nil {
@@ -258,13 +347,20 @@ func GetEntityFirst[E Entity](ctx context.Context, q Query, dst E) error {
 }
 
 // GetKeyAll はクエリにマッチするすべてのキーを取得します。
+// ctx に ReadAt で読み取り時刻を指定した場合は、その時刻のスナップショットから取得します。
 func GetKeyAll(ctx context.Context, q Query) ([]*datastore.Key, error) {
-	return client.GetAll(ctx, q.KeysOnly(), nil)
+	q, tx, err := snapshotQuery(ctx, q.KeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer endSnapshot(tx)
+	return client.GetAll(ctx, q, nil)
 }
 
 // GetKeyFirst はクエリにマッチする最初のキーを取得します。マッチするキーがない場合は datastore.ErrNoSuchEntity を返します。
+// ctx に ReadAt で読み取り時刻を指定した場合は、その時刻のスナップショットから取得します。
 func GetKeyFirst(ctx context.Context, q Query) (*datastore.Key, error) {
-	keys, err := client.GetAll(ctx, q.KeysOnly().Limit(1), nil)
+	keys, err := GetKeyAll(ctx, q.Limit(1))
 	if err != nil {
 		return nil, err
 	}
@@ -283,7 +379,7 @@ func DeleteCacheByEntities[E Entity](ctx context.Context, es []E) error {
 	cacheKeys := lo.Map(es, func(e E, _ int) datastore.Key {
 		return *e.Key()
 	})
-	return cache.DeleteEntities(ctx, cacheKeys)
+	return cacheDeleteEntities(ctx, cacheKeys)
 }
 
 // DeleteCacheByKeys はキーを元にキャッシュからエンティティを削除します。
@@ -295,7 +391,7 @@ func DeleteCacheByKeys(ctx context.Context, keys []*datastore.Key) error {
 	cacheKeys := lo.Map(keys, func(key *datastore.Key, _ int) datastore.Key {
 		return *key
 	})
-	return cache.DeleteEntities(ctx, cacheKeys)
+	return cacheDeleteEntities(ctx, cacheKeys)
 }
 
 // toAnySlice は任意の型のスライスを any 型のスライスに変換します。
@@ -328,7 +424,7 @@ func RemoveEntityCaches[E Entity](ctx context.Context, es []E) {
 }
 
 func RemoveCaches(ctx context.Context, keys []datastore.Key) {
-	err := cache.DeleteEntities(ctx, keys)
+	err := cacheDeleteEntities(ctx, keys)
 	if err != nil {
 		logger.Warn("failed to remove cache", slog.String("error", err.Error()))
 	}
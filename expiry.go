@@ -0,0 +1,243 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// expiresAtProperty は有効期限を保存するプロパティ名です。
+const expiresAtProperty = "ExpiresAt"
+
+// Expirable は有効期限を持つエンティティのインターフェースです。
+// ExpiryBase を埋め込むことで実装できます。
+type Expirable interface {
+	ExpiresAt() time.Time
+	SetExpiresAt(t time.Time)
+}
+
+// ExpiryBase は有効期限を保持するための構造体です。
+// EntityBase などと一緒に埋め込んで使用します。
+// 有効期限を有効にするには、RegisterKind で KindOptions.Expiry を設定します。
+type ExpiryBase struct {
+	ExpiresAtColumn time.Time `datastore:"ExpiresAt"`
+}
+
+func (e *ExpiryBase) ExpiresAt() time.Time {
+	return e.ExpiresAtColumn
+}
+
+func (e *ExpiryBase) SetExpiresAt(t time.Time) {
+	e.ExpiresAtColumn = t.Truncate(time.Microsecond)
+}
+
+// IsExpired は有効期限を過ぎているかどうかを返します。
+func (e *ExpiryBase) IsExpired() bool {
+	return !e.ExpiresAtColumn.IsZero() && !Now().Before(e.ExpiresAtColumn)
+}
+
+// expiresAt はプロパティから Kind の設定に従って有効期限を求めます。有効期限が無い場合はゼロ値を返します。
+func expiresAt(kind string, ps []datastore.Property) time.Time {
+	opts := optionsOf(kind)
+	if !opts.Expiry && opts.TTL <= 0 {
+		return time.Time{}
+	}
+	var t time.Time
+	for _, p := range ps {
+		v, ok := p.Value.(time.Time)
+		if !ok || v.IsZero() {
+			continue
+		}
+		switch {
+		case opts.Expiry && p.Name == expiresAtProperty:
+		case opts.TTL > 0 && p.Name == updatedAtProperty:
+			v = v.Add(opts.TTL)
+		default:
+			continue
+		}
+		if t.IsZero() || v.Before(t) {
+			t = v
+		}
+	}
+	return t
+}
+
+// isExpired はプロパティが期限切れのエンティティのものかどうかを返します。
+func isExpired(kind string, ps []datastore.Property) bool {
+	t := expiresAt(kind, ps)
+	return !t.IsZero() && !Now().Before(t)
+}
+
+// excludeMissing は GetMulti の結果から存在しないエンティティを除外します。
+// 期限切れになったエンティティなど、クエリの実行後に存在しないものとして扱われたエンティティは結果に含めません。
+// 他のエラーがある場合は、除外した後の位置に合わせた MultiError を返します。
+func excludeMissing[E any](es []E, err error) ([]E, error) {
+	var merr datastore.MultiError
+	if err == nil || !errors.As(err, &merr) || len(merr) != len(es) {
+		return es, err
+	}
+	out := es[:0]
+	rest := make(datastore.MultiError, 0, len(es))
+	problem := false
+	for i, e := range es {
+		if errors.Is(merr[i], datastore.ErrNoSuchEntity) {
+			continue
+		}
+		out = append(out, e)
+		rest = append(rest, merr[i])
+		problem = problem || merr[i] != nil
+	}
+	if problem {
+		return out, rest
+	}
+	return out, nil
+}
+
+// SweepProgress は ExpirySweeper の進捗です。
+type SweepProgress struct {
+	// Kind は削除している Kind です。
+	Kind string
+	// Batches は実行したバッチの数です。
+	Batches int
+	// Deleted は削除したエンティティの合計数です。
+	Deleted int
+	// LastBatch は直前のバッチで削除したエンティティの数です。
+	LastBatch int
+}
+
+// ExpirySweeper は期限切れのエンティティを Datastore から削除するためのインターフェースです。
+// 期限切れのエンティティをキーのみのクエリで検索し、バッチごとに PurgeMulti で削除します。
+// 論理削除が有効な Kind でも論理削除せずに消去し、論理削除済みの期限切れのエンティティも消去します。
+// PurgeMulti と同様に削除前後のフックを呼び出し、キャッシュを削除します。
+// KindOptions.Expiry の場合は ExpiresAt、KindOptions.TTL の場合は UpdatedAt の単一プロパティのインデックスを使用します。
+type ExpirySweeper interface {
+	WithBatchSize(n int) ExpirySweeper
+	WithBatchInterval(d time.Duration) ExpirySweeper
+	WithProgress(f func(SweepProgress)) ExpirySweeper
+	RunBatch(ctx context.Context) (deleted int, done bool, err error)
+	Run(ctx context.Context) (int, error)
+}
+
+type expirySweeper struct {
+	kind          string
+	batchSize     int
+	batchInterval time.Duration
+	progress      func(SweepProgress)
+}
+
+// NewExpirySweeper コンストラクタ
+// kind は RegisterKind で KindOptions.Expiry または KindOptions.TTL を設定している必要があります。
+func NewExpirySweeper(kind string) ExpirySweeper {
+	return &expirySweeper{
+		kind:          kind,
+		batchSize:     500,
+		batchInterval: time.Second,
+	}
+}
+
+// WithBatchSize は1回の PurgeMulti で削除するエンティティの最大数を設定します。
+// デフォルトは500件です。
+func (s *expirySweeper) WithBatchSize(n int) ExpirySweeper {
+	s.batchSize = max(n, 1)
+	return s
+}
+
+// WithBatchInterval は Run でバッチの間に空ける待ち時間を設定します。
+// 書き込みの負荷を抑えるために使用します。デフォルトは1秒です。
+func (s *expirySweeper) WithBatchInterval(d time.Duration) ExpirySweeper {
+	s.batchInterval = d
+	return s
+}
+
+// WithProgress は Run でバッチごとに呼び出す進捗の通知先を設定します。
+func (s *expirySweeper) WithProgress(f func(SweepProgress)) ExpirySweeper {
+	s.progress = f
+	return s
+}
+
+// expiredQueries は期限切れのエンティティのキーを検索するクエリを返します。
+func (s *expirySweeper) expiredQueries(now time.Time) ([]Query, error) {
+	opts := optionsOf(s.kind)
+	var qs []Query
+	if opts.Expiry {
+		qs = append(qs, NewQuery(s.kind).IncludeDeleted().KeysOnly().
+			FilterField(expiresAtProperty, ">", time.Time{}).
+			FilterField(expiresAtProperty, "<=", now))
+	}
+	if opts.TTL > 0 {
+		qs = append(qs, NewQuery(s.kind).IncludeDeleted().KeysOnly().
+			FilterField(updatedAtProperty, "<=", now.Add(-opts.TTL)))
+	}
+	if len(qs) == 0 {
+		return nil, fmt.Errorf("entitystore: kind %s has no expiry", s.kind)
+	}
+	return qs, nil
+}
+
+// RunBatch は期限切れのエンティティを1バッチ分削除します。
+// 戻り値として、削除したエンティティの数と、期限切れのエンティティをすべて削除したかどうかを返します。
+func (s *expirySweeper) RunBatch(ctx context.Context) (int, bool, error) {
+	qs, err := s.expiredQueries(Now())
+	if err != nil {
+		return 0, false, err
+	}
+	var keys []*datastore.Key
+	// 親のキーはポインタで比較されるため、エンコードしたキーで重複を除く
+	seen := map[string]bool{}
+	for _, q := range qs {
+		itr := client.Run(ctx, q.Limit(s.batchSize))
+		for len(keys) < s.batchSize {
+			key, err := itr.Next(nil)
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return 0, false, err
+			}
+			if !seen[key.Encode()] {
+				seen[key.Encode()] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return 0, true, nil
+	}
+	if err := PurgeMulti(ctx, keys); err != nil {
+		return 0, false, err
+	}
+	return len(keys), len(keys) < s.batchSize, nil
+}
+
+// Run は期限切れのエンティティをすべて削除するまでバッチを繰り返し、削除したエンティティの数を返します。
+// バッチの間には WithBatchInterval で設定した時間を空けます。
+// ctx がキャンセルされた場合は、それまでに削除した数と ctx のエラーを返します。
+func (s *expirySweeper) Run(ctx context.Context) (int, error) {
+	p := SweepProgress{Kind: s.kind}
+	for {
+		n, done, err := s.RunBatch(ctx)
+		if err != nil {
+			return p.Deleted, err
+		}
+		if n > 0 {
+			p.Batches++
+			p.Deleted += n
+			p.LastBatch = n
+			if s.progress != nil {
+				s.progress(p)
+			}
+		}
+		if done {
+			return p.Deleted, nil
+		}
+		select {
+		case <-ctx.Done():
+			return p.Deleted, ctx.Err()
+		case <-time.After(s.batchInterval):
+		}
+	}
+}
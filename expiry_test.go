@@ -0,0 +1,141 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return now }
+	t.Cleanup(func() { Now = time.Now })
+	ps := []datastore.Property{
+		{Name: "UpdatedAt", Value: now.Add(-2 * time.Hour)},
+		{Name: "ExpiresAt", Value: now.Add(time.Hour)},
+	}
+
+	RegisterKind("ExpiryTestEntity", KindOptions{})
+	require.True(t, expiresAt("ExpiryTestEntity", ps).IsZero())
+	require.False(t, isExpired("ExpiryTestEntity", ps))
+
+	RegisterKind("ExpiryTestEntity", KindOptions{Expiry: true})
+	require.Equal(t, now.Add(time.Hour), expiresAt("ExpiryTestEntity", ps))
+	require.False(t, isExpired("ExpiryTestEntity", ps))
+
+	// TTL と両方を指定した場合は先に来る方
+	RegisterKind("ExpiryTestEntity", KindOptions{Expiry: true, TTL: time.Hour})
+	require.Equal(t, now.Add(-time.Hour), expiresAt("ExpiryTestEntity", ps))
+	require.True(t, isExpired("ExpiryTestEntity", ps))
+
+	// ExpiresAt がゼロ値の場合は期限切れにならない
+	RegisterKind("ExpiryTestEntity", KindOptions{Expiry: true})
+	ps = setProperty(ps, "ExpiresAt", time.Time{})
+	require.False(t, isExpired("ExpiryTestEntity", ps))
+	ps = setProperty(ps, "ExpiresAt", now)
+	require.True(t, isExpired("ExpiryTestEntity", ps))
+	RegisterKind("ExpiryTestEntity", KindOptions{})
+}
+
+func TestLoadEntity_期限切れ(t *testing.T) {
+	ctx := context.Background()
+	RegisterKind("ExpiryTestEntity", KindOptions{Expiry: true})
+	defer RegisterKind("ExpiryTestEntity", KindOptions{})
+	key := datastore.NameKey("ExpiryTestEntity", "1", nil)
+	e := &ExpiryTestEntity{Id: 1}
+	e.SetExpiresAt(Now().Add(time.Hour))
+	ps, err := saveStruct(e)
+	require.NoError(t, err)
+	require.NoError(t, loadEntity(ctx, key, ps, &ExpiryTestEntity{}))
+
+	e.SetExpiresAt(Now().Add(-time.Hour))
+	require.True(t, e.IsExpired())
+	ps, err = saveStruct(e)
+	require.NoError(t, err)
+	require.Equal(t, datastore.ErrNoSuchEntity, loadEntity(ctx, key, ps, &ExpiryTestEntity{}))
+}
+
+func TestExcludeMissing(t *testing.T) {
+	es, err := excludeMissing([]int{1, 2, 3}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, es)
+
+	es, err = excludeMissing([]int{1, 2, 3}, datastore.MultiError{nil, datastore.ErrNoSuchEntity, nil})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, es)
+
+	// 他のエラーは除外した後の位置で返す
+	other := errors.New("other")
+	es, err = excludeMissing([]int{1, 2, 3}, datastore.MultiError{datastore.ErrNoSuchEntity, nil, other})
+	require.Equal(t, []int{2, 3}, es)
+	require.Equal(t, datastore.MultiError{nil, other}, err)
+}
+
+func TestExpirySweeper_IncludesDeleted(t *testing.T) {
+	RegisterKind("ExpiryTestEntity", KindOptions{Expiry: true, SoftDelete: true, TTL: time.Hour})
+	defer RegisterKind("ExpiryTestEntity", KindOptions{})
+
+	// 論理削除済みのエンティティも消去の対象にする
+	qs, err := NewExpirySweeper("ExpiryTestEntity").(*expirySweeper).expiredQueries(Now())
+	require.NoError(t, err)
+	require.Len(t, qs, 2)
+	for _, q := range qs {
+		iq, ok := asQuery(q)
+		require.True(t, ok)
+		require.True(t, iq.includeDeleted)
+	}
+}
+
+func TestExpirySweeper(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	RegisterKind("ExpiryTestEntity", KindOptions{Expiry: true})
+	defer RegisterKind("ExpiryTestEntity", KindOptions{})
+	err := DeleteAll(ctx, "ExpiryTestEntity")
+	require.NoError(t, err)
+
+	var es []*ExpiryTestEntity
+	for i := 1; i <= 5; i++ {
+		e := &ExpiryTestEntity{Id: i}
+		if i <= 3 {
+			e.SetExpiresAt(Now().Add(-time.Hour))
+		} else if i == 4 {
+			e.SetExpiresAt(Now().Add(time.Hour))
+		}
+		es = append(es, e)
+	}
+	require.NoError(t, PutEntityMulti(ctx, es))
+
+	// 期限切れのエンティティは取得できず、GetEntityAll の結果から除外される
+	require.Equal(t, datastore.ErrNoSuchEntity, GetEntity(ctx, &ExpiryTestEntity{Id: 1}))
+	var all []*ExpiryTestEntity
+	require.NoError(t, GetEntityAll(ctx, NewQuery("ExpiryTestEntity"), &all))
+	require.Len(t, all, 2)
+	list, _, err := NewEntityLister(NewQuery("ExpiryTestEntity"), &ExpiryTestEntity{}).GetList(ctx, 10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	var progress []SweepProgress
+	deleted, err := NewExpirySweeper("ExpiryTestEntity").
+		WithBatchSize(2).
+		WithBatchInterval(0).
+		WithProgress(func(p SweepProgress) { progress = append(progress, p) }).
+		Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, deleted)
+	require.Equal(t, []SweepProgress{
+		{Kind: "ExpiryTestEntity", Batches: 1, Deleted: 2, LastBatch: 2},
+		{Kind: "ExpiryTestEntity", Batches: 2, Deleted: 3, LastBatch: 1},
+	}, progress)
+
+	keys, err := GetKeyAll(ctx, NewQuery("ExpiryTestEntity"))
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	_, err = NewExpirySweeper("TestEntity").Run(ctx)
+	require.Error(t, err)
+}
@@ -0,0 +1,180 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// historyKind は変更履歴を保存する Kind です。
+// 変更履歴は変更されたエンティティのキーを親とする子エンティティとして保存されます。
+const historyKind = "EntitystoreHistory"
+
+// HistoryRecord はエンティティの変更履歴の1件です。
+// KindOptions.History が有効な Kind のエンティティを書き込むたびに記録されます。
+type HistoryRecord struct {
+	// Key は変更履歴自体のキーです。親が変更されたエンティティのキーになります。
+	Key *datastore.Key
+	// Type は変更の種類です。論理削除の場合は MutationTypeDelete になります。
+	Type MutationType
+	// Actor は WithActor で設定された操作者です。
+	Actor string
+	// Timestamp は変更日時です。
+	Timestamp time.Time
+	// Before は変更前のプロパティです。新規作成の場合は nil になります。
+	Before []datastore.Property
+	// After は変更後のプロパティです。削除の場合は nil になります。
+	After []datastore.Property
+}
+
+// EntityKey は変更されたエンティティのキーを返します。
+func (r *HistoryRecord) EntityKey() *datastore.Key {
+	if r.Key == nil {
+		return nil
+	}
+	return r.Key.Parent
+}
+
+// Save は datastore.PropertyLoadSaver の実装です。
+func (r *HistoryRecord) Save() ([]datastore.Property, error) {
+	ps := []datastore.Property{
+		{Name: "Type", Value: int64(r.Type)},
+		{Name: "Actor", Value: r.Actor},
+		{Name: "Timestamp", Value: r.Timestamp},
+	}
+	if r.Before != nil {
+		ps = append(ps, datastore.Property{Name: "Before", Value: &datastore.Entity{Properties: r.Before}, NoIndex: true})
+	}
+	if r.After != nil {
+		ps = append(ps, datastore.Property{Name: "After", Value: &datastore.Entity{Properties: r.After}, NoIndex: true})
+	}
+	return ps, nil
+}
+
+// Load は datastore.PropertyLoadSaver の実装です。
+func (r *HistoryRecord) Load(ps []datastore.Property) error {
+	for _, p := range ps {
+		switch p.Name {
+		case "Type":
+			n, _ := p.Value.(int64)
+			r.Type = MutationType(n)
+		case "Actor":
+			r.Actor, _ = p.Value.(string)
+		case "Timestamp":
+			r.Timestamp, _ = p.Value.(time.Time)
+		case "Before":
+			if e, ok := p.Value.(*datastore.Entity); ok {
+				r.Before = e.Properties
+			}
+		case "After":
+			if e, ok := p.Value.(*datastore.Entity); ok {
+				r.After = e.Properties
+			}
+		}
+	}
+	return nil
+}
+
+// historyMutations は変更履歴を記録する Mutation を作成します。
+// buildMutations の後に、トランザクション内で呼び出します。
+func historyMutations(ctx context.Context, ops []*writeOp) []*datastore.Mutation {
+	var muts []*datastore.Mutation
+	now := Now().Truncate(time.Microsecond)
+	actor := ActorFromContext(ctx)
+	for _, op := range ops {
+		if op.skipped || !optionsOf(op.key.Kind).History {
+			continue
+		}
+		if op.isDelete() && !op.exists {
+			continue // 存在しないエンティティの削除は記録しない
+		}
+		rec := &HistoryRecord{
+			Type:      op.typ,
+			Actor:     actor,
+			Timestamp: now,
+			Before:    op.prev,
+			After:     op.next,
+		}
+		muts = append(muts, datastore.NewInsert(datastore.IncompleteKey(historyKind, op.key), rec))
+	}
+	return muts
+}
+
+// ListHistory はエンティティの変更履歴を新しい順に取得します。
+// limit と cur の扱いは EntityLister.GetList と同様です。
+// このクエリには EntitystoreHistory の Timestamp 降順の祖先クエリ用の複合インデックスが必要です。
+func ListHistory(ctx context.Context, key *datastore.Key, limit int, cur string) ([]*HistoryRecord, string, error) {
+	q := NewQuery(historyKind).Ancestor(key).Order("-Timestamp")
+	if cur != "" {
+		cursor, err := datastore.DecodeCursor(cur)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(cursor)
+	}
+	itr := client.Run(ctx, q)
+	var recs []*HistoryRecord
+	for len(recs) < limit {
+		rec := &HistoryRecord{}
+		hkey, err := itr.Next(rec)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		rec.Key = hkey
+		recs = append(recs, rec)
+	}
+	// カーソルの取得
+	newCur := ""
+	if len(recs) == limit {
+		cursor, err := itr.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := itr.Next(&HistoryRecord{}); !errors.Is(err, iterator.Done) {
+			newCur = cursor.String()
+		}
+	}
+	return recs, newCur, nil
+}
+
+// RestoreHistory は変更履歴に記録されている状態にエンティティを戻します。
+// rec の変更後の状態を書き込みます。削除の履歴の場合は削除前の状態を書き込みます。
+// 記録されているプロパティは KindOptions.Entity の型のエンティティにロードしてから書き込むため、
+// 通常の書き込みと同様に書き込み前のフック、検証、一意制約の確認が行われ、変更履歴として記録されます。
+// KindOptions.Entity が指定されていない場合はエラーを返します。
+func RestoreHistory(ctx context.Context, rec *HistoryRecord) error {
+	key := rec.EntityKey()
+	if key == nil {
+		return errors.New("entitystore: history record has no key")
+	}
+	ps := rec.After
+	if rec.Type == MutationTypeDelete {
+		ps = rec.Before
+	}
+	if ps == nil {
+		return fmt.Errorf("entitystore: history record %v has no properties to restore", rec.Key)
+	}
+	opts := optionsOf(key.Kind)
+	if opts.Entity == nil {
+		return fmt.Errorf("entitystore: restoring history of %s requires KindOptions.Entity", key.Kind)
+	}
+	e := entityConstructor(opts.Entity)()
+	loaded, err := loadBlobs(ctx, e, ps)
+	if err != nil {
+		return err
+	}
+	if err := migrateEntity(ctx, key, loaded, e); err != nil {
+		return err
+	}
+	if err := setEntityKey(e, key); err != nil {
+		return err
+	}
+	return write(ctx, []*writeOp{{typ: MutationTypeUpsert, key: key, src: e}})
+}
@@ -0,0 +1,83 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryRecord_SaveLoad(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	rec := &HistoryRecord{
+		Type:      MutationTypeUpsert,
+		Actor:     "user1",
+		Timestamp: now,
+		After:     []datastore.Property{{Name: "Value", Value: "Test"}},
+	}
+	ps, err := rec.Save()
+	require.NoError(t, err)
+
+	rec2 := &HistoryRecord{}
+	require.NoError(t, rec2.Load(ps))
+	require.Equal(t, MutationTypeUpsert, rec2.Type)
+	require.Equal(t, "user1", rec2.Actor)
+	require.Equal(t, now, rec2.Timestamp)
+	require.Nil(t, rec2.Before)
+	require.Equal(t, "Test", rec2.After[0].Value)
+}
+
+func TestHistoryMutations(t *testing.T) {
+	ctx := WithActor(context.Background(), "user1")
+	RegisterKind("HistoryTestEntity", KindOptions{History: true})
+	ops := []*writeOp{
+		{typ: MutationTypeUpsert, key: datastore.NameKey("HistoryTestEntity", "1", nil), next: []datastore.Property{}},
+		{typ: MutationTypeUpsert, key: datastore.NameKey("HistoryTestEntity", "2", nil), skipped: true},
+		{typ: MutationTypeDelete, key: datastore.NameKey("HistoryTestEntity", "3", nil)},
+		{typ: MutationTypeUpsert, key: datastore.NameKey("TestEntity", "1", nil), next: []datastore.Property{}},
+	}
+	muts := historyMutations(ctx, ops)
+	require.Len(t, muts, 1)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := WithActor(context.Background(), "user1")
+	DefaultTestInitialize(ctx, nil)
+	RegisterKind("HistoryTestEntity", KindOptions{History: true, Entity: &HistoryTestEntity{}})
+	err := DeleteAll(ctx, "HistoryTestEntity")
+	require.NoError(t, err)
+
+	e := &HistoryTestEntity{Id: 1, Value: "Test1"}
+	require.NoError(t, PutEntity(ctx, e))
+	e.Value = "Test2"
+	require.NoError(t, PutEntity(ctx, e))
+	require.NoError(t, DeleteEntity(ctx, e))
+
+	recs, cur, err := ListHistory(ctx, e.Key(), 10, "")
+	require.NoError(t, err)
+	require.Empty(t, cur)
+	require.Len(t, recs, 3)
+	require.Equal(t, MutationTypeDelete, recs[0].Type)
+	require.Equal(t, "user1", recs[0].Actor)
+	require.Nil(t, recs[2].Before)
+
+	// 削除前の状態に戻す
+	require.NoError(t, RestoreHistory(ctx, recs[0]))
+	e2 := &HistoryTestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e2))
+	require.Equal(t, "Test2", e2.Value)
+}
+
+func TestRestoreHistory_RequiresEntity(t *testing.T) {
+	RegisterKind("HistoryTestEntity", KindOptions{History: true})
+	defer RegisterKind("HistoryTestEntity", KindOptions{})
+	rec := &HistoryRecord{
+		Key:   datastore.IDKey(historyKind, 1, datastore.NameKey("HistoryTestEntity", "1", nil)),
+		Type:  MutationTypeUpsert,
+		After: []datastore.Property{{Name: "Value", Value: "Test1"}},
+	}
+	// 登録されたエンティティの型が無い場合は、検証などを経ずに書き込まないようにエラーにする
+	require.Error(t, RestoreHistory(context.Background(), rec))
+}
@@ -0,0 +1,125 @@
+package entitystore
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// PostLoader はロード後に呼び出されるフックを実装するエンティティのインターフェースです。
+// キャッシュから取得した場合も、Datastoreから取得した場合も呼び出されます。
+type PostLoader interface {
+	PostLoad(ctx context.Context) error
+}
+
+// PostPutter は保存後に呼び出されるフックを実装するエンティティのインターフェースです。
+type PostPutter interface {
+	PostPut(ctx context.Context) error
+}
+
+// PreDeleter は削除前に呼び出されるフックを実装するエンティティのインターフェースです。
+// エラーを返した場合は削除を中止します。
+type PreDeleter interface {
+	PreDelete(ctx context.Context) error
+}
+
+// PostDeleter は削除後に呼び出されるフックを実装するエンティティのインターフェースです。
+type PostDeleter interface {
+	PostDelete(ctx context.Context) error
+}
+
+// HookFunc は GlobalHooks に登録するフック関数です。
+// e は対象のエンティティです。キーのみで削除する場合など、エンティティが無い場合は nil になります。
+type HookFunc func(ctx context.Context, key *datastore.Key, e any) error
+
+// GlobalHooks は Kind に関係なくすべてのエンティティに対して呼び出されるフックです。
+// 必要なフックのみ設定します。
+// エンティティ自身のフックがある場合は、エンティティのフックの後に呼び出されます。
+type GlobalHooks struct {
+	PostLoad   HookFunc
+	PrePut     HookFunc
+	PostPut    HookFunc
+	PreDelete  HookFunc
+	PostDelete HookFunc
+}
+
+// globalHooks は登録済みの GlobalHooks です。
+var globalHooks []GlobalHooks
+
+// globalHooksMu は globalHooks を保護します。
+var globalHooksMu sync.RWMutex
+
+// RegisterGlobalHooks はすべてのエンティティに対して呼び出されるフックを登録します。
+// 複数登録した場合は登録した順に呼び出されます。
+func RegisterGlobalHooks(h GlobalHooks) {
+	globalHooksMu.Lock()
+	defer globalHooksMu.Unlock()
+	globalHooks = append(globalHooks, h)
+}
+
+// runGlobalHooks は登録済みの GlobalHooks から pick で選んだフックを順に呼び出します。
+func runGlobalHooks(ctx context.Context, pick func(GlobalHooks) HookFunc, key *datastore.Key, e any) error {
+	globalHooksMu.RLock()
+	hs := globalHooks
+	globalHooksMu.RUnlock()
+	for _, h := range hs {
+		if f := pick(h); f != nil {
+			if err := f(ctx, key, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runPostLoad はロード後のフックを呼び出します。
+func runPostLoad(ctx context.Context, key *datastore.Key, e any) error {
+	if h, ok := e.(PostLoader); ok {
+		if err := h.PostLoad(ctx); err != nil {
+			return err
+		}
+	}
+	return runGlobalHooks(ctx, func(h GlobalHooks) HookFunc { return h.PostLoad }, key, e)
+}
+
+// runPrePut は保存前のフックを呼び出します。
+// エンティティの PrePutAction もここで呼び出されます。
+func runPrePut(ctx context.Context, key *datastore.Key, e any) error {
+	if h, ok := e.(Entity); ok {
+		if err := h.PrePutAction(ctx); err != nil {
+			return err
+		}
+	}
+	return runGlobalHooks(ctx, func(h GlobalHooks) HookFunc { return h.PrePut }, key, e)
+}
+
+// runPostPut は保存後のフックを呼び出します。
+func runPostPut(ctx context.Context, key *datastore.Key, e any) error {
+	if h, ok := e.(PostPutter); ok {
+		if err := h.PostPut(ctx); err != nil {
+			return err
+		}
+	}
+	return runGlobalHooks(ctx, func(h GlobalHooks) HookFunc { return h.PostPut }, key, e)
+}
+
+// runPreDelete は削除前のフックを呼び出します。
+func runPreDelete(ctx context.Context, key *datastore.Key, e any) error {
+	if h, ok := e.(PreDeleter); ok {
+		if err := h.PreDelete(ctx); err != nil {
+			return err
+		}
+	}
+	return runGlobalHooks(ctx, func(h GlobalHooks) HookFunc { return h.PreDelete }, key, e)
+}
+
+// runPostDelete は削除後のフックを呼び出します。
+func runPostDelete(ctx context.Context, key *datastore.Key, e any) error {
+	if h, ok := e.(PostDeleter); ok {
+		if err := h.PostDelete(ctx); err != nil {
+			return err
+		}
+	}
+	return runGlobalHooks(ctx, func(h GlobalHooks) HookFunc { return h.PostDelete }, key, e)
+}
@@ -0,0 +1,68 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEntity_PostLoad(t *testing.T) {
+	ctx := context.Background()
+	var globalCalled []string
+	RegisterGlobalHooks(GlobalHooks{
+		PostLoad: func(_ context.Context, key *datastore.Key, _ any) error {
+			globalCalled = append(globalCalled, key.Name)
+			return nil
+		},
+	})
+	t.Cleanup(func() { globalHooks = nil })
+
+	e := &HookTestEntity{}
+	err := loadEntity(ctx, datastore.NameKey("HookTestEntity", "1", nil), []datastore.Property{
+		{Name: "Id", Value: int64(1)},
+		{Name: "Value", Value: "Test Value"},
+	}, e)
+	require.NoError(t, err)
+	require.Equal(t, "Test Value", e.Value)
+	require.Equal(t, []string{"PostLoad"}, e.Called)
+	require.Equal(t, []string{"1"}, globalCalled)
+}
+
+func TestHooks_PutAndDelete(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	var prePut []string
+	RegisterGlobalHooks(GlobalHooks{
+		PrePut: func(_ context.Context, key *datastore.Key, _ any) error {
+			prePut = append(prePut, key.Kind)
+			return nil
+		},
+	})
+	t.Cleanup(func() { globalHooks = nil })
+
+	e := &HookTestEntity{Id: 1, Value: "Test Value"}
+	err := PutEntity(ctx, e)
+	require.NoError(t, err)
+	require.Equal(t, []string{"PostPut"}, e.Called)
+	require.Equal(t, []string{"HookTestEntity"}, prePut)
+	require.False(t, e.UpdatedAt().IsZero())
+
+	// MutateEntity でも PrePutAction が呼び出される
+	e2 := &HookTestEntity{Id: 2, Value: "Test Value 2"}
+	err = MutateEntity(ctx, NewUpsert(e2))
+	require.NoError(t, err)
+	require.False(t, e2.UpdatedAt().IsZero())
+
+	// PreDelete がエラーを返すと削除されない
+	protected := &HookTestEntity{Id: 2, Value: "protected"}
+	err = DeleteEntity(ctx, protected)
+	require.Error(t, err)
+	err = GetEntity(ctx, &HookTestEntity{Id: 2})
+	require.NoError(t, err)
+
+	err = DeleteEntity(ctx, e)
+	require.NoError(t, err)
+	require.Equal(t, []string{"PostPut", "PreDelete", "PostDelete"}, e.Called)
+}
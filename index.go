@@ -0,0 +1,309 @@
+package entitystore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"gopkg.in/yaml.v3"
+)
+
+// recordQueries が true の場合、実行したクエリに必要なインデックスを記録します。
+var recordQueries bool
+
+// requiredIndexes は宣言または記録したクエリに必要な複合インデックスです。
+var requiredIndexes = map[string]Index{}
+
+// requiredIndexesMu は requiredIndexes を保護します。
+var requiredIndexesMu sync.Mutex
+
+// Index は Datastore の複合インデックスです。index.yaml の1つのエントリに対応します。
+type Index struct {
+	Kind       string
+	Ancestor   bool
+	Properties []IndexProperty
+}
+
+// IndexProperty は複合インデックスのプロパティです。
+type IndexProperty struct {
+	Name string
+	Desc bool
+}
+
+// String はインデックスの文字列表現を返します。同じインデックスは同じ文字列になります。
+func (idx Index) String() string {
+	var sb strings.Builder
+	sb.WriteString(idx.Kind)
+	if idx.Ancestor {
+		sb.WriteString(" (ancestor)")
+	}
+	for i, p := range idx.Properties {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(p.Name)
+		if p.Desc {
+			sb.WriteString(" desc")
+		}
+	}
+	return sb.String()
+}
+
+// isEquality は等価フィルタとして扱う演算子かどうかを返します。
+func isEquality(op string) bool {
+	return op == "=" || op == "in"
+}
+
+// appendEntityFilter は datastore.EntityFilter に含まれるプロパティのフィルタを追加します。
+// OR フィルタは、含まれるすべての条件を AND で結合したものとして扱います。
+func appendEntityFilter(filters []queryFilter, ef datastore.EntityFilter) []queryFilter {
+	switch f := ef.(type) {
+	case datastore.PropertyFilter:
+		filters = append(filters, queryFilter{name: f.FieldName, op: strings.TrimSpace(f.Operator), value: f.Value})
+	case datastore.AndFilter:
+		for _, sub := range f.Filters {
+			filters = appendEntityFilter(filters, sub)
+		}
+	case datastore.OrFilter:
+		for _, sub := range f.Filters {
+			filters = appendEntityFilter(filters, sub)
+		}
+	}
+	return filters
+}
+
+// IndexOf はクエリの実行に必要な複合インデックスを返します。
+// 組み込みのインデックスで実行できる場合や、entitystore のクエリでない場合は false を返します。
+//
+// 複合インデックスのプロパティは、等価フィルタのプロパティ (名前順)、並び順のプロパティ、
+// 不等価フィルタのプロパティ、射影のプロパティの順に並べます。
+// 論理削除が有効な Kind では DeletedAt の等価フィルタを含みます。
+func IndexOf(q Query) (Index, bool) {
+	qq, ok := asQuery(q)
+	if !ok || qq.kind == "" {
+		return Index{}, false
+	}
+	filters := qq.filters
+	if !qq.includeDeleted && optionsOf(qq.kind).SoftDelete {
+		filters = append(slices.Clip(filters), queryFilter{name: deletedAtProperty, op: "="})
+	}
+
+	idx := Index{Kind: qq.kind, Ancestor: qq.ancestor}
+	seen := map[string]bool{}
+	add := func(name string, desc bool) {
+		if !seen[name] {
+			seen[name] = true
+			idx.Properties = append(idx.Properties, IndexProperty{Name: name, Desc: desc})
+		}
+	}
+	ordered := map[string]bool{}
+	for _, o := range qq.orders {
+		ordered[o.name] = true
+	}
+	var eq, ineq []string
+	for _, f := range filters {
+		if isEquality(f.op) {
+			eq = append(eq, f.name)
+		} else {
+			ineq = append(ineq, f.name)
+		}
+	}
+	sort.Strings(eq)
+	for _, name := range eq {
+		if !ordered[name] {
+			add(name, false)
+		}
+	}
+	for _, o := range qq.orders {
+		add(o.name, o.desc)
+	}
+	for _, name := range ineq {
+		add(name, false)
+	}
+	numFiltered := len(idx.Properties)
+	for _, name := range qq.projection {
+		add(name, false)
+	}
+
+	switch {
+	case len(idx.Properties) == 0:
+		// Kind と祖先のみ
+		return Index{}, false
+	case len(qq.orders) == 0 && len(ineq) == 0 && numFiltered == len(idx.Properties):
+		// 等価フィルタのみ (祖先を含む) はマージ結合で実行できる
+		return Index{}, false
+	case !qq.ancestor && len(idx.Properties) == 1:
+		// 単一プロパティのインデックス
+		return Index{}, false
+	}
+	return idx, true
+}
+
+// DeclareQuery はアプリケーションで使用するクエリを宣言し、必要な複合インデックスを RequiredIndexes に追加します。
+// 宣言したクエリは実行されません。
+func DeclareQuery(qs ...Query) {
+	for _, q := range qs {
+		recordQuery(q)
+	}
+}
+
+// recordQuery はクエリに必要な複合インデックスを記録します。
+func recordQuery(q Query) {
+	idx, ok := IndexOf(q)
+	if !ok {
+		return
+	}
+	requiredIndexesMu.Lock()
+	defer requiredIndexesMu.Unlock()
+	requiredIndexes[idx.String()] = idx
+}
+
+// RequiredIndexes は DeclareQuery で宣言したクエリと、Config.RecordQueries が有効な場合に実行したクエリに必要な複合インデックスを返します。
+// 結果は Kind とプロパティの順に並べます。
+func RequiredIndexes() []Index {
+	requiredIndexesMu.Lock()
+	defer requiredIndexesMu.Unlock()
+	indexes := make([]Index, 0, len(requiredIndexes))
+	for _, idx := range requiredIndexes {
+		indexes = append(indexes, idx)
+	}
+	sortIndexes(indexes)
+	return indexes
+}
+
+// ResetRequiredIndexes は宣言または記録した複合インデックスを消去します。
+func ResetRequiredIndexes() {
+	requiredIndexesMu.Lock()
+	defer requiredIndexesMu.Unlock()
+	requiredIndexes = map[string]Index{}
+}
+
+// sortIndexes はインデックスを Kind とプロパティの順に並べます。
+func sortIndexes(indexes []Index) {
+	sort.Slice(indexes, func(i, j int) bool {
+		if indexes[i].Kind != indexes[j].Kind {
+			return indexes[i].Kind < indexes[j].Kind
+		}
+		return indexes[i].String() < indexes[j].String()
+	})
+}
+
+// IndexDiff は必要な複合インデックスと index.yaml の差分です。
+type IndexDiff struct {
+	// Missing は必要だが index.yaml に無いインデックスです。
+	Missing []Index
+	// Unused は index.yaml にあるが必要とされていないインデックスです。
+	// 宣言も記録もされていないクエリが使用している可能性があるため、削除する前に確認してください。
+	Unused []Index
+}
+
+// HasMissing は不足しているインデックスがあるかどうかを返します。
+func (d IndexDiff) HasMissing() bool {
+	return len(d.Missing) > 0
+}
+
+// String は差分をレポートとして返します。
+func (d IndexDiff) String() string {
+	var sb strings.Builder
+	for _, idx := range d.Missing {
+		fmt.Fprintf(&sb, "missing: %s\n", idx)
+	}
+	for _, idx := range d.Unused {
+		fmt.Fprintf(&sb, "unused: %s\n", idx)
+	}
+	return sb.String()
+}
+
+// DiffIndexes は必要な複合インデックス required と既存のインデックス existing の差分を返します。
+func DiffIndexes(required, existing []Index) IndexDiff {
+	have := map[string]bool{}
+	for _, idx := range existing {
+		have[idx.String()] = true
+	}
+	need := map[string]bool{}
+	var diff IndexDiff
+	for _, idx := range required {
+		need[idx.String()] = true
+		if !have[idx.String()] {
+			diff.Missing = append(diff.Missing, idx)
+		}
+	}
+	for _, idx := range existing {
+		if !need[idx.String()] {
+			diff.Unused = append(diff.Unused, idx)
+		}
+	}
+	sortIndexes(diff.Missing)
+	sortIndexes(diff.Unused)
+	return diff
+}
+
+// indexYAML は index.yaml の形式です。
+type indexYAML struct {
+	Indexes []struct {
+		Kind       string `yaml:"kind"`
+		Ancestor   string `yaml:"ancestor"`
+		Properties []struct {
+			Name      string `yaml:"name"`
+			Direction string `yaml:"direction"`
+		} `yaml:"properties"`
+	} `yaml:"indexes"`
+}
+
+// ReadIndexYAML は index.yaml を読み込みます。
+func ReadIndexYAML(r io.Reader) ([]Index, error) {
+	var y indexYAML
+	if err := yaml.NewDecoder(r).Decode(&y); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("entitystore: invalid index.yaml: %w", err)
+	}
+	indexes := make([]Index, 0, len(y.Indexes))
+	for _, e := range y.Indexes {
+		idx := Index{Kind: e.Kind}
+		switch e.Ancestor {
+		case "yes", "true":
+			idx.Ancestor = true
+		case "", "no", "false":
+		default:
+			return nil, fmt.Errorf("entitystore: invalid ancestor %q for kind %s in index.yaml", e.Ancestor, e.Kind)
+		}
+		for _, p := range e.Properties {
+			switch p.Direction {
+			case "", "asc":
+				idx.Properties = append(idx.Properties, IndexProperty{Name: p.Name})
+			case "desc":
+				idx.Properties = append(idx.Properties, IndexProperty{Name: p.Name, Desc: true})
+			default:
+				return nil, fmt.Errorf("entitystore: invalid direction %q for kind %s in index.yaml", p.Direction, e.Kind)
+			}
+		}
+		indexes = append(indexes, idx)
+	}
+	return indexes, nil
+}
+
+// WriteIndexYAML はインデックスを index.yaml の形式で書き込みます。
+func WriteIndexYAML(w io.Writer, indexes []Index) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("indexes:\n")
+	for _, idx := range indexes {
+		fmt.Fprintf(bw, "  - kind: %s\n", idx.Kind)
+		if idx.Ancestor {
+			bw.WriteString("    ancestor: yes\n")
+		}
+		bw.WriteString("    properties:\n")
+		for _, p := range idx.Properties {
+			fmt.Fprintf(bw, "      - name: %s\n", p.Name)
+			if p.Desc {
+				bw.WriteString("        direction: desc\n")
+			}
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,106 @@
+package entitystore
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexOf(t *testing.T) {
+	RegisterKind("IndexSoftDeleteEntity", KindOptions{SoftDelete: true})
+	defer RegisterKind("IndexSoftDeleteEntity", KindOptions{})
+	parent := datastore.NameKey("Parent", "p", nil)
+
+	tests := []struct {
+		name string
+		q    Query
+		want string
+	}{
+		{"kind only", NewQuery("E"), ""},
+		{"ancestor only", NewQuery("E").Ancestor(parent), ""},
+		{"equality only", NewQuery("E").FilterField("A", "=", 1).FilterField("B", "=", 2), ""},
+		{"ancestor and equality", NewQuery("E").Ancestor(parent).FilterField("A", "=", 1), ""},
+		{"single inequality", NewQuery("E").FilterField("A", ">", 1), ""},
+		{"single order", NewQuery("E").Order("-A"), ""},
+		{"inequality and order on same property", NewQuery("E").FilterField("A", ">", 1).Order("A"), ""},
+		{"equality and order", NewQuery("E").FilterField("B", "=", 1).FilterField("A", "in", []any{1}).Order("-C"), "E: A, B, C desc"},
+		{"equality and inequality", NewQuery("E").FilterField("B", "=", 1).FilterField("A", "<", 2), "E: B, A"},
+		{"ancestor and order", NewQuery("E").Ancestor(parent).Order("-Timestamp"), "E (ancestor): Timestamp desc"},
+		{"projection", NewQuery("E").FilterField("A", "=", 1).Project("B"), "E: A, B"},
+		{"deprecated filter", NewQuery("E").Filter("A =", 1).Filter("B >", 2), "E: A, B"},
+		{"entity filter", NewQuery("E").FilterEntity(datastore.OrFilter{Filters: []datastore.EntityFilter{
+			datastore.PropertyFilter{FieldName: "A", Operator: "=", Value: 1},
+			datastore.PropertyFilter{FieldName: "B", Operator: "=", Value: 2},
+		}}).Order("C"), "E: A, B, C"},
+		{"soft delete", NewQuery("IndexSoftDeleteEntity").Order("Name"), "IndexSoftDeleteEntity: DeletedAt, Name"},
+		{"soft delete including deleted", NewQuery("IndexSoftDeleteEntity").IncludeDeleted().Order("Name"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx, ok := IndexOf(tt.q)
+			if tt.want == "" {
+				require.False(t, ok, idx.String())
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, tt.want, idx.String())
+		})
+	}
+}
+
+func TestIndexOfDoesNotShareFilters(t *testing.T) {
+	base := NewQuery("E").FilterField("A", "=", 1).Order("B")
+	q1 := base.FilterField("C", "=", 1)
+	q2 := base.FilterField("D", "=", 1)
+	idx1, _ := IndexOf(q1)
+	idx2, _ := IndexOf(q2)
+	require.Equal(t, "E: A, C, B", idx1.String())
+	require.Equal(t, "E: A, D, B", idx2.String())
+}
+
+func TestDeclareQuery(t *testing.T) {
+	ResetRequiredIndexes()
+	defer ResetRequiredIndexes()
+	key := datastore.IDKey("Entity", 1, nil)
+	DeclareQuery(
+		NewQuery(historyKind).Ancestor(key).Order("-Timestamp"),
+		NewQuery(historyKind).Ancestor(key).Order("-Timestamp"),
+		NewQuery("IndexTestEntity").FilterField("Name", "=", "a").Order("-Value"),
+		NewQuery("IndexTestEntity").FilterField("Name", "=", "a"),
+	)
+	required := RequiredIndexes()
+	require.Len(t, required, 2)
+	require.Equal(t, historyKind+" (ancestor): Timestamp desc", required[0].String())
+	require.Equal(t, "IndexTestEntity: Name, Value desc", required[1].String())
+
+	f, err := os.Open("index.yaml")
+	require.NoError(t, err)
+	defer f.Close()
+	existing, err := ReadIndexYAML(f)
+	require.NoError(t, err)
+
+	diff := DiffIndexes(required, existing)
+	require.True(t, diff.HasMissing())
+	require.Len(t, diff.Missing, 1)
+	require.Equal(t, "IndexTestEntity", diff.Missing[0].Kind)
+	require.NotEmpty(t, diff.Unused)
+	require.Contains(t, diff.String(), "missing: IndexTestEntity: Name, Value desc\n")
+}
+
+func TestIndexYAML(t *testing.T) {
+	src, err := os.ReadFile("index.yaml")
+	require.NoError(t, err)
+	indexes, err := ReadIndexYAML(bytes.NewReader(src))
+	require.NoError(t, err)
+	require.NotEmpty(t, indexes)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteIndexYAML(&buf, indexes))
+	require.Equal(t, string(src), buf.String())
+
+	_, err = ReadIndexYAML(bytes.NewReader([]byte("indexes:\n  - kind: A\n    properties:\n      - name: B\n        direction: up\n")))
+	require.Error(t, err)
+}
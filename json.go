@@ -0,0 +1,565 @@
+package entitystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// JSONKeyFormat は JSON でのキーの表し方です。
+type JSONKeyFormat int
+
+const (
+	// JSONKeyEncoded はキーを datastore.Key.Encode の URL セーフな文字列で表します。
+	JSONKeyEncoded JSONKeyFormat = iota
+	// JSONKeyObject はキーを kind, id または name, namespace, parent を持つオブジェクトで表します。
+	// id は精度が失われないよう文字列で表します。
+	JSONKeyObject
+)
+
+// JSONOptions は JSON への変換の設定です。
+type JSONOptions struct {
+	KeyFormat JSONKeyFormat
+}
+
+// jsonMember は順序を保つ JSON オブジェクトのメンバーです。
+type jsonMember struct {
+	name  string
+	value any
+}
+
+// jsonObject はメンバーの順序を保つ JSON オブジェクトです。
+type jsonObject []jsonMember
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(m.name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, fmt.Errorf("entitystore: failed to encode %s: %w", m.name, err)
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeJSONObject は JSON オブジェクトをメンバーの順序を保って読み込みます。
+func decodeJSONObject(data []byte) ([]jsonMember, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("entitystore: expected JSON object but got %s", data)
+	}
+	var members []jsonMember
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		members = append(members, jsonMember{name: tok.(string), value: raw})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// isJSONNull は JSON の値が null かどうかを返します。
+func isJSONNull(raw json.RawMessage) bool {
+	return string(bytes.TrimSpace(raw)) == "null"
+}
+
+// keyValue はキーを JSON の値に変換します。
+func (o JSONOptions) keyValue(key *datastore.Key) any {
+	if key == nil {
+		return nil
+	}
+	if o.KeyFormat != JSONKeyObject {
+		return key.Encode()
+	}
+	obj := jsonObject{{"kind", key.Kind}}
+	switch {
+	case key.Name != "":
+		obj = append(obj, jsonMember{"name", key.Name})
+	case key.ID != 0:
+		obj = append(obj, jsonMember{"id", strconv.FormatInt(key.ID, 10)})
+	}
+	if key.Namespace != "" {
+		obj = append(obj, jsonMember{"namespace", key.Namespace})
+	}
+	if key.Parent != nil {
+		obj = append(obj, jsonMember{"parent", o.keyValue(key.Parent)})
+	}
+	return obj
+}
+
+// MarshalKeyJSON はキーを JSON に変換します。
+func MarshalKeyJSON(key *datastore.Key, opts JSONOptions) ([]byte, error) {
+	return json.Marshal(opts.keyValue(key))
+}
+
+// UnmarshalKeyJSON は MarshalKeyJSON で変換したキーを読み込みます。
+// 文字列とオブジェクトのどちらの形式も読み込めます。null の場合は nil を返します。
+func UnmarshalKeyJSON(data []byte) (*datastore.Key, error) {
+	if isJSONNull(data) {
+		return nil, nil
+	}
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		return datastore.DecodeKey(s)
+	}
+	var obj struct {
+		Kind      string          `json:"kind"`
+		ID        string          `json:"id"`
+		Name      string          `json:"name"`
+		Namespace string          `json:"namespace"`
+		Parent    json.RawMessage `json:"parent"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("entitystore: invalid key JSON: %w", err)
+	}
+	if obj.Kind == "" {
+		return nil, errors.New("entitystore: invalid key JSON: kind is empty")
+	}
+	key := &datastore.Key{Kind: obj.Kind, Name: obj.Name, Namespace: obj.Namespace}
+	if obj.ID != "" {
+		id, err := strconv.ParseInt(obj.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("entitystore: invalid key JSON: %w", err)
+		}
+		key.ID = id
+	}
+	if len(obj.Parent) > 0 {
+		parent, err := UnmarshalKeyJSON(obj.Parent)
+		if err != nil {
+			return nil, err
+		}
+		key.Parent = parent
+	}
+	return key, nil
+}
+
+// MarshalEntityJSON はエンティティを API のレスポンスなどで使用する JSON に変換します。
+// エンティティのプロパティをそのままの名前のメンバーとし、エンティティのキーは "__key__" のメンバーにします。
+// 値は以下のように表します。
+//   - 日時: RFC 3339 形式の UTC の文字列
+//   - []byte: Base64 の文字列
+//   - キー: JSONOptions.KeyFormat の形式
+//   - datastore.GeoPoint: lat と lng を持つオブジェクト
+//   - 入れ子のエンティティ: オブジェクト
+//
+// 暗号化するフィールドは復号した値で、Blob は値で出力します。取得していない Blob は BlobStore への参照のまま出力します。
+func MarshalEntityJSON(e any, opts JSONOptions) ([]byte, error) {
+	ps, err := savePlainStruct(e)
+	if err != nil {
+		return nil, err
+	}
+	unwrapBlobs(ps)
+	obj := opts.plainProperties(ps)
+	if ent, ok := e.(Entity); ok && ent.Key() != nil {
+		obj = append(jsonObject{{keyProperty, opts.keyValue(ent.Key())}}, obj...)
+	}
+	return json.Marshal(obj)
+}
+
+// plainProperties はプロパティを MarshalEntityJSON の形式のオブジェクトに変換します。
+func (o JSONOptions) plainProperties(ps []datastore.Property) jsonObject {
+	obj := make(jsonObject, 0, len(ps))
+	for _, p := range ps {
+		obj = append(obj, jsonMember{p.Name, o.plainValue(p.Value)})
+	}
+	return obj
+}
+
+// plainValue はプロパティの値を MarshalEntityJSON の形式に変換します。
+func (o JSONOptions) plainValue(v any) any {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case *datastore.Key:
+		return o.keyValue(v)
+	case datastore.GeoPoint:
+		return jsonObject{{"lat", v.Lat}, {"lng", v.Lng}}
+	case *datastore.Entity:
+		if v == nil {
+			return nil
+		}
+		obj := o.plainProperties(v.Properties)
+		if v.Key != nil {
+			obj = append(jsonObject{{keyProperty, o.keyValue(v.Key)}}, obj...)
+		}
+		return obj
+	case []any:
+		values := make([]any, len(v))
+		for i, ev := range v {
+			values[i] = o.plainValue(ev)
+		}
+		return values
+	}
+	return v
+}
+
+// UnmarshalEntityJSON は MarshalEntityJSON で変換した JSON をエンティティに読み込みます。
+// 値の型はエンティティのフィールドの型から判断します。
+// "__key__" のメンバーがある場合は、KeySetter または構造体タグ `entitystore:"id"` のフィールドにキーを設定します。
+func UnmarshalEntityJSON(data []byte, e any) error {
+	t := reflect.TypeOf(e)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("entitystore: UnmarshalEntityJSON requires a pointer to a struct but got %T", e)
+	}
+	members, err := decodeJSONObject(data)
+	if err != nil {
+		return err
+	}
+	d := plainDecoder{schema: newQuerySchema(t.Elem().Name(), t.Elem())}
+	ps, key, err := d.properties(members, "")
+	if err != nil {
+		return err
+	}
+	if err := loadStruct(key, ps, e); err != nil {
+		return err
+	}
+	if key != nil {
+		return setEntityKey(e, key)
+	}
+	return nil
+}
+
+// plainDecoder は MarshalEntityJSON の形式の JSON を、エンティティの型の情報からプロパティに変換します。
+type plainDecoder struct {
+	schema *querySchema
+}
+
+// properties は JSON オブジェクトのメンバーをプロパティに変換します。prefix は入れ子のエンティティのプロパティ名の接頭辞です。
+func (d plainDecoder) properties(members []jsonMember, prefix string) ([]datastore.Property, *datastore.Key, error) {
+	var key *datastore.Key
+	ps := make([]datastore.Property, 0, len(members))
+	for _, m := range members {
+		raw := m.value.(json.RawMessage)
+		if m.name == keyProperty {
+			var err error
+			if key, err = UnmarshalKeyJSON(raw); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		name := prefix + m.name
+		meta := d.schema.properties[name]
+		v, err := d.value(raw, meta.class, name+".")
+		if err != nil {
+			return nil, nil, fmt.Errorf("entitystore: invalid JSON value of %s: %w", name, err)
+		}
+		ps = append(ps, datastore.Property{Name: m.name, Value: v, NoIndex: meta.noindex})
+	}
+	return ps, key, nil
+}
+
+// value は JSON の値をプロパティの値に変換します。型の情報が無い場合は JSON の値から推測します。
+func (d plainDecoder) value(raw json.RawMessage, class valueClass, prefix string) (any, error) {
+	raw = bytes.TrimSpace(raw)
+	if isJSONNull(raw) {
+		return nil, nil
+	}
+	if raw[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(raw, &elems); err != nil {
+			return nil, err
+		}
+		values := make([]any, len(elems))
+		for i, elem := range elems {
+			v, err := d.value(elem, class, prefix)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+	switch class {
+	case classBool:
+		var b bool
+		err := json.Unmarshal(raw, &b)
+		return b, err
+	case classInt:
+		var n int64
+		err := json.Unmarshal(raw, &n)
+		return n, err
+	case classFloat:
+		var f float64
+		err := json.Unmarshal(raw, &f)
+		return f, err
+	case classString:
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case classBytes:
+		var b []byte
+		err := json.Unmarshal(raw, &b)
+		return b, err
+	case classTime:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case classKey:
+		return UnmarshalKeyJSON(raw)
+	case classGeo:
+		var g struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		}
+		err := json.Unmarshal(raw, &g)
+		return datastore.GeoPoint{Lat: g.Lat, Lng: g.Lng}, err
+	case classEntity:
+		return d.entity(raw, prefix)
+	}
+	// 型の情報が無い場合
+	switch raw[0] {
+	case '{':
+		return d.entity(raw, prefix)
+	case '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case 't', 'f':
+		var b bool
+		err := json.Unmarshal(raw, &b)
+		return b, err
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return nil, err
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	return n.Float64()
+}
+
+// entity は JSON オブジェクトを入れ子のエンティティに変換します。
+func (d plainDecoder) entity(raw json.RawMessage, prefix string) (any, error) {
+	members, err := decodeJSONObject(raw)
+	if err != nil {
+		return nil, err
+	}
+	ps, key, err := d.properties(members, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &datastore.Entity{Key: key, Properties: ps}, nil
+}
+
+// MarshalPropertiesJSON はプロパティを、型の情報を含む JSON に変換します。
+// エクスポートなど、エンティティの型が無くても UnmarshalPropertiesJSON で元のプロパティに戻す必要がある場合に使用します。
+// 各プロパティは Datastore の REST API の Value と同じく、値の種類を名前にしたメンバー
+// (nullValue, booleanValue, integerValue, doubleValue, timestampValue, keyValue, stringValue,
+// blobValue, geoPointValue, entityValue, arrayValue) を持つオブジェクトで表し、
+// インデックスを作成しないプロパティには excludeFromIndexes を付けます。
+// integerValue は精度が失われないよう文字列で表します。
+func MarshalPropertiesJSON(ps []datastore.Property, opts JSONOptions) ([]byte, error) {
+	obj, err := opts.typedProperties(ps)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+// typedProperties はプロパティを MarshalPropertiesJSON の形式のオブジェクトに変換します。
+func (o JSONOptions) typedProperties(ps []datastore.Property) (jsonObject, error) {
+	obj := make(jsonObject, 0, len(ps))
+	for _, p := range ps {
+		v, err := o.typedValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("entitystore: property %s: %w", p.Name, err)
+		}
+		if p.NoIndex {
+			v = append(v, jsonMember{"excludeFromIndexes", true})
+		}
+		obj = append(obj, jsonMember{p.Name, v})
+	}
+	return obj, nil
+}
+
+// typedValue はプロパティの値を MarshalPropertiesJSON の形式に変換します。
+func (o JSONOptions) typedValue(v any) (jsonObject, error) {
+	switch v := v.(type) {
+	case nil:
+		return jsonObject{{"nullValue", nil}}, nil
+	case bool:
+		return jsonObject{{"booleanValue", v}}, nil
+	case int64:
+		return jsonObject{{"integerValue", strconv.FormatInt(v, 10)}}, nil
+	case float64:
+		return jsonObject{{"doubleValue", v}}, nil
+	case time.Time:
+		return jsonObject{{"timestampValue", v.UTC().Format(time.RFC3339Nano)}}, nil
+	case *datastore.Key:
+		return jsonObject{{"keyValue", o.keyValue(v)}}, nil
+	case string:
+		return jsonObject{{"stringValue", v}}, nil
+	case []byte:
+		return jsonObject{{"blobValue", base64.StdEncoding.EncodeToString(v)}}, nil
+	case datastore.GeoPoint:
+		return jsonObject{{"geoPointValue", jsonObject{{"latitude", v.Lat}, {"longitude", v.Lng}}}}, nil
+	case *datastore.Entity:
+		if v == nil {
+			return jsonObject{{"nullValue", nil}}, nil
+		}
+		props, err := o.typedProperties(v.Properties)
+		if err != nil {
+			return nil, err
+		}
+		ent := jsonObject{}
+		if v.Key != nil {
+			ent = append(ent, jsonMember{"key", o.keyValue(v.Key)})
+		}
+		ent = append(ent, jsonMember{"properties", props})
+		return jsonObject{{"entityValue", ent}}, nil
+	case []any:
+		values := make([]any, len(v))
+		for i, ev := range v {
+			tv, err := o.typedValue(ev)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = tv
+		}
+		return jsonObject{{"arrayValue", jsonObject{{"values", values}}}}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+// UnmarshalPropertiesJSON は MarshalPropertiesJSON で変換した JSON をプロパティに戻します。
+// キーは文字列とオブジェクトのどちらの形式も読み込めます。
+func UnmarshalPropertiesJSON(data []byte) ([]datastore.Property, error) {
+	members, err := decodeJSONObject(data)
+	if err != nil {
+		return nil, err
+	}
+	return typedProperties(members)
+}
+
+// typedProperties は MarshalPropertiesJSON の形式のオブジェクトのメンバーをプロパティに変換します。
+func typedProperties(members []jsonMember) ([]datastore.Property, error) {
+	ps := make([]datastore.Property, 0, len(members))
+	for _, m := range members {
+		v, noIndex, err := typedValue(m.value.(json.RawMessage))
+		if err != nil {
+			return nil, fmt.Errorf("entitystore: invalid JSON value of %s: %w", m.name, err)
+		}
+		ps = append(ps, datastore.Property{Name: m.name, Value: v, NoIndex: noIndex})
+	}
+	return ps, nil
+}
+
+// typedValue は MarshalPropertiesJSON の形式の値を、プロパティの値とインデックスを作成しないかどうかに変換します。
+func typedValue(raw json.RawMessage) (any, bool, error) {
+	var tv struct {
+		BooleanValue   *bool           `json:"booleanValue"`
+		IntegerValue   *string         `json:"integerValue"`
+		DoubleValue    *float64        `json:"doubleValue"`
+		TimestampValue *string         `json:"timestampValue"`
+		KeyValue       json.RawMessage `json:"keyValue"`
+		StringValue    *string         `json:"stringValue"`
+		BlobValue      *[]byte         `json:"blobValue"`
+		GeoPointValue  *struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"geoPointValue"`
+		EntityValue *struct {
+			Key        json.RawMessage `json:"key"`
+			Properties json.RawMessage `json:"properties"`
+		} `json:"entityValue"`
+		ArrayValue *struct {
+			Values []json.RawMessage `json:"values"`
+		} `json:"arrayValue"`
+		ExcludeFromIndexes bool `json:"excludeFromIndexes"`
+	}
+	if err := json.Unmarshal(raw, &tv); err != nil {
+		return nil, false, err
+	}
+	// nullValue は値が null のため、メンバーがあるかどうかで判定します
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, false, err
+	}
+	_, isNull := members["nullValue"]
+	var v any
+	var err error
+	switch {
+	case tv.BooleanValue != nil:
+		v = *tv.BooleanValue
+	case tv.IntegerValue != nil:
+		v, err = strconv.ParseInt(*tv.IntegerValue, 10, 64)
+	case tv.DoubleValue != nil:
+		v = *tv.DoubleValue
+	case tv.TimestampValue != nil:
+		v, err = time.Parse(time.RFC3339Nano, *tv.TimestampValue)
+	case tv.KeyValue != nil:
+		v, err = UnmarshalKeyJSON(tv.KeyValue)
+	case tv.StringValue != nil:
+		v = *tv.StringValue
+	case tv.BlobValue != nil:
+		v = *tv.BlobValue
+	case tv.GeoPointValue != nil:
+		v = datastore.GeoPoint{Lat: tv.GeoPointValue.Latitude, Lng: tv.GeoPointValue.Longitude}
+	case tv.EntityValue != nil:
+		ent := &datastore.Entity{}
+		if len(tv.EntityValue.Key) > 0 {
+			if ent.Key, err = UnmarshalKeyJSON(tv.EntityValue.Key); err != nil {
+				return nil, false, err
+			}
+		}
+		if len(tv.EntityValue.Properties) > 0 {
+			members, err := decodeJSONObject(tv.EntityValue.Properties)
+			if err != nil {
+				return nil, false, err
+			}
+			if ent.Properties, err = typedProperties(members); err != nil {
+				return nil, false, err
+			}
+		}
+		v = ent
+	case tv.ArrayValue != nil:
+		values := make([]any, len(tv.ArrayValue.Values))
+		for i, elem := range tv.ArrayValue.Values {
+			if values[i], _, err = typedValue(elem); err != nil {
+				return nil, false, err
+			}
+		}
+		v = values
+	case isNull:
+	default:
+		return nil, false, errors.New("no value")
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return v, tv.ExcludeFromIndexes, nil
+}
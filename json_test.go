@@ -0,0 +1,130 @@
+package entitystore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyJSON(t *testing.T) {
+	parent := datastore.NameKey("Parent", "p", nil)
+	parent.Namespace = "ns"
+	key := datastore.IDKey("Child", 1<<60+1, parent)
+	key.Namespace = "ns"
+
+	for _, format := range []JSONKeyFormat{JSONKeyEncoded, JSONKeyObject} {
+		data, err := MarshalKeyJSON(key, JSONOptions{KeyFormat: format})
+		require.NoError(t, err)
+		got, err := UnmarshalKeyJSON(data)
+		require.NoError(t, err)
+		require.True(t, key.Equal(got), string(data))
+	}
+
+	data, err := MarshalKeyJSON(key, JSONOptions{KeyFormat: JSONKeyObject})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"kind":"Child","id":"1152921504606846977","namespace":"ns","parent":{"kind":"Parent","name":"p","namespace":"ns"}}`, string(data))
+
+	got, err := UnmarshalKeyJSON([]byte("null"))
+	require.NoError(t, err)
+	require.Nil(t, got)
+	_, err = UnmarshalKeyJSON([]byte(`{"id":"1"}`))
+	require.Error(t, err)
+}
+
+func TestMarshalEntityJSON(t *testing.T) {
+	author := datastore.NameKey("RefTestAuthor", "1", nil)
+	e := &QueryTestEntity{
+		Id:      3,
+		Name:    "name",
+		Score:   1.5,
+		Count:   2,
+		Tags:    []string{"a", "b"},
+		Memo:    "memo",
+		Address: QueryTestAddress{City: "Tokyo", Zip: "100"},
+		Author:  RefTo[*RefTestAuthor](author),
+	}
+	e.SetUpdatedAt(time.Date(2024, 1, 2, 3, 4, 5, 6000, time.FixedZone("JST", 9*60*60)))
+
+	data, err := MarshalEntityJSON(e, JSONOptions{KeyFormat: JSONKeyObject})
+	require.NoError(t, err)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(data, &m))
+	require.Equal(t, map[string]any{"kind": "QueryTestEntity", "id": "3"}, m[keyProperty])
+	require.Equal(t, "2024-01-01T18:04:05.000006Z", m["UpdatedAt"])
+	require.Equal(t, "name", m["name"])
+	require.Equal(t, []any{"a", "b"}, m["Tags"])
+	require.Equal(t, "Tokyo", m["Address.City"])
+	require.Equal(t, map[string]any{"kind": "RefTestAuthor", "name": "1"}, m["Author"])
+
+	// "__key__" は最初のメンバーになる
+	require.Contains(t, string(data[:len(`{"__key__"`)]), keyProperty)
+
+	dst := &QueryTestEntity{}
+	require.NoError(t, UnmarshalEntityJSON(data, dst))
+	require.True(t, e.UpdatedAt().Equal(dst.UpdatedAt()))
+	require.Equal(t, e.Name, dst.Name)
+	require.Equal(t, e.Score, dst.Score)
+	require.Equal(t, e.Count, dst.Count)
+	require.Equal(t, e.Tags, dst.Tags)
+	require.Equal(t, e.Address, dst.Address)
+	require.True(t, author.Equal(dst.Author.Key()))
+}
+
+func TestUnmarshalEntityJSON_Key(t *testing.T) {
+	src := &TaggedTestEntity{Id: 5, Value: "v"}
+	data, err := MarshalEntityJSON(src, JSONOptions{})
+	require.NoError(t, err)
+
+	dst := &TaggedTestEntity{}
+	require.NoError(t, UnmarshalEntityJSON(data, dst))
+	require.Equal(t, int64(5), dst.Id)
+	require.Equal(t, "v", dst.Value)
+
+	require.Error(t, UnmarshalEntityJSON(data, TaggedTestEntity{}))
+	require.Error(t, UnmarshalEntityJSON([]byte(`{"Value":1}`), &TaggedTestEntity{}))
+}
+
+func TestPropertiesJSON(t *testing.T) {
+	key := datastore.IDKey("Kind", 1<<60+1, nil)
+	ps := []datastore.Property{
+		{Name: "Null", Value: nil},
+		{Name: "Bool", Value: true},
+		{Name: "Int", Value: int64(1<<60 + 1)},
+		{Name: "Float", Value: 1.5},
+		{Name: "Time", Value: time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)},
+		{Name: "Key", Value: key},
+		{Name: "String", Value: "s"},
+		{Name: "Bytes", Value: []byte{0, 1, 2}, NoIndex: true},
+		{Name: "Geo", Value: datastore.GeoPoint{Lat: 35.6, Lng: 139.7}},
+		{Name: "Entity", Value: &datastore.Entity{
+			Key:        datastore.NameKey("Nested", "n", nil),
+			Properties: []datastore.Property{{Name: "A", Value: int64(1)}},
+		}},
+		{Name: "Array", Value: []any{int64(1), "a", nil}},
+	}
+
+	for _, format := range []JSONKeyFormat{JSONKeyEncoded, JSONKeyObject} {
+		data, err := MarshalPropertiesJSON(ps, JSONOptions{KeyFormat: format})
+		require.NoError(t, err)
+		got, err := UnmarshalPropertiesJSON(data)
+		require.NoError(t, err)
+		require.Equal(t, len(ps), len(got))
+		for i := range ps {
+			require.Equal(t, ps[i].Name, got[i].Name)
+			require.Equal(t, ps[i].NoIndex, got[i].NoIndex)
+			require.Empty(t, diffProperties(ps[i:i+1], got[i:i+1]), ps[i].Name)
+		}
+	}
+
+	data, err := MarshalPropertiesJSON(ps[2:3], JSONOptions{})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Int":{"integerValue":"1152921504606846977"}}`, string(data))
+
+	_, err = MarshalPropertiesJSON([]datastore.Property{{Name: "X", Value: 1}}, JSONOptions{})
+	require.Error(t, err)
+	_, err = UnmarshalPropertiesJSON([]byte(`{"X":{}}`))
+	require.Error(t, err)
+}
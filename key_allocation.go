@@ -0,0 +1,122 @@
+package entitystore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KeySetter はエンティティのキーを受け取るエンティティのインターフェースです。
+// ID の自動割り当て時には割り当てられたキーで、ロード時にはロードしたエンティティのキーで呼び出されます。
+// SetKey を実装しない場合、ID の自動割り当て時には構造体タグ `entitystore:"id"` を付けた整数のフィールドに ID が設定されます。
+type KeySetter interface {
+	SetKey(key *datastore.Key)
+}
+
+// idFieldCache は型ごとの ID フィールドの位置のキャッシュです。
+var idFieldCache sync.Map // map[reflect.Type][]int
+
+// hasTagOption は構造体タグ `entitystore:"..."` に opt が含まれているかどうかを返します。
+func hasTagOption(sf reflect.StructField, opt string) bool {
+	_, ok := tagOptionValue(sf, opt)
+	return ok
+}
+
+// tagOptionValue は構造体タグ `entitystore:"..."` の opt または opt=value の値を返します。
+func tagOptionValue(sf reflect.StructField, opt string) (string, bool) {
+	tag, ok := sf.Tag.Lookup("entitystore")
+	if !ok {
+		return "", false
+	}
+	for _, o := range strings.Split(tag, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(o), "=")
+		if name == opt {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// idField は構造体タグ `entitystore:"id"` を付けたフィールドの位置を返します。結果はキャッシュされます。
+func idField(t reflect.Type) ([]int, error) {
+	if cached, ok := idFieldCache.Load(t); ok {
+		return cached.([]int), nil
+	}
+	var index []int
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() || !hasTagOption(sf, "id") {
+			continue
+		}
+		switch sf.Type.Kind() {
+		case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		default:
+			return nil, fmt.Errorf("entitystore: id field %s.%s must be an integer but is %s", t.Name(), sf.Name, sf.Type)
+		}
+		index = sf.Index
+		break
+	}
+	idFieldCache.Store(t, index)
+	return index, nil
+}
+
+// setEntityKey は割り当てられたキーをエンティティに書き戻します。
+// KeySetter を実装している場合は SetKey を、TaggedEntityBase を埋め込んでいる場合は ApplyKey を、
+// そうでない場合は ID フィールドを使用します。
+// どちらも無い場合は何もしません。
+func setEntityKey(e any, key *datastore.Key) error {
+	if ks, ok := e.(KeySetter); ok {
+		ks.SetKey(key)
+		return nil
+	}
+	if _, ok := e.(keyTagged); ok {
+		return ApplyKey(e, key)
+	}
+	v := reflect.ValueOf(e)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	v = v.Elem()
+	index, err := idField(v.Type())
+	if err != nil || index == nil {
+		return err
+	}
+	f := v.FieldByIndex(index)
+	switch f.Kind() {
+	case reflect.Uint, reflect.Uint64:
+		f.SetUint(uint64(key.ID))
+	default:
+		f.SetInt(key.ID)
+	}
+	return nil
+}
+
+// allocateKeys はキーが不完全な保存操作に ID を一括で割り当て、エンティティに書き戻します。
+// 削除と更新の操作は対象外です。
+func allocateKeys(ctx context.Context, ops []*writeOp) error {
+	var targets []*writeOp
+	var keys []*datastore.Key
+	for _, op := range ops {
+		if op.key.Incomplete() && (op.typ == MutationTypeInsert || op.typ == MutationTypeUpsert) {
+			targets = append(targets, op)
+			keys = append(keys, op.key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	allocated, err := allocateIDs(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for i, op := range targets {
+		op.key = allocated[i]
+		if err := setEntityKey(op.src, op.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
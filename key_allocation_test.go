@@ -0,0 +1,61 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+type keySetterTestEntity struct {
+	TestEntity
+	key *datastore.Key
+}
+
+func (e *keySetterTestEntity) SetKey(key *datastore.Key) {
+	e.key = key
+}
+
+func TestSetEntityKey(t *testing.T) {
+	key := datastore.IDKey("AutoIDTestEntity", 123, nil)
+
+	e := &AutoIDTestEntity{}
+	require.NoError(t, setEntityKey(e, key))
+	require.Equal(t, int64(123), e.Id)
+
+	ks := &keySetterTestEntity{}
+	require.NoError(t, setEntityKey(ks, key))
+	require.Equal(t, key, ks.key)
+
+	// ID フィールドが無い場合は何もしない
+	require.NoError(t, setEntityKey(&TestEntity{}, key))
+
+	type invalid struct {
+		Id string `entitystore:"id"`
+	}
+	require.Error(t, setEntityKey(&invalid{}, key))
+}
+
+func TestPutEntity_AutoID(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	require.NoError(t, DeleteAll(ctx, "AutoIDTestEntity"))
+
+	e := &AutoIDTestEntity{Value: "Test1"}
+	require.NoError(t, PutEntity(ctx, e))
+	require.NotZero(t, e.Id)
+
+	es := []*AutoIDTestEntity{{Value: "Test2"}, {Value: "Test3"}}
+	require.NoError(t, PutEntityMulti(ctx, es))
+	require.NotZero(t, es[0].Id)
+	require.NotEqual(t, es[0].Id, es[1].Id)
+
+	e4 := &AutoIDTestEntity{Value: "Test4"}
+	require.NoError(t, MutateEntity(ctx, NewInsert(e4)))
+	require.NotZero(t, e4.Id)
+
+	loaded := &AutoIDTestEntity{Id: e.Id}
+	require.NoError(t, GetEntity(ctx, loaded))
+	require.Equal(t, "Test1", loaded.Value)
+}
@@ -0,0 +1,251 @@
+package entitystore
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// keyMeta は構造体タグから取得したキーの情報です。
+type keyMeta struct {
+	kind      string
+	namespace string
+	id        []int
+	name      []int
+	parent    []int
+	ns        []int
+}
+
+// keyMetaCache は型ごとのキーの情報のキャッシュです。
+var keyMetaCache sync.Map // map[reflect.Type]*keyMeta
+
+// rawKeySetter は親のキーのフィールドにキーを設定するためのインターフェースです。
+type rawKeySetter interface {
+	setRawKey(key *datastore.Key)
+}
+
+func (k *Key[E]) setRawKey(key *datastore.Key) {
+	k.key = key
+}
+
+// keyMetaOf は型のキーの情報を構造体タグから取得します。結果はキャッシュされます。
+//
+// 以下の構造体タグ `entitystore:"..."` を使用します。
+//   - kind=名前, namespace=名前: 埋め込みフィールドに付けて Kind と名前空間を指定します。Kind を省略した場合は型名になります。
+//   - id: 数値 ID のフィールド (整数型)
+//   - name: 文字列 ID のフィールド (string)
+//   - parent: 親のキーのフィールド (*datastore.Key または Key[P])
+//   - namespace: 名前空間のフィールド (string)
+func keyMetaOf(t reflect.Type) (*keyMeta, error) {
+	if cached, ok := keyMetaCache.Load(t); ok {
+		return cached.(*keyMeta), nil
+	}
+	m := &keyMeta{kind: t.Name()}
+	for _, sf := range reflect.VisibleFields(t) {
+		if sf.Anonymous {
+			if kind, ok := tagOptionValue(sf, "kind"); ok && kind != "" {
+				m.kind = kind
+			}
+			if ns, ok := tagOptionValue(sf, "namespace"); ok && ns != "" {
+				m.namespace = ns
+			}
+			continue
+		}
+		if !sf.IsExported() || throughPointer(t, sf.Index) {
+			continue
+		}
+		var err error
+		switch {
+		case hasTagOption(sf, "id"):
+			err = m.setField(&m.id, sf, isIntegerKind(sf.Type.Kind()))
+		case hasTagOption(sf, "name"):
+			err = m.setField(&m.name, sf, sf.Type.Kind() == reflect.String)
+		case hasTagOption(sf, "parent"):
+			ok := sf.Type == reflect.TypeOf((*datastore.Key)(nil)) || reflect.PointerTo(sf.Type).Implements(reflect.TypeOf((*rawKeySetter)(nil)).Elem())
+			err = m.setField(&m.parent, sf, ok)
+		case hasTagOption(sf, "namespace"):
+			err = m.setField(&m.ns, sf, sf.Type.Kind() == reflect.String)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("entitystore: invalid key tag on %s: %w", t.Name(), err)
+		}
+	}
+	if m.id != nil && m.name != nil {
+		return nil, fmt.Errorf("entitystore: %s has both id and name fields", t.Name())
+	}
+	if m.id == nil && m.name == nil {
+		return nil, fmt.Errorf("entitystore: %s has no id or name field", t.Name())
+	}
+	keyMetaCache.Store(t, m)
+	return m, nil
+}
+
+// setField はキーのフィールドの位置を記録します。
+func (m *keyMeta) setField(dst *[]int, sf reflect.StructField, typeOK bool) error {
+	if !typeOK {
+		return fmt.Errorf("field %s has unsupported type %s", sf.Name, sf.Type)
+	}
+	if *dst != nil {
+		return fmt.Errorf("duplicate tag on field %s", sf.Name)
+	}
+	*dst = sf.Index
+	return nil
+}
+
+// throughPointer はフィールドの位置がポインタの埋め込みフィールドを経由するかどうかを返します。
+func throughPointer(t reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		f := t.Field(i)
+		if f.Type.Kind() == reflect.Ptr {
+			return true
+		}
+		t = f.Type
+	}
+	return false
+}
+
+// isIntegerKind は整数型かどうかを返します。
+func isIntegerKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	default:
+		return false
+	}
+}
+
+// structValue は構造体のポインタから構造体の値を取り出します。
+func structValue(e any) (reflect.Value, error) {
+	v := reflect.ValueOf(e)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("entitystore: %T is not a pointer to struct", e)
+	}
+	return v.Elem(), nil
+}
+
+// DeriveKey は構造体タグからエンティティのキーを作成します。
+// 構造体タグの書き方は TaggedEntityBase を参照してください。
+// 他の EntityBase を埋め込んでいるため TaggedEntityBase を使用できない場合は、Key() メソッドから呼び出して使用します。
+//
+//	func (e *User) Key() *datastore.Key {
+//		return entitystore.DeriveKey(e)
+//	}
+//
+// 構造体タグが不正な場合はパニックを起こします。
+func DeriveKey(e any) *datastore.Key {
+	v, err := structValue(e)
+	if err != nil {
+		panic(err)
+	}
+	m, err := keyMetaOf(v.Type())
+	if err != nil {
+		panic(err)
+	}
+	var parent *datastore.Key
+	if m.parent != nil {
+		switch p := v.FieldByIndex(m.parent).Interface().(type) {
+		case *datastore.Key:
+			parent = p
+		case interface{ Key() *datastore.Key }:
+			parent = p.Key()
+		}
+	}
+	var key *datastore.Key
+	if m.id != nil {
+		f := v.FieldByIndex(m.id)
+		var id int64
+		if f.CanInt() {
+			id = f.Int()
+		} else {
+			id = int64(f.Uint())
+		}
+		key = datastore.IDKey(m.kind, id, parent)
+	} else {
+		key = datastore.NameKey(m.kind, v.FieldByIndex(m.name).String(), parent)
+	}
+	key.Namespace = m.namespace
+	if m.ns != nil {
+		if ns := v.FieldByIndex(m.ns).String(); ns != "" {
+			key.Namespace = ns
+		}
+	}
+	return key
+}
+
+// ApplyKey はキーの ID、親のキー、名前空間を構造体タグの付いたフィールドに設定します。
+// DeriveKey の逆の操作です。
+func ApplyKey(e any, key *datastore.Key) error {
+	v, err := structValue(e)
+	if err != nil {
+		return err
+	}
+	m, err := keyMetaOf(v.Type())
+	if err != nil {
+		return err
+	}
+	if key.Kind != m.kind {
+		return fmt.Errorf("entitystore: key kind %q does not match %q", key.Kind, m.kind)
+	}
+	if m.id != nil {
+		f := v.FieldByIndex(m.id)
+		if f.CanInt() {
+			f.SetInt(key.ID)
+		} else {
+			f.SetUint(uint64(key.ID))
+		}
+	} else {
+		v.FieldByIndex(m.name).SetString(key.Name)
+	}
+	if m.parent != nil {
+		f := v.FieldByIndex(m.parent)
+		if rs, ok := f.Addr().Interface().(rawKeySetter); ok {
+			rs.setRawKey(key.Parent)
+		} else {
+			f.Set(reflect.ValueOf(key.Parent))
+		}
+	}
+	if m.ns != nil {
+		v.FieldByIndex(m.ns).SetString(key.Namespace)
+	}
+	return nil
+}
+
+// TaggedEntityBase は構造体タグからキーを作成するエンティティのための EntityBase です。
+// T には埋め込み先の構造体の型を指定します。Kind() は構造体タグから Kind 名を返します。
+// Key() は埋め込み先の構造体で DeriveKey を呼び出して定義するか、entitystore-gen で生成します。
+//
+//	type Book struct {
+//		entitystore.TaggedEntityBase[Book] `entitystore:"kind=Book"`
+//		Id     int64          `datastore:"-" entitystore:"id"`
+//		Author *datastore.Key `datastore:"-" entitystore:"parent"`
+//		Title  string
+//	}
+//
+//	func (e *Book) Key() *datastore.Key {
+//		return entitystore.DeriveKey(e)
+//	}
+//
+// ID や親のキーのフィールドはキーに含まれるため、`datastore:"-"` でプロパティから除外できます。
+// ロード時と ID の自動割り当て時には、KeySetter を実装していなければ ApplyKey でキーからこれらのフィールドが設定されます。
+type TaggedEntityBase[T any] struct {
+	EntityBase
+}
+
+// keyTagged は TaggedEntityBase を埋め込んだエンティティのインターフェースです。
+type keyTagged interface {
+	keyTagged()
+}
+
+func (b *TaggedEntityBase[T]) keyTagged() {}
+
+// Kind は Kind 名を返します。Kinder の実装です。
+func (b *TaggedEntityBase[T]) Kind() string {
+	m, err := keyMetaOf(reflect.TypeFor[T]())
+	if err != nil {
+		panic(err)
+	}
+	return m.kind
+}
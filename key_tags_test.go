@@ -0,0 +1,86 @@
+package entitystore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyMetaOf(t *testing.T) {
+	m, err := keyMetaOf(reflect.TypeOf(TaggedTestEntity{}))
+	require.NoError(t, err)
+	require.Equal(t, "TaggedTestEntity", m.kind)
+
+	type noID struct {
+		Value string
+	}
+	_, err = keyMetaOf(reflect.TypeOf(noID{}))
+	require.Error(t, err)
+
+	type named struct {
+		EntityBase `entitystore:"kind=Named,namespace=ns1"`
+		Code       string           `entitystore:"name"`
+		Owner      Key[*TestEntity] `entitystore:"parent"`
+	}
+	e := &named{Code: "abc", Owner: NameKey[*TestEntity]("1")}
+	key := DeriveKey(e)
+	require.Equal(t, "Named", key.Kind)
+	require.Equal(t, "abc", key.Name)
+	require.Equal(t, "ns1", key.Namespace)
+	require.Equal(t, "TestEntity", key.Parent.Kind)
+
+	e2 := &named{}
+	require.NoError(t, ApplyKey(e2, key))
+	require.Equal(t, "abc", e2.Code)
+	require.True(t, e2.Owner.Equal(e.Owner))
+}
+
+func TestTaggedEntityBase(t *testing.T) {
+	parent := datastore.NameKey("TestEntity", "1", nil)
+	e := &TaggedTestEntity{Id: 10, Parent: parent}
+	require.Equal(t, datastore.IDKey("TaggedTestEntity", 10, parent), e.Key())
+	require.Equal(t, "TaggedTestEntity", KindOf[*TaggedTestEntity]())
+
+	var ent Entity = e
+	require.Equal(t, int64(10), ent.Key().ID)
+
+	// ロード時にキーからフィールドを設定する
+	loaded := &TaggedTestEntity{}
+	ps, err := saveStruct(e)
+	require.NoError(t, err)
+	require.NoError(t, loadEntity(context.Background(), e.Key(), ps, loaded))
+	require.Equal(t, int64(10), loaded.Id)
+	require.Equal(t, parent, loaded.Parent)
+
+	// ID の自動割り当て時にもキーからフィールドを設定する
+	allocated := &TaggedTestEntity{}
+	require.NoError(t, setEntityKey(allocated, datastore.IDKey("TaggedTestEntity", 20, parent)))
+	require.Equal(t, int64(20), allocated.Id)
+	require.Equal(t, parent, allocated.Parent)
+
+	// コピーしたエンティティはコピー先のフィールドからキーを作成する
+	copied := *e
+	copied.Id = 30
+	require.Equal(t, int64(30), copied.Key().ID)
+	require.Equal(t, int64(10), e.Key().ID)
+}
+
+func TestTaggedEntityBase_PutAndGet(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	require.NoError(t, DeleteAll(ctx, "TaggedTestEntity"))
+
+	e := &TaggedTestEntity{Value: "Test1"}
+	require.NoError(t, PutEntity(ctx, e))
+	require.NotZero(t, e.Id)
+
+	keys, err := GetKeyAll(ctx, NewQuery("TaggedTestEntity"))
+	require.NoError(t, err)
+	es := []*TaggedTestEntity{{}}
+	require.NoError(t, GetMulti(ctx, keys, toAnySlice(es)))
+	require.Equal(t, e.Id, es[0].Id)
+	require.Equal(t, "Test1", es[0].Value)
+}
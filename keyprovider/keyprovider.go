@@ -0,0 +1,51 @@
+// Package keyprovider は entitystore のフィールド暗号化に使用する鍵を提供します。
+package keyprovider
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeyNotFound は指定された ID の鍵が存在しない場合に返されるエラーです。
+var ErrKeyNotFound = errors.New("keyprovider: key not found")
+
+// KeyProvider はフィールド暗号化の鍵を提供するインターフェースです。
+// 鍵は AES-128, AES-192, AES-256 のいずれかに対応する 16, 24, 32 バイトである必要があります。
+// 暗号文には鍵の ID が一緒に保存されるため、鍵をローテーションしても古い鍵で暗号化したデータを復号できます。
+type KeyProvider interface {
+	// CurrentKey は新しく暗号化する際に使用する鍵と、その鍵の ID を返します。
+	CurrentKey() (id string, key []byte, err error)
+	// Key は ID の鍵を返します。存在しない場合は ErrKeyNotFound を返します。
+	Key(id string) ([]byte, error)
+}
+
+// Static は固定の鍵を使用する KeyProvider の実装です。
+// 鍵をローテーションする場合は、新しい鍵を Keys に追加して Current を新しい鍵の ID に変更します。
+// 古い鍵は、その鍵で暗号化したデータが残っている間は Keys に残しておく必要があります。
+type Static struct {
+	// Current は暗号化に使用する鍵の ID です。
+	Current string
+	// Keys は鍵の ID と鍵の組です。
+	Keys map[string][]byte
+}
+
+func (s *Static) CurrentKey() (string, []byte, error) {
+	key, err := s.Key(s.Current)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.Current, key, nil
+}
+
+func (s *Static) Key(id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, id)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("keyprovider: key %q has invalid length %d", id, len(key))
+	}
+}
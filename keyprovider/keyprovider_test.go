@@ -0,0 +1,35 @@
+package keyprovider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatic(t *testing.T) {
+	s := &Static{
+		Current: "v2",
+		Keys: map[string][]byte{
+			"v1":    make([]byte, 16),
+			"v2":    make([]byte, 32),
+			"short": make([]byte, 10),
+		},
+	}
+	id, key, err := s.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, "v2", id)
+	require.Len(t, key, 32)
+
+	key, err = s.Key("v1")
+	require.NoError(t, err)
+	require.Len(t, key, 16)
+
+	_, err = s.Key("v3")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = s.Key("short")
+	require.Error(t, err)
+
+	s.Current = "v3"
+	_, _, err = s.CurrentKey()
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
@@ -0,0 +1,72 @@
+package entitystore
+
+import (
+	"sync"
+	"time"
+)
+
+// KindOptions は Kind ごとの動作を設定するための構造体です。
+// RegisterKind で Kind に対して登録します。
+type KindOptions struct {
+	// SoftDelete が true の場合、削除はエンティティを消去せずに DeletedAt プロパティに削除日時を記録します。
+	// 対象の Kind のエンティティは SoftDeleteBase を埋め込むなどして DeletedAt プロパティを持つ必要があります。
+	// 論理削除されたエンティティは Get などでは存在しないものとして扱われ、
+	// NewQuery で作成したクエリからは DeletedAt がゼロ値であることを条件に除外されます。
+	// そのため、他のフィルタや並び順と組み合わせる場合は DeletedAt を含む複合インデックスが必要になります。
+	// また、DeletedAt プロパティを持たない既存のエンティティはクエリにマッチしなくなるので、保存し直す必要があります。
+	SoftDelete bool
+	// History が true の場合、書き込みのたびに同じトランザクション内で変更履歴を記録します。
+	// 変更履歴はエンティティの子エンティティとして保存され、ListHistory で取得できます。
+	// 変更前後のプロパティをすべて保存するため、エンティティのサイズが大きい場合は
+	// 変更履歴のエンティティがサイズの上限を超える可能性があります。
+	// BlobStore に保存した Blob は変更履歴から参照されるため、参照されなくなっても削除しません。
+	// RestoreHistory で変更履歴の状態に戻すには Entity を指定してください。
+	History bool
+	// Outbox が true の場合、書き込みのたびに同じトランザクション内でアウトボックスに変更イベントを記録します。
+	// 記録したイベントは OutboxRelay で EventSink に配信します。
+	Outbox bool
+	// Unique は一意制約です。制約ごとにプロパティ名を指定し、複数指定した場合は複合制約になります。
+	// 構造体タグ `entitystore:"unique"` で宣言した制約と合わせて、書き込みのトランザクション内で確認されます。
+	// 値は番兵エンティティで予約するため、既存のエンティティに制約を追加した場合は
+	// RepairUniqueConstraints で番兵エンティティを作成する必要があります。
+	// 構造体タグの制約は、キーのみで削除する場合のようにエンティティの無い書き込みでは Entity から取得します。
+	// 構造体タグ `entitystore:"encrypt"` で暗号化するプロパティは指定できません。
+	Unique [][]string
+	// Entity は Kind のエンティティの例です。構造体タグで宣言された一意制約と BlobStore に保存するフィールドの取得、
+	// RestoreHistory で変更履歴のプロパティをロードするエンティティの作成に使用します。
+	// 構造体タグで一意制約を宣言している場合は、Delete や ExpirySweeper などのキーのみの削除でも
+	// 番兵エンティティを削除できるように指定してください。
+	// 指定しない場合、キーのみの削除は BlobStore を使用していれば書き込み前の値を読み込み、参照している Blob を削除します。
+	Entity Entity
+	// Expiry が true の場合、ExpiresAt プロパティの日時を過ぎたエンティティを期限切れとして扱います。
+	// 対象の Kind のエンティティは ExpiryBase を埋め込むなどして ExpiresAt プロパティを持つ必要があります。
+	// ExpiresAt がゼロ値のエンティティは期限切れになりません。
+	// 期限切れのエンティティは Get などでは存在しないものとして扱われ、GetEntityAll や EntityLister.GetList の結果から除外されます。
+	// Datastore からの削除は ExpirySweeper で行います。
+	Expiry bool
+	// TTL が 0 より大きい場合、UpdatedAt から TTL が経過したエンティティを期限切れとして扱います。
+	// Expiry と両方を指定した場合は、先に来る方の日時で期限切れになります。
+	TTL time.Duration
+}
+
+// kindOptions は Kind ごとの設定です。
+var kindOptions = map[string]KindOptions{}
+
+// kindOptionsMu は kindOptions を保護します。
+var kindOptionsMu sync.RWMutex
+
+// RegisterKind は Kind ごとの動作を設定します。
+// 同じ Kind に対して再度登録した場合は設定を置き換えます。
+// 通常はアプリケーションの初期化時に、エンティティを操作する前に呼び出します。
+func RegisterKind(kind string, opts KindOptions) {
+	kindOptionsMu.Lock()
+	defer kindOptionsMu.Unlock()
+	kindOptions[kind] = opts
+}
+
+// optionsOf は Kind の設定を返します。登録されていない場合はゼロ値を返します。
+func optionsOf(kind string) KindOptions {
+	kindOptionsMu.RLock()
+	defer kindOptionsMu.RUnlock()
+	return kindOptions[kind]
+}
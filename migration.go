@@ -0,0 +1,283 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// schemaVersionProperty は EntityBase がスキーマバージョンを保存するプロパティ名です。
+const schemaVersionProperty = "SchemaVersion"
+
+// migrationCheckpointKind は MigrationRunner のチェックポイントを保存する Kind です。
+const migrationCheckpointKind = "EntitystoreMigrationCheckpoint"
+
+// PropertyMigrationFunc はロード前のプロパティを1バージョン分移行する関数です。
+// 引数のスライスは複製されたものなので、変更してそのまま返しても構いません。
+type PropertyMigrationFunc func(ctx context.Context, ps []datastore.Property) ([]datastore.Property, error)
+
+// migrationStep はスキーマバージョンを1つ進める移行処理です。
+// props と strct のどちらか一方が設定されます。
+type migrationStep struct {
+	props PropertyMigrationFunc
+	strct func(ctx context.Context, e Entity) error
+}
+
+// migrations は Kind ごと、移行元のバージョンごとの移行処理です。
+var migrations = map[string]map[int]migrationStep{}
+
+// migrationsMu は migrations を保護します。
+var migrationsMu sync.RWMutex
+
+// RegisterPropertyMigration は kind のスキーマバージョン from から from+1 への移行処理をプロパティに対する関数として登録します。
+// 同じバージョンに対する移行処理が既に登録されている場合は置き換えます。
+func RegisterPropertyMigration(kind string, from int, f PropertyMigrationFunc) {
+	registerMigration(kind, from, migrationStep{props: f})
+}
+
+// RegisterStructMigration は kind のスキーマバージョン from から from+1 への移行処理を
+// ロード済みのエンティティに対する関数として登録します。
+// 同じバージョンに対する移行処理が既に登録されている場合は置き換えます。
+func RegisterStructMigration[E Entity](kind string, from int, f func(ctx context.Context, e E) error) {
+	registerMigration(kind, from, migrationStep{strct: func(ctx context.Context, e Entity) error {
+		te, ok := e.(E)
+		if !ok {
+			return fmt.Errorf("entitystore: migration of %s v%d expects %T but got %T", kind, from, te, e)
+		}
+		return f(ctx, te)
+	}})
+}
+
+func registerMigration(kind string, from int, step migrationStep) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if migrations[kind] == nil {
+		migrations[kind] = make(map[int]migrationStep)
+	}
+	migrations[kind][from] = step
+}
+
+// lookupMigration は kind の from からの移行処理を返します。
+func lookupMigration(kind string, from int) (migrationStep, bool) {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	step, ok := migrations[kind][from]
+	return step, ok
+}
+
+// hasMigrations は kind に移行処理が登録されているかどうかを返します。
+func hasMigrations(kind string) bool {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	return len(migrations[kind]) > 0
+}
+
+// storedSchemaVersion はプロパティに保存されているスキーマバージョンを返します。
+// スキーマバージョンが保存されていない場合は 0 を返します。
+func storedSchemaVersion(ps []datastore.Property) int {
+	for _, p := range ps {
+		if p.Name == schemaVersionProperty {
+			if v, ok := p.Value.(int64); ok {
+				return int(v)
+			}
+		}
+	}
+	return 0
+}
+
+// migrateEntity はプロパティをエンティティにロードします。
+// 保存されているスキーマバージョンが e.CurrentSchemaVersion() より古い場合は、
+// 登録されている移行処理を順番に適用し、スキーマバージョンを現在のものに更新します。
+// 移行処理が登録されていないバージョンは変更なしとして扱います。
+func migrateEntity(ctx context.Context, key *datastore.Key, ps []datastore.Property, e Entity) error {
+	kind := key.Kind
+	from := storedSchemaVersion(ps)
+	to := e.CurrentSchemaVersion()
+	if from >= to || !hasMigrations(kind) {
+		return loadStruct(key, ps, e)
+	}
+	// キャッシュの内容を変更しないよう複製してから移行する
+	// プロパティでの移行には暗号化されたプロパティを復号して渡す
+	ps, err := decryptProperties(key, e, slices.Clone(ps))
+	if err != nil {
+		return err
+	}
+	loaded := false
+	for v := from; v < to; v++ {
+		step, ok := lookupMigration(kind, v)
+		if !ok {
+			continue
+		}
+		if step.props != nil {
+			if loaded {
+				// 構造体での移行の後にプロパティでの移行がある場合はプロパティに戻す
+				if ps, err = savePlainStruct(e); err != nil {
+					return err
+				}
+				loaded = false
+			}
+			if ps, err = step.props(ctx, ps); err != nil {
+				return fmt.Errorf("entitystore: migration of %s v%d failed: %w", kind, v, err)
+			}
+		} else {
+			if !loaded {
+				if err = loadStruct(key, ps, e); err != nil {
+					return err
+				}
+				loaded = true
+			}
+			if err = step.strct(ctx, e); err != nil {
+				return fmt.Errorf("entitystore: migration of %s v%d failed: %w", kind, v, err)
+			}
+		}
+	}
+	if !loaded {
+		if err = loadStruct(key, ps, e); err != nil {
+			return err
+		}
+	}
+	e.SetSchemaVersion(to)
+	return nil
+}
+
+// MigrationRunner は古いスキーマバージョンのまま保存されているエンティティを一括で移行し、
+// 再保存するためのインターフェースです。
+// 処理はバッチごとにチェックポイントとしてDatastoreに記録されるため、中断しても続きから再開できます。
+type MigrationRunner interface {
+	WithBatchSize(n int) MigrationRunner
+	RunBatch(ctx context.Context) (migrated int, done bool, err error)
+	Run(ctx context.Context) (migrated int, err error)
+	Reset(ctx context.Context) error
+}
+
+type migrationRunner[E Entity] struct {
+	kind      string
+	e         E
+	batchSize int
+}
+
+// migrationCheckpoint は MigrationRunner の進捗です。
+type migrationCheckpoint struct {
+	Cursor    string `datastore:",noindex"`
+	Migrated  int    `datastore:",noindex"`
+	UpdatedAt time.Time
+}
+
+// NewMigrationRunner コンストラクタ
+// kind の SchemaVersion が e.CurrentSchemaVersion() より小さいエンティティを対象とします。
+// SchemaVersion プロパティを持たないエンティティは対象になりません。
+func NewMigrationRunner[E Entity](kind string, e E) MigrationRunner {
+	return &migrationRunner[E]{
+		kind:      kind,
+		e:         e,
+		batchSize: 100,
+	}
+}
+
+// WithBatchSize は1バッチで移行するエンティティの数を設定します。
+// デフォルトは100件です。
+func (r *migrationRunner[E]) WithBatchSize(n int) MigrationRunner {
+	r.batchSize = n
+	return r
+}
+
+// checkpointKey はチェックポイントのキーを返します。
+// 移行先のバージョンごとに別のチェックポイントになります。
+func (r *migrationRunner[E]) checkpointKey() *datastore.Key {
+	return datastore.NameKey(migrationCheckpointKind, fmt.Sprintf("%s@%d", r.kind, r.e.CurrentSchemaVersion()), nil)
+}
+
+// RunBatch は1バッチ分の移行を行い、チェックポイントを更新します。
+// 戻り値として、移行したエンティティの数と、すべての移行が完了したかどうかを返します。
+// 移行が完了した場合はチェックポイントを削除します。
+func (r *migrationRunner[E]) RunBatch(ctx context.Context) (int, bool, error) {
+	var cp migrationCheckpoint
+	cpKey := r.checkpointKey()
+	err := client.Get(ctx, cpKey, &cp)
+	if err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+		return 0, false, err
+	}
+	q := NewQuery(r.kind).FilterField(schemaVersionProperty, "<", r.e.CurrentSchemaVersion()).KeysOnly()
+	if cp.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(cp.Cursor)
+		if err != nil {
+			return 0, false, err
+		}
+		q = q.Start(cursor)
+	}
+	itr := client.Run(ctx, q)
+	var keys []*datastore.Key
+	for len(keys) < r.batchSize {
+		key, err := itr.Next(nil)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		keys = append(keys, key)
+	}
+	done := len(keys) < r.batchSize
+	migrated := 0
+	if len(keys) > 0 {
+		// ロード時に移行処理が適用されるので、そのまま保存し直す
+		constructor := entityConstructor(r.e)
+		es := make([]E, len(keys))
+		for i := range es {
+			es[i] = constructor()
+		}
+		err := GetMulti(ctx, keys, toAnySlice(es))
+		if IsProblem(err) {
+			return 0, false, err
+		}
+		es = PickUp(es, err)
+		if err := PutEntityMulti(ctx, es); err != nil {
+			return 0, false, err
+		}
+		migrated = len(es)
+	}
+	if done {
+		return migrated, true, client.Delete(ctx, cpKey)
+	}
+	cursor, err := itr.Cursor()
+	if err != nil {
+		return 0, false, err
+	}
+	cp.Cursor = cursor.String()
+	cp.Migrated += migrated
+	cp.UpdatedAt = Now()
+	if _, err := client.Put(ctx, cpKey, &cp); err != nil {
+		return 0, false, err
+	}
+	return migrated, false, nil
+}
+
+// Run は移行が完了するまでバッチを繰り返し実行し、移行したエンティティの数を返します。
+// ctx がキャンセルされた場合は、それまでのチェックポイントを残したまま ctx のエラーを返します。
+func (r *migrationRunner[E]) Run(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		n, done, err := r.RunBatch(ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if done {
+			return total, nil
+		}
+	}
+}
+
+// Reset はチェックポイントを削除し、次回の実行を最初からやり直すようにします。
+func (r *migrationRunner[E]) Reset(ctx context.Context) error {
+	return client.Delete(ctx, r.checkpointKey())
+}
@@ -0,0 +1,104 @@
+package entitystore
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// cleanupMigrations はテストの終了時に kind に登録した移行処理を削除します。
+// 移行処理はパッケージ全体で共有されるため、他のテストのロードに影響しないようにします。
+func cleanupMigrations(t *testing.T, kind string) {
+	t.Cleanup(func() {
+		migrationsMu.Lock()
+		defer migrationsMu.Unlock()
+		delete(migrations, kind)
+	})
+}
+
+func TestMigrateEntity(t *testing.T) {
+	ctx := context.Background()
+	cleanupMigrations(t, "MigrationTestEntity")
+	// v0 -> v1: Name を FullName に変更
+	RegisterPropertyMigration("MigrationTestEntity", 0, func(_ context.Context, ps []datastore.Property) ([]datastore.Property, error) {
+		for i := range ps {
+			if ps[i].Name == "Name" {
+				ps[i].Name = "FullName"
+			}
+		}
+		return ps, nil
+	})
+	// v1 -> v2: Age の初期値を設定
+	RegisterStructMigration("MigrationTestEntity", 1, func(_ context.Context, e *MigrationTestEntity) error {
+		if e.Age == 0 {
+			e.Age = 20
+		}
+		return nil
+	})
+
+	ps := []datastore.Property{
+		{Name: "Id", Value: int64(1)},
+		{Name: "Name", Value: "Taro"},
+		{Name: "SchemaVersion", Value: int64(0)},
+	}
+	e := &MigrationTestEntity{}
+	err := migrateEntity(ctx, datastore.IDKey("MigrationTestEntity", 1, nil), ps, e)
+	require.NoError(t, err)
+	require.Equal(t, "Taro", e.FullName)
+	require.Equal(t, 20, e.Age)
+	require.Equal(t, 2, e.SchemaVersion())
+	// 元のプロパティは変更されない
+	require.Equal(t, "Name", ps[1].Name)
+
+	// 最新バージョンの場合は移行しない
+	ps = []datastore.Property{
+		{Name: "Id", Value: int64(2)},
+		{Name: "FullName", Value: "Hanako"},
+		{Name: "Age", Value: int64(0)},
+		{Name: "SchemaVersion", Value: int64(2)},
+	}
+	e = &MigrationTestEntity{}
+	err = migrateEntity(ctx, datastore.IDKey("MigrationTestEntity", 2, nil), ps, e)
+	require.NoError(t, err)
+	require.Equal(t, "Hanako", e.FullName)
+	require.Equal(t, 0, e.Age)
+}
+
+func TestMigrationRunner(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	err := DeleteAll(ctx, "MigrationTestEntity")
+	require.NoError(t, err)
+
+	cleanupMigrations(t, "MigrationTestEntity")
+	RegisterStructMigration("MigrationTestEntity", 1, func(_ context.Context, e *MigrationTestEntity) error {
+		e.Age = 30
+		return nil
+	})
+	for i := 1; i <= 3; i++ {
+		_, err := client.Put(ctx, datastore.NameKey("MigrationTestEntity", strconv.Itoa(i), nil), &datastore.PropertyList{
+			{Name: "Id", Value: int64(i)},
+			{Name: "FullName", Value: "Name"},
+			{Name: "Age", Value: int64(0)},
+			{Name: "SchemaVersion", Value: int64(1)},
+		})
+		require.NoError(t, err)
+	}
+
+	n, err := NewMigrationRunner("MigrationTestEntity", &MigrationTestEntity{}).WithBatchSize(2).Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	count, err := Count(ctx, NewQuery("MigrationTestEntity").FilterField("SchemaVersion", "<", 2))
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	e := &MigrationTestEntity{Id: 1}
+	err = GetEntity(ctx, e)
+	require.NoError(t, err)
+	require.Equal(t, 30, e.Age)
+	require.Equal(t, 2, e.SchemaVersion())
+}
@@ -58,6 +58,22 @@ func (mr *MockEntityListerMockRecorder[E]) GetKeyList(ctx, limit, cur any) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeyList", reflect.TypeOf((*MockEntityLister[E])(nil).GetKeyList), ctx, limit, cur)
 }
 
+// GetKeyListTyped mocks base method.
+func (m *MockEntityLister[E]) GetKeyListTyped(ctx context.Context, limit int, cur string) ([]entitystore.Key[E], string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetKeyListTyped", ctx, limit, cur)
+	ret0, _ := ret[0].([]entitystore.Key[E])
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetKeyListTyped indicates an expected call of GetKeyListTyped.
+func (mr *MockEntityListerMockRecorder[E]) GetKeyListTyped(ctx, limit, cur any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeyListTyped", reflect.TypeOf((*MockEntityLister[E])(nil).GetKeyListTyped), ctx, limit, cur)
+}
+
 // GetList mocks base method.
 func (m *MockEntityLister[E]) GetList(ctx context.Context, limit int, cur string) ([]E, string, error) {
 	m.ctrl.T.Helper()
@@ -101,6 +101,20 @@ func (mr *MockQueryMockRecorder) End(c any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "End", reflect.TypeOf((*MockQuery)(nil).End), c)
 }
 
+// Err mocks base method.
+func (m *MockQuery) Err() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Err")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Err indicates an expected call of Err.
+func (mr *MockQueryMockRecorder) Err() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Err", reflect.TypeOf((*MockQuery)(nil).Err))
+}
+
 // EventualConsistency mocks base method.
 func (m *MockQuery) EventualConsistency() entitystore.Query {
 	m.ctrl.T.Helper()
@@ -157,6 +171,20 @@ func (mr *MockQueryMockRecorder) FilterField(fieldName, operator, value any) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FilterField", reflect.TypeOf((*MockQuery)(nil).FilterField), fieldName, operator, value)
 }
 
+// IncludeDeleted mocks base method.
+func (m *MockQuery) IncludeDeleted() entitystore.Query {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IncludeDeleted")
+	ret0, _ := ret[0].(entitystore.Query)
+	return ret0
+}
+
+// IncludeDeleted indicates an expected call of IncludeDeleted.
+func (mr *MockQueryMockRecorder) IncludeDeleted() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IncludeDeleted", reflect.TypeOf((*MockQuery)(nil).IncludeDeleted))
+}
+
 // KeysOnly mocks base method.
 func (m *MockQuery) KeysOnly() entitystore.Query {
 	m.ctrl.T.Helper()
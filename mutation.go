@@ -27,8 +27,9 @@ type Mutation struct {
 }
 
 // NewDelete は削除用のMutationを作成します。
+// 削除前後のフックを呼び出すため、対象のエンティティも保持します。
 func NewDelete[E Entity](e E) *Mutation {
-	return &Mutation{MutationTypeDelete, e.Key(), nil}
+	return &Mutation{MutationTypeDelete, e.Key(), e}
 }
 
 // NewInsert は新規作成用のMutationを作成します。
@@ -48,26 +49,13 @@ func NewUpsert[E Entity](e E) *Mutation {
 
 // MutateEntity は複数のエンティティに対して変更を適用します。
 // 引数として渡されたMutationのリストに基づいて、Datastoreに対して一括で変更を行います。
+// 新規作成、更新の前には PrePutAction を呼び出します。
+// 新規作成のエンティティのキーが不完全な場合は ID を割り当て、エンティティに書き戻します。
 // 変更後、キャッシュから該当エンティティを削除します。
+// Mutation の数が1回のコミットの上限を超える場合は、バッチに分割して並行して書き込むため、すべての変更が一括で適用されるとは限りません。
+// 一部のバッチだけが書き込まれた場合は、失敗したバッチの Mutation の位置にエラーを設定した datastore.MultiError を返します。
 func MutateEntity(ctx context.Context, muts ...*Mutation) error {
-	_, err := client.Mutate(ctx, lo.Map(muts, func(m *Mutation, _ int) *datastore.Mutation {
-		switch m.Type {
-		case MutationTypeDelete:
-			return datastore.NewDelete(m.Key)
-		case MutationTypeInsert:
-			return datastore.NewInsert(m.Key, m.Entity)
-		case MutationTypeUpdate:
-			return datastore.NewUpdate(m.Key, m.Entity)
-		case MutationTypeUpsert:
-			return datastore.NewUpsert(m.Key, m.Entity)
-		default:
-			panic("unknown mutation type")
-		}
-	})...)
-	if err != nil {
-		return err
-	}
-	return cache.DeleteEntities(ctx, lo.Map(muts, func(m *Mutation, _ int) datastore.Key {
-		return *m.Key
+	return write(ctx, lo.Map(muts, func(m *Mutation, _ int) *writeOp {
+		return &writeOp{typ: m.Type, key: m.Key, src: m.Entity}
 	}))
 }
@@ -0,0 +1,343 @@
+package entitystore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+	"google.golang.org/api/iterator"
+)
+
+// outboxKind はアウトボックスのイベントを保存する Kind です。
+const outboxKind = "EntitystoreOutbox"
+
+// outboxCheckpointKind は OutboxRelay の進捗を保存する Kind です。
+const outboxCheckpointKind = "EntitystoreOutboxCheckpoint"
+
+// Event はアウトボックスに記録されるエンティティの変更イベントです。
+// KindOptions.Outbox が有効な Kind のエンティティを書き込むと、同じトランザクション内で記録されます。
+type Event struct {
+	// ID はイベントの ID です。記録された順に並ぶ文字列になります。
+	// 少なくとも1回の配信のため同じイベントが複数回配信される可能性があるので、受信側で重複の判定に使用できます。
+	ID string
+	// Kind は変更されたエンティティの Kind です。
+	Kind string
+	// Key は変更されたエンティティのキーです。
+	Key *datastore.Key
+	// Type は変更の種類です。論理削除の場合は MutationTypeDelete になります。
+	Type MutationType
+	// Properties は変更後のプロパティです。削除の場合は nil になります。
+	Properties []datastore.Property
+	// Changed は変更されたプロパティの名前です。
+	// 新規作成の場合は変更後のすべてのプロパティ、削除の場合は変更前のすべてのプロパティになります。
+	Changed []string
+	// Timestamp はイベントが記録された日時です。
+	Timestamp time.Time
+}
+
+// Save は datastore.PropertyLoadSaver の実装です。
+func (e *Event) Save() ([]datastore.Property, error) {
+	changed := make([]any, len(e.Changed))
+	for i, name := range e.Changed {
+		changed[i] = name
+	}
+	ps := []datastore.Property{
+		{Name: "Kind", Value: e.Kind},
+		{Name: "Key", Value: e.Key},
+		{Name: "Type", Value: int64(e.Type)},
+		{Name: "Changed", Value: changed, NoIndex: true},
+		{Name: "Timestamp", Value: e.Timestamp},
+	}
+	if e.Properties != nil {
+		ps = append(ps, datastore.Property{Name: "Properties", Value: &datastore.Entity{Properties: e.Properties}, NoIndex: true})
+	}
+	return ps, nil
+}
+
+// Load は datastore.PropertyLoadSaver の実装です。
+func (e *Event) Load(ps []datastore.Property) error {
+	for _, p := range ps {
+		switch p.Name {
+		case "Kind":
+			e.Kind, _ = p.Value.(string)
+		case "Key":
+			e.Key, _ = p.Value.(*datastore.Key)
+		case "Type":
+			n, _ := p.Value.(int64)
+			e.Type = MutationType(n)
+		case "Changed":
+			vs, _ := p.Value.([]any)
+			e.Changed = make([]string, 0, len(vs))
+			for _, v := range vs {
+				if s, ok := v.(string); ok {
+					e.Changed = append(e.Changed, s)
+				}
+			}
+		case "Timestamp":
+			e.Timestamp, _ = p.Value.(time.Time)
+		case "Properties":
+			if ent, ok := p.Value.(*datastore.Entity); ok {
+				e.Properties = ent.Properties
+			}
+		}
+	}
+	return nil
+}
+
+// eventID はイベントの ID を作成します。
+// 日時の順に並ぶよう、日時を0埋めした数値の後に書き込み内の順番と乱数を付加します。
+func eventID(t time.Time, seq int) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%020d-%04d-%s", t.UnixNano(), seq, hex.EncodeToString(b))
+}
+
+// eventIDBefore は t より前に記録されたすべてのイベントの ID より大きい文字列を返します。
+func eventIDBefore(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// changedProperties は変更されたプロパティの名前を返します。
+func changedProperties(before, after []datastore.Property) []string {
+	return lo.Map(diffProperties(before, after), func(c PropertyChange, _ int) string {
+		return c.Name
+	})
+}
+
+// outboxMutations はアウトボックスにイベントを記録する Mutation を作成します。
+// buildMutations の後に、トランザクション内で呼び出します。
+func outboxMutations(ops []*writeOp) []*datastore.Mutation {
+	var muts []*datastore.Mutation
+	now := Now().Truncate(time.Microsecond)
+	for i, op := range ops {
+		if op.skipped || !optionsOf(op.key.Kind).Outbox {
+			continue
+		}
+		if op.isDelete() && !op.exists {
+			continue // 存在しないエンティティの削除は記録しない
+		}
+		ev := &Event{
+			ID:         eventID(now, i),
+			Kind:       op.key.Kind,
+			Key:        op.key,
+			Type:       op.typ,
+			Properties: op.next,
+			Changed:    changedProperties(op.prev, op.next),
+			Timestamp:  now,
+		}
+		if op.isDelete() {
+			ev.Properties = nil
+		}
+		muts = append(muts, datastore.NewInsert(datastore.NameKey(outboxKind, ev.ID, nil), ev))
+	}
+	return muts
+}
+
+// EventSink は OutboxRelay がイベントを配信する先のインターフェースです。
+// Deliver がエラーを返した場合は、同じイベントが再度配信されます。
+// events は記録された順に並んでいます。
+type EventSink interface {
+	Deliver(ctx context.Context, events []*Event) error
+}
+
+// EventSinkFunc は関数を EventSink として使用するための型です。
+type EventSinkFunc func(ctx context.Context, events []*Event) error
+
+// Deliver は EventSink の実装です。
+func (f EventSinkFunc) Deliver(ctx context.Context, events []*Event) error {
+	return f(ctx, events)
+}
+
+// OutboxRelay はアウトボックスのイベントを記録された順に EventSink に配信するためのインターフェースです。
+// 配信が完了した位置はチェックポイントとしてDatastoreに記録されるため、中断しても続きから再開できます。
+// 配信後、チェックポイントの記録前に中断した場合は同じイベントが再度配信されます (少なくとも1回の配信)。
+// 同じ名前の OutboxRelay を同時に複数実行しないでください。
+type OutboxRelay interface {
+	WithBatchSize(n int) OutboxRelay
+	WithRetry(maxAttempts int, backoff time.Duration) OutboxRelay
+	WithSettleDelay(d time.Duration) OutboxRelay
+	WithDeleteDelivered(b bool) OutboxRelay
+	RunBatch(ctx context.Context) (delivered int, done bool, err error)
+	Run(ctx context.Context, interval time.Duration) error
+	Reset(ctx context.Context) error
+}
+
+type outboxRelay struct {
+	name            string
+	sink            EventSink
+	batchSize       int
+	maxAttempts     int
+	backoff         time.Duration
+	settleDelay     time.Duration
+	deleteDelivered bool
+}
+
+// outboxCheckpoint は OutboxRelay の進捗です。
+type outboxCheckpoint struct {
+	LastEventID string `datastore:",noindex"`
+	Delivered   int    `datastore:",noindex"`
+	UpdatedAt   time.Time
+}
+
+// NewOutboxRelay コンストラクタ
+// name はチェックポイントを識別するための名前です。配信先ごとに別の名前を指定します。
+func NewOutboxRelay(name string, sink EventSink) OutboxRelay {
+	return &outboxRelay{
+		name:        name,
+		sink:        sink,
+		batchSize:   100,
+		maxAttempts: 3,
+		backoff:     time.Second,
+		settleDelay: 10 * time.Second,
+	}
+}
+
+// WithBatchSize は1回の Deliver で配信するイベントの最大数を設定します。
+// デフォルトは100件です。
+func (r *outboxRelay) WithBatchSize(n int) OutboxRelay {
+	r.batchSize = n
+	return r
+}
+
+// WithRetry は Deliver がエラーを返した場合の最大試行回数と、最初の再試行までの待ち時間を設定します。
+// 待ち時間は再試行のたびに2倍になります。
+// デフォルトは3回、1秒です。
+func (r *outboxRelay) WithRetry(maxAttempts int, backoff time.Duration) OutboxRelay {
+	r.maxAttempts = max(maxAttempts, 1)
+	r.backoff = backoff
+	return r
+}
+
+// WithSettleDelay は記録されてからこの時間が経過していないイベントを配信しないようにします。
+// トランザクションのコミットの順番はイベントの ID の順番と一致しないことがあるため、
+// 後からコミットされたイベントを読み飛ばさないように猶予を設けます。
+// デフォルトは10秒です。
+func (r *outboxRelay) WithSettleDelay(d time.Duration) OutboxRelay {
+	r.settleDelay = d
+	return r
+}
+
+// WithDeleteDelivered が true の場合、配信したイベントをアウトボックスから削除します。
+// 同じイベントを複数の OutboxRelay で配信する場合は使用しないでください。
+func (r *outboxRelay) WithDeleteDelivered(b bool) OutboxRelay {
+	r.deleteDelivered = b
+	return r
+}
+
+// checkpointKey はチェックポイントのキーを返します。
+func (r *outboxRelay) checkpointKey() *datastore.Key {
+	return datastore.NameKey(outboxCheckpointKind, r.name, nil)
+}
+
+// RunBatch は1バッチ分のイベントを配信し、チェックポイントを更新します。
+// 戻り値として、配信したイベントの数と、配信可能なイベントをすべて配信したかどうかを返します。
+// 再試行しても配信に失敗した場合は、チェックポイントを更新せずにエラーを返します。
+func (r *outboxRelay) RunBatch(ctx context.Context) (int, bool, error) {
+	var cp outboxCheckpoint
+	cpKey := r.checkpointKey()
+	err := client.Get(ctx, cpKey, &cp)
+	if err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+		return 0, false, err
+	}
+	q := NewQuery(outboxKind).
+		FilterField("__key__", "<", datastore.NameKey(outboxKind, eventIDBefore(Now().Add(-r.settleDelay)), nil)).
+		Order("__key__").
+		Limit(r.batchSize)
+	if cp.LastEventID != "" {
+		q = q.FilterField("__key__", ">", datastore.NameKey(outboxKind, cp.LastEventID, nil))
+	}
+	itr := client.Run(ctx, q)
+	var events []*Event
+	var keys []*datastore.Key
+	for {
+		ev := &Event{}
+		key, err := itr.Next(ev)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		ev.ID = key.Name
+		events = append(events, ev)
+		keys = append(keys, key)
+	}
+	if len(events) == 0 {
+		return 0, true, nil
+	}
+	if err := r.deliver(ctx, events); err != nil {
+		return 0, false, err
+	}
+	cp.LastEventID = events[len(events)-1].ID
+	cp.Delivered += len(events)
+	cp.UpdatedAt = Now()
+	if _, err := client.Put(ctx, cpKey, &cp); err != nil {
+		return 0, false, err
+	}
+	if r.deleteDelivered {
+		if err := client.DeleteMulti(ctx, keys); err != nil {
+			return 0, false, err
+		}
+	}
+	return len(events), len(events) < r.batchSize, nil
+}
+
+// deliver はイベントを配信します。失敗した場合は待ち時間を空けて再試行します。
+func (r *outboxRelay) deliver(ctx context.Context, events []*Event) error {
+	backoff := r.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = r.sink.Deliver(ctx, events)
+		if err == nil || attempt >= r.maxAttempts {
+			break
+		}
+		logger.Warn(fmt.Sprintf(LogFormat, "OutboxRelay deliver error"), slog.String("relay", r.name), slog.Int("attempt", attempt), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return fmt.Errorf("entitystore: outbox relay %s failed to deliver events: %w", r.name, err)
+	}
+	return nil
+}
+
+// Run は ctx がキャンセルされるまで、interval ごとに配信可能なイベントをすべて配信します。
+// 配信に失敗した場合はエラーを記録し、次の interval で再度配信します。
+// ctx がキャンセルされた場合は ctx のエラーを返します。
+func (r *outboxRelay) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		for {
+			_, done, err := r.RunBatch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logger.Error(fmt.Sprintf(LogFormat, "OutboxRelay error"), slog.String("relay", r.name), slog.String("error", err.Error()))
+				break
+			}
+			if done {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Reset はチェックポイントを削除し、次回の実行をアウトボックスの先頭からやり直すようにします。
+func (r *outboxRelay) Reset(ctx context.Context) error {
+	return client.Delete(ctx, r.checkpointKey())
+}
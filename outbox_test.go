@@ -0,0 +1,76 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedProperties(t *testing.T) {
+	before := []datastore.Property{
+		{Name: "A", Value: "a"},
+		{Name: "B", Value: "b"},
+		{Name: "C", Value: "c"},
+	}
+	after := []datastore.Property{
+		{Name: "A", Value: "a"},
+		{Name: "B", Value: "x"},
+		{Name: "D", Value: "d"},
+	}
+	require.Equal(t, []string{"B", "C", "D"}, changedProperties(before, after))
+	require.Equal(t, []string{"A", "B", "C"}, changedProperties(before, nil))
+}
+
+func TestEventID(t *testing.T) {
+	t1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Microsecond)
+	require.Less(t, eventID(t1, 0), eventID(t1, 1))
+	require.Less(t, eventID(t1, 1), eventID(t2, 0))
+	require.Less(t, eventID(t1, 9), eventIDBefore(t2))
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	RegisterKind("OutboxTestEntity", KindOptions{Outbox: true})
+	require.NoError(t, DeleteAll(ctx, "OutboxTestEntity"))
+	require.NoError(t, DeleteAll(ctx, outboxKind))
+
+	var delivered []*Event
+	fail := true
+	relay := NewOutboxRelay("test", EventSinkFunc(func(ctx context.Context, events []*Event) error {
+		if fail {
+			fail = false
+			return errors.New("temporary error")
+		}
+		delivered = append(delivered, events...)
+		return nil
+	})).WithSettleDelay(0).WithRetry(2, time.Millisecond).WithDeleteDelivered(true)
+	require.NoError(t, relay.Reset(ctx))
+
+	e := &OutboxTestEntity{Id: 1, Value: "Test1"}
+	require.NoError(t, PutEntity(ctx, e))
+	e.Value = "Test2"
+	require.NoError(t, PutEntity(ctx, e))
+	require.NoError(t, DeleteEntity(ctx, e))
+
+	n, done, err := relay.RunBatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.True(t, done)
+	require.Len(t, delivered, 3)
+	require.Equal(t, MutationTypeUpsert, delivered[0].Type)
+	require.Contains(t, delivered[1].Changed, "Value")
+	require.Equal(t, MutationTypeDelete, delivered[2].Type)
+	require.Nil(t, delivered[2].Properties)
+
+	// 配信済みのイベントは再度配信されない
+	n, done, err = relay.RunBatch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.True(t, done)
+}
@@ -1,6 +1,12 @@
 package entitystore
 
-import "cloud.google.com/go/datastore"
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
 
 type Query interface {
 	Ancestor(ancestor *datastore.Key) Query
@@ -19,27 +25,58 @@ type Query interface {
 	Offset(offset int) Query
 	Start(c datastore.Cursor) Query
 	End(c datastore.Cursor) Query
+	IncludeDeleted() Query
 	NewAggregationQuery() *datastore.AggregationQuery
+	Err() error
 
 	Q() *datastore.Query
 }
 
 type query struct {
 	*datastore.Query
-	isKeysOnly bool
+	isKeysOnly     bool
+	kind           string
+	includeDeleted bool
+
+	// 以下はインデックスの算出に使用するため記録したクエリの条件です。
+	ancestor   bool
+	filters    []queryFilter
+	orders     []queryOrder
+	projection []string
+
+	// schema は NewQueryFor などで結び付けたエンティティの型の情報です。nil の場合は検証しません。
+	schema *querySchema
+	// err は検証で見つかった最初のエラーです。
+	err error
+}
+
+// queryFilter はクエリのフィルタです。
+type queryFilter struct {
+	name  string
+	op    string
+	value any
+}
+
+// queryOrder はクエリの並び順です。
+type queryOrder struct {
+	name string
+	desc bool
 }
 
+// NewQuery は kind に対するクエリを作成します。
+// kind の論理削除が有効な場合、論理削除されたエンティティは結果から除外されます。
 func NewQuery(kind string) Query {
 	var q Query
 	q = &query{
-		datastore.NewQuery(kind),
-		false,
+		Query: datastore.NewQuery(kind),
+		kind:  kind,
 	}
 	return q
 }
 
 func (q query) Ancestor(ancestor *datastore.Key) Query {
 	q.Query = q.Query.Ancestor(ancestor)
+	q.ancestor = true
 	return q
 }
 
@@ -60,27 +97,48 @@ func (q query) Transaction(t *datastore.Transaction) Query {
 
 func (q query) FilterEntity(ef datastore.EntityFilter) Query {
 	q.Query = q.Query.FilterEntity(ef)
+	n := len(q.filters)
+	q.filters = appendEntityFilter(slices.Clip(q.filters), ef)
+	for _, f := range q.filters[n:] {
+		q.check(q.schema.checkFilter(f))
+	}
 	return q
 }
 
 //goland:noinspection GoDeprecation
 func (q query) Filter(filterStr string, value interface{}) Query {
 	q.Query = q.Query.Filter(filterStr, value)
+	if name, op, ok := strings.Cut(strings.TrimSpace(filterStr), " "); ok {
+		f := queryFilter{name: name, op: strings.TrimSpace(op), value: value}
+		q.filters = append(slices.Clip(q.filters), f)
+		q.check(q.schema.checkFilter(f))
+	}
 	return q
 }
 
 func (q query) FilterField(fieldName, operator string, value interface{}) Query {
 	q.Query = q.Query.FilterField(fieldName, operator, value)
+	f := queryFilter{name: fieldName, op: operator, value: value}
+	q.filters = append(slices.Clip(q.filters), f)
+	q.check(q.schema.checkFilter(f))
 	return q
 }
 
 func (q query) Order(fieldName string) Query {
 	q.Query = q.Query.Order(fieldName)
+	name := strings.TrimSpace(fieldName)
+	o := queryOrder{name: strings.TrimPrefix(name, "-"), desc: strings.HasPrefix(name, "-")}
+	q.orders = append(slices.Clip(q.orders), o)
+	q.check(q.schema.checkSorted(o.name))
 	return q
 }
 
 func (q query) Project(fieldNames ...string) Query {
 	q.Query = q.Query.Project(fieldNames...)
+	q.projection = append(slices.Clip(q.projection), fieldNames...)
+	for _, name := range fieldNames {
+		q.check(q.schema.checkSorted(name))
+	}
 	return q
 }
 
@@ -91,6 +149,9 @@ func (q query) Distinct() Query {
 
 func (q query) DistinctOn(fieldNames ...string) Query {
 	q.Query = q.Query.DistinctOn(fieldNames...)
+	for _, name := range fieldNames {
+		q.check(q.schema.checkSorted(name))
+	}
 	return q
 }
 
@@ -120,6 +181,48 @@ func (q query) End(c datastore.Cursor) Query {
 	return q
 }
 
+// IncludeDeleted は論理削除されたエンティティも結果に含めるようにします。
+// GetEntityAll、GetEntityFirst、EntityLister.GetList でも論理削除されたエンティティをロードします。
+func (q query) IncludeDeleted() Query {
+	q.includeDeleted = true
+	return q
+}
+
+// Err は NewQueryFor などで検証したクエリの最初のエラーを返します。検証していない場合は nil を返します。
+func (q query) Err() error {
+	return q.err
+}
+
+// check は検証のエラーを記録します。最初のエラーのみを保持します。
+func (q *query) check(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// asQuery は Query を query に変換します。entitystore のクエリでない場合は false を返します。
+func asQuery(q Query) (query, bool) {
+	switch qq := q.(type) {
+	case query:
+		return qq, true
+	case *query:
+		return *qq, true
+	}
+	return query{}, false
+}
+
+func (q query) NewAggregationQuery() *datastore.AggregationQuery {
+	return q.Q().NewAggregationQuery()
+}
+
+// Q は実行する datastore.Query を返します。
+// 論理削除されたエンティティを除外する場合はその条件を追加したものを返します。
 func (q query) Q() *datastore.Query {
+	if recordQueries {
+		recordQuery(q)
+	}
+	if !q.includeDeleted && optionsOf(q.kind).SoftDelete {
+		return q.Query.FilterField(deletedAtProperty, "=", time.Time{})
+	}
 	return q.Query
 }
@@ -0,0 +1,388 @@
+package entitystore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrInvalidQuery はクエリの検証に失敗したことを表すエラーです。
+// errors.Is(err, ErrInvalidQuery) で QueryError かどうかを判定できます。
+var ErrInvalidQuery = errors.New("entitystore: invalid query")
+
+// QueryError はエンティティの型に対するクエリの検証エラーです。
+type QueryError struct {
+	Kind string
+	// Property は問題のあるプロパティ名です。
+	Property string
+	Message  string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("entitystore: invalid query on %s: %s: %s", e.Kind, e.Property, e.Message)
+}
+
+func (e *QueryError) Is(target error) bool {
+	return target == ErrInvalidQuery
+}
+
+// keyProperty はキーでフィルタや並び替えを行う際のプロパティ名です。
+const keyProperty = "__key__"
+
+// validOperators はフィルタに使用できる演算子です。
+var validOperators = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true, "not-in": true,
+}
+
+// valueClass はプロパティの値の種類です。Datastore では種類が異なる値は比較されません。
+type valueClass int
+
+const (
+	classAny valueClass = iota
+	classBool
+	classInt
+	classFloat
+	classString
+	classBytes
+	classTime
+	classKey
+	classGeo
+	classEntity
+)
+
+func (c valueClass) String() string {
+	switch c {
+	case classBool:
+		return "bool"
+	case classInt:
+		return "integer"
+	case classFloat:
+		return "float"
+	case classString:
+		return "string"
+	case classBytes:
+		return "[]byte"
+	case classTime:
+		return "time.Time"
+	case classKey:
+		return "*datastore.Key"
+	case classGeo:
+		return "datastore.GeoPoint"
+	case classEntity:
+		return "entity"
+	default:
+		return "any"
+	}
+}
+
+// classOf は型の値の種類を返します。
+func classOf(t reflect.Type) valueClass {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return classTime
+	case t == reflect.TypeOf((*datastore.Key)(nil)):
+		return classKey
+	case reflect.PointerTo(t).Implements(reflect.TypeOf((*refResolver)(nil)).Elem()):
+		return classKey
+	case t == blobType:
+		return classBytes
+	case t == reflect.TypeOf(datastore.GeoPoint{}):
+		return classGeo
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return classBytes
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return classBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return classInt
+	case reflect.Float32, reflect.Float64:
+		return classFloat
+	case reflect.String:
+		return classString
+	case reflect.Struct, reflect.Ptr:
+		return classEntity
+	default:
+		return classAny
+	}
+}
+
+// propertyMeta はクエリの検証に使用するプロパティの情報です。
+type propertyMeta struct {
+	class   valueClass
+	noindex bool
+}
+
+// querySchema はエンティティの型のプロパティの情報です。
+type querySchema struct {
+	kind       string
+	properties map[string]propertyMeta
+	// opaque は PropertyLoadSaver を実装しているなど、プロパティを構造体から判断できないことを表します。
+	opaque bool
+}
+
+// querySchemaKey は querySchemaCache のキーです。
+// 同じ型を複数の Kind で使用する場合があるため、Kind と型の組み合わせごとにキャッシュします。
+type querySchemaKey struct {
+	kind string
+	t    reflect.Type
+}
+
+// querySchemaCache は Kind と型ごとの querySchema のキャッシュです。
+var querySchemaCache sync.Map // map[querySchemaKey]*querySchema
+
+// querySchemaOf は構造体の型のプロパティの情報を `datastore` タグから取得します。
+func querySchemaOf(kind string, t reflect.Type) *querySchema {
+	key := querySchemaKey{kind: kind, t: t}
+	if cached, ok := querySchemaCache.Load(key); ok {
+		return cached.(*querySchema)
+	}
+	s := newQuerySchema(kind, t)
+	querySchemaCache.Store(key, s)
+	return s
+}
+
+// newQuerySchema は querySchemaOf のキャッシュしない版です。
+func newQuerySchema(kind string, t reflect.Type) *querySchema {
+	s := &querySchema{kind: kind, properties: map[string]propertyMeta{}}
+	if reflect.PointerTo(t).Implements(reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()) {
+		s.opaque = true
+	} else {
+		s.walk(t, "", false, map[reflect.Type]bool{})
+	}
+	return s
+}
+
+// walk は構造体のフィールドのプロパティを追加します。入れ子の構造体のプロパティは "A.B" の形式で追加します。
+// visiting は再帰的な構造体を無限に辿らないために使用します。
+func (s *querySchema) walk(t reflect.Type, prefix string, noindex bool, visiting map[reflect.Type]bool) {
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, opts, _ := strings.Cut(sf.Tag.Get("datastore"), ",")
+		if name == "-" || (!sf.IsExported() && !sf.Anonymous) {
+			continue
+		}
+		// 暗号化するフィールドと BlobStore に保存するフィールドはインデックスを作成しない
+		noidx := noindex || strings.Contains(","+opts+",", ",noindex,") ||
+			hasTagOption(sf, encryptOption) || hasTagOption(sf, blobOption)
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr && ft != reflect.TypeOf((*datastore.Key)(nil)) {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct && classOf(ft) == classEntity {
+			// 埋め込みの構造体のフィールドは外側の構造体のプロパティになる
+			s.walk(ft, prefix, noidx, visiting)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		elem := ft
+		if elem.Kind() == reflect.Slice && classOf(elem) != classBytes {
+			elem = elem.Elem()
+			if elem.Kind() == reflect.Ptr && elem != reflect.TypeOf((*datastore.Key)(nil)) {
+				elem = elem.Elem()
+			}
+		}
+		class := classOf(elem)
+		s.properties[prefix+name] = propertyMeta{class: class, noindex: noidx || elem == blobType}
+		if class == classEntity && elem.Kind() == reflect.Struct &&
+			!reflect.PointerTo(elem).Implements(reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()) {
+			s.walk(elem, prefix+name+".", noidx, visiting)
+		}
+	}
+}
+
+// property はプロパティの情報を返します。存在しない場合やインデックスが無い場合はエラーを返します。
+func (s *querySchema) property(name string) (propertyMeta, error) {
+	if name == keyProperty {
+		return propertyMeta{class: classKey}, nil
+	}
+	p, ok := s.properties[name]
+	if !ok {
+		msg := "no such property"
+		if similar := s.similar(name); similar != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", similar)
+		}
+		return p, &QueryError{Kind: s.kind, Property: name, Message: msg}
+	}
+	if p.noindex {
+		return p, &QueryError{Kind: s.kind, Property: name, Message: "property is not indexed (noindex)"}
+	}
+	return p, nil
+}
+
+// similar は name に最も近いプロパティ名を返します。近いものが無い場合は空文字列を返します。
+func (s *querySchema) similar(name string) string {
+	names := make([]string, 0, len(s.properties))
+	for n := range s.properties {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	best, bestDist := "", 3
+	for _, n := range names {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(n)); d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	return best
+}
+
+// editDistance は2つの文字列のレーベンシュタイン距離を返します。
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// checkFilter はフィルタのプロパティ名、演算子、値の型を検証します。
+func (s *querySchema) checkFilter(f queryFilter) error {
+	if s == nil {
+		return nil
+	}
+	if !validOperators[f.op] {
+		return &QueryError{Kind: s.kind, Property: f.name, Message: fmt.Sprintf("invalid operator %q", f.op)}
+	}
+	if s.opaque && f.name != keyProperty {
+		return nil
+	}
+	p, err := s.property(f.name)
+	if err != nil {
+		return err
+	}
+	if f.op == "in" || f.op == "not-in" {
+		v := reflect.ValueOf(f.value)
+		if !v.IsValid() || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || classOf(v.Type()) == classBytes {
+			return &QueryError{Kind: s.kind, Property: f.name, Message: fmt.Sprintf("operator %q requires a slice but got %T", f.op, f.value)}
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := s.checkValue(f.name, p, v.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.checkValue(f.name, p, f.value)
+}
+
+// checkValue は値の型がプロパティの型と比較できるかどうかを検証します。
+func (s *querySchema) checkValue(name string, p propertyMeta, value any) error {
+	if value == nil || p.class == classAny {
+		return nil
+	}
+	if p.class == classEntity {
+		return &QueryError{Kind: s.kind, Property: name, Message: "cannot filter on an entity property; filter on its nested properties instead"}
+	}
+	vc := classOf(reflect.TypeOf(value))
+	if vc == classAny || vc == p.class {
+		return nil
+	}
+	msg := fmt.Sprintf("value of type %T is not comparable with %s property", value, p.class)
+	if (vc == classInt && p.class == classFloat) || (vc == classFloat && p.class == classInt) {
+		msg += " (integers and floats never match in Datastore)"
+	}
+	return &QueryError{Kind: s.kind, Property: name, Message: msg}
+}
+
+// checkSorted は並び順や射影のプロパティを検証します。
+func (s *querySchema) checkSorted(name string) error {
+	if s == nil || (s.opaque && name != keyProperty) {
+		return nil
+	}
+	p, err := s.property(name)
+	if err != nil {
+		return err
+	}
+	if p.class == classEntity {
+		return &QueryError{Kind: s.kind, Property: name, Message: "cannot order or project an entity property"}
+	}
+	return nil
+}
+
+// checkAggregated は合計や平均を集計するプロパティを検証します。
+func (s *querySchema) checkAggregated(name string) error {
+	if s == nil || s.opaque {
+		return nil
+	}
+	p, err := s.property(name)
+	if err != nil {
+		return err
+	}
+	if p.class != classInt && p.class != classFloat && p.class != classAny {
+		return &QueryError{Kind: s.kind, Property: name, Message: fmt.Sprintf("cannot aggregate %s property", p.class)}
+	}
+	return nil
+}
+
+// validate は記録したクエリの条件をすべて検証し、最初のエラーを返します。
+func (s *querySchema) validate(q query) error {
+	for _, f := range q.filters {
+		if err := s.checkFilter(f); err != nil {
+			return err
+		}
+	}
+	for _, o := range q.orders {
+		if err := s.checkSorted(o.name); err != nil {
+			return err
+		}
+	}
+	for _, name := range q.projection {
+		if err := s.checkSorted(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewQueryFor はエンティティの型 E に対する、検証付きのクエリを作成します。
+// 以降のフィルタや並び順は E の構造体の `datastore` タグ (flatten した入れ子のフィールドを含む) と照合され、
+// 存在しないプロパティ、不正な演算子、プロパティと型の異なる値、noindex のプロパティを使用するとエラーになります。
+// エラーは Query.Err で取得でき、GetEntityAll や EntityLister などはクエリを送信せずにそのエラーを返します。
+// E が PropertyLoadSaver を実装している場合、プロパティ名と値の型は検証しません。
+func NewQueryFor[E Entity]() Query {
+	return BindQuery[E](NewQuery(KindOf[E]()))
+}
+
+// BindQuery は作成済みのクエリをエンティティの型 E に結び付け、NewQueryFor と同様に検証します。
+// すでに追加されているフィルタや並び順も検証します。entitystore のクエリでない場合はそのまま返します。
+func BindQuery[E Entity](q Query) Query {
+	qq, ok := asQuery(q)
+	if !ok {
+		return q
+	}
+	qq.schema = querySchemaOf(qq.kind, reflect.TypeFor[E]().Elem())
+	if qq.err == nil {
+		qq.err = qq.schema.validate(qq)
+	}
+	return qq
+}
@@ -0,0 +1,98 @@
+package entitystore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewQueryFor(t *testing.T) {
+	authorKey := datastore.NameKey("RefTestAuthor", "a", nil)
+	tests := []struct {
+		name string
+		q    Query
+		err  string
+	}{
+		{"valid", NewQueryFor[*QueryTestEntity]().
+			FilterField("name", "=", "a").
+			FilterField("Count", ">", 1).
+			FilterField("Tags", "in", []string{"x", "y"}).
+			FilterField("Address.zip", "=", "100").
+			FilterField("Author", "=", authorKey).
+			FilterField("UpdatedAt", "<", time.Now()).
+			FilterField("DeletedAt", "=", time.Time{}).
+			FilterField("__key__", ">", datastore.IDKey("QueryTestEntity", 1, nil)).
+			Order("-Score").
+			Project("name"), ""},
+		{"nil value", NewQueryFor[*QueryTestEntity]().FilterField("name", "=", nil), ""},
+		{"typo", NewQueryFor[*QueryTestEntity]().FilterField("Naem", "=", "a"), `Naem: no such property (did you mean "name"?)`},
+		{"untagged name", NewQueryFor[*QueryTestEntity]().FilterField("Id", "=", 1), "Id: no such property"},
+		{"invalid operator", NewQueryFor[*QueryTestEntity]().FilterField("name", "==", "a"), `invalid operator "=="`},
+		{"type mismatch", NewQueryFor[*QueryTestEntity]().FilterField("Count", "=", "1"), "value of type string is not comparable with integer property"},
+		{"int for float", NewQueryFor[*QueryTestEntity]().FilterField("Score", ">", 1), "integers and floats never match"},
+		{"in requires slice", NewQueryFor[*QueryTestEntity]().FilterField("Tags", "in", "x"), `operator "in" requires a slice`},
+		{"in element type", NewQueryFor[*QueryTestEntity]().FilterField("Count", "in", []any{1, "2"}), "value of type string"},
+		{"noindex filter", NewQueryFor[*QueryTestEntity]().FilterField("Memo", "=", "a"), "Memo: property is not indexed"},
+		{"noindex order", NewQueryFor[*QueryTestEntity]().Order("-Memo"), "Memo: property is not indexed"},
+		{"unknown order", NewQueryFor[*QueryTestEntity]().Order("Missing"), "Missing: no such property"},
+		{"unknown projection", NewQueryFor[*QueryTestEntity]().Project("Missing"), "Missing: no such property"},
+		{"deprecated filter", NewQueryFor[*QueryTestEntity]().Filter("Count >", "1"), "value of type string"},
+		{"entity filter", NewQueryFor[*QueryTestEntity]().FilterEntity(datastore.OrFilter{Filters: []datastore.EntityFilter{
+			datastore.PropertyFilter{FieldName: "name", Operator: "=", Value: "a"},
+			datastore.PropertyFilter{FieldName: "nmae", Operator: "=", Value: "b"},
+		}}), "nmae: no such property"},
+		{"first error is kept", NewQueryFor[*QueryTestEntity]().FilterField("A", "=", 1).FilterField("B", "=", 1), "A: no such property"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.q.Err()
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.ErrorIs(t, err, ErrInvalidQuery)
+			require.Contains(t, err.Error(), tt.err)
+			var qerr *QueryError
+			require.True(t, errors.As(err, &qerr))
+			require.Equal(t, "QueryTestEntity", qerr.Kind)
+		})
+	}
+}
+
+func TestBindQuery(t *testing.T) {
+	q := NewQuery("QueryTestEntity").FilterField("Valeu", "=", 1)
+	require.NoError(t, q.Err())
+	require.ErrorIs(t, BindQuery[*QueryTestEntity](q).Err(), ErrInvalidQuery)
+
+	// 作成済みのクエリはそのまま使用できる
+	require.NoError(t, BindQuery[*QueryTestEntity](NewQuery("QueryTestEntity").Order("name")).Err())
+
+	// 同じ型を別の Kind に結び付けた場合は、その Kind のエラーになる
+	err := BindQuery[*QueryTestEntity](NewQuery("ArchivedQueryTestEntity").FilterField("Valeu", "=", 1)).Err()
+	var qerr *QueryError
+	require.True(t, errors.As(err, &qerr))
+	require.Equal(t, "ArchivedQueryTestEntity", qerr.Kind)
+}
+
+func TestQueryValidation_RejectsBeforeSending(t *testing.T) {
+	q := NewQueryFor[*QueryTestEntity]().FilterField("Valeu", "=", 1)
+	ctx := t.Context()
+
+	// client が無くてもクエリを送信する前にエラーになる
+	_, _, err := NewEntityLister(q, &QueryTestEntity{}).GetList(ctx, 10, "")
+	require.ErrorIs(t, err, ErrInvalidQuery)
+	err = GetEntityFirst(ctx, q, &QueryTestEntity{})
+	require.ErrorIs(t, err, ErrInvalidQuery)
+	_, err = Count(ctx, q)
+	require.ErrorIs(t, err, ErrInvalidQuery)
+
+	valid := NewQueryFor[*QueryTestEntity]()
+	_, err = IntSum(ctx, valid, "name")
+	require.ErrorContains(t, err, "cannot aggregate string property")
+	err = NewAggregation(valid).WithAvg("Memo").Run(ctx)
+	require.ErrorContains(t, err, "Memo: property is not indexed")
+}
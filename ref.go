@@ -0,0 +1,302 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+)
+
+// refKeyProperty は Ref を保存する際に、キーを入れ子のエンティティから取り出すための目印のプロパティ名です。
+const refKeyProperty = "__ref__"
+
+// ErrDanglingRef は参照先のエンティティが存在しないことを表すエラーです。
+// errors.Is(err, datastore.ErrNoSuchEntity) でも判定できます。
+var ErrDanglingRef = errors.New("entitystore: dangling reference")
+
+// DanglingRefError は参照先のエンティティが存在しない場合に返されるエラーです。
+type DanglingRefError struct {
+	Key *datastore.Key
+}
+
+func (e *DanglingRefError) Error() string {
+	return fmt.Sprintf("entitystore: dangling reference to %v", e.Key)
+}
+
+func (e *DanglingRefError) Is(target error) bool {
+	return target == ErrDanglingRef || target == datastore.ErrNoSuchEntity
+}
+
+// Ref は他のエンティティへの型付きの参照です。
+// エンティティのフィールドとして使用すると、Datastoreには参照先のキーとして保存されます。
+// 参照先は Get で個別に、または ResolveRefs でまとめて取得できます。
+//
+//	type Order struct {
+//		EntityBase
+//		Id       int
+//		Customer Ref[*Customer]
+//	}
+type Ref[E Entity] struct {
+	key      *datastore.Key
+	entity   E
+	resolved bool
+	err      error
+}
+
+// NewRef は e を参照する Ref を作成します。e は取得済みの参照先として扱われます。
+func NewRef[E Entity](e E) Ref[E] {
+	return Ref[E]{key: e.Key(), entity: e, resolved: true}
+}
+
+// RefTo は key を参照する Ref を作成します。
+func RefTo[E Entity](key *datastore.Key) Ref[E] {
+	return Ref[E]{key: key}
+}
+
+// Key は参照先のキーを返します。参照が設定されていない場合は nil を返します。
+func (r Ref[E]) Key() *datastore.Key {
+	return r.key
+}
+
+// IsZero は参照が設定されていないかどうかを返します。
+func (r Ref[E]) IsZero() bool {
+	return r.key == nil
+}
+
+// Set は参照先を e に変更します。
+func (r *Ref[E]) Set(e E) {
+	*r = NewRef(e)
+}
+
+// Resolved は参照先を取得済みかどうかを返します。参照先が存在しなかった場合も true を返します。
+func (r Ref[E]) Resolved() bool {
+	return r.resolved
+}
+
+// Entity は取得済みの参照先を返します。
+// 取得していない場合や、参照先が存在しなかった場合は false を返します。
+func (r Ref[E]) Entity() (E, bool) {
+	return r.entity, r.resolved && r.err == nil
+}
+
+// IsDangling は参照先を取得した結果、参照先が存在しなかったかどうかを返します。
+func (r Ref[E]) IsDangling() bool {
+	return r.resolved && r.err != nil
+}
+
+// Get は参照先のエンティティを返します。
+// 取得していない場合はキャッシュまたはDatastoreから取得します。
+// 参照先が存在しない場合は *DanglingRefError を返します。
+func (r *Ref[E]) Get(ctx context.Context) (E, error) {
+	var zero E
+	if r.key == nil {
+		return zero, errors.New("entitystore: reference is not set")
+	}
+	if !r.resolved {
+		e := r.newTarget().(E)
+		err := Get(ctx, r.key, e)
+		if err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+			return zero, err
+		}
+		r.resolve(e, err == nil)
+	}
+	if r.err != nil {
+		return zero, r.err
+	}
+	return r.entity, nil
+}
+
+// Save は datastore.PropertyLoadSaver の実装です。
+// 保存時に saveStruct によって参照先のキーのプロパティに置き換えられます。
+func (r *Ref[E]) Save() ([]datastore.Property, error) {
+	var v any
+	if r.key != nil {
+		v = r.key
+	}
+	return []datastore.Property{{Name: refKeyProperty, Value: v}}, nil
+}
+
+// Load は datastore.PropertyLoadSaver の実装です。
+func (r *Ref[E]) Load(ps []datastore.Property) error {
+	*r = Ref[E]{}
+	for _, p := range ps {
+		if key, ok := p.Value.(*datastore.Key); ok {
+			r.key = key
+		}
+	}
+	return nil
+}
+
+// refResolver は ResolveRefs で参照先を設定するためのインターフェースです。
+type refResolver interface {
+	refKey() *datastore.Key
+	isResolved() bool
+	newTarget() any
+	resolve(e any, found bool)
+}
+
+func (r *Ref[E]) refKey() *datastore.Key {
+	return r.key
+}
+
+func (r *Ref[E]) isResolved() bool {
+	return r.resolved
+}
+
+func (r *Ref[E]) newTarget() any {
+	var zero E
+	return reflect.New(reflect.TypeOf(zero).Elem()).Interface()
+}
+
+func (r *Ref[E]) resolve(e any, found bool) {
+	r.resolved = true
+	r.entity, r.err = *new(E), nil
+	if !found {
+		r.err = &DanglingRefError{Key: r.key}
+		return
+	}
+	if te, ok := e.(E); ok {
+		r.entity = te
+	} else {
+		r.err = fmt.Errorf("entitystore: reference to %v is %T but got %T", r.key, r.entity, e)
+	}
+}
+
+// unwrapRefs は saveStruct で保存したプロパティの Ref を参照先のキーに置き換えます。
+func unwrapRefs(ps []datastore.Property) {
+	for i := range ps {
+		ps[i].Value = unwrapRefValue(ps[i].Value)
+	}
+}
+
+// unwrapRefValue はプロパティの値が Ref の場合にキーを返します。
+func unwrapRefValue(v any) any {
+	switch v := v.(type) {
+	case *datastore.Entity:
+		if v == nil {
+			return v
+		}
+		if len(v.Properties) == 1 && v.Properties[0].Name == refKeyProperty {
+			return v.Properties[0].Value
+		}
+		unwrapRefs(v.Properties)
+	case []any:
+		for i := range v {
+			v[i] = unwrapRefValue(v[i])
+		}
+	}
+	return v
+}
+
+// collectRefs は v に含まれる未取得の Ref を集めます。
+// 構造体のフィールド、スライスと配列の要素を辿りますが、ポインタのフィールドは辿りません。
+func collectRefs(v reflect.Value, refs []refResolver) []refResolver {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return refs
+		}
+		return collectRefs(v.Elem(), refs)
+	case reflect.Struct:
+		if v.CanAddr() {
+			if r, ok := v.Addr().Interface().(refResolver); ok {
+				if !r.isResolved() && r.refKey() != nil {
+					refs = append(refs, r)
+				}
+				return refs
+			}
+		}
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			sf := t.Field(i)
+			if !sf.IsExported() || sf.Type.Kind() == reflect.Ptr || isDatastoreValueType(sf.Type) {
+				continue
+			}
+			refs = collectRefs(v.Field(i), refs)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Ptr {
+			return refs
+		}
+		for i := 0; i < v.Len(); i++ {
+			refs = collectRefs(v.Index(i), refs)
+		}
+	}
+	return refs
+}
+
+// ResolveRefs はエンティティに含まれる Ref の参照先をまとめて取得します。
+// 参照先は Kind ごとに1回の GetMulti で、キャッシュを使用して取得します。
+// 参照先が存在しない Ref はエラーにはならず、IsDangling が true になります。
+func ResolveRefs(ctx context.Context, entities ...any) error {
+	return ResolveRefsDepth(ctx, 1, entities...)
+}
+
+// ResolveRefsDepth は ResolveRefs と同様に Ref の参照先を取得し、取得した参照先の Ref も depth 段まで続けて取得します。
+// 同じキーのエンティティは1度だけ取得して同じインスタンスを共有するため、参照が循環していても無限に取得することはありません。
+// entities のうちエンティティであるものも、同じキーへの参照先として共有されます。
+func ResolveRefsDepth(ctx context.Context, depth int, entities ...any) error {
+	loaded := map[datastore.Key]any{}
+	for _, e := range entities {
+		if ent, ok := e.(Entity); ok && ent.Key() != nil {
+			loaded[*ent.Key()] = e
+		}
+	}
+	level := entities
+	for d := 0; d < depth && len(level) > 0; d++ {
+		var refs []refResolver
+		for _, e := range level {
+			refs = collectRefs(reflect.ValueOf(e), refs)
+		}
+		// 取得していないキーを Kind ごとにまとめる
+		type target struct {
+			keys []*datastore.Key
+			dst  []any
+		}
+		targets := map[string]*target{}
+		var kinds []string
+		pending := map[datastore.Key]bool{}
+		for _, r := range refs {
+			key := r.refKey()
+			if _, ok := loaded[*key]; ok || pending[*key] {
+				continue
+			}
+			pending[*key] = true
+			t, ok := targets[key.Kind]
+			if !ok {
+				t = &target{}
+				targets[key.Kind] = t
+				kinds = append(kinds, key.Kind)
+			}
+			t.keys = append(t.keys, key)
+			t.dst = append(t.dst, r.newTarget())
+		}
+		var next []any
+		for _, kind := range kinds {
+			t := targets[kind]
+			err := GetMulti(ctx, t.keys, t.dst)
+			if IsProblem(err) {
+				return err
+			}
+			var merr datastore.MultiError
+			errors.As(err, &merr)
+			for i, key := range t.keys {
+				if merr != nil && merr[i] != nil {
+					loaded[*key] = nil // 参照先が存在しない
+					continue
+				}
+				loaded[*key] = t.dst[i]
+				next = append(next, t.dst[i])
+			}
+		}
+		for _, r := range refs {
+			e := loaded[*r.refKey()]
+			r.resolve(e, e != nil)
+		}
+		level = lo.Uniq(next)
+	}
+	return nil
+}
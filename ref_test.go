@@ -0,0 +1,87 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRef_SaveLoad(t *testing.T) {
+	author := &RefTestAuthor{Id: 1}
+	book := &RefTestBook{Id: 1, Author: NewRef(author), Editors: []Ref[*RefTestAuthor]{NewRef(author)}}
+	ps, err := saveStruct(book)
+	require.NoError(t, err)
+	m := propertyMap(ps)
+	require.Equal(t, author.Key(), m["Author"].Value)
+	require.Equal(t, []any{author.Key()}, m["Editors"].Value)
+
+	loaded := &RefTestBook{}
+	require.NoError(t, loadStruct(nil, ps, loaded))
+	require.Equal(t, author.Key(), loaded.Author.Key())
+	require.False(t, loaded.Author.Resolved())
+	require.Equal(t, author.Key(), loaded.Editors[0].Key())
+
+	// 参照が設定されていない場合
+	ps, err = saveStruct(&RefTestBook{Id: 2})
+	require.NoError(t, err)
+	require.Nil(t, propertyMap(ps)["Author"].Value)
+}
+
+func TestCollectRefs(t *testing.T) {
+	book := &RefTestBook{
+		Author:  RefTo[*RefTestAuthor](datastore.NameKey("RefTestAuthor", "1", nil)),
+		Editors: []Ref[*RefTestAuthor]{RefTo[*RefTestAuthor](datastore.NameKey("RefTestAuthor", "2", nil)), {}},
+	}
+	refs := collectRefs(reflect.ValueOf(book), nil)
+	require.Len(t, refs, 2)
+
+	refs[0].resolve(&RefTestAuthor{Id: 1}, true)
+	e, ok := book.Author.Entity()
+	require.True(t, ok)
+	require.Equal(t, 1, e.Id)
+
+	refs[1].resolve(nil, false)
+	require.True(t, book.Editors[0].IsDangling())
+	require.Len(t, collectRefs(reflect.ValueOf(book), nil), 0)
+}
+
+func TestResolveRefs(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	require.NoError(t, DeleteAll(ctx, "RefTestAuthor"))
+	require.NoError(t, DeleteAll(ctx, "RefTestBook"))
+
+	author := &RefTestAuthor{Id: 1, Name: "Author1"}
+	book := &RefTestBook{Id: 1, Title: "Book1", Author: NewRef(author)}
+	author.Favorite = NewRef(book)
+	require.NoError(t, PutEntity(ctx, author))
+	book.Editors = []Ref[*RefTestAuthor]{RefTo[*RefTestAuthor](datastore.NameKey("RefTestAuthor", "99", nil))}
+	require.NoError(t, PutEntity(ctx, book))
+
+	loaded := &RefTestBook{Id: 1}
+	require.NoError(t, GetEntity(ctx, loaded))
+	// 循環した参照でも深さの分だけ取得する
+	require.NoError(t, ResolveRefsDepth(ctx, 3, loaded))
+	a, ok := loaded.Author.Entity()
+	require.True(t, ok)
+	require.Equal(t, "Author1", a.Name)
+	fav, ok := a.Favorite.Entity()
+	require.True(t, ok)
+	require.Same(t, loaded, fav)
+
+	// 参照先が存在しない
+	require.True(t, loaded.Editors[0].IsDangling())
+	_, err := loaded.Editors[0].Get(ctx)
+	require.True(t, errors.Is(err, ErrDanglingRef))
+
+	// 個別に取得
+	loaded2 := &RefTestBook{Id: 1}
+	require.NoError(t, GetEntity(ctx, loaded2))
+	a, err = loaded2.Author.Get(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "Author1", a.Name)
+}
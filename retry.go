@@ -0,0 +1,353 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryOperation はリトライの設定を個別に変更できる Datastore の操作の種類です。
+type RetryOperation string
+
+const (
+	// RetryLookup は Get と GetMulti です。
+	RetryLookup RetryOperation = "Lookup"
+	// RetryQuery は GetAll、Count と集計クエリです。Run のイテレーターはリトライしません。
+	RetryQuery RetryOperation = "Query"
+	// RetryCommit は Put、Delete と Mutate です。
+	RetryCommit RetryOperation = "Commit"
+	// RetryTransaction は RunInTransaction と NewTransaction です。
+	RetryTransaction RetryOperation = "Transaction"
+	// RetryAllocate は AllocateIDs と ReserveIDs です。
+	RetryAllocate RetryOperation = "Allocate"
+)
+
+// DefaultRetryCodes はリトライするエラーのコードのデフォルトです。
+var DefaultRetryCodes = []codes.Code{codes.Aborted, codes.Unavailable, codes.DeadlineExceeded}
+
+// RetryPolicy は Datastore の呼び出しが一時的なエラーで失敗した場合のリトライの設定です。
+// 待ち時間は InitialBackoff から Multiplier 倍ずつ MaxBackoff まで増やし、0 からその時間までのランダムな時間だけ待ちます。
+// MaxAttempts が 1 以下の場合はリトライしません。
+type RetryPolicy struct {
+	// MaxAttempts は最初の呼び出しを含めた最大の試行回数です。
+	MaxAttempts int
+	// InitialBackoff は最初のリトライまでの最大の待ち時間です。0 の場合は 100ms です。
+	InitialBackoff time.Duration
+	// MaxBackoff は待ち時間の上限です。0 の場合は 5s です。
+	MaxBackoff time.Duration
+	// Multiplier はリトライごとに待ち時間を増やす倍率です。1 未満の場合は 2 です。
+	Multiplier float64
+	// Codes はリトライするエラーのコードです。空の場合は DefaultRetryCodes を使用します。
+	Codes []codes.Code
+	// Overrides は操作の種類ごとの設定です。ゼロ値のフィールドはこの RetryPolicy の値を使用します。
+	Overrides map[RetryOperation]RetryPolicy
+}
+
+// forOperation は操作の種類に適用する設定を返します。
+func (p RetryPolicy) forOperation(op RetryOperation) RetryPolicy {
+	o, ok := p.Overrides[op]
+	if !ok {
+		return p
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = p.MaxAttempts
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = p.InitialBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = p.MaxBackoff
+	}
+	if o.Multiplier == 0 {
+		o.Multiplier = p.Multiplier
+	}
+	if len(o.Codes) == 0 {
+		o.Codes = p.Codes
+	}
+	return o
+}
+
+// enabled はいずれかの操作でリトライするかどうかを返します。
+func (p RetryPolicy) enabled() bool {
+	if p.MaxAttempts > 1 {
+		return true
+	}
+	for _, o := range p.Overrides {
+		if o.MaxAttempts > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff は attempt 回目の失敗の後に待つ時間を返します。
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	initial, maxBackoff, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	d := float64(initial)
+	for range attempt - 1 {
+		d *= multiplier
+		if d >= float64(maxBackoff) {
+			break
+		}
+	}
+	d = min(d, float64(maxBackoff))
+	return time.Duration(rand.Float64() * d)
+}
+
+// retryable はエラーがリトライするエラーかどうかを返します。
+func (p RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	if errors.Is(err, datastore.ErrConcurrentTransaction) {
+		code = codes.Aborted
+	}
+	if code == codes.OK || code == codes.Unknown {
+		return false
+	}
+	if len(p.Codes) == 0 {
+		return slices.Contains(DefaultRetryCodes, code)
+	}
+	return slices.Contains(p.Codes, code)
+}
+
+// retrySleep は d だけ待ちます。テスト時に差し替え可能にするために変数として定義しています。
+var retrySleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// idempotentKey は Mutate が冪等であることを表す context のキーです。
+type idempotentKey struct{}
+
+// WithIdempotent は Mutate の呼び出しが冪等であることを表す context を返します。
+// Mutate は挿入を含む場合があるため、この context で呼び出した場合だけリトライします。
+// 挿入を含まない Mutate を Client から直接呼び出す場合に使用します。
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// isIdempotent は WithIdempotent で冪等であることが示されているかどうかを返します。
+func isIdempotent(ctx context.Context) bool {
+	v, _ := ctx.Value(idempotentKey{}).(bool)
+	return v
+}
+
+// hasIncompleteKey は不完全なキーを含むかどうかを返します。不完全なキーの保存はリトライすると重複して作成される可能性があります。
+func hasIncompleteKey(keys []*datastore.Key) bool {
+	return slices.ContainsFunc(keys, func(key *datastore.Key) bool { return key.Incomplete() })
+}
+
+// retryingClient は一時的なエラーで失敗した Datastore の呼び出しをリトライする DatastoreClient です。
+type retryingClient struct {
+	DatastoreClient
+	policy RetryPolicy
+}
+
+// NewRetryingClient は c の呼び出しを policy に従ってリトライする DatastoreClient を返します。
+// 成功したかどうか分からない呼び出しを繰り返しても結果が変わらない操作だけをリトライします。
+// 不完全なキーの保存、サーバー側の変換を含む保存、WithIdempotent を指定していない Mutate はリトライしません。
+// RunInTransaction はトランザクション全体をやり直すため、Datastore のライブラリのリトライの代わりに policy に従ってリトライします。
+// Initialize で Config.Retry を指定した場合に使用されます。
+func NewRetryingClient(c DatastoreClient, policy RetryPolicy) DatastoreClient {
+	return &retryingClient{DatastoreClient: c, policy: policy}
+}
+
+// retry は policy に従って f をリトライします。
+func retry(ctx context.Context, policy RetryPolicy, name string, f func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if logger != nil {
+			logger.Warn(
+				fmt.Sprintf(LogFormat, name+" retrying"),
+				slog.Int("attempt", attempt), slog.String("error", err.Error()),
+			)
+		}
+		if serr := retrySleep(ctx, policy.backoff(attempt)); serr != nil {
+			return err
+		}
+	}
+}
+
+func (c *retryingClient) do(ctx context.Context, op RetryOperation, name string, f func() error) error {
+	return retry(ctx, c.policy.forOperation(op), name, f)
+}
+
+func (c *retryingClient) AllocateIDs(ctx context.Context, keys []*datastore.Key) (ret []*datastore.Key, err error) {
+	err = c.do(ctx, RetryAllocate, "AllocateIDs", func() error {
+		ret, err = c.DatastoreClient.AllocateIDs(ctx, keys)
+		return err
+	})
+	return ret, err
+}
+
+func (c *retryingClient) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return c.do(ctx, RetryAllocate, "ReserveIDs", func() error {
+		return c.DatastoreClient.ReserveIDs(ctx, keys)
+	})
+}
+
+func (c *retryingClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return c.do(ctx, RetryLookup, "Get", func() error {
+		return c.DatastoreClient.Get(ctx, key, dst)
+	})
+}
+
+func (c *retryingClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return c.do(ctx, RetryLookup, "GetMulti", func() error {
+		return c.DatastoreClient.GetMulti(ctx, keys, dst)
+	})
+}
+
+func (c *retryingClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (ret *datastore.Key, err error) {
+	if key.Incomplete() {
+		return c.DatastoreClient.Put(ctx, key, src)
+	}
+	err = c.do(ctx, RetryCommit, "Put", func() error {
+		ret, err = c.DatastoreClient.Put(ctx, key, src)
+		return err
+	})
+	return ret, err
+}
+
+func (c *retryingClient) PutWithOptions(ctx context.Context, req *datastore.PutRequest, opts ...datastore.PutOption) (ret *datastore.Key, err error) {
+	if req.Key.Incomplete() || len(req.Transforms) > 0 {
+		return c.DatastoreClient.PutWithOptions(ctx, req, opts...)
+	}
+	err = c.do(ctx, RetryCommit, "PutWithOptions", func() error {
+		ret, err = c.DatastoreClient.PutWithOptions(ctx, req, opts...)
+		return err
+	})
+	return ret, err
+}
+
+func (c *retryingClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (ret []*datastore.Key, err error) {
+	if hasIncompleteKey(keys) {
+		return c.DatastoreClient.PutMulti(ctx, keys, src)
+	}
+	err = c.do(ctx, RetryCommit, "PutMulti", func() error {
+		ret, err = c.DatastoreClient.PutMulti(ctx, keys, src)
+		return err
+	})
+	return ret, err
+}
+
+func (c *retryingClient) PutMultiWithOptions(ctx context.Context, reqs []*datastore.PutRequest, opts ...datastore.PutOption) (ret []*datastore.Key, err error) {
+	if slices.ContainsFunc(reqs, func(req *datastore.PutRequest) bool { return req.Key.Incomplete() || len(req.Transforms) > 0 }) {
+		return c.DatastoreClient.PutMultiWithOptions(ctx, reqs, opts...)
+	}
+	err = c.do(ctx, RetryCommit, "PutMultiWithOptions", func() error {
+		ret, err = c.DatastoreClient.PutMultiWithOptions(ctx, reqs, opts...)
+		return err
+	})
+	return ret, err
+}
+
+func (c *retryingClient) Delete(ctx context.Context, key *datastore.Key) error {
+	return c.do(ctx, RetryCommit, "Delete", func() error {
+		return c.DatastoreClient.Delete(ctx, key)
+	})
+}
+
+func (c *retryingClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return c.do(ctx, RetryCommit, "DeleteMulti", func() error {
+		return c.DatastoreClient.DeleteMulti(ctx, keys)
+	})
+}
+
+func (c *retryingClient) Mutate(ctx context.Context, muts ...*datastore.Mutation) (ret []*datastore.Key, err error) {
+	if !isIdempotent(ctx) {
+		return c.DatastoreClient.Mutate(ctx, muts...)
+	}
+	err = c.do(ctx, RetryCommit, "Mutate", func() error {
+		ret, err = c.DatastoreClient.Mutate(ctx, muts...)
+		return err
+	})
+	return ret, err
+}
+
+func (c *retryingClient) NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (tx *datastore.Transaction, err error) {
+	err = c.do(ctx, RetryTransaction, "NewTransaction", func() error {
+		tx, err = c.DatastoreClient.NewTransaction(ctx, opts...)
+		return err
+	})
+	return tx, err
+}
+
+func (c *retryingClient) RunInTransaction(ctx context.Context, f func(tx *datastore.Transaction) error, opts ...datastore.TransactionOption) (cmt *datastore.Commit, err error) {
+	policy := c.policy.forOperation(RetryTransaction)
+	if policy.MaxAttempts <= 1 {
+		return c.DatastoreClient.RunInTransaction(ctx, f, opts...)
+	}
+	// ライブラリのリトライは無効にする。opts で MaxAttempts を指定した場合はそちらを優先する
+	opts = append([]datastore.TransactionOption{datastore.MaxAttempts(1)}, opts...)
+	err = retry(ctx, policy, "RunInTransaction", func() error {
+		cmt, err = c.DatastoreClient.RunInTransaction(ctx, f, opts...)
+		return err
+	})
+	return cmt, err
+}
+
+func (c *retryingClient) Count(ctx context.Context, q Query) (n int, err error) {
+	err = c.do(ctx, RetryQuery, "Count", func() error {
+		n, err = c.DatastoreClient.Count(ctx, q)
+		return err
+	})
+	return n, err
+}
+
+func (c *retryingClient) GetAll(ctx context.Context, q Query, dst interface{}) (keys []*datastore.Key, err error) {
+	err = c.do(ctx, RetryQuery, "GetAll", func() error {
+		keys, err = c.DatastoreClient.GetAll(ctx, q, dst)
+		return err
+	})
+	return keys, err
+}
+
+func (c *retryingClient) GetAllWithOptions(ctx context.Context, q Query, dst interface{}, opts ...datastore.RunOption) (res datastore.GetAllWithOptionsResult, err error) {
+	err = c.do(ctx, RetryQuery, "GetAllWithOptions", func() error {
+		res, err = c.DatastoreClient.GetAllWithOptions(ctx, q, dst, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *retryingClient) RunAggregationQuery(ctx context.Context, aq *datastore.AggregationQuery) (ar datastore.AggregationResult, err error) {
+	err = c.do(ctx, RetryQuery, "RunAggregationQuery", func() error {
+		ar, err = c.DatastoreClient.RunAggregationQuery(ctx, aq)
+		return err
+	})
+	return ar, err
+}
+
+func (c *retryingClient) RunAggregationQueryWithOptions(ctx context.Context, aq *datastore.AggregationQuery, opts ...datastore.RunOption) (ar datastore.AggregationWithOptionsResult, err error) {
+	err = c.do(ctx, RetryQuery, "RunAggregationQueryWithOptions", func() error {
+		ar, err = c.DatastoreClient.RunAggregationQueryWithOptions(ctx, aq, opts...)
+		return err
+	})
+	return ar, err
+}
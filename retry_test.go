@@ -0,0 +1,184 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyClient は指定した回数だけエラーを返す DatastoreClient です。
+type flakyClient struct {
+	DatastoreClient
+	errs  []error
+	calls int
+}
+
+func (c *flakyClient) next() error {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return c.errs[c.calls-1]
+	}
+	return nil
+}
+
+func (c *flakyClient) Get(context.Context, *datastore.Key, interface{}) error {
+	return c.next()
+}
+
+func (c *flakyClient) Put(_ context.Context, key *datastore.Key, _ interface{}) (*datastore.Key, error) {
+	return key, c.next()
+}
+
+func (c *flakyClient) Mutate(context.Context, ...*datastore.Mutation) ([]*datastore.Key, error) {
+	return nil, c.next()
+}
+
+func (c *flakyClient) RunInTransaction(_ context.Context, f func(tx *datastore.Transaction) error, _ ...datastore.TransactionOption) (*datastore.Commit, error) {
+	if err := f(nil); err != nil {
+		return nil, err
+	}
+	return nil, c.next()
+}
+
+func withoutRetrySleep(t *testing.T) *[]time.Duration {
+	var waits []time.Duration
+	old := retrySleep
+	retrySleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	t.Cleanup(func() { retrySleep = old })
+	return &waits
+}
+
+func TestRetry_Transient(t *testing.T) {
+	ctx := context.Background()
+	waits := withoutRetrySleep(t)
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	fc := &flakyClient{errs: []error{unavailable, unavailable}}
+	c := NewRetryingClient(fc, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+
+	require.NoError(t, c.Get(ctx, datastore.NameKey("Kind", "1", nil), nil))
+	require.Equal(t, 3, fc.calls)
+	require.Len(t, *waits, 2)
+	for _, d := range *waits {
+		require.LessOrEqual(t, d, 2*time.Millisecond)
+	}
+
+	// 最大の試行回数を超えた場合は最後のエラーを返す
+	fc = &flakyClient{errs: []error{unavailable, unavailable, unavailable}}
+	c = NewRetryingClient(fc, RetryPolicy{MaxAttempts: 3})
+	require.ErrorIs(t, c.Get(ctx, datastore.NameKey("Kind", "1", nil), nil), unavailable)
+	require.Equal(t, 3, fc.calls)
+}
+
+func TestRetry_NotRetryable(t *testing.T) {
+	ctx := context.Background()
+	withoutRetrySleep(t)
+	key := datastore.NameKey("Kind", "1", nil)
+	policy := RetryPolicy{MaxAttempts: 3}
+
+	for _, err := range []error{datastore.ErrNoSuchEntity, status.Error(codes.InvalidArgument, "invalid"), errors.New("other")} {
+		fc := &flakyClient{errs: []error{err}}
+		require.Error(t, NewRetryingClient(fc, policy).Get(ctx, key, nil))
+		require.Equal(t, 1, fc.calls)
+	}
+
+	// リトライするコードを変更できる
+	fc := &flakyClient{errs: []error{status.Error(codes.Unavailable, "unavailable")}}
+	require.Error(t, NewRetryingClient(fc, RetryPolicy{MaxAttempts: 3, Codes: []codes.Code{codes.Aborted}}).Get(ctx, key, nil))
+	require.Equal(t, 1, fc.calls)
+}
+
+func TestRetry_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	withoutRetrySleep(t)
+	aborted := status.Error(codes.Aborted, "aborted")
+	policy := RetryPolicy{MaxAttempts: 3}
+
+	// 不完全なキーの保存はリトライしない
+	fc := &flakyClient{errs: []error{aborted}}
+	_, err := NewRetryingClient(fc, policy).Put(ctx, datastore.IncompleteKey("Kind", nil), nil)
+	require.ErrorIs(t, err, aborted)
+	require.Equal(t, 1, fc.calls)
+	fc = &flakyClient{errs: []error{aborted}}
+	_, err = NewRetryingClient(fc, policy).Put(ctx, datastore.NameKey("Kind", "1", nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, fc.calls)
+
+	// Mutate は WithIdempotent を指定した場合だけリトライする
+	fc = &flakyClient{errs: []error{aborted}}
+	_, err = NewRetryingClient(fc, policy).Mutate(ctx)
+	require.ErrorIs(t, err, aborted)
+	require.Equal(t, 1, fc.calls)
+	fc = &flakyClient{errs: []error{aborted}}
+	_, err = NewRetryingClient(fc, policy).Mutate(WithIdempotent(ctx))
+	require.NoError(t, err)
+	require.Equal(t, 2, fc.calls)
+
+	require.Equal(t, ctx, mutateContext(ctx, []*writeOp{{typ: MutationTypeInsert}, {typ: MutationTypeUpsert}}))
+	require.True(t, isIdempotent(mutateContext(ctx, []*writeOp{{typ: MutationTypeUpdate}, {typ: MutationTypeDelete}})))
+}
+
+func TestRetry_Transaction(t *testing.T) {
+	ctx := context.Background()
+	withoutRetrySleep(t)
+	fc := &flakyClient{errs: []error{datastore.ErrConcurrentTransaction}}
+	runs := 0
+	_, err := NewRetryingClient(fc, RetryPolicy{MaxAttempts: 2}).RunInTransaction(ctx, func(*datastore.Transaction) error {
+		runs++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, runs)
+
+	// f のエラーはリトライしない
+	fc = &flakyClient{}
+	runs = 0
+	_, err = NewRetryingClient(fc, RetryPolicy{MaxAttempts: 2}).RunInTransaction(ctx, func(*datastore.Transaction) error {
+		runs++
+		return ErrConflict
+	})
+	require.ErrorIs(t, err, ErrConflict)
+	require.Equal(t, 1, runs)
+}
+
+func TestRetryPolicy_Overrides(t *testing.T) {
+	ctx := context.Background()
+	withoutRetrySleep(t)
+	policy := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		Overrides:      map[RetryOperation]RetryPolicy{RetryLookup: {MaxAttempts: 2}},
+	}
+	require.Equal(t, 2, policy.forOperation(RetryLookup).MaxAttempts)
+	require.Equal(t, time.Second, policy.forOperation(RetryLookup).InitialBackoff)
+	require.Equal(t, 5, policy.forOperation(RetryCommit).MaxAttempts)
+	require.True(t, RetryPolicy{Overrides: map[RetryOperation]RetryPolicy{RetryQuery: {MaxAttempts: 2}}}.enabled())
+	require.False(t, RetryPolicy{}.enabled())
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	fc := &flakyClient{errs: []error{unavailable, unavailable, unavailable}}
+	require.Error(t, NewRetryingClient(fc, policy).Get(ctx, datastore.NameKey("Kind", "1", nil), nil))
+	require.Equal(t, 2, fc.calls)
+
+	// 待ち時間は上限を超えない
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Multiplier: 2}
+	for attempt := 1; attempt < 100; attempt++ {
+		require.LessOrEqual(t, p.backoff(attempt), 3*time.Second)
+	}
+}
+
+func TestRetry_ContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fc := &flakyClient{errs: []error{status.Error(codes.Unavailable, "unavailable")}}
+	require.Error(t, NewRetryingClient(fc, RetryPolicy{MaxAttempts: 3}).Get(ctx, datastore.NameKey("Kind", "1", nil), nil))
+	require.Equal(t, 1, fc.calls)
+}
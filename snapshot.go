@@ -0,0 +1,56 @@
+package entitystore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// readTimeKey は ReadAt で指定した読み取り時刻を保持する context のキーです。
+type readTimeKey struct{}
+
+// ReadAt は t の時点のスナップショットから読み取るための context を返します。
+// この context を指定した Get、GetMulti、GetEntity、GetEntityMulti、GetEntityAll、GetEntityFirst、GetKeyAll、
+// EntityLister、Count、集計関数と Aggregation は、キャッシュを使用せずに t の時点の Datastore の内容を読み取ります。
+// 同じ t を指定した読み取りはすべて同じスナップショットから読み取るため、一貫したレポートの作成などに使用できます。
+// t は過去の時刻である必要があり、1時間より前の時刻の場合はポイントインタイムリカバリが有効で、分単位の時刻である必要があります。
+// Datastore のライブラリの制限により、t は秒単位に切り捨てます。書き込みには影響しません。
+// 読み取ったエンティティはロード時のプロパティを記録しないため、Config.SkipUnchanged が有効でも保存は省略されません。
+func ReadAt(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, readTimeKey{}, t.Truncate(time.Second))
+}
+
+// readTimeOf は ReadAt で指定した読み取り時刻を返します。
+func readTimeOf(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(readTimeKey{}).(time.Time)
+	return t, ok && !t.IsZero()
+}
+
+// snapshotTransaction は ReadAt で読み取り時刻が指定されている場合に、その時刻を読み取る読み取り専用のトランザクションを開始します。
+// 読み取り時刻が指定されていない場合は nil を返します。
+// DatastoreClient.WithReadOptions はクライアントの設定を変更してしまうため、読み取り専用のトランザクションを使用します。
+func snapshotTransaction(ctx context.Context) (*datastore.Transaction, error) {
+	t, ok := readTimeOf(ctx)
+	if !ok {
+		return nil, nil
+	}
+	return client.NewTransaction(ctx, datastore.ReadOnly, datastore.WithReadTime(t))
+}
+
+// endSnapshot は snapshotTransaction で開始したトランザクションを終了します。
+func endSnapshot(tx *datastore.Transaction) {
+	if tx != nil {
+		_ = tx.Rollback()
+	}
+}
+
+// snapshotQuery は ReadAt で読み取り時刻が指定されている場合に、q をその時刻のスナップショットに対して実行するクエリにします。
+// 戻り値のトランザクションはクエリの結果を読み終えてから endSnapshot で終了する必要があります。
+func snapshotQuery(ctx context.Context, q Query) (Query, *datastore.Transaction, error) {
+	tx, err := snapshotTransaction(ctx)
+	if err != nil || tx == nil {
+		return q, nil, err
+	}
+	return q.Transaction(tx), tx, nil
+}
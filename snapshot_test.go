@@ -0,0 +1,73 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAt(t *testing.T) {
+	ctx := context.Background()
+	_, ok := readTimeOf(ctx)
+	require.False(t, ok)
+	_, ok = readTimeOf(ReadAt(ctx, time.Time{}))
+	require.False(t, ok)
+
+	// 読み取り時刻は秒単位に切り捨てる
+	rt, ok := readTimeOf(ReadAt(ctx, time.Date(2024, 1, 2, 3, 4, 5, 678, time.UTC)))
+	require.True(t, ok)
+	require.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), rt)
+
+	// 読み取り時刻を指定していない場合はトランザクションを開始しない
+	tx, err := snapshotTransaction(ctx)
+	require.NoError(t, err)
+	require.Nil(t, tx)
+	q, tx, err := snapshotQuery(ctx, NewQuery("TestEntity"))
+	require.NoError(t, err)
+	require.Nil(t, tx)
+	require.Equal(t, NewQuery("TestEntity"), q)
+}
+
+func TestReadAt_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	err := DeleteAll(ctx, "AggregationTestEntity")
+	require.NoError(t, err)
+
+	require.NoError(t, PutEntityMulti(ctx, []*AggregationTestEntity{{Id: 1, Value: 10}, {Id: 2, Value: 20}}))
+	time.Sleep(2 * time.Second)
+	before := time.Now()
+	time.Sleep(2 * time.Second)
+	require.NoError(t, PutEntityMulti(ctx, []*AggregationTestEntity{{Id: 1, Value: 15}, {Id: 3, Value: 30}}))
+	// キャッシュに最新の値を載せておく
+	require.NoError(t, GetEntity(ctx, &AggregationTestEntity{Id: 1}))
+
+	snap := ReadAt(ctx, before)
+	e := &AggregationTestEntity{Id: 1}
+	require.NoError(t, GetEntity(snap, e))
+	require.Equal(t, 10, e.Value)
+
+	var all []*AggregationTestEntity
+	require.NoError(t, GetEntityAll(snap, NewQuery("AggregationTestEntity").Order("Value"), &all))
+	require.Len(t, all, 2)
+	require.Equal(t, []int{10, 20}, []int{all[0].Value, all[1].Value})
+
+	list, _, err := NewEntityLister(NewQuery("AggregationTestEntity"), &AggregationTestEntity{}).GetList(snap, 10, "")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	count, err := Count(snap, NewQuery("AggregationTestEntity"))
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	agg := NewAggregation(NewQuery("AggregationTestEntity")).WithCount().WithIntSum("Value")
+	require.NoError(t, agg.Run(snap))
+	require.Equal(t, 2, agg.Count())
+	require.Equal(t, 30, agg.IntSum("Value"))
+
+	// 読み取り時刻を指定しない場合は最新の値
+	count, err = Count(ctx, NewQuery("AggregationTestEntity"))
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+}
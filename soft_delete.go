@@ -0,0 +1,146 @@
+package entitystore
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+)
+
+// deletedAtProperty は論理削除の削除日時を保存するプロパティ名です。
+const deletedAtProperty = "DeletedAt"
+
+// SoftDeletable は論理削除の削除日時を持つエンティティのインターフェースです。
+// SoftDeleteBase を埋め込むことで実装できます。
+type SoftDeletable interface {
+	DeletedAt() time.Time
+	SetDeletedAt(t time.Time)
+}
+
+// SoftDeleteBase は論理削除の削除日時を保持するための構造体です。
+// EntityBase などと一緒に埋め込んで使用します。
+// 論理削除を有効にするには、RegisterKind で KindOptions.SoftDelete を設定します。
+type SoftDeleteBase struct {
+	DeletedAtColumn time.Time `datastore:"DeletedAt"`
+}
+
+func (e *SoftDeleteBase) DeletedAt() time.Time {
+	return e.DeletedAtColumn
+}
+
+func (e *SoftDeleteBase) SetDeletedAt(t time.Time) {
+	e.DeletedAtColumn = t.Truncate(time.Microsecond)
+}
+
+// IsDeleted は論理削除されているかどうかを返します。
+func (e *SoftDeleteBase) IsDeleted() bool {
+	return !e.DeletedAtColumn.IsZero()
+}
+
+// includeDeletedKey は論理削除されたエンティティもロードすることを表す context のキーです。
+type includeDeletedKey struct{}
+
+// withIncludeDeleted は q が IncludeDeleted を指定したクエリの場合に、論理削除されたエンティティもロードする context を返します。
+func withIncludeDeleted(ctx context.Context, q Query) context.Context {
+	if qq, ok := asQuery(q); ok && qq.includeDeleted {
+		return context.WithValue(ctx, includeDeletedKey{}, true)
+	}
+	return ctx
+}
+
+// includesDeleted は ctx が論理削除されたエンティティもロードするものかどうかを返します。
+func includesDeleted(ctx context.Context) bool {
+	v, _ := ctx.Value(includeDeletedKey{}).(bool)
+	return v
+}
+
+// isSoftDeleted はプロパティが論理削除されたエンティティのものかどうかを返します。
+func isSoftDeleted(kind string, ps []datastore.Property) bool {
+	if !optionsOf(kind).SoftDelete {
+		return false
+	}
+	for _, p := range ps {
+		if p.Name == deletedAtProperty {
+			t, ok := p.Value.(time.Time)
+			return ok && !t.IsZero()
+		}
+	}
+	return false
+}
+
+// setProperty は ps の name プロパティの値を value にしたスライスを返します。
+// プロパティが無い場合は追加します。ps 自体は変更しません。
+func setProperty(ps []datastore.Property, name string, value any) []datastore.Property {
+	ps = slices.Clone(ps)
+	for i := range ps {
+		if ps[i].Name == name {
+			ps[i].Value = value
+			return ps
+		}
+	}
+	return append(ps, datastore.Property{Name: name, Value: value})
+}
+
+// applySoftDelete は論理削除が有効な Kind の削除操作を、削除日時を記録する更新に置き換えます。
+func applySoftDelete(ops []*writeOp) {
+	now := Now().Truncate(time.Microsecond)
+	for _, op := range ops {
+		if op.isDelete() && !op.purge && op.patch == nil && optionsOf(op.key.Kind).SoftDelete {
+			op.patch = func(ps []datastore.Property) []datastore.Property {
+				return setProperty(ps, deletedAtProperty, now)
+			}
+		}
+	}
+}
+
+// restoreOps は論理削除されたエンティティを復元する書き込み操作を作成します。
+func restoreOps(keys []*datastore.Key) []*writeOp {
+	return lo.Map(keys, func(key *datastore.Key, _ int) *writeOp {
+		return &writeOp{typ: MutationTypeUpdate, key: key, patch: func(ps []datastore.Property) []datastore.Property {
+			return setProperty(ps, deletedAtProperty, time.Time{})
+		}}
+	})
+}
+
+// Restore は論理削除されたエンティティを復元します。
+// エンティティが存在しない場合は何もしません。
+func Restore(ctx context.Context, key *datastore.Key) error {
+	return write(ctx, restoreOps([]*datastore.Key{key}))
+}
+
+// RestoreMulti は論理削除された複数のエンティティを一括で復元します。
+// 各エンティティの復元はそれぞれ独立しているため、1回のコミットの上限を超える場合はバッチに分割して並行して復元し、
+// 一部のバッチだけが復元されることがあります。
+func RestoreMulti(ctx context.Context, keys []*datastore.Key) error {
+	return write(ctx, restoreOps(keys))
+}
+
+// RestoreEntity は論理削除されたエンティティを復元し、復元したエンティティを e にロードします。
+func RestoreEntity[E Entity](ctx context.Context, e E) error {
+	err := Restore(ctx, e.Key())
+	if err != nil {
+		return err
+	}
+	return GetEntity(ctx, e)
+}
+
+// Purge はエンティティを論理削除せずにDatastoreとキャッシュから削除します。
+// 論理削除されたエンティティを完全に削除する場合に使用します。
+func Purge(ctx context.Context, key *datastore.Key) error {
+	return write(ctx, []*writeOp{{typ: MutationTypeDelete, key: key, purge: true}})
+}
+
+// PurgeMulti は複数のエンティティを論理削除せずにDatastoreとキャッシュから一括削除します。
+// 1回のコミットの上限を超える場合は、DeleteMulti と同様にバッチに分割して並行して削除します。
+func PurgeMulti(ctx context.Context, keys []*datastore.Key) error {
+	return write(ctx, lo.Map(keys, func(key *datastore.Key, _ int) *writeOp {
+		return &writeOp{typ: MutationTypeDelete, key: key, purge: true}
+	}))
+}
+
+// PurgeEntity はエンティティを論理削除せずにDatastoreとキャッシュから削除します。
+func PurgeEntity[E Entity](ctx context.Context, e E) error {
+	return write(ctx, []*writeOp{{typ: MutationTypeDelete, key: e.Key(), src: e, purge: true}})
+}
@@ -0,0 +1,89 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetProperty(t *testing.T) {
+	ps := []datastore.Property{
+		{Name: "Value", Value: "Test Value"},
+	}
+	ps2 := setProperty(ps, "Value", "New Value")
+	require.Equal(t, "New Value", ps2[0].Value)
+	require.Equal(t, "Test Value", ps[0].Value)
+
+	ps3 := setProperty(ps, "DeletedAt", time.Time{})
+	require.Len(t, ps3, 2)
+	require.Len(t, ps, 1)
+}
+
+func TestLoadEntity_論理削除済み(t *testing.T) {
+	ctx := context.Background()
+	RegisterKind("SoftDeleteTestEntity", KindOptions{SoftDelete: true})
+	key := datastore.NameKey("SoftDeleteTestEntity", "1", nil)
+	ps := []datastore.Property{
+		{Name: "Id", Value: int64(1)},
+		{Name: "DeletedAt", Value: time.Time{}},
+	}
+	err := loadEntity(ctx, key, ps, &SoftDeleteTestEntity{})
+	require.NoError(t, err)
+
+	ps = setProperty(ps, "DeletedAt", time.Now())
+	err = loadEntity(ctx, key, ps, &SoftDeleteTestEntity{})
+	require.Equal(t, datastore.ErrNoSuchEntity, err)
+
+	// IncludeDeleted を指定したクエリの取得では論理削除されたエンティティもロードする
+	e := &SoftDeleteTestEntity{}
+	require.NoError(t, loadEntity(withIncludeDeleted(ctx, NewQuery("SoftDeleteTestEntity").IncludeDeleted()), key, ps, e))
+	require.True(t, e.IsDeleted())
+	require.False(t, includesDeleted(withIncludeDeleted(ctx, NewQuery("SoftDeleteTestEntity"))))
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	RegisterKind("SoftDeleteTestEntity", KindOptions{SoftDelete: true})
+	err := DeleteAll(ctx, "SoftDeleteTestEntity")
+	require.NoError(t, err)
+
+	err = PutEntityMulti(ctx, []*SoftDeleteTestEntity{
+		{Id: 1, Value: "Test1"},
+		{Id: 2, Value: "Test2"},
+	})
+	require.NoError(t, err)
+
+	// キーのみ指定したエンティティで削除しても他のプロパティは維持される
+	err = DeleteEntity(ctx, &SoftDeleteTestEntity{Id: 1})
+	require.NoError(t, err)
+	err = GetEntity(ctx, &SoftDeleteTestEntity{Id: 1})
+	require.Equal(t, datastore.ErrNoSuchEntity, err)
+
+	q := NewQuery("SoftDeleteTestEntity")
+	count, err := Count(ctx, q)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	count, err = Count(ctx, q.IncludeDeleted())
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	var all []*SoftDeleteTestEntity
+	require.NoError(t, GetEntityAll(ctx, q.IncludeDeleted(), &all))
+	require.Len(t, all, 2)
+
+	err = Restore(ctx, datastore.NameKey("SoftDeleteTestEntity", "1", nil))
+	require.NoError(t, err)
+	e := &SoftDeleteTestEntity{Id: 1}
+	require.NoError(t, GetEntity(ctx, e))
+	require.Equal(t, "Test1", e.Value)
+	require.False(t, e.IsDeleted())
+
+	err = PurgeEntity(ctx, e)
+	require.NoError(t, err)
+	count, err = Count(ctx, q.IncludeDeleted())
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
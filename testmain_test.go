@@ -2,6 +2,7 @@ package entitystore
 
 import (
 	"context"
+	"errors"
 	"strconv"
 
 	"cloud.google.com/go/datastore"
@@ -51,3 +52,242 @@ func DefaultTestInitialize(ctx context.Context, cs cachestore.Cachestore) {
 		panic(err)
 	}
 }
+
+type MigrationTestEntity struct {
+	EntityBase
+	Id       int
+	FullName string
+	Age      int
+}
+
+func (e *MigrationTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("MigrationTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+func (e *MigrationTestEntity) CurrentSchemaVersion() int {
+	return 2
+}
+
+type HookTestEntity struct {
+	EntityBase
+	Id     int
+	Value  string
+	Called []string `datastore:"-"`
+}
+
+func (e *HookTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("HookTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+func (e *HookTestEntity) PostLoad(_ context.Context) error {
+	e.Called = append(e.Called, "PostLoad")
+	return nil
+}
+
+func (e *HookTestEntity) PostPut(_ context.Context) error {
+	e.Called = append(e.Called, "PostPut")
+	return nil
+}
+
+func (e *HookTestEntity) PreDelete(_ context.Context) error {
+	if e.Value == "protected" {
+		return errors.New("protected entity")
+	}
+	e.Called = append(e.Called, "PreDelete")
+	return nil
+}
+
+func (e *HookTestEntity) PostDelete(_ context.Context) error {
+	e.Called = append(e.Called, "PostDelete")
+	return nil
+}
+
+type VersionedTestEntity struct {
+	VersionedEntityBase
+	Id    int
+	Value string
+}
+
+func (e *VersionedTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("VersionedTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type AuditedTestEntity struct {
+	AuditedEntityBase
+	Id    int
+	Value string
+}
+
+func (e *AuditedTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("AuditedTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type SoftDeleteTestEntity struct {
+	EntityBase
+	SoftDeleteBase
+	Id    int
+	Value string
+}
+
+func (e *SoftDeleteTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("SoftDeleteTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type ValidationTestAddress struct {
+	City string `validate:"required"`
+}
+
+type ValidationTestEntity struct {
+	EntityBase
+	Id      int
+	Name    string `validate:"required,max=5"`
+	Age     int    `validate:"min=0,max=150"`
+	Code    string `validate:"len=3,regex=^[A-Z]{1,3}$"`
+	Status  string `validate:"enum=active|inactive"`
+	Address ValidationTestAddress
+}
+
+func (e *ValidationTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("ValidationTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+func (e *ValidationTestEntity) Validate(_ context.Context) error {
+	if e.Age < 20 && e.Status == "active" {
+		return &ValidationError{Fields: []FieldError{{Field: "Status", Rule: "custom", Message: "minors cannot be active"}}}
+	}
+	return nil
+}
+
+type HistoryTestEntity struct {
+	EntityBase
+	Id    int
+	Value string
+}
+
+func (e *HistoryTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("HistoryTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type OutboxTestEntity struct {
+	EntityBase
+	Id    int
+	Value string
+}
+
+func (e *OutboxTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("OutboxTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type AutoIDTestEntity struct {
+	EntityBase
+	Id    int64 `datastore:"-" entitystore:"id"`
+	Value string
+}
+
+func (e *AutoIDTestEntity) Key() *datastore.Key {
+	return datastore.IDKey("AutoIDTestEntity", e.Id, nil)
+}
+
+type UniqueTestEntity struct {
+	EntityBase
+	Id        int
+	Email     string `entitystore:"unique"`
+	Tenant    string `entitystore:"unique=tenant_code"`
+	Code      string `entitystore:"unique=tenant_code"`
+	NotUnique string
+}
+
+func (e *UniqueTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("UniqueTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type RefTestAuthor struct {
+	EntityBase
+	Id       int
+	Name     string
+	Favorite Ref[*RefTestBook]
+}
+
+func (e *RefTestAuthor) Key() *datastore.Key {
+	return datastore.NameKey("RefTestAuthor", strconv.Itoa(e.Id), nil)
+}
+
+type RefTestBook struct {
+	EntityBase
+	Id      int
+	Title   string
+	Author  Ref[*RefTestAuthor]
+	Editors []Ref[*RefTestAuthor]
+}
+
+func (e *RefTestBook) Key() *datastore.Key {
+	return datastore.NameKey("RefTestBook", strconv.Itoa(e.Id), nil)
+}
+
+type TaggedTestEntity struct {
+	TaggedEntityBase[TaggedTestEntity] `entitystore:"kind=TaggedTestEntity"`
+	Id                                 int64          `datastore:"-" entitystore:"id"`
+	Parent                             *datastore.Key `datastore:"-" entitystore:"parent"`
+	Value                              string
+}
+
+func (e *TaggedTestEntity) Key() *datastore.Key {
+	return DeriveKey(e)
+}
+
+type QueryTestAddress struct {
+	City string
+	Zip  string `datastore:"zip"`
+}
+
+type QueryTestEntity struct {
+	EntityBase
+	SoftDeleteBase
+	Id      int    `datastore:"-"`
+	Name    string `datastore:"name"`
+	Score   float64
+	Count   int
+	Tags    []string
+	Memo    string           `datastore:",noindex"`
+	Address QueryTestAddress `datastore:",flatten"`
+	Author  Ref[*RefTestAuthor]
+}
+
+func (e *QueryTestEntity) Key() *datastore.Key {
+	return datastore.IDKey("QueryTestEntity", int64(e.Id), nil)
+}
+
+type EncryptionTestEntity struct {
+	EntityBase
+	Id     int
+	Email  string `entitystore:"encrypt"`
+	Secret []byte `datastore:"secret" entitystore:"encrypt"`
+	Value  string
+}
+
+func (e *EncryptionTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("EncryptionTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type BlobTestEntity struct {
+	EntityBase
+	Id          int
+	Body        string `entitystore:"blob"`
+	Attachments []Blob
+	Thumbnail   Blob
+}
+
+func (e *BlobTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("BlobTestEntity", strconv.Itoa(e.Id), nil)
+}
+
+type ExpiryTestEntity struct {
+	EntityBase
+	ExpiryBase
+	Id    int
+	Value string
+}
+
+func (e *ExpiryTestEntity) Key() *datastore.Key {
+	return datastore.NameKey("ExpiryTestEntity", strconv.Itoa(e.Id), nil)
+}
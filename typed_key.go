@@ -0,0 +1,226 @@
+package entitystore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+)
+
+// Kinder は Kind 名を返すエンティティのインターフェースです。
+// 実装していない場合、Kind 名は空のエンティティの Key() から取得します。
+type Kinder interface {
+	Kind() string
+}
+
+// kindCache は型ごとの Kind 名のキャッシュです。
+var kindCache sync.Map // map[reflect.Type]string
+
+// KindOf はエンティティの型 E の Kind 名を返します。
+// E はエンティティの構造体のポインタ型である必要があります。
+func KindOf[E Entity]() string {
+	t := reflect.TypeFor[E]()
+	if cached, ok := kindCache.Load(t); ok {
+		return cached.(string)
+	}
+	e := reflect.New(t.Elem()).Interface().(E)
+	var kind string
+	if k, ok := any(e).(Kinder); ok {
+		kind = k.Kind()
+	} else {
+		kind = e.Key().Kind
+	}
+	kindCache.Store(t, kind)
+	return kind
+}
+
+// Key はエンティティの型 E を持つ型付きのキーです。
+// 異なる Kind のキーを誤って渡すことをコンパイル時に防ぎます。
+// ゼロ値はキーが設定されていない状態を表します。
+type Key[E Entity] struct {
+	key *datastore.Key
+}
+
+// IDKey は数値 ID の Key を作成します。
+func IDKey[E Entity](id int64) Key[E] {
+	return Key[E]{datastore.IDKey(KindOf[E](), id, nil)}
+}
+
+// NameKey は文字列 ID の Key を作成します。
+func NameKey[E Entity](name string) Key[E] {
+	return Key[E]{datastore.NameKey(KindOf[E](), name, nil)}
+}
+
+// IncompleteKey は ID が割り当てられていない Key を作成します。
+func IncompleteKey[E Entity]() Key[E] {
+	return Key[E]{datastore.IncompleteKey(KindOf[E](), nil)}
+}
+
+// ChildIDKey は親のキーを持つ数値 ID の Key を作成します。
+func ChildIDKey[E, P Entity](parent Key[P], id int64) Key[E] {
+	return Key[E]{datastore.IDKey(KindOf[E](), id, parent.key)}
+}
+
+// ChildNameKey は親のキーを持つ文字列 ID の Key を作成します。
+func ChildNameKey[E, P Entity](parent Key[P], name string) Key[E] {
+	return Key[E]{datastore.NameKey(KindOf[E](), name, parent.key)}
+}
+
+// KeyOf はエンティティの Key を返します。
+func KeyOf[E Entity](e E) Key[E] {
+	return Key[E]{e.Key()}
+}
+
+// ToKey は *datastore.Key を Key に変換します。
+// キーの Kind が E の Kind と異なる場合はエラーを返します。
+func ToKey[E Entity](key *datastore.Key) (Key[E], error) {
+	if key == nil {
+		return Key[E]{}, nil
+	}
+	if kind := KindOf[E](); key.Kind != kind {
+		return Key[E]{}, fmt.Errorf("entitystore: key kind %q does not match %q", key.Kind, kind)
+	}
+	return Key[E]{key}, nil
+}
+
+// ToKeys は複数の *datastore.Key を Key に変換します。
+func ToKeys[E Entity](keys []*datastore.Key) ([]Key[E], error) {
+	tkeys := make([]Key[E], len(keys))
+	for i, key := range keys {
+		k, err := ToKey[E](key)
+		if err != nil {
+			return nil, err
+		}
+		tkeys[i] = k
+	}
+	return tkeys, nil
+}
+
+// ParentKey は k の親のキーを P の Key として返します。
+// 親のキーの Kind が P の Kind と異なる場合はエラーを返します。
+func ParentKey[P, E Entity](k Key[E]) (Key[P], error) {
+	if k.key == nil {
+		return Key[P]{}, nil
+	}
+	return ToKey[P](k.key.Parent)
+}
+
+// Key は *datastore.Key を返します。
+func (k Key[E]) Key() *datastore.Key {
+	return k.key
+}
+
+// IsZero はキーが設定されていないかどうかを返します。
+func (k Key[E]) IsZero() bool {
+	return k.key == nil
+}
+
+// Kind は Kind 名を返します。
+func (k Key[E]) Kind() string {
+	if k.key == nil {
+		return KindOf[E]()
+	}
+	return k.key.Kind
+}
+
+// ID は数値 ID を返します。
+func (k Key[E]) ID() int64 {
+	if k.key == nil {
+		return 0
+	}
+	return k.key.ID
+}
+
+// Name は文字列 ID を返します。
+func (k Key[E]) Name() string {
+	if k.key == nil {
+		return ""
+	}
+	return k.key.Name
+}
+
+// Parent は親のキーを返します。型付きの親のキーが必要な場合は ParentKey を使用します。
+func (k Key[E]) Parent() *datastore.Key {
+	if k.key == nil {
+		return nil
+	}
+	return k.key.Parent
+}
+
+// Equal は2つのキーが同じかどうかを返します。
+func (k Key[E]) Equal(o Key[E]) bool {
+	return k.key.Equal(o.key)
+}
+
+// String はキーの文字列表現を返します。
+func (k Key[E]) String() string {
+	if k.key == nil {
+		return ""
+	}
+	return k.key.String()
+}
+
+// Encode はキーを URL などで使用できる文字列にエンコードします。
+func (k Key[E]) Encode() string {
+	if k.key == nil {
+		return ""
+	}
+	return k.key.Encode()
+}
+
+// keysOf は Key のスライスを *datastore.Key のスライスに変換します。
+func keysOf[E Entity](keys []Key[E]) []*datastore.Key {
+	return lo.Map(keys, func(k Key[E], _ int) *datastore.Key {
+		return k.key
+	})
+}
+
+// GetTyped は Key のエンティティを取得します。
+// キャッシュの扱いは Get と同様です。
+func GetTyped[E Entity](ctx context.Context, key Key[E]) (E, error) {
+	e := reflect.New(reflect.TypeFor[E]().Elem()).Interface().(E)
+	if err := Get(ctx, key.key, e); err != nil {
+		var zero E
+		return zero, err
+	}
+	return e, nil
+}
+
+// GetMultiTyped は複数の Key のエンティティを一括取得します。
+// 存在しないエンティティがある場合は、GetMulti と同様に datastore.MultiError を返します。
+// その場合も取得できたエンティティは返されるので、PickUp で取り出すことができます。
+func GetMultiTyped[E Entity](ctx context.Context, keys []Key[E]) ([]E, error) {
+	t := reflect.TypeFor[E]().Elem()
+	es := make([]E, len(keys))
+	for i := range es {
+		es[i] = reflect.New(t).Interface().(E)
+	}
+	err := GetMulti(ctx, keysOf(keys), toAnySlice(es))
+	if IsProblem(err) {
+		return nil, err
+	}
+	return es, err
+}
+
+// DeleteTyped は Key のエンティティを削除します。
+func DeleteTyped[E Entity](ctx context.Context, key Key[E]) error {
+	return Delete(ctx, key.key)
+}
+
+// DeleteMultiTyped は複数の Key のエンティティを一括削除します。
+func DeleteMultiTyped[E Entity](ctx context.Context, keys []Key[E]) error {
+	return DeleteMulti(ctx, keysOf(keys))
+}
+
+// GetKeyAllTyped はクエリに一致するすべてのエンティティの Key を返します。
+// クエリの Kind が E の Kind と異なる場合はエラーを返します。
+func GetKeyAllTyped[E Entity](ctx context.Context, q Query) ([]Key[E], error) {
+	keys, err := GetKeyAll(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return ToKeys[E](keys)
+}
@@ -0,0 +1,64 @@
+package entitystore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKindOf(t *testing.T) {
+	require.Equal(t, "TestEntity", KindOf[*TestEntity]())
+	require.Equal(t, "RefTestBook", KindOf[*RefTestBook]())
+}
+
+func TestTypedKey(t *testing.T) {
+	k := NameKey[*TestEntity]("1")
+	require.Equal(t, datastore.NameKey("TestEntity", "1", nil), k.Key())
+	require.Equal(t, "TestEntity", k.Kind())
+	require.True(t, k.Equal(KeyOf(&TestEntity{Id: 1})))
+	require.True(t, Key[*TestEntity]{}.IsZero())
+
+	parent := IDKey[*RefTestAuthor](10)
+	child := ChildNameKey[*RefTestBook](parent, "b1")
+	require.Equal(t, "RefTestBook", child.Kind())
+	p, err := ParentKey[*RefTestAuthor](child)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), p.ID())
+	_, err = ParentKey[*TestEntity](child)
+	require.Error(t, err)
+
+	_, err = ToKey[*TestEntity](datastore.NameKey("RefTestBook", "1", nil))
+	require.Error(t, err)
+	k2, err := ToKey[*TestEntity](datastore.NameKey("TestEntity", "1", nil))
+	require.NoError(t, err)
+	require.True(t, k.Equal(k2))
+}
+
+func TestGetTyped(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	require.NoError(t, PutEntityMulti(ctx, []*TestEntity{{Id: 1, Value: "Test1"}, {Id: 2, Value: "Test2"}}))
+
+	e, err := GetTyped(ctx, NameKey[*TestEntity]("1"))
+	require.NoError(t, err)
+	require.Equal(t, "Test1", e.Value)
+
+	es, err := GetMultiTyped(ctx, []Key[*TestEntity]{NameKey[*TestEntity]("1"), NameKey[*TestEntity]("3")})
+	require.Error(t, err)
+	require.Len(t, PickUp(es, err), 1)
+
+	keys, err := GetKeyAllTyped[*TestEntity](ctx, NewQuery("TestEntity"))
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	tkeys, cur, err := NewEntityLister(NewQuery("TestEntity"), &TestEntity{}).GetKeyListTyped(ctx, 1, "")
+	require.NoError(t, err)
+	require.Len(t, tkeys, 1)
+	require.NotEmpty(t, cur)
+
+	require.NoError(t, DeleteTyped(ctx, NameKey[*TestEntity]("1")))
+	_, err = GetTyped(ctx, NameKey[*TestEntity]("1"))
+	require.Equal(t, datastore.ErrNoSuchEntity, err)
+}
@@ -0,0 +1,330 @@
+package entitystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+)
+
+// uniqueKind は一意制約の値を予約するための番兵エンティティの Kind です。
+// 番兵エンティティのキー名は Kind、制約のプロパティ名、値のハッシュから作成されます。
+const uniqueKind = "EntitystoreUnique"
+
+// ErrDuplicate は一意制約に違反したことを表すエラーです。
+// errors.Is(err, ErrDuplicate) で DuplicateError かどうかを判定できます。
+var ErrDuplicate = errors.New("entitystore: duplicate value")
+
+// DuplicateError は一意制約に違反した場合に返されるエラーです。
+type DuplicateError struct {
+	// Key は保存しようとしたエンティティのキーです。
+	Key *datastore.Key
+	// Fields は違反した一意制約のプロパティ名です。複合制約の場合は複数になります。
+	Fields []string
+	// Owner は既に同じ値を使用しているエンティティのキーです。
+	Owner *datastore.Key
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("entitystore: duplicate value of %s on %v: already used by %v", strings.Join(e.Fields, "+"), e.Key, e.Owner)
+}
+
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrDuplicate
+}
+
+// uniqueSentinel は一意制約の値を予約する番兵エンティティです。
+type uniqueSentinel struct {
+	Kind       string
+	Owner      *datastore.Key
+	Constraint string `datastore:",noindex"`
+}
+
+// uniqueTagConstraints は Kind ごとの構造体タグで宣言された一意制約です。
+// プロパティのみの書き込みでも制約を確認できるよう、エンティティを保存したときに記録します。
+var uniqueTagConstraints sync.Map // map[string][][]string
+
+// uniqueTypeCache は型ごとの構造体タグで宣言された一意制約のキャッシュです。
+var uniqueTypeCache sync.Map // map[reflect.Type][][]string
+
+// constraintsOfType は構造体タグ `entitystore:"unique"` で宣言された一意制約を返します。
+// `entitystore:"unique=group"` のように同じグループ名を付けたフィールドは複合制約になります。
+func constraintsOfType(t reflect.Type) [][]string {
+	if cached, ok := uniqueTypeCache.Load(t); ok {
+		return cached.([][]string)
+	}
+	var cs [][]string
+	groups := map[string]int{}
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() || sf.Anonymous {
+			continue
+		}
+		group, ok := tagOptionValue(sf, "unique")
+		if !ok {
+			continue
+		}
+		name := sf.Name
+		if tag, _, _ := strings.Cut(sf.Tag.Get("datastore"), ","); tag != "" && tag != "-" {
+			name = tag
+		}
+		if group == "" {
+			cs = append(cs, []string{name})
+		} else if i, ok := groups[group]; ok {
+			cs[i] = append(cs[i], name)
+		} else {
+			groups[group] = len(cs)
+			cs = append(cs, []string{name})
+		}
+	}
+	uniqueTypeCache.Store(t, cs)
+	return cs
+}
+
+// uniqueConstraintsOf は Kind の一意制約を返します。
+// KindOptions.Unique と、src の構造体タグで宣言された制約を合わせたものになります。
+// src が nil の場合は KindOptions.Entity の構造体タグを使用します。
+func uniqueConstraintsOf(kind string, src any) [][]string {
+	opts := optionsOf(kind)
+	cs := opts.Unique
+	if src == nil && opts.Entity != nil {
+		src = opts.Entity
+	}
+	var tagged [][]string
+	if t := reflect.TypeOf(src); t != nil {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			tagged = constraintsOfType(t)
+			if len(tagged) > 0 {
+				uniqueTagConstraints.Store(kind, tagged)
+			}
+		}
+	} else if v, ok := uniqueTagConstraints.Load(kind); ok {
+		tagged = v.([][]string)
+	}
+	if len(tagged) == 0 {
+		return cs
+	}
+	return lo.UniqBy(append(append([][]string{}, cs...), tagged...), func(c []string) string {
+		return strings.Join(c, "+")
+	})
+}
+
+// encodeUniqueValue はプロパティの値を番兵エンティティのキー名に使用する文字列に変換します。
+func encodeUniqueValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return "s:" + v
+	case int64:
+		return fmt.Sprintf("i:%d", v)
+	case float64:
+		return fmt.Sprintf("f:%v", v)
+	case bool:
+		return fmt.Sprintf("b:%t", v)
+	case time.Time:
+		return "t:" + v.UTC().Format(time.RFC3339Nano)
+	case *datastore.Key:
+		return "k:" + v.Encode()
+	case []byte:
+		return "y:" + base64.StdEncoding.EncodeToString(v)
+	default:
+		return fmt.Sprintf("%T:%v", v, v)
+	}
+}
+
+// sentinelKeys はプロパティから番兵エンティティのキーを作成します。
+// 制約のプロパティが無いか、nil または空文字列の場合はその制約の番兵エンティティを作成しません。
+func sentinelKeys(key *datastore.Key, constraints [][]string, ps []datastore.Property) map[string]*datastore.Key {
+	keys := map[string]*datastore.Key{}
+	if ps == nil {
+		return keys
+	}
+	m := propertyMap(ps)
+	for _, c := range constraints {
+		values := make([]string, 0, len(c))
+		for _, name := range c {
+			p, ok := m[name]
+			if !ok || p.Value == nil || p.Value == "" {
+				break
+			}
+			values = append(values, encodeUniqueValue(p.Value))
+		}
+		if len(values) < len(c) {
+			continue
+		}
+		hash := sha256.Sum256([]byte(strings.Join(values, "\x00")))
+		name := key.Kind + ":" + strings.Join(c, "+") + ":" + hex.EncodeToString(hash[:])
+		sk := datastore.NameKey(uniqueKind, name, nil)
+		sk.Namespace = key.Namespace
+		keys[name] = sk
+	}
+	return keys
+}
+
+// constraintName は番兵エンティティのキー名から制約のプロパティ名を取り出します。
+func constraintName(name string) string {
+	parts := strings.Split(name, ":")
+	if len(parts) < 3 {
+		return name
+	}
+	return parts[len(parts)-2]
+}
+
+// hasUniqueConstraints は書き込み操作の Kind に一意制約があるかどうかを返します。
+func hasUniqueConstraints(op *writeOp) bool {
+	return len(uniqueConstraintsOf(op.key.Kind, op.src)) > 0
+}
+
+// uniqueMutations は一意制約を確認し、番兵エンティティを作成・削除する Mutation を作成します。
+// buildMutations の後に、トランザクション内で呼び出します。
+// 論理削除したエンティティの値は予約されたままになります。
+func uniqueMutations(tx *datastore.Transaction, ops []*writeOp) ([]*datastore.Mutation, error) {
+	type claim struct {
+		op  int
+		key *datastore.Key
+	}
+	var claims []claim
+	claimed := map[string]int{}
+	released := map[string]*datastore.Key{}
+	merr := make(datastore.MultiError, len(ops))
+	for i, op := range ops {
+		if op.skipped {
+			continue
+		}
+		cs := uniqueConstraintsOf(op.key.Kind, op.src)
+		if len(cs) == 0 {
+			continue
+		}
+		before := sentinelKeys(op.key, cs, op.prev)
+		after := sentinelKeys(op.key, cs, op.next)
+		for name, sk := range before {
+			if _, ok := after[name]; !ok {
+				released[name] = sk
+			}
+		}
+		for name, sk := range after {
+			if _, ok := before[name]; ok {
+				continue
+			}
+			if j, ok := claimed[name]; ok {
+				merr[i] = &DuplicateError{Key: op.key, Fields: strings.Split(constraintName(name), "+"), Owner: ops[j].key}
+				continue
+			}
+			claimed[name] = i
+			claims = append(claims, claim{op: i, key: sk})
+		}
+	}
+	// 既に予約されている値かどうかを確認する
+	if len(claims) > 0 {
+		keys := lo.Map(claims, func(c claim, _ int) *datastore.Key { return c.key })
+		sentinels := make([]uniqueSentinel, len(keys))
+		err := tx.GetMulti(keys, sentinels)
+		if IsProblem(err) {
+			return nil, err
+		}
+		var gerr datastore.MultiError
+		errors.As(err, &gerr)
+		for i, c := range claims {
+			if gerr != nil && gerr[i] != nil {
+				continue // 予約されていない
+			}
+			if _, ok := released[c.key.Name]; ok {
+				continue // 同じ書き込みで解放される
+			}
+			if owner := sentinels[i].Owner; !owner.Equal(ops[c.op].key) {
+				merr[c.op] = &DuplicateError{Key: ops[c.op].key, Fields: strings.Split(constraintName(c.key.Name), "+"), Owner: owner}
+			}
+		}
+	}
+	if lo.SomeBy(merr, func(err error) bool { return err != nil }) {
+		if len(ops) == 1 {
+			return nil, merr[0]
+		}
+		return nil, merr
+	}
+	var muts []*datastore.Mutation
+	for _, c := range claims {
+		op := ops[c.op]
+		muts = append(muts, datastore.NewUpsert(c.key, &uniqueSentinel{Kind: op.key.Kind, Owner: op.key, Constraint: constraintName(c.key.Name)}))
+	}
+	for name, sk := range released {
+		if _, ok := claimed[name]; !ok {
+			muts = append(muts, datastore.NewDelete(sk))
+		}
+	}
+	return muts, nil
+}
+
+// RepairUniqueConstraints は Kind のすべてのエンティティから一意制約の番兵エンティティを作り直します。
+// 既存のエンティティに一意制約を追加した場合や、番兵エンティティが失われた場合に使用します。
+// e は対象の Kind のエンティティで、構造体タグの一意制約の取得に使用します。
+// 戻り値として、作成した番兵エンティティの数を返します。
+// 同じ値を持つエンティティが複数ある場合は、最初のエンティティの値のみを予約し、残りを *DuplicateError として返します。
+// 処理はトランザクションを使用しないので、対象の Kind への書き込みが無い状態で実行してください。
+func RepairUniqueConstraints[E Entity](ctx context.Context, e E) (int, error) {
+	kind := e.Key().Kind
+	cs := uniqueConstraintsOf(kind, e)
+	keys, err := client.GetAll(ctx, NewQuery(kind).IncludeDeleted().KeysOnly(), nil)
+	if err != nil {
+		return 0, err
+	}
+	// Datastore API の制限により、最大500件ずつ処理
+	const batchSize = 500
+	desired := map[string]*datastore.Key{}
+	owners := map[string]*datastore.Key{}
+	var dups []error
+	for i := 0; i < len(keys); i += batchSize {
+		batch := keys[i:min(i+batchSize, len(keys))]
+		pls := make([]datastore.PropertyList, len(batch))
+		err := client.GetMulti(ctx, batch, pls)
+		if IsProblem(err) {
+			return 0, err
+		}
+		for j, key := range batch {
+			for name, sk := range sentinelKeys(key, cs, pls[j]) {
+				if owner, ok := owners[name]; ok {
+					dups = append(dups, &DuplicateError{Key: key, Fields: strings.Split(constraintName(name), "+"), Owner: owner})
+					continue
+				}
+				desired[name] = sk
+				owners[name] = key
+			}
+		}
+	}
+	// 不要になった番兵エンティティを削除
+	existing, err := client.GetAll(ctx, NewQuery(uniqueKind).FilterField("Kind", "=", kind).KeysOnly(), nil)
+	if err != nil {
+		return 0, err
+	}
+	stale := lo.Filter(existing, func(k *datastore.Key, _ int) bool {
+		_, ok := desired[k.Name]
+		return !ok
+	})
+	for _, chunk := range lo.Chunk(stale, batchSize) {
+		if err := client.DeleteMulti(ctx, chunk); err != nil {
+			return 0, err
+		}
+	}
+	// 番兵エンティティを作成
+	names := lo.Keys(desired)
+	for _, chunk := range lo.Chunk(names, batchSize) {
+		sks := lo.Map(chunk, func(name string, _ int) *datastore.Key { return desired[name] })
+		sentinels := lo.Map(chunk, func(name string, _ int) *uniqueSentinel {
+			return &uniqueSentinel{Kind: kind, Owner: owners[name], Constraint: constraintName(name)}
+		})
+		if _, err := client.PutMulti(ctx, sks, sentinels); err != nil {
+			return 0, err
+		}
+	}
+	return len(desired), errors.Join(dups...)
+}
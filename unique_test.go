@@ -0,0 +1,84 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConstraintsOfType(t *testing.T) {
+	cs := constraintsOfType(reflect.TypeOf(UniqueTestEntity{}))
+	require.Equal(t, [][]string{{"Email"}, {"Tenant", "Code"}}, cs)
+}
+
+func TestSentinelKeys(t *testing.T) {
+	key := datastore.NameKey("UniqueTestEntity", "1", nil)
+	cs := [][]string{{"Email"}, {"Tenant", "Code"}}
+	ps := []datastore.Property{
+		{Name: "Email", Value: "a@example.com"},
+		{Name: "Tenant", Value: "t1"},
+		{Name: "Code", Value: ""},
+	}
+	keys := sentinelKeys(key, cs, ps)
+	require.Len(t, keys, 1) // 空文字列を含む制約は対象外
+	for name, sk := range keys {
+		require.Equal(t, uniqueKind, sk.Kind)
+		require.Equal(t, "Email", constraintName(name))
+	}
+
+	ps2 := setProperty(ps, "Email", "b@example.com")
+	keys2 := sentinelKeys(key, cs, ps2)
+	require.Len(t, keys2, 1)
+	for name := range keys2 {
+		require.NotContains(t, keys, name)
+	}
+}
+
+func TestUniqueConstraintsOf_KeyOnly(t *testing.T) {
+	// 保存したことの無い Kind でも、登録したエンティティの構造体タグからキーのみの削除の制約を取得する
+	RegisterKind("UniqueKeyOnlyEntity", KindOptions{Unique: [][]string{{"Name"}}, Entity: &UniqueTestEntity{}})
+	defer RegisterKind("UniqueKeyOnlyEntity", KindOptions{})
+	require.Equal(t, [][]string{{"Name"}, {"Email"}, {"Tenant", "Code"}}, uniqueConstraintsOf("UniqueKeyOnlyEntity", nil))
+	require.True(t, hasUniqueConstraints(&writeOp{typ: MutationTypeDelete, key: datastore.NameKey("UniqueKeyOnlyEntity", "1", nil)}))
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	ctx := context.Background()
+	DefaultTestInitialize(ctx, nil)
+	require.NoError(t, DeleteAll(ctx, "UniqueTestEntity"))
+	require.NoError(t, DeleteAll(ctx, uniqueKind))
+
+	require.NoError(t, PutEntity(ctx, &UniqueTestEntity{Id: 1, Email: "a@example.com", Tenant: "t1", Code: "c1"}))
+
+	// 同じ値は使用できない
+	err := PutEntity(ctx, &UniqueTestEntity{Id: 2, Email: "a@example.com"})
+	require.True(t, errors.Is(err, ErrDuplicate))
+	var derr *DuplicateError
+	require.True(t, errors.As(err, &derr))
+	require.Equal(t, []string{"Email"}, derr.Fields)
+	require.Equal(t, "1", derr.Owner.Name)
+
+	err = PutEntity(ctx, &UniqueTestEntity{Id: 2, Email: "b@example.com", Tenant: "t1", Code: "c1"})
+	require.True(t, errors.As(err, &derr))
+	require.Equal(t, []string{"Tenant", "Code"}, derr.Fields)
+
+	// 値を変更すると以前の値は解放される
+	require.NoError(t, PutEntity(ctx, &UniqueTestEntity{Id: 1, Email: "c@example.com", Tenant: "t1", Code: "c1"}))
+	require.NoError(t, PutEntity(ctx, &UniqueTestEntity{Id: 2, Email: "a@example.com"}))
+
+	// 削除すると値は解放される
+	require.NoError(t, DeleteEntity(ctx, &UniqueTestEntity{Id: 1}))
+	require.NoError(t, PutEntity(ctx, &UniqueTestEntity{Id: 3, Email: "c@example.com"}))
+
+	// 番兵エンティティを作り直す
+	require.NoError(t, DeleteAll(ctx, uniqueKind))
+	n, err := RepairUniqueConstraints(ctx, &UniqueTestEntity{})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	err = PutEntity(ctx, &UniqueTestEntity{Id: 4, Email: "c@example.com"})
+	require.True(t, errors.Is(err, ErrDuplicate))
+}
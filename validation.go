@@ -0,0 +1,360 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrValidation はエンティティの検証に失敗したことを表すエラーです。
+// errors.Is(err, ErrValidation) で ValidationError かどうかを判定できます。
+var ErrValidation = errors.New("entitystore: validation failed")
+
+// Validator は保存前の検証を実装するエンティティのインターフェースです。
+// Validate が返したエラーは ValidationError にまとめられます。
+// Validate で *ValidationError を返した場合は、そのフィールドのエラーが構造体タグの検証結果に追加されます。
+type Validator interface {
+	Validate(ctx context.Context) error
+}
+
+// FieldError は1つのフィールドの検証エラーです。
+type FieldError struct {
+	// Field はフィールド名です。ネストした構造体のフィールドは "Address.City" のように表します。
+	Field string
+	// Rule は満たさなかった検証ルールです。
+	Rule string
+	// Message はエラーの内容です。
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError はエンティティの検証エラーです。
+// 検証に失敗したすべてのフィールドのエラーを保持します。
+type ValidationError struct {
+	Fields []FieldError
+	// Err は Validate メソッドが返した、*ValidationError 以外のエラーです。
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields)+1)
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Error())
+	}
+	if e.Err != nil {
+		msgs = append(msgs, e.Err.Error())
+	}
+	return "entitystore: validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// validationRule は構造体タグから解析した検証ルールです。
+type validationRule struct {
+	name  string
+	arg   string
+	num   float64
+	re    *regexp.Regexp
+	enums []string
+}
+
+// validatedField は検証ルールを持つ、またはネストした構造体のフィールドです。
+type validatedField struct {
+	index  []int
+	name   string
+	rules  []validationRule
+	nested bool
+}
+
+// validationCache は型ごとの検証ルールのキャッシュです。
+var validationCache sync.Map // map[reflect.Type][]validatedField
+
+// Validate はエンティティを検証します。
+// 構造体タグ `validate:"..."` による検証と、Validator を実装している場合は Validate メソッドによる検証を行い、
+// 失敗した場合はすべてのエラーをまとめた *ValidationError を返します。
+// 保存時には PutEntity などのすべての書き込みで自動的に呼び出されます。
+//
+// 構造体タグにはカンマ区切りで以下のルールを指定できます。
+//   - required: ゼロ値でないこと
+//   - min=n, max=n: 数値の場合は値、文字列・スライス・マップの場合は長さの下限・上限
+//   - len=n: 文字列・スライス・マップの長さ
+//   - enum=a|b|c: 値がいずれかと一致すること
+//   - regex=pattern: 文字列が正規表現にマッチすること (カンマを含められるよう最後に指定します)
+func Validate(ctx context.Context, e any) error {
+	verr := &ValidationError{}
+	v := reflect.ValueOf(e)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		if err := validateStruct(v, "", verr); err != nil {
+			return err
+		}
+	}
+	if vr, ok := e.(Validator); ok {
+		err := vr.Validate(ctx)
+		var ve *ValidationError
+		if errors.As(err, &ve) {
+			verr.Fields = append(verr.Fields, ve.Fields...)
+			if ve.Err != nil {
+				verr.Err = ve.Err
+			}
+		} else if err != nil {
+			verr.Err = err
+		}
+	}
+	if len(verr.Fields) == 0 && verr.Err == nil {
+		return nil
+	}
+	return verr
+}
+
+// validateStruct は構造体の各フィールドを検証し、エラーを verr に追加します。
+// 構造体タグが不正な場合はエラーを返します。
+func validateStruct(v reflect.Value, prefix string, verr *ValidationError) error {
+	fields, err := validatedFields(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		name := prefix + f.name
+		for _, r := range f.rules {
+			if msg := r.check(fv); msg != "" {
+				verr.Fields = append(verr.Fields, FieldError{Field: name, Rule: r.name, Message: msg})
+			}
+		}
+		if f.nested {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			np := prefix
+			if f.name != "" {
+				np = name + "."
+			}
+			if err := validateStruct(fv, np, verr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validatedFields は型の検証対象のフィールドを返します。結果はキャッシュされます。
+func validatedFields(t reflect.Type) ([]validatedField, error) {
+	if cached, ok := validationCache.Load(t); ok {
+		return cached.([]validatedField), nil
+	}
+	var fields []validatedField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		f := validatedField{index: sf.Index, name: sf.Name}
+		if tag, ok := sf.Tag.Lookup("validate"); ok && tag != "" && tag != "-" {
+			rules, err := parseValidationTag(tag)
+			if err != nil {
+				return nil, fmt.Errorf("entitystore: invalid validate tag on %s.%s: %w", t.Name(), sf.Name, err)
+			}
+			f.rules = rules
+		}
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		f.nested = ft.Kind() == reflect.Struct && !isDatastoreValueType(ft)
+		if sf.Anonymous && f.nested && len(f.rules) == 0 {
+			// 埋め込みフィールドは親のフィールドとして扱う
+			embedded, err := validatedFields(ft)
+			if err != nil {
+				return nil, err
+			}
+			if sf.Type.Kind() == reflect.Ptr {
+				// ポインタの埋め込みは FieldByIndex で nil を辿れないのでネストとして扱う
+				f.name = ""
+				fields = append(fields, f)
+				continue
+			}
+			for _, ef := range embedded {
+				ef.index = append(append([]int{}, sf.Index...), ef.index...)
+				fields = append(fields, ef)
+			}
+			continue
+		}
+		if len(f.rules) > 0 || f.nested {
+			fields = append(fields, f)
+		}
+	}
+	validationCache.Store(t, fields)
+	return fields, nil
+}
+
+// isDatastoreValueType は Datastore で1つの値として扱われる構造体型かどうかを返します。
+func isDatastoreValueType(t reflect.Type) bool {
+	return t == reflect.TypeOf(time.Time{}) ||
+		t == reflect.TypeOf(datastore.GeoPoint{}) ||
+		t == reflect.TypeOf(datastore.Key{})
+}
+
+// parseValidationTag は構造体タグを検証ルールに変換します。
+func parseValidationTag(tag string) ([]validationRule, error) {
+	var rules []validationRule
+	for tag != "" {
+		var part string
+		if strings.HasPrefix(tag, "regex=") {
+			part, tag = tag, "" // 正規表現はカンマを含められるよう残りすべてを使う
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			part, tag = tag[:i], tag[i+1:]
+		} else {
+			part, tag = tag, ""
+		}
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		r := validationRule{name: name, arg: arg}
+		switch name {
+		case "":
+			continue
+		case "required":
+		case "min", "max", "len":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s requires a number: %w", name, err)
+			}
+			r.num = n
+		case "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			r.re = re
+		case "enum":
+			r.enums = strings.Split(arg, "|")
+		default:
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// check は値がルールを満たしているかを確認し、満たしていない場合はエラーメッセージを返します。
+func (r validationRule) check(v reflect.Value) string {
+	switch r.name {
+	case "required":
+		if v.IsZero() || (hasLength(v) && v.Len() == 0) {
+			return "is required"
+		}
+	case "min":
+		if n, ok := measure(v); ok && n < r.num {
+			return fmt.Sprintf("must be at least %s", r.arg)
+		}
+	case "max":
+		if n, ok := measure(v); ok && n > r.num {
+			return fmt.Sprintf("must be at most %s", r.arg)
+		}
+	case "len":
+		if hasLength(v) && float64(length(v)) != r.num {
+			return fmt.Sprintf("length must be %s", r.arg)
+		}
+	case "regex":
+		if v.Kind() == reflect.String && !r.re.MatchString(v.String()) {
+			return fmt.Sprintf("must match %s", r.arg)
+		}
+	case "enum":
+		s := fmt.Sprint(v.Interface())
+		for _, e := range r.enums {
+			if s == e {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s", strings.Join(r.enums, ", "))
+	}
+	return ""
+}
+
+// hasLength は長さを持つ値かどうかを返します。
+func hasLength(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	default:
+		return false
+	}
+}
+
+// measure は min, max で比較する値を返します。
+// 数値の場合は値を、長さを持つ値の場合は長さを返します。
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	if hasLength(v) {
+		return float64(length(v)), true
+	}
+	return 0, false
+}
+
+// length は値の長さを返します。文字列の場合は文字数を返します。
+func length(v reflect.Value) int {
+	if v.Kind() == reflect.String {
+		return utf8.RuneCountInString(v.String())
+	}
+	return v.Len()
+}
+
+// validateOps は保存操作のエンティティを検証します。
+// 単一の操作の場合は *ValidationError を、複数の操作の場合は
+// 失敗したエンティティの位置に *ValidationError を設定した datastore.MultiError を返します。
+func validateOps(ctx context.Context, ops []*writeOp) error {
+	merr := make(datastore.MultiError, len(ops))
+	failed := false
+	for i, op := range ops {
+		if op.isDelete() || op.src == nil || op.unchanged {
+			continue
+		}
+		err := Validate(ctx, op.src)
+		if err != nil {
+			merr[i] = err
+			failed = true
+		}
+	}
+	if !failed {
+		return nil
+	}
+	if len(ops) == 1 {
+		return merr[0]
+	}
+	return merr
+}
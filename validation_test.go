@@ -0,0 +1,59 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	valid := &ValidationTestEntity{
+		Id: 1, Name: "あいうえお", Age: 30, Code: "ABC", Status: "active",
+		Address: ValidationTestAddress{City: "Tokyo"},
+	}
+	require.NoError(t, Validate(ctx, valid))
+
+	invalid := &ValidationTestEntity{Id: 2, Age: 10, Code: "abcd", Status: "active"}
+	err := Validate(ctx, invalid)
+	require.ErrorIs(t, err, ErrValidation)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr))
+	require.Equal(t, []FieldError{
+		{Field: "Name", Rule: "required", Message: "is required"},
+		{Field: "Code", Rule: "len", Message: "length must be 3"},
+		{Field: "Code", Rule: "regex", Message: "must match ^[A-Z]{1,3}$"},
+		{Field: "Address.City", Rule: "required", Message: "is required"},
+		{Field: "Status", Rule: "custom", Message: "minors cannot be active"},
+	}, verr.Fields)
+}
+
+func TestParseValidationTag(t *testing.T) {
+	rules, err := parseValidationTag("required,regex=^a{1,2}$")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "^a{1,2}$", rules[1].arg)
+
+	_, err = parseValidationTag("unknown")
+	require.Error(t, err)
+	_, err = parseValidationTag("min=abc")
+	require.Error(t, err)
+}
+
+func TestValidateOps(t *testing.T) {
+	ctx := context.Background()
+	ops := []*writeOp{
+		{typ: MutationTypeUpsert, src: &ValidationTestEntity{Name: "OK", Code: "ABC", Status: "inactive", Address: ValidationTestAddress{City: "Tokyo"}}},
+		{typ: MutationTypeDelete},
+		{typ: MutationTypeUpsert, src: &ValidationTestEntity{Code: "ABC", Status: "inactive", Address: ValidationTestAddress{City: "Tokyo"}}},
+	}
+	err := validateOps(ctx, ops)
+	var merr datastore.MultiError
+	require.True(t, errors.As(err, &merr))
+	require.Nil(t, merr[0])
+	require.Nil(t, merr[1])
+	require.ErrorIs(t, merr[2], ErrValidation)
+}
@@ -0,0 +1,366 @@
+package entitystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"github.com/samber/lo"
+)
+
+// writeOp は1つのエンティティに対する書き込み操作です。
+type writeOp struct {
+	typ MutationType
+	key *datastore.Key
+	// src は保存するエンティティです。
+	// 削除の場合は削除対象のエンティティで、キーのみで削除する場合は nil になります。
+	src any
+	// ifUnchanged が true の場合は、ロード時から変更されていない場合のみ書き込みます。
+	ifUnchanged bool
+	// expect は ifUnchanged の場合の、ロード時点のエンティティの状態です。
+	expect entityVersion
+	// purge が true の場合は、論理削除が有効な Kind でもエンティティを消去します。
+	purge bool
+	// patch が設定されている場合は、src の代わりに書き込み前のプロパティを patch で変更したものを書き込みます。
+	// 書き込み前にエンティティが存在しない場合は何も書き込みません。
+	patch func(ps []datastore.Property) []datastore.Property
+	// props が設定されている場合は、src の代わりにこのプロパティを書き込みます。
+	props []datastore.Property
+
+	// 以下はトランザクション内で書き込む場合に、書き込み前に読み込んだ値です。
+
+	// exists は書き込み前にエンティティが存在していたかどうかです。
+	exists bool
+	// prev は書き込み前に保存されていたプロパティです。
+	prev []datastore.Property
+
+	// 以下は buildMutations で設定される値です。
+
+	// next は書き込むプロパティです。削除の場合は nil になります。
+	next []datastore.Property
+	// skipped は書き込む必要が無いため、Mutation を作成しなかったかどうかです。
+	skipped bool
+	// unchanged はロード時から変更されていないため、書き込みを省略するかどうかです。
+	unchanged bool
+	// blobs は next から参照している、BlobStore に保存する値です。
+	blobs map[string][]byte
+}
+
+// isDelete は削除操作かどうかを返します。
+func (op *writeOp) isDelete() bool {
+	return op.typ == MutationTypeDelete
+}
+
+// write は書き込み操作をまとめて実行します。
+// 書き込み前のフック、エンティティの検証、IDの割り当て、BlobStoreへの保存、Datastoreへの書き込み、キャッシュの削除、
+// 不要になった Blob の削除、書き込み後のフックの順に処理します。
+// 書き込み前のフックや検証がエラーを返した場合は何も書き込みません。
+func write(ctx context.Context, ops []*writeOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	applySoftDelete(ops)
+	if err := markUnchanged(ops); err != nil {
+		return err
+	}
+	if lo.EveryBy(ops, func(op *writeOp) bool { return op.unchanged }) {
+		return nil
+	}
+	// 条件付き書き込みはすべて書き込むかどれも書き込まないことを保証するため、1回のコミットに収まる必要がある
+	if lo.SomeBy(ops, func(op *writeOp) bool { return op.ifUnchanged }) && len(commitBatches(ops)) > 1 {
+		return ErrTooManyMutations
+	}
+	// 条件付き書き込みの場合は PrePutAction で更新される前の状態を記録しておく
+	var restores []func()
+	for _, op := range ops {
+		if op.ifUnchanged {
+			e, ok := op.src.(Entity)
+			if !ok {
+				return fmt.Errorf("entitystore: conditional write requires an Entity but got %T", op.src)
+			}
+			op.expect = versionOf(e)
+			restores = append(restores, preserveEntity(e))
+		}
+	}
+	// 条件付き書き込みが競合やエラーで書き込まれなかった場合は、フックで更新されたバージョンや更新日時を元に戻す
+	// 呼び出し元がロードし直さずに再試行しても、同じ条件で比較できるようにする
+	committed := false
+	defer func() {
+		if !committed {
+			for _, restore := range restores {
+				restore()
+			}
+		}
+	}()
+	// 書き込み前のフック
+	for _, op := range ops {
+		if op.unchanged {
+			continue
+		}
+		var err error
+		if op.isDelete() {
+			err = runPreDelete(ctx, op.key, op.src)
+		} else {
+			err = runPrePut(ctx, op.key, op.src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// 検証
+	if err := validateOps(ctx, ops); err != nil {
+		return err
+	}
+	// キーが不完全な場合は ID を割り当てる
+	if err := allocateKeys(ctx, ops); err != nil {
+		return err
+	}
+	// Datastore に書き込み
+	done, werr := commit(ctx, ops)
+	if werr != nil {
+		var merr datastore.MultiError
+		if len(ops) == 1 && errors.As(werr, &merr) && len(merr) == 1 {
+			werr = merr[0] // 単一の操作の場合は MultiError を展開する
+		}
+		if len(done) == 0 {
+			return werr
+		}
+	}
+	committed = true
+	// キャッシュを削除
+	// 書き込みは済んでいるため、キャッシュの削除に失敗しても書き込みのエラーと合わせて返し、以降の処理は続ける
+	if err := cacheDeleteEntities(ctx, lo.Map(done, func(op *writeOp, _ int) datastore.Key {
+		return *op.key
+	})); err != nil {
+		werr = errors.Join(werr, err)
+	}
+	deleteUnusedBlobs(ctx, done)
+	updateSnapshots(done)
+	// 書き込み後のフック
+	for _, op := range done {
+		if op.unchanged {
+			continue
+		}
+		var err error
+		if op.isDelete() {
+			err = runPostDelete(ctx, op.key, op.src)
+		} else {
+			err = runPostPut(ctx, op.key, op.src)
+		}
+		if err != nil {
+			return errors.Join(werr, err)
+		}
+	}
+	return werr
+}
+
+// commit は書き込み操作を Datastore に書き込み、書き込みに成功した操作を返します。
+// 1回のコミットの Mutation の数の上限を超える場合は、操作をバッチに分割して並行して書き込みます。
+// 分割した場合はバッチごとにコミットするため、一部のバッチだけが書き込まれることがあります。
+// その場合は書き込みに失敗したバッチの操作の位置にエラーを設定した MultiError を返します。
+func commit(ctx context.Context, ops []*writeOp) ([]*writeOp, error) {
+	bs := commitBatches(ops)
+	errs := make([]error, len(bs))
+	runBatches(len(bs), func(i int) {
+		errs[i] = commitBatch(ctx, ops[bs[i].lo:bs[i].hi])
+	})
+	var done []*writeOp
+	for i, b := range bs {
+		if errs[i] == nil {
+			done = append(done, ops[b.lo:b.hi]...)
+		}
+	}
+	return done, mergeBatchErrors(len(ops), bs, errs)
+}
+
+// commitBatch は書き込み操作を1回のコミットで書き込みます。
+func commitBatch(ctx context.Context, ops []*writeOp) error {
+	if needsTransaction(ops) {
+		return writeInTransaction(ctx, ops)
+	}
+	muts, err := buildMutations(ops)
+	if err != nil {
+		return err
+	}
+	if err := uploadBlobs(ctx, ops); err != nil {
+		return err
+	}
+	_, err = client.Mutate(mutateContext(ctx, ops), muts...)
+	return err
+}
+
+// commitBatches は1回のコミットの Mutation の数が maxCommitMutations を超えないように書き込み操作を分割します。
+// 変更履歴、アウトボックスと一意制約の番兵エンティティの Mutation も含めて数えます。
+func commitBatches(ops []*writeOp) []batch {
+	var bs []batch
+	n := 0
+	for i, op := range ops {
+		m := mutationsOf(op)
+		if len(bs) == 0 || n+m > maxCommitMutations {
+			bs = append(bs, batch{lo: i, hi: i})
+			n = 0
+		}
+		bs[len(bs)-1].hi = i + 1
+		n += m
+	}
+	return bs
+}
+
+// mutationsOf は書き込み操作が1回のコミットで使用する Mutation の最大数を返します。
+func mutationsOf(op *writeOp) int {
+	opts := optionsOf(op.key.Kind)
+	n := 1
+	if opts.History {
+		n++
+	}
+	if opts.Outbox {
+		n++
+	}
+	// 一意制約ごとに、新しい値の予約と古い値の解放
+	return n + 2*len(uniqueConstraintsOf(op.key.Kind, op.src))
+}
+
+// mutateContext は挿入を含まない場合に、Mutate をリトライできるよう冪等であることを表す context を返します。
+func mutateContext(ctx context.Context, ops []*writeOp) context.Context {
+	if lo.SomeBy(ops, func(op *writeOp) bool { return op.typ == MutationTypeInsert && !op.unchanged }) {
+		return ctx
+	}
+	return WithIdempotent(ctx)
+}
+
+// needsTransaction は書き込み前の値を読み込むためにトランザクションが必要かどうかを返します。
+func needsTransaction(ops []*writeOp) bool {
+	return lo.SomeBy(ops, func(op *writeOp) bool {
+		opts := optionsOf(op.key.Kind)
+		return op.ifUnchanged || op.patch != nil || needsCreationCheck(op) || opts.History || opts.Outbox ||
+			hasUniqueConstraints(op) || hasBlobs(op)
+	})
+}
+
+// writeInTransaction はトランザクション内で書き込み前の値を読み込み、条件の確認などを行ってから書き込みます。
+func writeInTransaction(ctx context.Context, ops []*writeOp) error {
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := loadPrevious(tx, ops); err != nil {
+			return err
+		}
+		if err := checkUnchanged(ctx, ops); err != nil {
+			return err
+		}
+		preserveCreation(ops)
+		muts, err := buildMutations(ops)
+		if err != nil {
+			return err
+		}
+		if err := uploadBlobs(ctx, ops); err != nil {
+			return err
+		}
+		umuts, err := uniqueMutations(tx, ops)
+		if err != nil {
+			return err
+		}
+		muts = append(muts, umuts...)
+		muts = append(muts, historyMutations(ctx, ops)...)
+		muts = append(muts, outboxMutations(ops)...)
+		_, err = tx.Mutate(muts...)
+		return err
+	})
+	return err
+}
+
+// loadPrevious はトランザクション内で書き込み前のプロパティを読み込み、各操作に設定します。
+func loadPrevious(tx *datastore.Transaction, ops []*writeOp) error {
+	keys := lo.Map(ops, func(op *writeOp, _ int) *datastore.Key {
+		return op.key
+	})
+	pls := make([]datastore.PropertyList, len(keys))
+	err := tx.GetMulti(keys, pls)
+	if IsProblem(err) {
+		return err
+	}
+	var merr datastore.MultiError
+	errors.As(err, &merr)
+	for i, op := range ops {
+		op.exists = merr == nil || merr[i] == nil
+		if op.exists {
+			op.prev = pls[i]
+		} else {
+			op.prev = nil
+		}
+	}
+	return nil
+}
+
+// buildMutations は書き込み操作を datastore.Mutation に変換します。
+// 書き込むプロパティは各操作の next に設定されます。
+func buildMutations(ops []*writeOp) ([]*datastore.Mutation, error) {
+	muts := make([]*datastore.Mutation, 0, len(ops))
+	for _, op := range ops {
+		op.next, op.skipped, op.blobs = nil, false, nil
+		typ := op.typ
+		switch {
+		case op.unchanged:
+			op.skipped = true
+			continue
+		case op.patch != nil:
+			if !op.exists {
+				op.skipped = true
+				continue
+			}
+			op.next = op.patch(op.prev)
+			typ = MutationTypeUpdate
+		case op.isDelete():
+			muts = append(muts, datastore.NewDelete(op.key))
+			continue
+		case op.props != nil:
+			op.next = op.props
+		default:
+			ps, blobs, err := saveStructBlobs(op.key, op.src)
+			if err != nil {
+				return nil, err
+			}
+			op.next, op.blobs = ps, blobs
+		}
+		pl := datastore.PropertyList(op.next)
+		switch typ {
+		case MutationTypeInsert:
+			muts = append(muts, datastore.NewInsert(op.key, &pl))
+		case MutationTypeUpdate:
+			muts = append(muts, datastore.NewUpdate(op.key, &pl))
+		case MutationTypeUpsert:
+			muts = append(muts, datastore.NewUpsert(op.key, &pl))
+		default:
+			return nil, fmt.Errorf("entitystore: unknown mutation type %d", op.typ)
+		}
+	}
+	return muts, nil
+}
+
+// putOps はキーとエンティティのスライスから保存用の書き込み操作を作成します。
+// src はエンティティのスライスである必要があります。
+func putOps(keys []*datastore.Key, src any) ([]*writeOp, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, errors.New("entitystore: src must be a slice")
+	}
+	if v.Len() != len(keys) {
+		return nil, errors.New("entitystore: keys and src slices have different length")
+	}
+	ops := make([]*writeOp, len(keys))
+	for i, key := range keys {
+		e := v.Index(i)
+		if e.Kind() == reflect.Struct {
+			e = e.Addr() // 構造体のスライスの場合は要素のポインタを保存する
+		}
+		ops[i] = &writeOp{typ: MutationTypeUpsert, key: key, src: e.Interface()}
+	}
+	return ops, nil
+}
+
+// deleteOps はキーのスライスから削除用の書き込み操作を作成します。
+func deleteOps(keys []*datastore.Key) []*writeOp {
+	return lo.Map(keys, func(key *datastore.Key, _ int) *writeOp {
+		return &writeOp{typ: MutationTypeDelete, key: key}
+	})
+}